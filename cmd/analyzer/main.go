@@ -2,27 +2,43 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/ryouol/log-distributor/pkg/analyzer"
+	"github.com/ryouol/log-distributor/pkg/logpb"
 	"github.com/ryouol/log-distributor/pkg/models"
+	"github.com/ryouol/log-distributor/pkg/registration"
+	"github.com/ryouol/log-distributor/pkg/tlsconfig"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 // MockAnalyzer represents a mock log analyzer service
 type MockAnalyzer struct {
-	ID         string
-	Port       int
-	Weight     float64
+	ID     string
+	Port   int
+	Weight float64
+	// AcceptEncoding lists the compressed request bodies the analyzer takes
+	AcceptEncoding string
+	// TLS serves HTTP and gRPC over TLS if set
+	TLS        *tls.Config
 	router     *mux.Router
 	httpServer *http.Server
+	grpcServer *grpc.Server
 	logCount   int
 }
 
@@ -51,6 +67,7 @@ func NewMockAnalyzer(id string, port int, weight float64) *MockAnalyzer {
 // setupRoutes configures the API routes
 func (a *MockAnalyzer) setupRoutes() {
 	a.router.HandleFunc("/analyze", a.handleAnalyze).Methods(http.MethodPost)
+	a.router.HandleFunc("/analyze/batch", a.handleAnalyzeBatch).Methods(http.MethodPost)
 	a.router.HandleFunc("/health", a.handleHealth).Methods(http.MethodGet)
 }
 
@@ -58,42 +75,133 @@ func (a *MockAnalyzer) setupRoutes() {
 func (a *MockAnalyzer) Start() {
 	go func() {
 		log.Printf("Starting Mock Analyzer %s on port %d with weight %.2f\n", a.ID, a.Port, a.Weight)
-		if err := a.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if a.TLS != nil {
+			a.httpServer.TLSConfig = a.TLS
+			err = a.httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = a.httpServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("HTTP server error: %v", err)
 		}
 	}()
 }
 
-// Stop gracefully stops the HTTP server
+// StartGRPC serves the LogAnalyzer gRPC service on the given port
+func (a *MockAnalyzer) StartGRPC(port int) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+
+	var opts []grpc.ServerOption
+	if a.TLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(a.TLS)))
+	}
+	a.grpcServer = grpc.NewServer(opts...)
+	logpb.RegisterLogAnalyzerServer(a.grpcServer, &grpcService{analyzer: a})
+	healthpb.RegisterHealthServer(a.grpcServer, health.NewServer())
+
+	go func() {
+		log.Printf("Starting gRPC service of Mock Analyzer %s on port %d\n", a.ID, port)
+		if err := a.grpcServer.Serve(listener); err != nil {
+			log.Fatalf("gRPC server error: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Stop gracefully stops the HTTP and gRPC servers
 func (a *MockAnalyzer) Stop(ctx context.Context) error {
+	if a.grpcServer != nil {
+		a.grpcServer.GracefulStop()
+	}
 	return a.httpServer.Shutdown(ctx)
 }
 
+// grpcService serves the mock analyzer over gRPC
+type grpcService struct {
+	logpb.UnimplementedLogAnalyzerServer
+	analyzer *MockAnalyzer
+}
+
+// Analyze handles analyzing a log packet sent over gRPC
+func (s *grpcService) Analyze(ctx context.Context, pb *logpb.LogPacket) (*logpb.AnalyzeResponse, error) {
+	return logpb.FromAnalyzeResponse(s.analyzer.process(logpb.ToPacket(pb))), nil
+}
+
 // handleAnalyze handles analyzing log packets
 func (a *MockAnalyzer) handleAnalyze(w http.ResponseWriter, r *http.Request) {
 	var packet models.LogPacket
+	if !a.decode(w, r, &packet) {
+		return
+	}
 
-	// Decode JSON request
-	if err := json.NewDecoder(r.Body).Decode(&packet); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(a.process(&packet))
+}
+
+// handleAnalyzeBatch handles analyzing several log packets in one request
+func (a *MockAnalyzer) handleAnalyzeBatch(w http.ResponseWriter, r *http.Request) {
+	var batch models.AnalyzeBatch
+	if !a.decode(w, r, &batch) {
 		return
 	}
 
-	// Process the logs (in this case, just count them)
+	log.Printf("[Analyzer %s] Received batch of %d packets\n", a.ID, len(batch.Packets))
+
+	results := make([]models.AnalyzeResponse, 0, len(batch.Packets))
+	for i := range batch.Packets {
+		results = append(results, a.process(&batch.Packets[i]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(models.AnalyzeBatchResponse{Results: results})
+}
+
+// decode reads a JSON request body, undoing any compression. It writes an
+// error response and returns false if the body cannot be read.
+func (a *MockAnalyzer) decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := analyzer.DecodeBody(r)
+	if err != nil {
+		w.Header().Set("Accept-Encoding", a.AcceptEncoding)
+		http.Error(w, "Unsupported content encoding", http.StatusUnsupportedMediaType)
+		return false
+	}
+
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// process counts the logs of a packet and acknowledges every log message
+func (a *MockAnalyzer) process(packet *models.LogPacket) models.AnalyzeResponse {
 	a.logCount += len(packet.LogMessages)
 
 	log.Printf("[Analyzer %s] Received packet with %d logs (Total: %d)\n",
 		a.ID, len(packet.LogMessages), a.logCount)
 
-	// Return success
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"status": "processed",
-	})
+	accepted := make([]string, 0, len(packet.LogMessages))
+	for _, msg := range packet.LogMessages {
+		accepted = append(accepted, msg.ID)
+	}
+
+	return models.AnalyzeResponse{
+		Status:   models.AnalyzeProcessed,
+		Accepted: accepted,
+	}
 }
 
 // handleHealth handles health check requests
 func (a *MockAnalyzer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if a.AcceptEncoding != "" {
+		w.Header().Set("Accept-Encoding", a.AcceptEncoding)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -109,14 +217,78 @@ func main() {
 		id     = flag.String("id", "analyzer1", "Analyzer ID")
 		port   = flag.Int("port", 8081, "HTTP server port")
 		weight = flag.Float64("weight", 1.0, "Analyzer weight")
+
+		grpcPort       = flag.Int("grpc-port", 0, "gRPC server port (disabled if 0)")
+		distributorURL = flag.String("distributor-url", "", "Distributor to register with (registration disabled if empty)")
+		advertiseURL   = flag.String("advertise-url", "", "URL the distributor reaches this analyzer at, grpc:// for the gRPC service (default http://localhost:<port>)")
+		capabilities   = flag.String("capabilities", "", "Comma-separated capabilities announced on registration (batch, zstd, gzip)")
+		group          = flag.String("group", "", "Analyzer group joined on registration (the distributor's default group if empty)")
+		acceptEncoding = flag.String("accept-encoding", "zstd, gzip", "Compressed request bodies announced on /health (none if empty)")
+
+		tlsCert         = flag.String("tls-cert", "", "Certificate file to serve HTTP and gRPC over TLS with (TLS disabled if empty)")
+		tlsKey          = flag.String("tls-key", "", "Key file of the served certificate")
+		tlsClientCA     = flag.String("tls-client-ca", "", "CA file that the distributor's client certificate must be signed by (not required if empty)")
+		distributorCA   = flag.String("distributor-ca", "", "CA file that the distributor's certificate is verified against (system CAs if empty)")
+		distributorCert = flag.String("distributor-cert", "", "Client certificate file presented to the distributor on registration")
+		distributorKey  = flag.String("distributor-key", "", "Key file of the client certificate presented to the distributor")
 	)
 	flag.Parse()
 
 	// Create mock analyzer
-	analyzer := NewMockAnalyzer(*id, *port, *weight)
+	mockAnalyzer := NewMockAnalyzer(*id, *port, *weight)
+	mockAnalyzer.AcceptEncoding = *acceptEncoding
+	if *tlsCert != "" || *tlsKey != "" {
+		serverTLS := tlsconfig.ServerConfig{CertFile: *tlsCert, KeyFile: *tlsKey}
+		if *tlsClientCA != "" {
+			serverTLS.ClientCAFile, serverTLS.ClientAuth = *tlsClientCA, tlsconfig.ClientAuthRequire
+		}
+		server, err := tlsconfig.NewServer(serverTLS)
+		if err != nil {
+			log.Fatalf("Invalid TLS settings: %v", err)
+		}
+		mockAnalyzer.TLS = server.TLSConfig()
+	}
 
 	// Start the analyzer
-	analyzer.Start()
+	mockAnalyzer.Start()
+	if *grpcPort != 0 {
+		if err := mockAnalyzer.StartGRPC(*grpcPort); err != nil {
+			log.Fatalf("Failed to start gRPC server: %v", err)
+		}
+	}
+
+	// Register with the distributor and keep the lease alive
+	registrationCtx, stopRegistration := context.WithCancel(context.Background())
+	registrationDone := make(chan struct{})
+	if *distributorURL != "" {
+		url := *advertiseURL
+		if url == "" && mockAnalyzer.TLS != nil {
+			url = fmt.Sprintf("https://localhost:%d", *port)
+		} else if url == "" {
+			url = fmt.Sprintf("http://localhost:%d", *port)
+		}
+		client := registration.NewClient(*distributorURL, models.AnalyzerRegistration{
+			ID:           *id,
+			URL:          url,
+			Weight:       *weight,
+			Capabilities: splitList(*capabilities),
+			Group:        *group,
+		})
+		clientTLS := tlsconfig.ClientConfig{CAFile: *distributorCA, CertFile: *distributorCert, KeyFile: *distributorKey}
+		if clientTLS.Enabled() {
+			config, err := clientTLS.Load()
+			if err != nil {
+				log.Fatalf("Invalid distributor TLS settings: %v", err)
+			}
+			client.SetTLS(config)
+		}
+		go func() {
+			client.Run(registrationCtx)
+			close(registrationDone)
+		}()
+	} else {
+		close(registrationDone)
+	}
 
 	// Wait for termination signal
 	sigChan := make(chan os.Signal, 1)
@@ -125,14 +297,29 @@ func main() {
 
 	log.Println("Shutting down...")
 
+	// Deregister before the server stops accepting packets
+	stopRegistration()
+	<-registrationDone
+
 	// Create a timeout context for graceful shutdown
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer shutdownCancel()
 
 	// Stop the HTTP server
-	if err := analyzer.Stop(shutdownCtx); err != nil {
+	if err := mockAnalyzer.Stop(shutdownCtx); err != nil {
 		log.Printf("Error during server shutdown: %v\n", err)
 	}
 
 	log.Println("Shutdown complete")
 }
+
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(s string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
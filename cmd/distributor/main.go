@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"log"
 	"os"
@@ -11,35 +12,290 @@ import (
 
 	"github.com/ryouol/log-distributor/pkg/analyzer"
 	"github.com/ryouol/log-distributor/pkg/api"
+	"github.com/ryouol/log-distributor/pkg/config"
+	"github.com/ryouol/log-distributor/pkg/deadletter"
 	"github.com/ryouol/log-distributor/pkg/distributor"
+	"github.com/ryouol/log-distributor/pkg/ratelimit"
+	"github.com/ryouol/log-distributor/pkg/syslog"
+	"github.com/ryouol/log-distributor/pkg/tlsconfig"
+	"github.com/ryouol/log-distributor/pkg/validation"
+	"github.com/ryouol/log-distributor/pkg/wal"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 func main() {
-	// Parse command-line flags
+	defaults := config.Default()
+
+	// Parse command-line flags. Flags given explicitly override the config
+	// file and environment.
 	var (
-		httpAddr            = flag.String("http-addr", ":8080", "HTTP server address")
-		queueSize           = flag.Int("queue-size", 10000, "Size of the work queue")
-		numWorkers          = flag.Int("workers", 10, "Number of worker goroutines")
-		healthCheckInterval = flag.Duration("health-check-interval", 10*time.Second, "Interval for health checks")
-		maxRetries          = flag.Int("max-retries", 3, "Maximum number of retries for failed packets")
-		retryInterval       = flag.Duration("retry-interval", 5*time.Second, "Interval between retries")
+		configPath          = flag.String("config", "", "Path to a JSON or YAML config file")
+		configPollInterval  = flag.Duration("config-poll-interval", 5*time.Second, "Interval at which the config file is checked for changes (0 disables)")
+		httpAddr            = flag.String("http-addr", defaults.Server.HTTPAddr, "HTTP server address")
+		grpcAddr            = flag.String("grpc-addr", defaults.Server.GRPCAddr, "gRPC ingestion server address (disabled if empty)")
+		otlpAgentAttribute  = flag.String("otlp-agent-attribute", defaults.Server.OTLPAgentAttribute, "OTLP resource attribute naming the agent of logs received at /v1/logs")
+		tlsCert             = flag.String("tls-cert", defaults.Server.TLS.CertFile, "Certificate file of the HTTP and gRPC servers (TLS disabled if empty)")
+		tlsKey              = flag.String("tls-key", defaults.Server.TLS.KeyFile, "Key file of the HTTP and gRPC servers")
+		tlsClientCA         = flag.String("tls-client-ca", defaults.Server.TLS.ClientCAFile, "CA file that agent certificates are verified against")
+		tlsClientAuth       = flag.String("tls-client-auth", defaults.Server.TLS.ClientAuth, "Agent certificate verification (none, optional, require)")
+		queueSize           = flag.Int("queue-size", defaults.Distributor.QueueSize, "Size of the work queue")
+		numWorkers          = flag.Int("workers", defaults.Distributor.NumWorkers, "Number of worker goroutines")
+		healthCheckInterval = flag.Duration("health-check-interval", defaults.Analyzer.HealthCheckInterval.Duration(), "Interval for health checks")
+		maxRetries          = flag.Int("max-retries", defaults.Distributor.MaxRetries, "Maximum number of retries for failed packets")
+		retryInterval       = flag.Duration("retry-interval", defaults.Distributor.RetryInterval.Duration(), "Delay before the first retry, doubled on each further attempt")
+		retryMaxDelay       = flag.Duration("retry-max-delay", defaults.Distributor.RetryMaxDelay.Duration(), "Maximum delay between retries")
+		retryJitter         = flag.Float64("retry-jitter", defaults.Distributor.RetryJitter, "Fraction of each retry delay that is randomized (0-1)")
+		retryWorkers        = flag.Int("retry-workers", defaults.Distributor.RetryWorkers, "Number of retry worker goroutines")
+		breakerFailures     = flag.Int("breaker-failure-threshold", defaults.Analyzer.Breaker.FailureThreshold, "Consecutive send failures that open an analyzer's circuit breaker")
+		breakerErrorRate    = flag.Float64("breaker-error-rate", defaults.Analyzer.Breaker.ErrorRate, "Error rate over the rolling window that opens an analyzer's circuit breaker")
+		breakerOpenTimeout  = flag.Duration("breaker-open-timeout", defaults.Analyzer.Breaker.OpenTimeout.Duration(), "Time an open circuit breaker waits before admitting trial packets")
+		strategyName        = flag.String("strategy", defaults.Distributor.Strategy, "Distribution strategy (weighted_random, weighted_round_robin, least_outstanding, power_of_two, consistent_hash)")
+		hashKey             = flag.String("hash-key", defaults.Distributor.HashKey, "Packet field used by consistent_hash (agent_id, source, metadata.<key>)")
+		walDir              = flag.String("wal-dir", defaults.Distributor.WALDir, "Directory for the write-ahead log (disabled if empty)")
+		walSegmentSize      = flag.Int64("wal-segment-size", defaults.Distributor.WALSegmentSize, "Size in bytes of write-ahead log segments")
+		walSyncInterval     = flag.Duration("wal-sync-interval", defaults.Distributor.WALSyncInterval.Duration(), "Interval over which write-ahead log appends are batched per fsync")
+		deadLetterCapacity  = flag.Int("dead-letter-capacity", defaults.Distributor.DeadLetterCapacity, "Maximum number of dead letters kept (0 disables the store)")
+		deadLetterFile      = flag.String("dead-letter-file", defaults.Distributor.DeadLetterFile, "File backing the dead-letter store (in memory only if empty)")
+		shutdownTimeout     = flag.Duration("shutdown-timeout", defaults.Distributor.ShutdownTimeout.Duration(), "Time spent delivering queued packets on shutdown before spilling the rest")
+		dedupTTL            = flag.Duration("dedup-ttl", defaults.Distributor.DedupTTL.Duration(), "Time packet IDs are remembered to turn away duplicates (0 disables)")
+		dedupCapacity       = flag.Int("dedup-capacity", defaults.Distributor.DedupCapacity, "Most packet IDs remembered for deduplication")
+		laneWeights         = flag.String("lane-weights", defaults.Distributor.LaneWeights, "Dequeue weight of each priority lane, as LEVEL=weight pairs")
+		laneShedAt          = flag.String("lane-shed-at", defaults.Distributor.LaneShedAt, "Queue fill fraction at which each priority lane is refused, as LEVEL=fraction pairs")
+		defaultGroup        = flag.String("default-group", defaults.Distributor.DefaultGroup, "Analyzer group of packets no route matches and of analyzers without a group")
+		replicas            = flag.Int("replicas", defaults.Distributor.Replicas, "Number of distinct analyzers each packet is sent to")
+		replicaAck          = flag.String("replica-ack", defaults.Distributor.ReplicaAck, "Replicas that must be accepted for a packet to count as delivered (one, quorum, all)")
+		analyzerCA          = flag.String("analyzer-ca", defaults.Analyzer.TLS.CAFile, "CA file that analyzer certificates are verified against (system CAs if empty)")
+		analyzerCert        = flag.String("analyzer-cert", defaults.Analyzer.TLS.CertFile, "Client certificate file presented to analyzers")
+		analyzerKey         = flag.String("analyzer-key", defaults.Analyzer.TLS.KeyFile, "Key file of the client certificate presented to analyzers")
+		idempotencyKeys     = flag.Bool("idempotency-keys", defaults.Analyzer.IdempotencyKeys, "Send packets to analyzers with an Idempotency-Key header")
+		stateFile           = flag.String("state-file", defaults.Analyzer.StateFile, "File keeping analyzer pool membership across restarts (disabled if empty)")
+		leaseTTL            = flag.Duration("lease-ttl", defaults.Analyzer.LeaseTTL.Duration(), "Time a self-registered analyzer stays in the pool without a heartbeat")
+		leaseExpiry         = flag.String("lease-expiry", defaults.Analyzer.LeaseExpiry, "What happens to an analyzer whose lease expires (evict, deactivate)")
+		syslogUDPAddr       = flag.String("syslog-udp-addr", defaults.Syslog.UDPAddr, "Address of the syslog UDP listener (disabled if empty)")
+		syslogTCPAddr       = flag.String("syslog-tcp-addr", defaults.Syslog.TCPAddr, "Address of the syslog TCP listener (disabled if empty)")
+		maxBodyBytes        = flag.Int64("max-body-bytes", defaults.Validation.MaxBodyBytes, "Largest request body holding a single log packet (0 for no limit)")
+		maxMessages         = flag.Int("max-messages", defaults.Validation.MaxMessages, "Most log messages in one packet (0 for no limit)")
+		maxMessageLength    = flag.Int("max-message-length", defaults.Validation.MaxMessageLength, "Longest log message text in bytes (0 for no limit)")
+		allowedLevels       = flag.String("allowed-levels", defaults.Validation.AllowedLevels, "Comma-separated log levels accepted (any if empty)")
+		requiredFields      = flag.String("required-fields", defaults.Validation.RequiredFields, "Comma-separated packet fields that must be set")
+		autoFill            = flag.Bool("auto-fill", defaults.Validation.AutoFill, "Generate missing packet and message IDs and timestamps instead of rejecting")
+		agentPacketRate     = flag.Float64("agent-packets-per-second", defaults.RateLimit.PacketsPerSecond, "Packets per second each agent may send (0 for no limit)")
+		agentPacketBurst    = flag.Int("agent-packet-burst", defaults.RateLimit.PacketBurst, "Packets an agent may send at once above its rate")
+		agentMessageRate    = flag.Float64("agent-messages-per-second", defaults.RateLimit.MessagesPerSecond, "Log messages per second each agent may send (0 for no limit)")
+		agentMessageBurst   = flag.Int("agent-message-burst", defaults.RateLimit.MessageBurst, "Log messages an agent may send at once above its rate")
+		agentDailyPackets   = flag.Int64("agent-daily-packets", defaults.RateLimit.DailyPackets, "Packets each agent may send per UTC day (0 for no limit)")
+		agentDailyMessages  = flag.Int64("agent-daily-messages", defaults.RateLimit.DailyMessages, "Log messages each agent may send per UTC day (0 for no limit)")
+		analyzers           = flag.String("analyzers", "", "Comma-separated analyzers to register at startup, as id=url@weight")
 	)
 	flag.Parse()
 
-	// Create analyzer pool
-	analyzerPool := analyzer.NewAnalyzerPool(*healthCheckInterval)
+	// Catch a malformed analyzer list before anything is started
+	staticAnalyzers, err := config.ParseAnalyzers(*analyzers)
+	if err != nil {
+		log.Fatalf("Invalid -analyzers: %v", err)
+	}
+
+	overrides := map[string]func(cfg *config.Config){
+		"http-addr":                 func(cfg *config.Config) { cfg.Server.HTTPAddr = *httpAddr },
+		"grpc-addr":                 func(cfg *config.Config) { cfg.Server.GRPCAddr = *grpcAddr },
+		"otlp-agent-attribute":      func(cfg *config.Config) { cfg.Server.OTLPAgentAttribute = *otlpAgentAttribute },
+		"tls-cert":                  func(cfg *config.Config) { cfg.Server.TLS.CertFile = *tlsCert },
+		"tls-key":                   func(cfg *config.Config) { cfg.Server.TLS.KeyFile = *tlsKey },
+		"tls-client-ca":             func(cfg *config.Config) { cfg.Server.TLS.ClientCAFile = *tlsClientCA },
+		"tls-client-auth":           func(cfg *config.Config) { cfg.Server.TLS.ClientAuth = *tlsClientAuth },
+		"queue-size":                func(cfg *config.Config) { cfg.Distributor.QueueSize = *queueSize },
+		"workers":                   func(cfg *config.Config) { cfg.Distributor.NumWorkers = *numWorkers },
+		"health-check-interval":     func(cfg *config.Config) { cfg.Analyzer.HealthCheckInterval = config.Duration(*healthCheckInterval) },
+		"max-retries":               func(cfg *config.Config) { cfg.Distributor.MaxRetries = *maxRetries },
+		"retry-interval":            func(cfg *config.Config) { cfg.Distributor.RetryInterval = config.Duration(*retryInterval) },
+		"retry-max-delay":           func(cfg *config.Config) { cfg.Distributor.RetryMaxDelay = config.Duration(*retryMaxDelay) },
+		"retry-jitter":              func(cfg *config.Config) { cfg.Distributor.RetryJitter = *retryJitter },
+		"retry-workers":             func(cfg *config.Config) { cfg.Distributor.RetryWorkers = *retryWorkers },
+		"breaker-failure-threshold": func(cfg *config.Config) { cfg.Analyzer.Breaker.FailureThreshold = *breakerFailures },
+		"breaker-error-rate":        func(cfg *config.Config) { cfg.Analyzer.Breaker.ErrorRate = *breakerErrorRate },
+		"breaker-open-timeout":      func(cfg *config.Config) { cfg.Analyzer.Breaker.OpenTimeout = config.Duration(*breakerOpenTimeout) },
+		"strategy":                  func(cfg *config.Config) { cfg.Distributor.Strategy = *strategyName },
+		"hash-key":                  func(cfg *config.Config) { cfg.Distributor.HashKey = *hashKey },
+		"wal-dir":                   func(cfg *config.Config) { cfg.Distributor.WALDir = *walDir },
+		"wal-segment-size":          func(cfg *config.Config) { cfg.Distributor.WALSegmentSize = *walSegmentSize },
+		"wal-sync-interval":         func(cfg *config.Config) { cfg.Distributor.WALSyncInterval = config.Duration(*walSyncInterval) },
+		"dead-letter-capacity":      func(cfg *config.Config) { cfg.Distributor.DeadLetterCapacity = *deadLetterCapacity },
+		"dead-letter-file":          func(cfg *config.Config) { cfg.Distributor.DeadLetterFile = *deadLetterFile },
+		"shutdown-timeout":          func(cfg *config.Config) { cfg.Distributor.ShutdownTimeout = config.Duration(*shutdownTimeout) },
+		"dedup-ttl":                 func(cfg *config.Config) { cfg.Distributor.DedupTTL = config.Duration(*dedupTTL) },
+		"dedup-capacity":            func(cfg *config.Config) { cfg.Distributor.DedupCapacity = *dedupCapacity },
+		"lane-weights":              func(cfg *config.Config) { cfg.Distributor.LaneWeights = *laneWeights },
+		"lane-shed-at":              func(cfg *config.Config) { cfg.Distributor.LaneShedAt = *laneShedAt },
+		"default-group":             func(cfg *config.Config) { cfg.Distributor.DefaultGroup = *defaultGroup },
+		"replicas":                  func(cfg *config.Config) { cfg.Distributor.Replicas = *replicas },
+		"replica-ack":               func(cfg *config.Config) { cfg.Distributor.ReplicaAck = *replicaAck },
+		"analyzer-ca":               func(cfg *config.Config) { cfg.Analyzer.TLS.CAFile = *analyzerCA },
+		"analyzer-cert":             func(cfg *config.Config) { cfg.Analyzer.TLS.CertFile = *analyzerCert },
+		"analyzer-key":              func(cfg *config.Config) { cfg.Analyzer.TLS.KeyFile = *analyzerKey },
+		"idempotency-keys":          func(cfg *config.Config) { cfg.Analyzer.IdempotencyKeys = *idempotencyKeys },
+		"state-file":                func(cfg *config.Config) { cfg.Analyzer.StateFile = *stateFile },
+		"lease-ttl":                 func(cfg *config.Config) { cfg.Analyzer.LeaseTTL = config.Duration(*leaseTTL) },
+		"lease-expiry":              func(cfg *config.Config) { cfg.Analyzer.LeaseExpiry = *leaseExpiry },
+		"syslog-udp-addr":           func(cfg *config.Config) { cfg.Syslog.UDPAddr = *syslogUDPAddr },
+		"syslog-tcp-addr":           func(cfg *config.Config) { cfg.Syslog.TCPAddr = *syslogTCPAddr },
+		"max-body-bytes":            func(cfg *config.Config) { cfg.Validation.MaxBodyBytes = *maxBodyBytes },
+		"max-messages":              func(cfg *config.Config) { cfg.Validation.MaxMessages = *maxMessages },
+		"max-message-length":        func(cfg *config.Config) { cfg.Validation.MaxMessageLength = *maxMessageLength },
+		"allowed-levels":            func(cfg *config.Config) { cfg.Validation.AllowedLevels = *allowedLevels },
+		"required-fields":           func(cfg *config.Config) { cfg.Validation.RequiredFields = *requiredFields },
+		"auto-fill":                 func(cfg *config.Config) { cfg.Validation.AutoFill = *autoFill },
+		"agent-packets-per-second":  func(cfg *config.Config) { cfg.RateLimit.PacketsPerSecond = *agentPacketRate },
+		"agent-packet-burst":        func(cfg *config.Config) { cfg.RateLimit.PacketBurst = *agentPacketBurst },
+		"agent-messages-per-second": func(cfg *config.Config) { cfg.RateLimit.MessagesPerSecond = *agentMessageRate },
+		"agent-message-burst":       func(cfg *config.Config) { cfg.RateLimit.MessageBurst = *agentMessageBurst },
+		"agent-daily-packets":       func(cfg *config.Config) { cfg.RateLimit.DailyPackets = *agentDailyPackets },
+		"agent-daily-messages":      func(cfg *config.Config) { cfg.RateLimit.DailyMessages = *agentDailyMessages },
+		"analyzers":                 func(cfg *config.Config) { cfg.Analyzers = staticAnalyzers },
+	}
+
+	// loadConfig layers the config file, environment and explicit flags
+	loadConfig := func() (*config.Config, error) {
+		cfg := config.Default()
+		if *configPath != "" {
+			loaded, err := config.Load(*configPath)
+			if err != nil {
+				return nil, err
+			}
+			cfg = loaded
+		} else if err := cfg.ApplyEnv(os.LookupEnv); err != nil {
+			return nil, err
+		}
+
+		flag.Visit(func(f *flag.Flag) {
+			if override, ok := overrides[f.Name]; ok {
+				override(cfg)
+			}
+		})
+		return cfg, cfg.Validate()
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	// Create distribution strategy
+	strategy, err := cfg.Strategy()
+	if err != nil {
+		log.Fatalf("Invalid strategy: %v", err)
+	}
+	lanes, err := cfg.LaneConfig()
+	if err != nil {
+		log.Fatalf("Invalid priority lanes: %v", err)
+	}
+	router := distributor.NewRouter(cfg.Distributor.DefaultGroup)
+	if err := router.SetRules(cfg.Rules()); err != nil {
+		log.Fatalf("Invalid routes: %v", err)
+	}
+
+	// Configure retries
+	options := []distributor.Option{
+		distributor.WithStrategy(strategy),
+		distributor.WithRetryPolicy(cfg.RetryPolicy()),
+		distributor.WithDedup(cfg.Distributor.DedupTTL.Duration(), cfg.Distributor.DedupCapacity),
+		distributor.WithLanes(lanes),
+		distributor.WithRouter(router),
+		distributor.WithReplication(cfg.Distributor.Replicas, distributor.AckMode(cfg.Distributor.ReplicaAck)),
+	}
+
+	// Open write-ahead log
+	if dir := cfg.Distributor.WALDir; dir != "" {
+		writeAheadLog, err := wal.Open(dir, wal.Options{
+			SegmentSize:  cfg.Distributor.WALSegmentSize,
+			SyncInterval: cfg.Distributor.WALSyncInterval.Duration(),
+		})
+		if err != nil {
+			log.Fatalf("Failed to open write-ahead log: %v", err)
+		}
+		log.Printf("Write-ahead log at %s has %d packets to replay\n", dir, writeAheadLog.Len())
+		options = append(options, distributor.WithWAL(writeAheadLog))
+	}
+
+	// Create dead-letter store
+	var deadLetters *deadletter.Store
+	if capacity := cfg.Distributor.DeadLetterCapacity; capacity > 0 {
+		if file := cfg.Distributor.DeadLetterFile; file != "" {
+			deadLetters, err = deadletter.OpenStore(file, capacity)
+			if err != nil {
+				log.Fatalf("Failed to open dead-letter store: %v", err)
+			}
+			defer deadLetters.Close()
+		} else {
+			deadLetters = deadletter.NewStore(capacity)
+		}
+		options = append(options, distributor.WithDeadLetters(deadLetters))
+	}
+
+	// Load the TLS settings of the servers and of analyzer connections
+	var serverTLS *tls.Config
+	if cfg.ServerTLS().Enabled() {
+		tlsServer, err := tlsconfig.NewServer(cfg.ServerTLS())
+		if err != nil {
+			log.Fatalf("Invalid server TLS settings: %v", err)
+		}
+		serverTLS = tlsServer.TLSConfig()
+	}
+	analyzerTLS, err := cfg.Analyzer.TLS.Load()
+	if err != nil {
+		log.Fatalf("Invalid analyzer TLS settings: %v", err)
+	}
+
+	// Create analyzer pool, restoring the membership saved by the last run
+	// before adding the statically configured analyzers
+	analyzerPool := analyzer.NewAnalyzerPool(
+		cfg.Analyzer.HealthCheckInterval.Duration(),
+		analyzer.WithBreakerConfig(cfg.BreakerConfig()),
+		analyzer.WithStateFile(cfg.Analyzer.StateFile),
+		analyzer.WithLeaseExpiry(analyzer.LeaseExpiry(cfg.Analyzer.LeaseExpiry)),
+		analyzer.WithBatchConfig(cfg.BatchConfig()),
+		analyzer.WithIdempotencyKeys(cfg.Analyzer.IdempotencyKeys),
+		analyzer.WithClientTLS(analyzerTLS),
+	)
+	restored, err := analyzerPool.RestoreState()
+	if err != nil {
+		log.Fatalf("Failed to restore analyzer pool state: %v", err)
+	}
+	if restored > 0 {
+		log.Printf("Restored %d analyzers from %s\n", restored, cfg.Analyzer.StateFile)
+	}
+	config.SyncAnalyzers(analyzerPool, nil, cfg.Analyzers)
 
 	// Create log distributor
 	logDistributor := distributor.NewLogDistributor(
 		analyzerPool,
-		*queueSize,
-		*numWorkers,
-		*maxRetries,
-		*retryInterval,
+		cfg.Distributor.QueueSize,
+		cfg.Distributor.NumWorkers,
+		cfg.Distributor.MaxRetries,
+		cfg.Distributor.RetryInterval.Duration(),
+		options...,
 	)
 
+	// Packets are checked against the validation limits before they are
+	// queued
+	validator, err := validation.New(cfg.ValidationConfig())
+	if err != nil {
+		log.Fatalf("Invalid validation settings: %v", err)
+	}
+
 	// Create API server
-	server := api.NewServer(*httpAddr, logDistributor, analyzerPool)
+	server := api.NewServer(cfg.Server.HTTPAddr, logDistributor, analyzerPool,
+		api.WithTimeouts(
+			cfg.Server.ReadTimeout.Duration(),
+			cfg.Server.WriteTimeout.Duration(),
+			cfg.Server.IdleTimeout.Duration(),
+		),
+		api.WithLeaseTTL(cfg.Analyzer.LeaseTTL.Duration()),
+		api.WithOTLPAgentAttribute(cfg.Server.OTLPAgentAttribute),
+		api.WithValidator(validator),
+		api.WithRateLimiter(ratelimit.NewLimiter(cfg.RateLimits())),
+		api.WithTLS(serverTLS),
+	)
 
 	// Context that will be canceled on shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -53,12 +309,59 @@ func main() {
 
 	// Start the HTTP server
 	server.Start()
-	log.Printf("Log distributor started on %s\n", *httpAddr)
+	log.Printf("Log distributor started on %s using %s strategy\n", cfg.Server.HTTPAddr, strategy.Name())
+
+	// Start the gRPC ingestion server
+	var grpcServer *api.GRPCServer
+	if cfg.Server.GRPCAddr != "" {
+		var opts []grpc.ServerOption
+		if max := cfg.Validation.MaxBodyBytes; max > 0 {
+			opts = append(opts, grpc.MaxRecvMsgSize(int(max)))
+		}
+		if serverTLS != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(serverTLS)))
+		}
+		grpcServer = api.NewGRPCServer(cfg.Server.GRPCAddr, server.Enqueue, opts...)
+		if err := grpcServer.Start(); err != nil {
+			log.Fatalf("Failed to start gRPC server: %v", err)
+		}
+	}
+
+	// Start the syslog listener
+	var syslogListener *syslog.Listener
+	if cfg.Syslog.UDPAddr != "" || cfg.Syslog.TCPAddr != "" {
+		syslogListener, err = syslog.Listen(cfg.SyslogConfig(), server)
+		if err != nil {
+			log.Fatalf("Failed to start syslog listener: %v", err)
+		}
+		syslogListener.Start()
+		log.Printf("Syslog listener started on udp %q, tcp %q\n", cfg.Syslog.UDPAddr, cfg.Syslog.TCPAddr)
+	}
+
+	// Apply safe config changes when the file changes or on SIGHUP
+	var reloader *config.Reloader
+	if *configPath != "" {
+		reloader = config.NewReloader(*configPath, loadConfig, cfg, logDistributor, analyzerPool)
+		if *configPollInterval > 0 {
+			go reloader.Watch(ctx, *configPollInterval)
+		}
+	}
 
 	// Wait for termination signal
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if reloader == nil {
+			log.Println("Ignoring SIGHUP, no config file given")
+			continue
+		}
+		if err := reloader.Reload(); err != nil {
+			log.Printf("Failed to reload configuration: %v\n", err)
+		}
+	}
 
 	log.Println("Shutting down...")
 
@@ -70,9 +373,30 @@ func main() {
 	if err := server.Stop(shutdownCtx); err != nil {
 		log.Printf("Error during server shutdown: %v\n", err)
 	}
+	if grpcServer != nil {
+		if err := grpcServer.Stop(shutdownCtx); err != nil {
+			log.Printf("Error during gRPC server shutdown: %v\n", err)
+		}
+	}
+	if syslogListener != nil {
+		if err := syslogListener.Stop(shutdownCtx); err != nil {
+			log.Printf("Error during syslog listener shutdown: %v\n", err)
+		}
+		stats := syslogListener.Stats()
+		log.Printf("Syslog listener received %d messages, dropped %d, rejected %d\n", stats.Received, stats.Dropped, stats.Rejected)
+	}
 
-	// Stop the distributor
-	logDistributor.Stop()
+	// Deliver the backlog, then spill what is left
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), cfg.Distributor.ShutdownTimeout.Duration())
+	defer drainCancel()
+	report := logDistributor.Shutdown(drainCtx)
+	log.Printf("Flushed %d packets, dropped %d while draining\n", report.Flushed, report.Dropped)
+	if report.Spilled > 0 {
+		log.Printf("Spilled %d undelivered packets to the %s\n", report.Spilled, report.SpilledTo)
+	}
+	if report.Lost > 0 {
+		log.Printf("Lost %d undelivered packets, enable -wal-dir or the dead-letter store to keep them\n", report.Lost)
+	}
 
 	log.Println("Shutdown complete")
 }
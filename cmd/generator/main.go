@@ -13,6 +13,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/ryouol/log-distributor/pkg/models"
+	"github.com/ryouol/log-distributor/pkg/tlsconfig"
 )
 
 var (
@@ -211,6 +212,9 @@ func main() {
 		rate           = flag.Int("rate", 10, "Packets per second")
 		batchSize      = flag.Int("batch", 5, "Log messages per packet")
 		duration       = flag.Duration("duration", 30*time.Second, "Test duration")
+		caFile         = flag.String("ca", "", "CA file that an https:// distributor's certificate is verified against (system CAs if empty)")
+		certFile       = flag.String("cert", "", "Client certificate file presented to the distributor")
+		keyFile        = flag.String("key", "", "Key file of the client certificate")
 	)
 	flag.Parse()
 
@@ -219,5 +223,15 @@ func main() {
 
 	// Create and run generator
 	generator := NewGenerator(*distributorURL, *agentID, *rate, *batchSize)
+	clientTLS := tlsconfig.ClientConfig{CAFile: *caFile, CertFile: *certFile, KeyFile: *keyFile}
+	if clientTLS.Enabled() {
+		config, err := clientTLS.Load()
+		if err != nil {
+			log.Fatalf("Invalid TLS settings: %v", err)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+		generator.client.Transport = transport
+	}
 	generator.Run(*duration)
 }
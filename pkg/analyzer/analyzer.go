@@ -1,23 +1,136 @@
 package analyzer
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/ryouol/log-distributor/pkg/models"
+	"google.golang.org/grpc"
+)
+
+// ErrAnalyzerNotFound is returned when no analyzer in the pool has the
+// requested ID
+var ErrAnalyzerNotFound = errors.New("analyzer not found")
+
+// ErrAnalyzerExists is returned when adding an analyzer whose ID is already
+// in the pool
+var ErrAnalyzerExists = errors.New("analyzer already exists")
+
+// AdminState is the operator-controlled state of an analyzer
+type AdminState string
+
+// Admin states
+const (
+	// AdminEnabled analyzers receive traffic while their breaker allows it
+	AdminEnabled AdminState = "enabled"
+	// AdminDisabled analyzers receive no traffic until enabled again
+	AdminDisabled AdminState = "disabled"
+	// AdminDraining analyzers receive no new traffic and are removed once
+	// their in-flight sends finish
+	AdminDraining AdminState = "draining"
 )
 
 // Analyzer represents a log analyzer service
 type Analyzer struct {
-	ID     string  `json:"id"`
-	URL    string  `json:"url"`
-	Weight float64 `json:"weight"`
-	Active bool    `json:"active"`
+	ID         string     `json:"id"`
+	URL        string     `json:"url"`
+	Weight     float64    `json:"weight"`
+	Active     bool       `json:"active"`
+	AdminState AdminState `json:"admin_state"`
+	// Group names the analyzer group that routing rules send packets to,
+	// the default group if empty
+	Group string `json:"group,omitempty"`
+	// Capabilities are reported by analyzers that register themselves
+	Capabilities []string        `json:"capabilities,omitempty"`
+	breaker      *CircuitBreaker `json:"-"`
+	// throttledUntil is set when the analyzer asks for a pause with
+	// Retry-After; it is guarded by the pool mutex
+	throttledUntil time.Time
+	// leaseTTL is non-zero for analyzers that registered themselves and must
+	// renew their lease before leaseExpiresAt; guarded by the pool mutex
+	leaseTTL       time.Duration
+	leaseExpiresAt time.Time
+	// leaseExpired is set when an expired lease deactivated the analyzer
+	leaseExpired bool
+	// counters and health are guarded by the pool mutex
+	counters SendCounters
+	health   HealthStatus
+	// encoding is the request body encoding the analyzer accepts and
+	// batcher collects its packets if batching is enabled; both are guarded
+	// by the pool mutex
+	encoding string
+	batcher  *batcher
+	// grpcConn is the connection to an analyzer with a grpc:// URL, dialed
+	// for grpcTarget; both are guarded by the pool mutex
+	grpcConn   *grpc.ClientConn
+	grpcTarget string
+	// tlsConfig and httpClient are set for an analyzer with TLS settings of
+	// its own; both are guarded by the pool mutex
+	tlsConfig  *tls.Config
+	httpClient *http.Client
+	// entry is the pool's own analyzer a snapshot was taken of, nil for the
+	// pool's analyzers themselves
+	entry *Analyzer
+}
+
+// snapshot returns a copy of the analyzer's settings that later changes to
+// the pool leave alone. The caller must hold the pool mutex.
+func (a *Analyzer) snapshot() *Analyzer {
+	return &Analyzer{
+		ID:           a.ID,
+		URL:          a.URL,
+		Weight:       a.Weight,
+		Active:       a.Active,
+		AdminState:   a.AdminState,
+		Group:        a.Group,
+		Capabilities: a.Capabilities,
+		entry:        a,
+	}
+}
+
+// pooled returns the pool's own analyzer for a snapshot, or the analyzer
+// itself if it is not one
+func (a *Analyzer) pooled() *Analyzer {
+	if a.entry != nil {
+		return a.entry
+	}
+	return a
+}
+
+// available reports whether the analyzer may receive traffic. The caller
+// must hold the pool mutex.
+func (a *Analyzer) available() bool {
+	return a.AdminState == AdminEnabled && !a.leaseExpired && a.breaker.State() != BreakerOpen
+}
+
+// AnalyzerStatus is a point-in-time view of an analyzer and its breaker
+type AnalyzerStatus struct {
+	ID         string        `json:"id"`
+	URL        string        `json:"url"`
+	Weight     float64       `json:"weight"`
+	Active     bool          `json:"active"`
+	AdminState AdminState    `json:"admin_state"`
+	Group      string        `json:"group,omitempty"`
+	Breaker    BreakerStatus `json:"breaker"`
+	Health     HealthStatus  `json:"health"`
+	Counters   SendCounters  `json:"counters"`
+	Batching   bool          `json:"batching"`
+	Encoding   string        `json:"encoding,omitempty"`
+	// ThrottledUntil is set while the analyzer has asked for a pause
+	ThrottledUntil *time.Time `json:"throttled_until,omitempty"`
+	Capabilities   []string   `json:"capabilities,omitempty"`
+	// LeaseExpiresAt is set for analyzers that registered themselves
+	LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty"`
+	LeaseExpired   bool       `json:"lease_expired,omitempty"`
 }
 
 // AnalyzerPool manages a pool of analyzers
@@ -27,64 +140,203 @@ type AnalyzerPool struct {
 	mutex               sync.RWMutex
 	healthCheckInterval time.Duration
 	httpClient          *http.Client
+	breakerConfig       BreakerConfig
+	statePath           string
+	leaseExpiry         LeaseExpiry
+	batchConfig         BatchConfig
+	grpcDialOptions     []grpc.DialOption
+	idempotencyKeys     bool
+	// tlsConfig is used for analyzers without TLS settings of their own
+	tlsConfig *tls.Config
+}
+
+// PoolOption configures optional AnalyzerPool behaviour
+type PoolOption func(*AnalyzerPool)
+
+// WithBreakerConfig sets the circuit breaker settings used for every analyzer
+func WithBreakerConfig(config BreakerConfig) PoolOption {
+	return func(p *AnalyzerPool) {
+		p.breakerConfig = config.normalized()
+	}
 }
 
 // NewAnalyzerPool creates a new analyzer pool
-func NewAnalyzerPool(healthCheckInterval time.Duration) *AnalyzerPool {
-	return &AnalyzerPool{
+func NewAnalyzerPool(healthCheckInterval time.Duration, opts ...PoolOption) *AnalyzerPool {
+	p := &AnalyzerPool{
 		analyzers:           make([]*Analyzer, 0),
 		healthCheckInterval: healthCheckInterval,
-		httpClient: &http.Client{
-			Timeout: 5 * time.Second,
-		},
+		httpClient:          newHTTPClient(nil),
+		breakerConfig:       DefaultBreakerConfig(),
+		leaseExpiry:         LeaseEvict,
+		batchConfig:         DefaultBatchConfig(),
 	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	return p
 }
 
-// AddAnalyzer adds a new analyzer to the pool
-func (p *AnalyzerPool) AddAnalyzer(id, url string, weight float64) {
+// AddAnalyzer adds a new analyzer to the pool. It returns
+// ErrAnalyzerExists if the ID is taken.
+func (p *AnalyzerPool) AddAnalyzer(id, url string, weight float64) error {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
+	if p.find(id) != nil {
+		return ErrAnalyzerExists
+	}
+
+	p.addAnalyzer(id, url, weight, AdminEnabled)
+	p.saveState()
+	return nil
+}
+
+// addAnalyzer adds an analyzer in the given admin state. The caller must hold
+// the mutex.
+func (p *AnalyzerPool) addAnalyzer(id, url string, weight float64, state AdminState) *Analyzer {
 	analyzer := &Analyzer{
-		ID:     id,
-		URL:    url,
-		Weight: weight,
-		Active: true,
+		ID:         id,
+		URL:        url,
+		Weight:     weight,
+		Active:     state == AdminEnabled,
+		AdminState: state,
+		breaker:    NewCircuitBreaker(p.breakerConfig),
+		health:     HealthStatus{Status: HealthUnknown},
 	}
 
 	p.analyzers = append(p.analyzers, analyzer)
 	p.recalculateTotalWeight()
+	return analyzer
 }
 
-// RemoveAnalyzer removes an analyzer from the pool
-func (p *AnalyzerPool) RemoveAnalyzer(id string) {
+// RemoveAnalyzer removes an analyzer from the pool. It returns
+// ErrAnalyzerNotFound if no analyzer has the ID.
+func (p *AnalyzerPool) RemoveAnalyzer(id string) error {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
 	for i, a := range p.analyzers {
 		if a.ID == id {
 			p.analyzers = append(p.analyzers[:i], p.analyzers[i+1:]...)
+			p.closeTransport(a)
 			p.recalculateTotalWeight()
-			break
+			p.saveState()
+			return nil
 		}
 	}
+	return ErrAnalyzerNotFound
+}
+
+// UpdateAnalyzer changes the URL and weight of an analyzer, keeping its
+// breaker state. Sends already under way finish with the old URL; snapshots
+// handed out before keep the old weight.
+func (p *AnalyzerPool) UpdateAnalyzer(id, url string, weight float64) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	a := p.find(id)
+	if a == nil {
+		return ErrAnalyzerNotFound
+	}
+
+	a.URL = url
+	a.Weight = weight
+	p.recalculateTotalWeight()
+	p.saveState()
+	return nil
+}
+
+// SetGroup moves an analyzer to the named group, or to the default group if
+// group is empty
+func (p *AnalyzerPool) SetGroup(id, group string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	a := p.find(id)
+	if a == nil {
+		return ErrAnalyzerNotFound
+	}
+
+	a.Group = group
+	p.saveState()
+	return nil
 }
 
-// GetActiveAnalyzers returns a list of active analyzers
+// GetActiveAnalyzers returns snapshots of the active analyzers, leaving out
+// any that asked for a pause with Retry-After and half-open ones whose trial
+// sends are all taken. The snapshots are not updated when the analyzers
+// change, so they can be read without locking.
 func (p *AnalyzerPool) GetActiveAnalyzers() []*Analyzer {
 	p.mutex.RLock()
 	defer p.mutex.RUnlock()
 
+	now := time.Now()
 	active := make([]*Analyzer, 0)
 	for _, a := range p.analyzers {
-		if a.Active {
-			active = append(active, a)
+		if a.Active && !now.Before(a.throttledUntil) && a.breaker.admitting() {
+			active = append(active, a.snapshot())
 		}
 	}
 
 	return active
 }
 
+// ListAnalyzers returns the status of every analyzer in the pool
+func (p *AnalyzerPool) ListAnalyzers() []AnalyzerStatus {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	now := time.Now()
+	statuses := make([]AnalyzerStatus, 0, len(p.analyzers))
+	for _, a := range p.analyzers {
+		statuses = append(statuses, a.status(now))
+	}
+	return statuses
+}
+
+// GetAnalyzer returns the status of one analyzer
+func (p *AnalyzerPool) GetAnalyzer(id string) (AnalyzerStatus, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	a := p.find(id)
+	if a == nil {
+		return AnalyzerStatus{}, ErrAnalyzerNotFound
+	}
+	return a.status(time.Now()), nil
+}
+
+// status returns a point-in-time view of the analyzer. The caller must hold
+// the pool mutex.
+func (a *Analyzer) status(now time.Time) AnalyzerStatus {
+	status := AnalyzerStatus{
+		ID:         a.ID,
+		URL:        a.URL,
+		Weight:     a.Weight,
+		Active:     a.Active,
+		AdminState: a.AdminState,
+		Group:      a.Group,
+		Breaker:    a.breaker.Status(),
+		Health:     a.health,
+		Counters:   a.counters,
+		Batching:   a.batcher != nil,
+		Encoding:   a.encoding,
+	}
+	if now.Before(a.throttledUntil) {
+		throttledUntil := a.throttledUntil
+		status.ThrottledUntil = &throttledUntil
+	}
+	if a.leaseTTL > 0 {
+		leaseExpiresAt := a.leaseExpiresAt
+		status.LeaseExpiresAt = &leaseExpiresAt
+		status.LeaseExpired = a.leaseExpired
+		status.Capabilities = a.Capabilities
+	}
+	return status
+}
+
 // recalculateTotalWeight recalculates the total weight of active analyzers
 func (p *AnalyzerPool) recalculateTotalWeight() {
 	total := 0.0
@@ -96,43 +348,227 @@ func (p *AnalyzerPool) recalculateTotalWeight() {
 	p.totalWeight = total
 }
 
-// SendLogPacket sends a log packet to the specified analyzer
-func (p *AnalyzerPool) SendLogPacket(ctx context.Context, analyzer *Analyzer, packet *models.LogPacket) error {
+// SendLogPacket sends a log packet to the specified analyzer over the
+// transport its URL selects. For an HTTP analyzer with batching enabled, the
+// packet joins the pending batch and the call returns once the batch was
+// sent, with the packet's own outcome.
+func (p *AnalyzerPool) SendLogPacket(ctx context.Context, analyzer *Analyzer, packet *models.LogPacket) (err error) {
+	analyzer = analyzer.pooled()
+	p.beginSend(analyzer)
+	defer func() { p.endSend(analyzer, err) }()
+
+	if isGRPC(p.url(analyzer)) {
+		return p.sendGRPC(ctx, analyzer, packet)
+	}
+
 	payload, err := json.Marshal(packet)
 	if err != nil {
 		return fmt.Errorf("failed to marshal log packet: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", analyzer.URL+"/analyze", strings.NewReader(string(payload)))
+	p.mutex.RLock()
+	batcher := analyzer.batcher
+	p.mutex.RUnlock()
+	if batcher != nil {
+		item := &batchItem{ctx: ctx, payload: payload, key: p.idempotencyKey(packet), done: make(chan error, 1)}
+		batcher.submit(item)
+		select {
+		case err := <-item.done:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	body, retryAfter, err := p.post(ctx, analyzer, "/analyze", payload, p.idempotencyKey(packet))
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	// Older analyzers reply without a body or with a bare status, which means
+	// everything was accepted
+	var result models.AnalyzeResponse
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil
+	}
+	return partialDelivery(analyzer.ID, result, retryAfter)
+}
+
+// post sends a JSON body to an analyzer, compressed with the encoding it
+// negotiated and with the idempotency key if not empty, and feeds the
+// outcome to its breaker. It returns the body of a 200 response and any
+// Retry-After the analyzer sent.
+func (p *AnalyzerPool) post(ctx context.Context, analyzer *Analyzer, path string, payload []byte, key string) ([]byte, time.Duration, error) {
+	if !analyzer.breaker.Allow() {
+		p.syncActive(analyzer)
+		return nil, 0, fmt.Errorf("analyzer %s: %w", analyzer.ID, ErrCircuitOpen)
+	}
 
-	resp, err := p.httpClient.Do(req)
+	encoding := p.encoding(analyzer)
+	resp, err := p.do(ctx, analyzer, path, payload, encoding, key)
+	if err == nil && resp.StatusCode == http.StatusUnsupportedMediaType && encoding != EncodingIdentity {
+		// The analyzer stopped taking compressed bodies, send it plain
+		resp.Body.Close()
+		log.Printf("Analyzer %s refused %s bodies, sending uncompressed\n", analyzer.ID, encoding)
+		p.setEncoding(analyzer, EncodingIdentity)
+		resp, err = p.do(ctx, analyzer, path, payload, EncodingIdentity, key)
+	}
 	if err != nil {
-		// Mark analyzer as inactive
-		p.SetAnalyzerActive(analyzer.ID, false)
-		return fmt.Errorf("failed to send log packet to analyzer %s: %w", analyzer.ID, err)
+		p.recordSend(analyzer, false)
+		return nil, 0, fmt.Errorf("failed to send log packet to analyzer %s: %w", analyzer.ID, err)
 	}
 	defer resp.Body.Close()
 
+	retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if retryAfter > 0 {
+		p.throttle(analyzer, retryAfter)
+	}
+
+	// An explicit request to slow down is not a failure of the analyzer
+	if (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) && retryAfter > 0 {
+		p.recordSend(analyzer, true)
+		return nil, 0, &BackpressureError{AnalyzerID: analyzer.ID, StatusCode: resp.StatusCode, RetryAfter: retryAfter}
+	}
+
+	// Server errors and throttling count against the analyzer; other
+	// rejections are about the packet, not the analyzer's health
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("analyzer %s returned non-OK status: %d", analyzer.ID, resp.StatusCode)
+		healthy := resp.StatusCode < http.StatusInternalServerError && resp.StatusCode != http.StatusTooManyRequests
+		p.recordSend(analyzer, healthy)
+		return nil, 0, fmt.Errorf("analyzer %s returned non-OK status: %d", analyzer.ID, resp.StatusCode)
 	}
 
-	return nil
+	p.recordSend(analyzer, true)
+
+	// An unreadable body is treated like an empty one
+	body, _ := io.ReadAll(resp.Body)
+	return body, retryAfter, nil
+}
+
+// do sends one request with the body in the given encoding
+func (p *AnalyzerPool) do(ctx context.Context, analyzer *Analyzer, path string, payload []byte, encoding, key string) (*http.Response, error) {
+	body, err := compress(encoding, payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url(analyzer)+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if encoding != EncodingIdentity {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	if key != "" {
+		req.Header.Set(HeaderIdempotencyKey, key)
+	}
+	return p.client(analyzer).Do(req)
+}
+
+// partialDelivery turns an analyzer's response into a PartialDeliveryError
+// if it did not accept every log message
+func partialDelivery(analyzerID string, result models.AnalyzeResponse, retryAfter time.Duration) error {
+	if len(result.Rejected) == 0 && len(result.Deferred) == 0 {
+		return nil
+	}
+
+	partial := &PartialDeliveryError{
+		AnalyzerID: analyzerID,
+		Deferred:   result.Deferred,
+		RetryAfter: retryAfter,
+	}
+	for _, r := range result.Rejected {
+		partial.Rejected = append(partial.Rejected, r.ID)
+	}
+	return partial
+}
+
+// url returns the current URL of an analyzer, which UpdateAnalyzer and
+// Register may change at any time
+func (p *AnalyzerPool) url(a *Analyzer) string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return a.URL
+}
+
+// encoding returns the body encoding negotiated with an analyzer
+func (p *AnalyzerPool) encoding(a *Analyzer) string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return a.encoding
+}
+
+// setEncoding changes the body encoding used for an analyzer
+func (p *AnalyzerPool) setEncoding(a *Analyzer, encoding string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	a.encoding = encoding
+}
+
+// throttle pauses traffic to an analyzer for the given duration
+func (p *AnalyzerPool) throttle(a *Analyzer, d time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	until := time.Now().Add(d)
+	if until.After(a.throttledUntil) {
+		a.throttledUntil = until
+	}
+}
+
+// recordSend feeds a send result to an analyzer's breaker
+func (p *AnalyzerPool) recordSend(a *Analyzer, success bool) {
+	a.breaker.RecordSend(success)
+	p.syncActive(a)
+}
+
+// recordProbe feeds a health probe result to an analyzer's breaker and
+// remembers it as the analyzer's health
+func (p *AnalyzerPool) recordProbe(a *Analyzer, success bool) {
+	a.breaker.RecordProbe(success)
+
+	p.mutex.Lock()
+	now := time.Now()
+	a.health.LastCheck = &now
+	if success {
+		a.health.Status = HealthHealthy
+	} else {
+		a.health.Status = HealthUnhealthy
+	}
+	p.mutex.Unlock()
+
+	p.syncActive(a)
+}
+
+// syncActive updates an analyzer's active flag from its admin and breaker
+// state
+func (p *AnalyzerPool) syncActive(a *Analyzer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	active := a.available()
+	if a.Active != active {
+		a.Active = active
+		p.recalculateTotalWeight()
+	}
 }
 
-// SetAnalyzerActive sets the active status of an analyzer
+// SetAnalyzerActive sets the active status of an analyzer by forcing its
+// breaker open or resetting it to closed
 func (p *AnalyzerPool) SetAnalyzerActive(id string, active bool) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
 	for _, a := range p.analyzers {
 		if a.ID == id {
-			a.Active = active
+			if active {
+				a.breaker.Reset()
+			} else {
+				a.breaker.ForceOpen()
+			}
+			a.Active = a.available()
 			break
 		}
 	}
@@ -140,10 +576,36 @@ func (p *AnalyzerPool) SetAnalyzerActive(id string, active bool) {
 	p.recalculateTotalWeight()
 }
 
-// StartHealthCheck starts periodic health checks of all analyzers
+// SetAdminState enables or disables an analyzer. A disabled analyzer keeps
+// its place in the pool and its health checks but receives no traffic.
+// Enabling a draining analyzer cancels the drain.
+func (p *AnalyzerPool) SetAdminState(id string, state AdminState) error {
+	if state != AdminEnabled && state != AdminDisabled {
+		return fmt.Errorf("invalid admin state %q", state)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	a := p.find(id)
+	if a == nil {
+		return ErrAnalyzerNotFound
+	}
+
+	a.AdminState = state
+	a.Active = a.available()
+	p.recalculateTotalWeight()
+	p.saveState()
+	return nil
+}
+
+// StartHealthCheck starts periodic health checks of all analyzers and
+// expires the leases of self-registered analyzers
 func (p *AnalyzerPool) StartHealthCheck(ctx context.Context) {
 	ticker := time.NewTicker(p.healthCheckInterval)
 	defer ticker.Stop()
+	leaseTicker := time.NewTicker(leaseCheckInterval)
+	defer leaseTicker.Stop()
 
 	for {
 		select {
@@ -151,6 +613,8 @@ func (p *AnalyzerPool) StartHealthCheck(ctx context.Context) {
 			return
 		case <-ticker.C:
 			p.checkAllAnalyzers(ctx)
+		case now := <-leaseTicker.C:
+			p.ExpireLeases(now)
 		}
 	}
 }
@@ -163,6 +627,8 @@ func (p *AnalyzerPool) checkAllAnalyzers(ctx context.Context) {
 	p.mutex.RUnlock()
 
 	for _, a := range analyzers {
+		// Let breakers whose open timeout passed admit trial traffic
+		p.syncActive(a)
 		go p.checkAnalyzerHealth(ctx, a)
 	}
 }
@@ -172,22 +638,30 @@ func (p *AnalyzerPool) checkAnalyzerHealth(ctx context.Context, a *Analyzer) {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, "GET", a.URL+"/health", nil)
+	url := p.url(a)
+	if isGRPC(url) {
+		p.checkGRPCHealth(ctx, a)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url+"/health", nil)
 	if err != nil {
-		p.SetAnalyzerActive(a.ID, false)
+		p.recordProbe(a, false)
 		return
 	}
 
-	resp, err := p.httpClient.Do(req)
+	resp, err := p.client(a).Do(req)
 	if err != nil {
-		p.SetAnalyzerActive(a.ID, false)
+		p.recordProbe(a, false)
 		return
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusOK {
-		p.SetAnalyzerActive(a.ID, true)
-	} else {
-		p.SetAnalyzerActive(a.ID, false)
+	// Analyzers announce the body encodings they take on their health
+	// response, as a server would after a 415
+	if offered := resp.Header.Values("Accept-Encoding"); resp.StatusCode == http.StatusOK && len(offered) > 0 {
+		p.setEncoding(a, NegotiateEncoding(offered))
 	}
+
+	p.recordProbe(a, resp.StatusCode == http.StatusOK)
 }
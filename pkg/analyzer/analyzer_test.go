@@ -3,8 +3,10 @@ package analyzer
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -102,6 +104,70 @@ func TestGetActiveAnalyzers(t *testing.T) {
 	}
 }
 
+// TestActiveAnalyzerSnapshots tests that analyzers handed out by the pool
+// stay unchanged while the pool updates them
+func TestActiveAnalyzerSnapshots(t *testing.T) {
+	pool := NewAnalyzerPool(time.Second * 10)
+	pool.AddAnalyzer("analyzer1", "http://example.com/1", 0.5)
+
+	snapshot := pool.GetActiveAnalyzers()[0]
+	pool.SetAdminState("analyzer1", AdminDisabled)
+	if !snapshot.Active || snapshot.Weight != 0.5 {
+		t.Errorf("Expected the snapshot to stay active with weight 0.5, got %v and %v", snapshot.Active, snapshot.Weight)
+	}
+	if n := len(pool.GetActiveAnalyzers()); n != 0 {
+		t.Errorf("Expected no active analyzers, got %d", n)
+	}
+
+	// Readers of snapshots must not race with updates
+	pool.SetAdminState("analyzer1", AdminEnabled)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			pool.SetAdminState("analyzer1", AdminDisabled)
+			pool.SetAdminState("analyzer1", AdminEnabled)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		for _, a := range pool.GetActiveAnalyzers() {
+			_ = a.Active && a.Weight > 0
+		}
+	}
+	<-done
+}
+
+// TestUpdateAnalyzerDuringSends tests that changing an analyzer's URL does
+// not race with sends reading it
+func TestUpdateAnalyzerDuringSends(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	pool := NewAnalyzerPool(time.Second * 10)
+	pool.AddAnalyzer("analyzer1", server.URL, 1.0)
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			pool.UpdateAnalyzer("analyzer1", server.URL, float64(i%3+1))
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		snapshot := pool.GetActiveAnalyzers()[0]
+		pool.SendLogPacket(context.Background(), snapshot, &models.LogPacket{PacketID: fmt.Sprintf("p%d", i)})
+	}
+	close(stop)
+	<-done
+}
+
 // TestSendLogPacket tests sending log packets to analyzers
 func TestSendLogPacket(t *testing.T) {
 	// Create a test HTTP server to act as analyzer
@@ -243,3 +309,121 @@ func TestHealthCheck(t *testing.T) {
 		t.Fatalf("Expected 1 active analyzer after server becomes healthy again, got %d", len(activeAnalyzers))
 	}
 }
+
+// TestSendLogPacketPartial tests decoding a partial acceptance response
+func TestSendLogPacketPartial(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "2")
+		json.NewEncoder(w).Encode(models.AnalyzeResponse{
+			Status:   models.AnalyzePartial,
+			Accepted: []string{"log1"},
+			Rejected: []models.LogRejection{{ID: "log2", Reason: "unsupported source"}},
+			Deferred: []string{"log3"},
+		})
+	}))
+	defer server.Close()
+
+	pool := NewAnalyzerPool(time.Second * 10)
+	pool.AddAnalyzer("test-analyzer", server.URL, 1.0)
+
+	packet := &models.LogPacket{
+		PacketID: "test-packet-id",
+		LogMessages: []models.LogMessage{
+			{ID: "log1"}, {ID: "log2"}, {ID: "log3"},
+		},
+	}
+
+	err := pool.SendLogPacket(context.Background(), pool.analyzers[0], packet)
+	partial, ok := err.(*PartialDeliveryError)
+	if !ok {
+		t.Fatalf("Expected PartialDeliveryError, got %v", err)
+	}
+	if len(partial.Rejected) != 1 || partial.Rejected[0] != "log2" {
+		t.Errorf("Expected 'log2' to be rejected, got %v", partial.Rejected)
+	}
+	if len(partial.Deferred) != 1 || partial.Deferred[0] != "log3" {
+		t.Errorf("Expected 'log3' to be deferred, got %v", partial.Deferred)
+	}
+	if partial.RetryAfter != 2*time.Second {
+		t.Errorf("Expected retry after 2s, got %v", partial.RetryAfter)
+	}
+
+	// The analyzer is paused for the Retry-After period
+	if len(pool.GetActiveAnalyzers()) != 0 {
+		t.Error("Expected throttled analyzer to be left out of active analyzers")
+	}
+}
+
+// TestSendLogPacketBackpressure tests that 429 with Retry-After throttles without tripping the breaker
+func TestSendLogPacketBackpressure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	pool := NewAnalyzerPool(time.Second*10, WithBreakerConfig(BreakerConfig{FailureThreshold: 1}))
+	pool.AddAnalyzer("test-analyzer", server.URL, 1.0)
+
+	err := pool.SendLogPacket(context.Background(), pool.analyzers[0], &models.LogPacket{PacketID: "test-packet-id"})
+	backpressure, ok := err.(*BackpressureError)
+	if !ok {
+		t.Fatalf("Expected BackpressureError, got %v", err)
+	}
+	if backpressure.RetryAfter != time.Second {
+		t.Errorf("Expected retry after 1s, got %v", backpressure.RetryAfter)
+	}
+
+	status := pool.ListAnalyzers()[0]
+	if status.Breaker.State != BreakerClosed {
+		t.Errorf("Expected breaker to stay closed, got '%s'", status.Breaker.State)
+	}
+	if status.ThrottledUntil == nil {
+		t.Error("Expected analyzer to be throttled")
+	}
+}
+
+// TestSendLogPacketIdempotencyKey tests that retries of a packet carry the
+// same key and the remainder of a partial delivery a different one
+func TestSendLogPacketIdempotencyKey(t *testing.T) {
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(HeaderIdempotencyKey))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	pool := NewAnalyzerPool(time.Second*10, WithIdempotencyKeys(true))
+	pool.AddAnalyzer("test-analyzer", server.URL, 1.0)
+	a := pool.analyzers[0]
+
+	packet := &models.LogPacket{
+		PacketID:    "packet1",
+		LogMessages: []models.LogMessage{{ID: "msg1"}, {ID: "msg2"}},
+	}
+	pool.SendLogPacket(context.Background(), a, packet)
+	pool.SendLogPacket(context.Background(), a, packet)
+	pool.SendLogPacket(context.Background(), a, &models.LogPacket{
+		PacketID:    "packet1",
+		LogMessages: []models.LogMessage{{ID: "msg2"}},
+	})
+
+	if len(keys) != 3 {
+		t.Fatalf("Expected 3 requests, got %d", len(keys))
+	}
+	if keys[0] == "" || keys[0] != keys[1] || keys[0] != IdempotencyKey(packet) {
+		t.Errorf("Expected retries to share the key, got %q and %q", keys[0], keys[1])
+	}
+	if keys[2] == keys[0] || !strings.HasPrefix(keys[2], "packet1-") {
+		t.Errorf("Expected a different key for the remainder, got %q", keys[2])
+	}
+
+	// Keys are off by default
+	keys = nil
+	plain := NewAnalyzerPool(time.Second * 10)
+	plain.AddAnalyzer("test-analyzer", server.URL, 1.0)
+	plain.SendLogPacket(context.Background(), plain.analyzers[0], packet)
+	if len(keys) != 1 || keys[0] != "" {
+		t.Errorf("Expected no key without WithIdempotencyKeys, got %v", keys)
+	}
+}
@@ -0,0 +1,256 @@
+package analyzer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// CapabilityBatch is announced by self-registering analyzers that take
+// POST /analyze/batch
+const CapabilityBatch = "batch"
+
+// BatchConfig sets when the packets collected for a batching analyzer are
+// sent as one request
+type BatchConfig struct {
+	// MaxPackets sends a batch once it holds this many packets
+	MaxPackets int
+	// MaxBytes sends a batch once its packets add up to this many bytes of
+	// JSON
+	MaxBytes int
+	// MaxDelay sends a batch this long after its first packet arrived
+	MaxDelay time.Duration
+}
+
+// DefaultBatchConfig returns the batch thresholds used unless
+// WithBatchConfig says otherwise
+func DefaultBatchConfig() BatchConfig {
+	return BatchConfig{
+		MaxPackets: 100,
+		MaxBytes:   1 << 20,
+		MaxDelay:   50 * time.Millisecond,
+	}
+}
+
+// normalized fills in defaults for unset fields
+func (c BatchConfig) normalized() BatchConfig {
+	defaults := DefaultBatchConfig()
+	if c.MaxPackets <= 0 {
+		c.MaxPackets = defaults.MaxPackets
+	}
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = defaults.MaxBytes
+	}
+	if c.MaxDelay <= 0 {
+		c.MaxDelay = defaults.MaxDelay
+	}
+	return c
+}
+
+// WithBatchConfig sets the thresholds of analyzers that have batching
+// enabled
+func WithBatchConfig(config BatchConfig) PoolOption {
+	return func(p *AnalyzerPool) {
+		p.batchConfig = config.normalized()
+	}
+}
+
+// batchItem is a packet waiting for its batch to be sent, together with the
+// channel its sender waits on for the packet's own outcome. The batch is
+// sent for as long as the context of any of its senders is not done.
+type batchItem struct {
+	ctx     context.Context
+	payload json.RawMessage
+	key     string
+	done    chan error
+}
+
+// batcher collects the packets sent to one analyzer until a threshold is
+// reached
+type batcher struct {
+	config  BatchConfig
+	flush   func(items []*batchItem)
+	pending []*batchItem
+	bytes   int
+	timer   *time.Timer
+	mutex   sync.Mutex
+}
+
+// newBatcher creates a batcher handing full batches to flush
+func newBatcher(config BatchConfig, flush func(items []*batchItem)) *batcher {
+	return &batcher{
+		config: config,
+		flush:  flush,
+	}
+}
+
+// submit adds a packet to the pending batch. A batch filled by the packet is
+// sent from the calling goroutine; otherwise the batch is sent by whichever
+// comes first of a later packet filling it or its delay expiring.
+func (b *batcher) submit(item *batchItem) {
+	b.mutex.Lock()
+	b.pending = append(b.pending, item)
+	b.bytes += len(item.payload)
+
+	var full []*batchItem
+	if len(b.pending) >= b.config.MaxPackets || b.bytes >= b.config.MaxBytes {
+		full = b.take()
+	} else if len(b.pending) == 1 {
+		b.timer = time.AfterFunc(b.config.MaxDelay, b.flushPending)
+	}
+	b.mutex.Unlock()
+
+	if full != nil {
+		b.flush(full)
+	}
+}
+
+// flushPending sends whatever is pending
+func (b *batcher) flushPending() {
+	b.mutex.Lock()
+	items := b.take()
+	b.mutex.Unlock()
+
+	if len(items) > 0 {
+		b.flush(items)
+	}
+}
+
+// take empties the pending batch. The caller must hold the mutex.
+func (b *batcher) take() []*batchItem {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	items := b.pending
+	b.pending = nil
+	b.bytes = 0
+	return items
+}
+
+// SetBatching turns batching on or off for an analyzer. Packets already
+// collected are sent right away when batching is turned off.
+func (p *AnalyzerPool) SetBatching(id string, enabled bool) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	a := p.find(id)
+	if a == nil {
+		return ErrAnalyzerNotFound
+	}
+
+	p.setBatching(a, enabled)
+	p.saveState()
+	return nil
+}
+
+// setBatching turns batching on or off. The caller must hold the mutex.
+func (p *AnalyzerPool) setBatching(a *Analyzer, enabled bool) {
+	switch {
+	case enabled && a.batcher == nil:
+		a.batcher = newBatcher(p.batchConfig, func(items []*batchItem) {
+			p.sendBatch(a, items)
+		})
+	case !enabled && a.batcher != nil:
+		go a.batcher.flushPending()
+		a.batcher = nil
+	}
+}
+
+// sendBatch posts a batch to an analyzer and hands every packet its own
+// outcome. Packets whose sender gave up before the batch was sent are left
+// out.
+func (p *AnalyzerPool) sendBatch(a *Analyzer, items []*batchItem) {
+	waiting := items[:0]
+	for _, item := range items {
+		if err := item.ctx.Err(); err != nil {
+			item.done <- err
+			continue
+		}
+		waiting = append(waiting, item)
+	}
+	if len(waiting) == 0 {
+		return
+	}
+	items = waiting
+
+	ctx, cancel := batchContext(items)
+	defer cancel()
+
+	outcomes, err := p.postBatch(ctx, a, items)
+	for i, item := range items {
+		switch {
+		case err != nil:
+			item.done <- err
+		case i < len(outcomes):
+			item.done <- outcomes[i]
+		default:
+			item.done <- nil
+		}
+	}
+}
+
+// batchContext returns a context that is done once the contexts of all the
+// senders of a batch are
+func batchContext(items []*batchItem) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var mutex sync.Mutex
+	remaining := len(items)
+	stops := make([]func() bool, len(items))
+	for i, item := range items {
+		stops[i] = context.AfterFunc(item.ctx, func() {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if remaining--; remaining == 0 {
+				cancel()
+			}
+		})
+	}
+
+	return ctx, func() {
+		for _, stop := range stops {
+			stop()
+		}
+		cancel()
+	}
+}
+
+// postBatch posts a batch and returns the outcome of every packet the
+// analyzer reported a result for
+func (p *AnalyzerPool) postBatch(ctx context.Context, a *Analyzer, items []*batchItem) ([]error, error) {
+	batch := struct {
+		Packets         []json.RawMessage `json:"packets"`
+		IdempotencyKeys []string          `json:"idempotency_keys,omitempty"`
+	}{Packets: make([]json.RawMessage, len(items))}
+	for i, item := range items {
+		batch.Packets[i] = item.payload
+		if item.key != "" {
+			batch.IdempotencyKeys = append(batch.IdempotencyKeys, item.key)
+		}
+	}
+
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal batch: %w", err)
+	}
+
+	body, retryAfter, err := p.post(ctx, a, "/analyze/batch", payload, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// A body without results accepts the whole batch
+	var result models.AnalyzeBatchResponse
+	json.Unmarshal(body, &result)
+
+	outcomes := make([]error, len(result.Results))
+	for i, r := range result.Results {
+		outcomes[i] = partialDelivery(a.ID, r, retryAfter)
+	}
+	return outcomes, nil
+}
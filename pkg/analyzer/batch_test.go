@@ -0,0 +1,287 @@
+package analyzer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// batchServer is a fake analyzer recording the batches it receives
+type batchServer struct {
+	batches   [][]models.LogPacket
+	keys      [][]string
+	encodings []string
+	// reject lists log message IDs the analyzer rejects
+	reject map[string]bool
+	mutex  sync.Mutex
+}
+
+func (s *batchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/analyze/batch" {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := DecodeBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	var batch models.AnalyzeBatch
+	if err := json.NewDecoder(body).Decode(&batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	s.batches = append(s.batches, batch.Packets)
+	s.keys = append(s.keys, batch.IdempotencyKeys)
+	s.encodings = append(s.encodings, r.Header.Get("Content-Encoding"))
+	s.mutex.Unlock()
+
+	var response models.AnalyzeBatchResponse
+	for _, packet := range batch.Packets {
+		result := models.AnalyzeResponse{Status: models.AnalyzeProcessed}
+		for _, msg := range packet.LogMessages {
+			if s.reject[msg.ID] {
+				result.Status = models.AnalyzePartial
+				result.Rejected = append(result.Rejected, models.LogRejection{ID: msg.ID})
+			}
+		}
+		response.Results = append(response.Results, result)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// sendConcurrently sends the packets from separate goroutines and returns
+// their outcomes in order
+func sendConcurrently(pool *AnalyzerPool, a *Analyzer, packets []*models.LogPacket) []error {
+	errs := make([]error, len(packets))
+	var wg sync.WaitGroup
+	for i, packet := range packets {
+		wg.Add(1)
+		go func(i int, packet *models.LogPacket) {
+			defer wg.Done()
+			errs[i] = pool.SendLogPacket(context.Background(), a, packet)
+		}(i, packet)
+	}
+	wg.Wait()
+	return errs
+}
+
+// TestBatchBySize tests that packets are merged into one compressed request
+// once the batch is full
+func TestBatchBySize(t *testing.T) {
+	server := &batchServer{}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	pool := NewAnalyzerPool(time.Second*10, WithBatchConfig(BatchConfig{MaxPackets: 4, MaxDelay: time.Hour}))
+	pool.Register("analyzer1", httpServer.URL, 1, []string{CapabilityBatch, EncodingZstd, EncodingGzip}, time.Minute)
+
+	packets := make([]*models.LogPacket, 4)
+	for i := range packets {
+		packets[i] = &models.LogPacket{PacketID: "packet", LogMessages: []models.LogMessage{{ID: "msg"}}}
+	}
+	for i, err := range sendConcurrently(pool, pool.GetActiveAnalyzers()[0], packets) {
+		if err != nil {
+			t.Errorf("Expected packet %d to be delivered, got %v", i, err)
+		}
+	}
+
+	if len(server.batches) != 1 || len(server.batches[0]) != 4 {
+		t.Fatalf("Expected 1 batch of 4 packets, got %d batches", len(server.batches))
+	}
+	if server.encodings[0] != EncodingZstd {
+		t.Errorf("Expected a zstd body, got %q", server.encodings[0])
+	}
+
+	status, _ := pool.GetAnalyzer("analyzer1")
+	if !status.Batching || status.Counters.Sent != 4 {
+		t.Errorf("Expected batching with 4 packets counted, got %+v", status)
+	}
+}
+
+// TestBatchByDelay tests that a partial batch is sent after its delay and
+// every packet gets its own outcome
+func TestBatchByDelay(t *testing.T) {
+	server := &batchServer{reject: map[string]bool{"bad": true}}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	pool := NewAnalyzerPool(time.Second*10, WithBatchConfig(BatchConfig{MaxPackets: 100, MaxDelay: 20 * time.Millisecond}))
+	pool.AddAnalyzer("analyzer1", httpServer.URL, 1)
+	pool.SetBatching("analyzer1", true)
+
+	packets := []*models.LogPacket{
+		{PacketID: "good-packet", LogMessages: []models.LogMessage{{ID: "good"}}},
+		{PacketID: "bad-packet", LogMessages: []models.LogMessage{{ID: "bad"}}},
+	}
+	errs := sendConcurrently(pool, pool.GetActiveAnalyzers()[0], packets)
+
+	if len(server.batches) != 1 || len(server.batches[0]) != 2 {
+		t.Fatalf("Expected 1 batch of 2 packets, got %d batches", len(server.batches))
+	}
+	if server.encodings[0] != EncodingIdentity {
+		t.Errorf("Expected an uncompressed body, got %q", server.encodings[0])
+	}
+
+	if errs[0] != nil {
+		t.Errorf("Expected the good packet to be delivered, got %v", errs[0])
+	}
+	var partial *PartialDeliveryError
+	if !errors.As(errs[1], &partial) || len(partial.Rejected) != 1 || partial.Rejected[0] != "bad" {
+		t.Errorf("Expected the bad packet to be partly rejected, got %v", errs[1])
+	}
+}
+
+// TestBatchIdempotencyKeys tests that every packet of a batch is sent with
+// its own idempotency key
+func TestBatchIdempotencyKeys(t *testing.T) {
+	server := &batchServer{}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	pool := NewAnalyzerPool(time.Second*10, WithIdempotencyKeys(true),
+		WithBatchConfig(BatchConfig{MaxPackets: 2, MaxDelay: time.Hour}))
+	pool.AddAnalyzer("analyzer1", httpServer.URL, 1)
+	pool.SetBatching("analyzer1", true)
+
+	packets := []*models.LogPacket{
+		{PacketID: "packet1", LogMessages: []models.LogMessage{{ID: "msg1"}}},
+		{PacketID: "packet2", LogMessages: []models.LogMessage{{ID: "msg2"}}},
+	}
+	sendConcurrently(pool, pool.GetActiveAnalyzers()[0], packets)
+
+	if len(server.batches) != 1 || len(server.keys[0]) != 2 {
+		t.Fatalf("Expected 1 batch with 2 keys, got %d batches and keys %v", len(server.batches), server.keys)
+	}
+	for i, packet := range server.batches[0] {
+		if want := IdempotencyKey(&packet); server.keys[0][i] != want {
+			t.Errorf("Expected key %s for packet %s, got %s", want, packet.PacketID, server.keys[0][i])
+		}
+	}
+}
+
+// TestBatchSenderGivesUp tests that a sender stops waiting for its batch
+// when its context is done, and that a batch nobody waits for is not sent
+func TestBatchSenderGivesUp(t *testing.T) {
+	server := &batchServer{}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	pool := NewAnalyzerPool(time.Second*10, WithBatchConfig(BatchConfig{MaxPackets: 100, MaxDelay: time.Hour}))
+	pool.AddAnalyzer("analyzer1", httpServer.URL, 1)
+	pool.SetBatching("analyzer1", true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := pool.SendLogPacket(ctx, pool.GetActiveAnalyzers()[0], &models.LogPacket{PacketID: "packet1"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the send to give up at its deadline, got %v", err)
+	}
+
+	// Turning batching off flushes the abandoned packet
+	pool.SetBatching("analyzer1", false)
+	time.Sleep(20 * time.Millisecond)
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if len(server.batches) != 0 {
+		t.Errorf("Expected no batch to be sent, got %d", len(server.batches))
+	}
+}
+
+// TestBatchRequestCancelled tests that a batch request is cancelled once
+// every sender waiting for it gave up
+func TestBatchRequestCancelled(t *testing.T) {
+	release := make(chan struct{})
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer httpServer.Close()
+	defer close(release)
+
+	pool := NewAnalyzerPool(time.Second*10, WithBatchConfig(BatchConfig{MaxPackets: 1}))
+	pool.AddAnalyzer("analyzer1", httpServer.URL, 1)
+	pool.SetBatching("analyzer1", true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := pool.SendLogPacket(ctx, pool.GetActiveAnalyzers()[0], &models.LogPacket{PacketID: "packet1"}); err == nil {
+		t.Error("Expected the send to fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the batch request to be cancelled, took %v", elapsed)
+	}
+}
+
+// TestUnsupportedEncodingFallsBack tests that a 415 makes the pool resend
+// the body uncompressed and stop compressing
+func TestUnsupportedEncodingFallsBack(t *testing.T) {
+	var encodings []string
+	var mutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			w.Header().Set("Accept-Encoding", "gzip")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		mutex.Lock()
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		mutex.Unlock()
+		if r.Header.Get("Content-Encoding") != "" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	pool := NewAnalyzerPool(time.Second * 10)
+	pool.AddAnalyzer("analyzer1", server.URL, 1)
+	a := pool.analyzers[0]
+
+	pool.checkAnalyzerHealth(context.Background(), a)
+	if status, _ := pool.GetAnalyzer("analyzer1"); status.Encoding != EncodingGzip {
+		t.Fatalf("Expected gzip to be negotiated from the health check, got %q", status.Encoding)
+	}
+
+	if err := pool.SendLogPacket(context.Background(), a, &models.LogPacket{PacketID: "packet1"}); err != nil {
+		t.Fatalf("Expected the packet to be delivered uncompressed, got %v", err)
+	}
+	if len(encodings) != 2 || encodings[0] != EncodingGzip || encodings[1] != "" {
+		t.Errorf("Expected a gzip attempt and a plain resend, got %q", encodings)
+	}
+	if status, _ := pool.GetAnalyzer("analyzer1"); status.Encoding != EncodingIdentity {
+		t.Errorf("Expected compression to be turned off, got %q", status.Encoding)
+	}
+}
+
+// TestNegotiateEncoding tests picking the preferred encoding
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		offered  []string
+		expected string
+	}{
+		{nil, EncodingIdentity},
+		{[]string{"gzip"}, EncodingGzip},
+		{[]string{"gzip;q=0.5, zstd"}, EncodingZstd},
+		{[]string{"batch", "GZIP"}, EncodingGzip},
+		{[]string{"br, deflate"}, EncodingIdentity},
+	}
+
+	for _, test := range tests {
+		if got := NegotiateEncoding(test.offered); got != test.expected {
+			t.Errorf("Expected %q for %v, got %q", test.expected, test.offered, got)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package analyzer
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned when an analyzer's circuit breaker rejects a send
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerState is the state of a circuit breaker
+type BreakerState string
+
+// Breaker states
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// windowBuckets is the number of buckets the rolling window is split into
+const windowBuckets = 10
+
+// BreakerConfig controls when a circuit breaker opens and closes
+type BreakerConfig struct {
+	// FailureThreshold is the number of consecutive failures that opens the breaker
+	FailureThreshold int
+	// ProbeFailureThreshold is the number of consecutive failed health probes
+	// that opens the breaker
+	ProbeFailureThreshold int
+	// ErrorRateThreshold is the failure ratio over the window, between 0 and
+	// 1, that opens the breaker
+	ErrorRateThreshold float64
+	// MinRequests is the number of sends in the window before the error rate
+	// is taken into account
+	MinRequests int
+	// Window is the length of the rolling error-rate window
+	Window time.Duration
+	// OpenTimeout is how long the breaker stays open before admitting trial
+	// traffic, unless a health probe succeeds first
+	OpenTimeout time.Duration
+	// HalfOpenMaxTrials is the number of trial sends allowed in flight while
+	// half-open
+	HalfOpenMaxTrials int
+	// HalfOpenSuccesses is the number of successful trial sends that closes
+	// the breaker
+	HalfOpenSuccesses int
+}
+
+// DefaultBreakerConfig returns the breaker settings used by default
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		FailureThreshold:      5,
+		ProbeFailureThreshold: 1,
+		ErrorRateThreshold:    0.5,
+		MinRequests:           20,
+		Window:                30 * time.Second,
+		OpenTimeout:           10 * time.Second,
+		HalfOpenMaxTrials:     3,
+		HalfOpenSuccesses:     3,
+	}
+}
+
+// normalized fills in defaults for unset fields
+func (c BreakerConfig) normalized() BreakerConfig {
+	defaults := DefaultBreakerConfig()
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = defaults.FailureThreshold
+	}
+	if c.ProbeFailureThreshold <= 0 {
+		c.ProbeFailureThreshold = defaults.ProbeFailureThreshold
+	}
+	if c.ErrorRateThreshold <= 0 || c.ErrorRateThreshold > 1 {
+		c.ErrorRateThreshold = defaults.ErrorRateThreshold
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = defaults.MinRequests
+	}
+	if c.Window <= 0 {
+		c.Window = defaults.Window
+	}
+	if c.OpenTimeout <= 0 {
+		c.OpenTimeout = defaults.OpenTimeout
+	}
+	if c.HalfOpenMaxTrials <= 0 {
+		c.HalfOpenMaxTrials = defaults.HalfOpenMaxTrials
+	}
+	if c.HalfOpenSuccesses <= 0 {
+		c.HalfOpenSuccesses = defaults.HalfOpenSuccesses
+	}
+	return c
+}
+
+// BreakerStatus is a point-in-time view of a circuit breaker
+type BreakerStatus struct {
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	WindowRequests      int          `json:"window_requests"`
+	WindowErrorRate     float64      `json:"window_error_rate"`
+	OpenedAt            *time.Time   `json:"opened_at,omitempty"`
+}
+
+// windowBucket counts send results within one slice of the rolling window
+type windowBucket struct {
+	epoch     int64
+	successes int
+	failures  int
+}
+
+// CircuitBreaker tracks the health of one analyzer from send results and
+// health probes
+type CircuitBreaker struct {
+	config              BreakerConfig
+	state               BreakerState
+	consecutiveFailures int
+	probeFailures       int
+	buckets             [windowBuckets]windowBucket
+	openedAt            time.Time
+	trialsInFlight      int
+	trialSuccesses      int
+	now                 func() time.Time
+	mutex               sync.Mutex
+}
+
+// NewCircuitBreaker creates a closed circuit breaker
+func NewCircuitBreaker(config BreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{
+		config: config.normalized(),
+		state:  BreakerClosed,
+		now:    time.Now,
+	}
+}
+
+// State returns the current state, moving an open breaker to half-open once
+// its timeout has passed
+func (b *CircuitBreaker) State() BreakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.checkTimeout()
+	return b.state
+}
+
+// Allow reports whether a send may go through. While half-open it admits a
+// limited number of trial sends; every admitted send must be followed by
+// RecordSend.
+func (b *CircuitBreaker) Allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.checkTimeout()
+	switch b.state {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		if b.trialsInFlight >= b.config.HalfOpenMaxTrials {
+			return false
+		}
+		b.trialsInFlight++
+		return true
+	default:
+		return false
+	}
+}
+
+// admitting reports whether Allow would let a send through now, without
+// taking a trial slot
+func (b *CircuitBreaker) admitting() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.checkTimeout()
+	switch b.state {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		return b.trialsInFlight < b.config.HalfOpenMaxTrials
+	default:
+		return false
+	}
+}
+
+// RecordSend records the outcome of a send to the analyzer
+func (b *CircuitBreaker) RecordSend(success bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case BreakerClosed:
+		bucket := b.bucket()
+		if success {
+			bucket.successes++
+			b.consecutiveFailures = 0
+		} else {
+			bucket.failures++
+			b.consecutiveFailures++
+		}
+		if b.shouldOpen() {
+			b.open()
+		}
+	case BreakerHalfOpen:
+		if b.trialsInFlight > 0 {
+			b.trialsInFlight--
+		}
+		if !success {
+			b.consecutiveFailures++
+			b.open()
+			return
+		}
+		b.trialSuccesses++
+		if b.trialSuccesses >= b.config.HalfOpenSuccesses {
+			b.close()
+		}
+	}
+}
+
+// RecordProbe records the outcome of a health probe. A failed probe counts
+// towards opening the breaker; a successful probe lets an open breaker admit
+// trial traffic, but only trial sends can close it again.
+func (b *CircuitBreaker) RecordProbe(success bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if success {
+		b.probeFailures = 0
+		if b.state == BreakerOpen {
+			b.halfOpen()
+		}
+		return
+	}
+
+	b.probeFailures++
+	b.consecutiveFailures++
+	switch b.state {
+	case BreakerOpen:
+		// Still down, restart the open timeout
+		b.openedAt = b.now()
+	case BreakerHalfOpen:
+		b.open()
+	default:
+		if b.shouldOpen() {
+			b.open()
+		}
+	}
+}
+
+// ForceOpen opens the breaker regardless of its history
+func (b *CircuitBreaker) ForceOpen() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.open()
+}
+
+// Reset closes the breaker and clears its history
+func (b *CircuitBreaker) Reset() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.close()
+}
+
+// Status returns a snapshot of the breaker
+func (b *CircuitBreaker) Status() BreakerStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.checkTimeout()
+	successes, failures := b.windowCounts()
+	status := BreakerStatus{
+		State:               b.state,
+		ConsecutiveFailures: b.consecutiveFailures,
+		WindowRequests:      successes + failures,
+	}
+	if total := successes + failures; total > 0 {
+		status.WindowErrorRate = float64(failures) / float64(total)
+	}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	return status
+}
+
+// shouldOpen reports whether the closed breaker has seen enough failures to
+// open. The caller must hold the mutex.
+func (b *CircuitBreaker) shouldOpen() bool {
+	if b.consecutiveFailures >= b.config.FailureThreshold {
+		return true
+	}
+	if b.probeFailures >= b.config.ProbeFailureThreshold {
+		return true
+	}
+
+	successes, failures := b.windowCounts()
+	total := successes + failures
+	return total >= b.config.MinRequests &&
+		float64(failures)/float64(total) >= b.config.ErrorRateThreshold
+}
+
+// checkTimeout moves an open breaker to half-open once the open timeout has
+// passed. The caller must hold the mutex.
+func (b *CircuitBreaker) checkTimeout() {
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.config.OpenTimeout {
+		b.halfOpen()
+	}
+}
+
+// open moves the breaker to the open state. The caller must hold the mutex.
+func (b *CircuitBreaker) open() {
+	b.state = BreakerOpen
+	b.openedAt = b.now()
+	b.trialsInFlight = 0
+	b.trialSuccesses = 0
+}
+
+// halfOpen moves the breaker to the half-open state. The caller must hold
+// the mutex.
+func (b *CircuitBreaker) halfOpen() {
+	b.state = BreakerHalfOpen
+	b.trialsInFlight = 0
+	b.trialSuccesses = 0
+}
+
+// close moves the breaker to the closed state with a clean history. The
+// caller must hold the mutex.
+func (b *CircuitBreaker) close() {
+	b.state = BreakerClosed
+	b.consecutiveFailures = 0
+	b.probeFailures = 0
+	b.trialsInFlight = 0
+	b.trialSuccesses = 0
+	b.buckets = [windowBuckets]windowBucket{}
+}
+
+// bucketDuration is the time span covered by one window bucket
+func (b *CircuitBreaker) bucketDuration() int64 {
+	d := int64(b.config.Window) / windowBuckets
+	if d <= 0 {
+		d = 1
+	}
+	return d
+}
+
+// bucket returns the bucket for the current time, clearing it if it last
+// held an older slice of time. The caller must hold the mutex.
+func (b *CircuitBreaker) bucket() *windowBucket {
+	epoch := b.now().UnixNano() / b.bucketDuration()
+	bucket := &b.buckets[epoch%windowBuckets]
+	if bucket.epoch != epoch {
+		*bucket = windowBucket{epoch: epoch}
+	}
+	return bucket
+}
+
+// windowCounts sums the buckets that fall within the window. The caller must
+// hold the mutex.
+func (b *CircuitBreaker) windowCounts() (int, int) {
+	current := b.now().UnixNano() / b.bucketDuration()
+	successes, failures := 0, 0
+	for _, bucket := range b.buckets {
+		if current-bucket.epoch < windowBuckets {
+			successes += bucket.successes
+			failures += bucket.failures
+		}
+	}
+	return successes, failures
+}
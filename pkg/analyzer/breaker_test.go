@@ -0,0 +1,179 @@
+package analyzer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// testClock is a manually advanced clock for breaker tests
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time { return c.now }
+
+func newTestBreaker(config BreakerConfig) (*CircuitBreaker, *testClock) {
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	breaker := NewCircuitBreaker(config)
+	breaker.now = clock.Now
+	return breaker, clock
+}
+
+// TestBreakerConsecutiveFailures tests opening after consecutive send failures
+func TestBreakerConsecutiveFailures(t *testing.T) {
+	breaker, _ := newTestBreaker(BreakerConfig{FailureThreshold: 3})
+
+	breaker.RecordSend(false)
+	breaker.RecordSend(false)
+	if breaker.State() != BreakerClosed {
+		t.Fatalf("Expected breaker to stay closed below threshold, got %s", breaker.State())
+	}
+
+	// A success resets the consecutive count
+	breaker.RecordSend(true)
+	breaker.RecordSend(false)
+	breaker.RecordSend(false)
+	if breaker.State() != BreakerClosed {
+		t.Fatalf("Expected breaker to stay closed after reset, got %s", breaker.State())
+	}
+
+	breaker.RecordSend(false)
+	if breaker.State() != BreakerOpen {
+		t.Fatalf("Expected breaker to open, got %s", breaker.State())
+	}
+	if breaker.Allow() {
+		t.Error("Expected open breaker to reject sends")
+	}
+}
+
+// TestBreakerErrorRate tests opening on the rolling error rate
+func TestBreakerErrorRate(t *testing.T) {
+	breaker, clock := newTestBreaker(BreakerConfig{
+		FailureThreshold:   100,
+		ErrorRateThreshold: 0.5,
+		MinRequests:        10,
+		Window:             10 * time.Second,
+	})
+
+	for i := 0; i < 8; i++ {
+		breaker.RecordSend(false)
+		breaker.RecordSend(true)
+	}
+	if breaker.State() != BreakerOpen {
+		t.Fatalf("Expected breaker to open at 50%% error rate, got %s", breaker.State())
+	}
+
+	// Old failures age out of the window
+	breaker.Reset()
+	for i := 0; i < 4; i++ {
+		breaker.RecordSend(false)
+	}
+	clock.now = clock.now.Add(20 * time.Second)
+	for i := 0; i < 8; i++ {
+		breaker.RecordSend(true)
+	}
+	breaker.RecordSend(false)
+	breaker.RecordSend(false)
+	if breaker.State() != BreakerClosed {
+		t.Errorf("Expected aged-out failures to be ignored, got %s", breaker.State())
+	}
+}
+
+// TestBreakerHalfOpen tests trial admission and closing after successes
+func TestBreakerHalfOpen(t *testing.T) {
+	breaker, clock := newTestBreaker(BreakerConfig{
+		FailureThreshold:  1,
+		OpenTimeout:       time.Second,
+		HalfOpenMaxTrials: 2,
+		HalfOpenSuccesses: 2,
+	})
+
+	breaker.RecordSend(false)
+	clock.now = clock.now.Add(2 * time.Second)
+	if breaker.State() != BreakerHalfOpen {
+		t.Fatalf("Expected breaker to be half-open after timeout, got %s", breaker.State())
+	}
+
+	if !breaker.Allow() || !breaker.Allow() {
+		t.Fatal("Expected half-open breaker to admit trial sends")
+	}
+	if breaker.Allow() {
+		t.Fatal("Expected half-open breaker to limit trial sends")
+	}
+
+	breaker.RecordSend(true)
+	breaker.RecordSend(true)
+	if breaker.State() != BreakerClosed {
+		t.Fatalf("Expected breaker to close after trial successes, got %s", breaker.State())
+	}
+
+	// A failed trial reopens the breaker
+	breaker.RecordSend(false)
+	breaker.RecordProbe(true)
+	if breaker.State() != BreakerHalfOpen {
+		t.Fatalf("Expected successful probe to half-open the breaker, got %s", breaker.State())
+	}
+	breaker.Allow()
+	breaker.RecordSend(false)
+	if breaker.State() != BreakerOpen {
+		t.Errorf("Expected failed trial to reopen the breaker, got %s", breaker.State())
+	}
+}
+
+// TestHalfOpenSelection tests that a half-open analyzer is left out of
+// selection while all its trial sends are in flight
+func TestHalfOpenSelection(t *testing.T) {
+	pool := NewAnalyzerPool(time.Second*10, WithBreakerConfig(BreakerConfig{HalfOpenMaxTrials: 1}))
+	pool.AddAnalyzer("test-analyzer", "http://example.com", 1.0)
+	a := pool.analyzers[0]
+
+	a.breaker.ForceOpen()
+	a.breaker.RecordProbe(true)
+	pool.syncActive(a)
+	if len(pool.GetActiveAnalyzers()) != 1 {
+		t.Fatal("Expected a half-open analyzer with a free trial slot to be selectable")
+	}
+
+	a.breaker.Allow()
+	if len(pool.GetActiveAnalyzers()) != 0 {
+		t.Error("Expected a half-open analyzer without free trial slots to be left out")
+	}
+
+	a.breaker.RecordSend(true)
+	if len(pool.GetActiveAnalyzers()) != 1 {
+		t.Error("Expected the analyzer to be selectable once its trial finished")
+	}
+}
+
+// TestBreakerServerErrors tests that 5xx responses open the breaker
+func TestBreakerServerErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	pool := NewAnalyzerPool(time.Second*10, WithBreakerConfig(BreakerConfig{FailureThreshold: 2}))
+	pool.AddAnalyzer("test-analyzer", server.URL, 1.0)
+	analyzer := pool.GetActiveAnalyzers()[0]
+
+	packet := &models.LogPacket{PacketID: "test-packet"}
+	for i := 0; i < 2; i++ {
+		if err := pool.SendLogPacket(context.Background(), analyzer, packet); err == nil {
+			t.Fatal("Expected error for 500 response")
+		}
+	}
+
+	if len(pool.GetActiveAnalyzers()) != 0 {
+		t.Error("Expected analyzer to be inactive after repeated server errors")
+	}
+
+	statuses := pool.ListAnalyzers()
+	if statuses[0].Breaker.State != BreakerOpen {
+		t.Errorf("Expected breaker state 'open', got '%s'", statuses[0].Breaker.State)
+	}
+}
@@ -0,0 +1,56 @@
+package analyzer
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// PartialDeliveryError is returned when an analyzer accepted only part of a
+// packet. The listed log message IDs still need to be delivered.
+type PartialDeliveryError struct {
+	AnalyzerID string
+	// Rejected log messages should go to a different analyzer
+	Rejected []string
+	// Deferred log messages should be retried later
+	Deferred []string
+	// RetryAfter is the analyzer's requested delay, zero if none was given
+	RetryAfter time.Duration
+}
+
+func (e *PartialDeliveryError) Error() string {
+	return fmt.Sprintf("analyzer %s rejected %d and deferred %d log messages",
+		e.AnalyzerID, len(e.Rejected), len(e.Deferred))
+}
+
+// BackpressureError is returned when an analyzer asks the distributor to slow
+// down with 429 or 503 and a Retry-After header
+type BackpressureError struct {
+	AnalyzerID string
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *BackpressureError) Error() string {
+	return fmt.Sprintf("analyzer %s asked to retry after %s (status %d)",
+		e.AnalyzerID, e.RetryAfter, e.StatusCode)
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP
+// date. It returns zero if the header is missing or invalid.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
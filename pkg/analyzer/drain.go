@@ -0,0 +1,95 @@
+package analyzer
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// Health probe results
+const (
+	HealthUnknown   = "unknown"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+// HealthStatus is the outcome of the last health probe of an analyzer
+type HealthStatus struct {
+	Status    string     `json:"status"`
+	LastCheck *time.Time `json:"last_check,omitempty"`
+}
+
+// SendCounters counts the packets sent to an analyzer
+type SendCounters struct {
+	InFlight int   `json:"in_flight"`
+	Sent     int64 `json:"sent"`
+	Failed   int64 `json:"failed"`
+}
+
+// Drain stops sending new packets to an analyzer and removes it once the
+// sends in flight finish. It returns true if the analyzer was removed right
+// away because nothing was in flight.
+func (p *AnalyzerPool) Drain(id string) (bool, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	a := p.find(id)
+	if a == nil {
+		return false, ErrAnalyzerNotFound
+	}
+
+	a.AdminState = AdminDraining
+	a.Active = false
+	p.recalculateTotalWeight()
+
+	if a.counters.InFlight == 0 {
+		p.removeDrained(a)
+		return true, nil
+	}
+
+	log.Printf("Draining analyzer %s, %d sends in flight\n", a.ID, a.counters.InFlight)
+	p.saveState()
+	return false, nil
+}
+
+// beginSend counts a send to the analyzer as in flight
+func (p *AnalyzerPool) beginSend(a *Analyzer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	a.counters.InFlight++
+}
+
+// endSend records the outcome of a send and removes a draining analyzer once
+// its last send finished. Partial deliveries count as sent.
+func (p *AnalyzerPool) endSend(a *Analyzer, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	a.counters.InFlight--
+	var partial *PartialDeliveryError
+	if err == nil || errors.As(err, &partial) {
+		a.counters.Sent++
+	} else {
+		a.counters.Failed++
+	}
+
+	if a.AdminState == AdminDraining && a.counters.InFlight == 0 {
+		p.removeDrained(a)
+	}
+}
+
+// removeDrained removes a drained analyzer from the pool if it is still in
+// it. The caller must hold the mutex.
+func (p *AnalyzerPool) removeDrained(a *Analyzer) {
+	for i, candidate := range p.analyzers {
+		if candidate == a {
+			p.analyzers = append(p.analyzers[:i], p.analyzers[i+1:]...)
+			p.closeTransport(a)
+			log.Printf("Analyzer %s drained and removed\n", a.ID)
+			p.recalculateTotalWeight()
+			p.saveState()
+			return
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package analyzer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// TestDuplicateAndUnknownAnalyzers tests that duplicate IDs are refused and
+// removing an unknown ID is reported
+func TestDuplicateAndUnknownAnalyzers(t *testing.T) {
+	pool := NewAnalyzerPool(time.Second * 10)
+
+	if err := pool.AddAnalyzer("analyzer1", "http://example.com/1", 0.5); err != nil {
+		t.Fatalf("Expected first add to succeed, got %v", err)
+	}
+	if err := pool.AddAnalyzer("analyzer1", "http://example.com/other", 1); err != ErrAnalyzerExists {
+		t.Errorf("Expected ErrAnalyzerExists, got %v", err)
+	}
+	if n := len(pool.ListAnalyzers()); n != 1 {
+		t.Errorf("Expected 1 analyzer, got %d", n)
+	}
+
+	if err := pool.RemoveAnalyzer("missing"); err != ErrAnalyzerNotFound {
+		t.Errorf("Expected ErrAnalyzerNotFound, got %v", err)
+	}
+	if _, err := pool.GetAnalyzer("missing"); err != ErrAnalyzerNotFound {
+		t.Errorf("Expected ErrAnalyzerNotFound, got %v", err)
+	}
+}
+
+// TestDrainWaitsForInFlightSends tests that a draining analyzer gets no new
+// traffic and is removed once its last send finishes
+func TestDrainWaitsForInFlightSends(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	pool := NewAnalyzerPool(time.Second * 10)
+	pool.AddAnalyzer("analyzer1", server.URL, 1)
+	pool.AddAnalyzer("analyzer2", "http://example.com/2", 1)
+	target := pool.GetActiveAnalyzers()[0]
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- pool.SendLogPacket(context.Background(), target, &models.LogPacket{PacketID: "packet1"})
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	removed, err := pool.Drain("analyzer1")
+	if err != nil || removed {
+		t.Fatalf("Expected the drain to wait for the send in flight, got removed=%v err=%v", removed, err)
+	}
+
+	status, err := pool.GetAnalyzer("analyzer1")
+	if err != nil {
+		t.Fatalf("Expected the draining analyzer to stay in the pool, got %v", err)
+	}
+	if status.AdminState != AdminDraining || status.Counters.InFlight != 1 {
+		t.Errorf("Expected draining with 1 send in flight, got %s with %d", status.AdminState, status.Counters.InFlight)
+	}
+	for _, a := range pool.GetActiveAnalyzers() {
+		if a.ID == "analyzer1" {
+			t.Error("Expected the draining analyzer to receive no new traffic")
+		}
+	}
+
+	close(release)
+	if err := <-sent; err != nil {
+		t.Errorf("Expected the send in flight to succeed, got %v", err)
+	}
+
+	if _, err := pool.GetAnalyzer("analyzer1"); err != ErrAnalyzerNotFound {
+		t.Errorf("Expected the drained analyzer to be removed, got %v", err)
+	}
+
+	// An idle analyzer is removed right away
+	removed, err = pool.Drain("analyzer2")
+	if err != nil || !removed {
+		t.Errorf("Expected an idle analyzer to be removed at once, got removed=%v err=%v", removed, err)
+	}
+}
+
+// TestSendCounters tests that sends and failures are counted per analyzer
+func TestSendCounters(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	pool := NewAnalyzerPool(time.Second * 10)
+	pool.AddAnalyzer("good", server.URL, 1)
+	pool.AddAnalyzer("bad", "http://127.0.0.1:1", 1)
+
+	for _, a := range pool.GetActiveAnalyzers() {
+		pool.SendLogPacket(context.Background(), a, &models.LogPacket{PacketID: "packet1"})
+	}
+
+	good, _ := pool.GetAnalyzer("good")
+	if good.Counters.Sent != 1 || good.Counters.Failed != 0 || good.Counters.InFlight != 0 {
+		t.Errorf("Expected 1 sent packet for good, got %+v", good.Counters)
+	}
+	bad, _ := pool.GetAnalyzer("bad")
+	if bad.Counters.Sent != 0 || bad.Counters.Failed != 1 {
+		t.Errorf("Expected 1 failed packet for bad, got %+v", bad.Counters)
+	}
+	if good.Health.Status != HealthUnknown {
+		t.Errorf("Expected unknown health before any probe, got %s", good.Health.Status)
+	}
+}
@@ -0,0 +1,90 @@
+package analyzer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Request body encodings, in order of preference
+const (
+	EncodingZstd     = "zstd"
+	EncodingGzip     = "gzip"
+	EncodingIdentity = ""
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// NegotiateEncoding picks the preferred body encoding among those an
+// analyzer offered, for example in an Accept-Encoding header or as
+// registration capabilities
+func NegotiateEncoding(offered []string) string {
+	accepted := make(map[string]bool, len(offered))
+	for _, o := range offered {
+		for _, part := range strings.Split(o, ",") {
+			// Drop any quality value such as "gzip;q=0.5"
+			name, _, _ := strings.Cut(part, ";")
+			accepted[strings.ToLower(strings.TrimSpace(name))] = true
+		}
+	}
+
+	for _, encoding := range []string{EncodingZstd, EncodingGzip} {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+	return EncodingIdentity
+}
+
+// compress encodes a request body
+func compress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case EncodingIdentity:
+		return data, nil
+	case EncodingZstd:
+		return zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/2)), nil
+	case EncodingGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+}
+
+// DecodeBody returns the body of a request sent by the distributor, undoing
+// its Content-Encoding
+func DecodeBody(r *http.Request) (io.Reader, error) {
+	switch encoding := r.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+		return r.Body, nil
+	case EncodingGzip:
+		return gzip.NewReader(r.Body)
+	case EncodingZstd:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		decoded, err := zstdDecoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(decoded), nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+}
@@ -0,0 +1,166 @@
+package analyzer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/logpb"
+	"github.com/ryouol/log-distributor/pkg/models"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// SchemeGRPC selects the gRPC transport when used as the scheme of an
+// analyzer URL, as in grpc://analyzer1:9091. Other analyzers are sent JSON
+// over HTTP.
+const SchemeGRPC = "grpc"
+
+// retryAfterKey is the trailer in which gRPC analyzers ask for a pause, in
+// seconds
+const retryAfterKey = "retry-after"
+
+// WithGRPCDialOptions adds options used when connecting to gRPC analyzers.
+// Connections are unencrypted unless the options or the analyzer's TLS
+// settings say otherwise.
+func WithGRPCDialOptions(opts ...grpc.DialOption) PoolOption {
+	return func(p *AnalyzerPool) {
+		p.grpcDialOptions = append(p.grpcDialOptions, opts...)
+	}
+}
+
+// isGRPC reports whether an analyzer URL selects the gRPC transport
+func isGRPC(analyzerURL string) bool {
+	return strings.HasPrefix(analyzerURL, SchemeGRPC+"://")
+}
+
+// grpcConn returns the connection to a gRPC analyzer, replacing it if the
+// analyzer's URL changed
+func (p *AnalyzerPool) grpcConn(a *Analyzer) (*grpc.ClientConn, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if a.grpcConn != nil && a.grpcTarget == a.URL {
+		return a.grpcConn, nil
+	}
+	p.closeTransport(a)
+
+	u, err := url.Parse(a.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid gRPC analyzer URL %q", a.URL)
+	}
+
+	opts := append([]grpc.DialOption{grpc.WithTransportCredentials(p.transportCredentials(a))}, p.grpcDialOptions...)
+	conn, err := grpc.NewClient("passthrough:///"+u.Host, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to analyzer %s: %w", a.ID, err)
+	}
+	a.grpcConn, a.grpcTarget = conn, a.URL
+	return conn, nil
+}
+
+// closeTransport closes the connection to a gRPC analyzer, if any. The
+// caller must hold the mutex.
+func (p *AnalyzerPool) closeTransport(a *Analyzer) {
+	if a.grpcConn != nil {
+		a.grpcConn.Close()
+		a.grpcConn, a.grpcTarget = nil, ""
+	}
+}
+
+// sendGRPC sends a packet with the LogAnalyzer Analyze call and feeds the
+// outcome to the analyzer's breaker like post does for HTTP
+func (p *AnalyzerPool) sendGRPC(ctx context.Context, analyzer *Analyzer, packet *models.LogPacket) error {
+	pb, err := logpb.FromPacket(packet)
+	if err != nil {
+		return fmt.Errorf("failed to convert log packet: %w", err)
+	}
+
+	if !analyzer.breaker.Allow() {
+		p.syncActive(analyzer)
+		return fmt.Errorf("analyzer %s: %w", analyzer.ID, ErrCircuitOpen)
+	}
+
+	conn, err := p.grpcConn(analyzer)
+	if err != nil {
+		p.recordSend(analyzer, false)
+		return err
+	}
+
+	if key := p.idempotencyKey(packet); key != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, idempotencyKeyMD, key)
+	}
+
+	var trailer metadata.MD
+	response, err := logpb.NewLogAnalyzerClient(conn).Analyze(ctx, pb, grpc.Trailer(&trailer))
+
+	retryAfter := grpcRetryAfter(trailer)
+	if retryAfter > 0 {
+		p.throttle(analyzer, retryAfter)
+	}
+
+	if err != nil {
+		code := status.Code(err)
+
+		// An explicit request to slow down is not a failure of the analyzer
+		if (code == codes.ResourceExhausted || code == codes.Unavailable) && retryAfter > 0 {
+			p.recordSend(analyzer, true)
+			statusCode := http.StatusServiceUnavailable
+			if code == codes.ResourceExhausted {
+				statusCode = http.StatusTooManyRequests
+			}
+			return &BackpressureError{AnalyzerID: analyzer.ID, StatusCode: statusCode, RetryAfter: retryAfter}
+		}
+
+		p.recordSend(analyzer, packetRejected(code))
+		return fmt.Errorf("failed to send log packet to analyzer %s: %w", analyzer.ID, err)
+	}
+
+	p.recordSend(analyzer, true)
+	return partialDelivery(analyzer.ID, logpb.ToAnalyzeResponse(response), retryAfter)
+}
+
+// packetRejected reports whether a gRPC error code is about the packet rather
+// than the analyzer's health, like an HTTP 4xx other than 429
+func packetRejected(code codes.Code) bool {
+	switch code {
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange,
+		codes.NotFound, codes.AlreadyExists, codes.PermissionDenied, codes.Unauthenticated:
+		return true
+	default:
+		return false
+	}
+}
+
+// grpcRetryAfter reads the retry-after trailer. It returns zero if the
+// trailer is missing or invalid.
+func grpcRetryAfter(trailer metadata.MD) time.Duration {
+	values := trailer.Get(retryAfterKey)
+	if len(values) == 0 {
+		return 0
+	}
+	seconds, err := strconv.Atoi(values[0])
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// checkGRPCHealth probes a gRPC analyzer with the standard health service
+func (p *AnalyzerPool) checkGRPCHealth(ctx context.Context, a *Analyzer) {
+	conn, err := p.grpcConn(a)
+	if err != nil {
+		p.recordProbe(a, false)
+		return
+	}
+
+	response, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	p.recordProbe(a, err == nil && response.GetStatus() == healthpb.HealthCheckResponse_SERVING)
+}
@@ -0,0 +1,135 @@
+package analyzer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/logpb"
+	"github.com/ryouol/log-distributor/pkg/models"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// grpcAnalyzer is a fake gRPC analyzer recording the packets it receives
+type grpcAnalyzer struct {
+	logpb.UnimplementedLogAnalyzerServer
+	packets []*models.LogPacket
+	// throttle makes the analyzer ask for a pause instead of processing
+	throttle bool
+	mutex    sync.Mutex
+}
+
+func (s *grpcAnalyzer) Analyze(ctx context.Context, pb *logpb.LogPacket) (*logpb.AnalyzeResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.throttle {
+		grpc.SetTrailer(ctx, metadata.Pairs(retryAfterKey, "2"))
+		return nil, status.Error(codes.ResourceExhausted, "slow down")
+	}
+
+	packet := logpb.ToPacket(pb)
+	s.packets = append(s.packets, packet)
+
+	response := models.AnalyzeResponse{Status: models.AnalyzeProcessed}
+	for _, msg := range packet.LogMessages {
+		if msg.Level == models.Debug {
+			response.Status = models.AnalyzePartial
+			response.Rejected = append(response.Rejected, models.LogRejection{ID: msg.ID})
+		}
+	}
+	return logpb.FromAnalyzeResponse(response), nil
+}
+
+// startGRPCAnalyzer serves a fake analyzer in process and returns a pool
+// dialing it
+func startGRPCAnalyzer(t *testing.T, server *grpcAnalyzer) *AnalyzerPool {
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	logpb.RegisterLogAnalyzerServer(grpcServer, server)
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	return NewAnalyzerPool(time.Second*10, WithGRPCDialOptions(
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+	))
+}
+
+// TestGRPCTransport tests that an analyzer with a grpc:// URL is sent
+// packets and probed over gRPC
+func TestGRPCTransport(t *testing.T) {
+	server := &grpcAnalyzer{}
+	pool := startGRPCAnalyzer(t, server)
+	pool.AddAnalyzer("analyzer1", "grpc://bufnet", 1)
+	a := pool.analyzers[0]
+
+	pool.checkAnalyzerHealth(context.Background(), a)
+	if status, _ := pool.GetAnalyzer("analyzer1"); status.Health.Status != HealthHealthy {
+		t.Errorf("Expected the analyzer to be healthy, got %s", status.Health.Status)
+	}
+
+	packet := &models.LogPacket{
+		PacketID: "packet1",
+		AgentID:  "agent1",
+		SentAt:   time.Now(),
+		LogMessages: []models.LogMessage{
+			{ID: "msg1", Level: models.Info, Message: "hello", Metadata: map[string]interface{}{"user": "alice"}},
+		},
+	}
+	if err := pool.SendLogPacket(context.Background(), a, packet); err != nil {
+		t.Fatalf("Expected the packet to be delivered, got %v", err)
+	}
+
+	if len(server.packets) != 1 {
+		t.Fatalf("Expected 1 packet at the analyzer, got %d", len(server.packets))
+	}
+	received := server.packets[0]
+	if received.PacketID != "packet1" || !received.SentAt.Equal(packet.SentAt) || received.LogMessages[0].Metadata["user"] != "alice" {
+		t.Errorf("Expected the packet to survive the round trip, got %+v", received)
+	}
+
+	// Rejected messages come back as a partial delivery
+	packet.LogMessages = append(packet.LogMessages, models.LogMessage{ID: "msg2", Level: models.Debug})
+	var partial *PartialDeliveryError
+	if err := pool.SendLogPacket(context.Background(), a, packet); !errors.As(err, &partial) || len(partial.Rejected) != 1 || partial.Rejected[0] != "msg2" {
+		t.Errorf("Expected msg2 to be rejected, got %v", err)
+	}
+
+	if status, _ := pool.GetAnalyzer("analyzer1"); status.Counters.Sent != 2 {
+		t.Errorf("Expected 2 sent packets, got %+v", status.Counters)
+	}
+}
+
+// TestGRPCBackpressure tests that a retry-after trailer throttles the
+// analyzer without counting against its breaker
+func TestGRPCBackpressure(t *testing.T) {
+	server := &grpcAnalyzer{throttle: true}
+	pool := startGRPCAnalyzer(t, server)
+	pool.AddAnalyzer("analyzer1", "grpc://bufnet", 1)
+	a := pool.GetActiveAnalyzers()[0]
+
+	err := pool.SendLogPacket(context.Background(), a, &models.LogPacket{PacketID: "packet1"})
+	var backpressure *BackpressureError
+	if !errors.As(err, &backpressure) || backpressure.RetryAfter != 2*time.Second {
+		t.Fatalf("Expected backpressure for 2s, got %v", err)
+	}
+
+	if active := pool.GetActiveAnalyzers(); len(active) != 0 {
+		t.Errorf("Expected the analyzer to be throttled, got %d active", len(active))
+	}
+	if status, _ := pool.GetAnalyzer("analyzer1"); status.Breaker.State != BreakerClosed {
+		t.Errorf("Expected the breaker to stay closed, got %s", status.Breaker.State)
+	}
+}
@@ -0,0 +1,46 @@
+package analyzer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// HeaderIdempotencyKey carries the idempotency key of a packet sent to
+// POST /analyze. gRPC analyzers get it as the idempotency-key metadata.
+const HeaderIdempotencyKey = "Idempotency-Key"
+
+// idempotencyKeyMD is the gRPC metadata counterpart of HeaderIdempotencyKey
+const idempotencyKeyMD = "idempotency-key"
+
+// WithIdempotencyKeys sends every packet with an idempotency key, so that
+// analyzers can recognize the distributor's own retries. The key is the
+// same on every attempt to send a packet, but differs for the part of a
+// packet sent again after a partial delivery. Batched packets carry their
+// keys in the batch body's idempotency_keys, one per packet in order.
+func WithIdempotencyKeys(enabled bool) PoolOption {
+	return func(p *AnalyzerPool) {
+		p.idempotencyKeys = enabled
+	}
+}
+
+// IdempotencyKey derives the idempotency key of a packet from its ID and the
+// IDs of its log messages
+func IdempotencyKey(packet *models.LogPacket) string {
+	hash := sha256.New()
+	for _, msg := range packet.LogMessages {
+		hash.Write([]byte(msg.ID))
+		hash.Write([]byte{0})
+	}
+	return packet.PacketID + "-" + hex.EncodeToString(hash.Sum(nil)[:8])
+}
+
+// idempotencyKey returns the key to send a packet with, or an empty string
+// if keys are disabled
+func (p *AnalyzerPool) idempotencyKey(packet *models.LogPacket) string {
+	if !p.idempotencyKeys {
+		return ""
+	}
+	return IdempotencyKey(packet)
+}
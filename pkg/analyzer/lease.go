@@ -0,0 +1,150 @@
+package analyzer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ErrNotRegistered is returned when a heartbeat arrives for an analyzer that
+// holds no lease, telling it to register again
+var ErrNotRegistered = errors.New("analyzer is not registered")
+
+// leaseCheckInterval is how often expired leases are looked for
+const leaseCheckInterval = time.Second
+
+// LeaseExpiry is what happens to a self-registered analyzer whose lease runs
+// out
+type LeaseExpiry string
+
+// Lease expiry actions
+const (
+	// LeaseEvict removes the analyzer from the pool
+	LeaseEvict LeaseExpiry = "evict"
+	// LeaseDeactivate keeps the analyzer but sends it no traffic until it
+	// renews its lease
+	LeaseDeactivate LeaseExpiry = "deactivate"
+)
+
+// ParseLeaseExpiry validates a lease expiry action name
+func ParseLeaseExpiry(s string) (LeaseExpiry, error) {
+	switch LeaseExpiry(s) {
+	case LeaseEvict, LeaseDeactivate:
+		return LeaseExpiry(s), nil
+	default:
+		return "", fmt.Errorf("unknown lease expiry action %q", s)
+	}
+}
+
+// WithLeaseExpiry sets what happens to self-registered analyzers whose lease
+// expires. By default they are evicted.
+func WithLeaseExpiry(action LeaseExpiry) PoolOption {
+	return func(p *AnalyzerPool) {
+		p.leaseExpiry = action
+	}
+}
+
+// Register adds or updates a self-registered analyzer and starts its lease.
+// It returns true if the analyzer was not in the pool before. An analyzer an
+// operator disabled stays disabled. A new URL or weight is only seen by sends
+// and snapshots that start after the call.
+func (p *AnalyzerPool) Register(id, url string, weight float64, capabilities []string, ttl time.Duration) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	a := p.find(id)
+	created := a == nil
+	if created {
+		a = p.addAnalyzer(id, url, weight, AdminEnabled)
+	} else {
+		a.URL = url
+		a.Weight = weight
+	}
+
+	a.Capabilities = capabilities
+	if encoding := NegotiateEncoding(capabilities); encoding != EncodingIdentity {
+		a.encoding = encoding
+	}
+	if hasCapability(capabilities, CapabilityBatch) {
+		p.setBatching(a, true)
+	}
+	a.leaseTTL = ttl
+	a.leaseExpiresAt = time.Now().Add(ttl)
+	a.leaseExpired = false
+	a.Active = a.available()
+	p.recalculateTotalWeight()
+	p.saveState()
+	return created
+}
+
+// RenewLease extends the lease of a self-registered analyzer by its lease
+// duration, reactivating it if the lease had already expired
+func (p *AnalyzerPool) RenewLease(id string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	a := p.find(id)
+	if a == nil {
+		return ErrAnalyzerNotFound
+	}
+	if a.leaseTTL == 0 {
+		return ErrNotRegistered
+	}
+
+	a.leaseExpiresAt = time.Now().Add(a.leaseTTL)
+	if a.leaseExpired {
+		a.leaseExpired = false
+		a.Active = a.available()
+		p.recalculateTotalWeight()
+	}
+	return nil
+}
+
+// ExpireLeases evicts or deactivates self-registered analyzers whose lease
+// ran out before now and returns their IDs
+func (p *AnalyzerPool) ExpireLeases(now time.Time) []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	expired := make([]string, 0)
+	remaining := p.analyzers[:0]
+	for _, a := range p.analyzers {
+		if a.leaseTTL == 0 || a.leaseExpired || now.Before(a.leaseExpiresAt) {
+			remaining = append(remaining, a)
+			continue
+		}
+
+		expired = append(expired, a.ID)
+		if p.leaseExpiry == LeaseDeactivate {
+			log.Printf("Lease of analyzer %s expired, deactivating it\n", a.ID)
+			a.leaseExpired = true
+			a.Active = false
+			remaining = append(remaining, a)
+		} else {
+			log.Printf("Lease of analyzer %s expired, evicting it\n", a.ID)
+			p.closeTransport(a)
+		}
+	}
+
+	if len(expired) > 0 {
+		// Clear the tail so evicted analyzers can be collected
+		for i := len(remaining); i < len(p.analyzers); i++ {
+			p.analyzers[i] = nil
+		}
+		p.analyzers = remaining
+		p.recalculateTotalWeight()
+		p.saveState()
+	}
+	return expired
+}
+
+// hasCapability reports whether capabilities include the given one
+func hasCapability(capabilities []string, capability string) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package analyzer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// TestLeaseEviction tests that an analyzer is evicted once its lease expires
+func TestLeaseEviction(t *testing.T) {
+	pool := NewAnalyzerPool(time.Second * 10)
+	pool.AddAnalyzer("static", "http://example.com/static", 1)
+
+	if created := pool.Register("dynamic", "http://example.com/dynamic", 0.5, []string{"json"}, time.Minute); !created {
+		t.Error("Expected registration to add a new analyzer")
+	}
+	if len(pool.GetActiveAnalyzers()) != 2 {
+		t.Fatalf("Expected 2 active analyzers, got %d", len(pool.GetActiveAnalyzers()))
+	}
+
+	// Nothing expires before the lease runs out
+	if expired := pool.ExpireLeases(time.Now().Add(30 * time.Second)); len(expired) != 0 {
+		t.Errorf("Expected no expired leases, got %v", expired)
+	}
+
+	// Renewing pushes the expiry out again
+	if err := pool.RenewLease("dynamic"); err != nil {
+		t.Fatalf("Expected lease renewal to succeed, got %v", err)
+	}
+
+	expired := pool.ExpireLeases(time.Now().Add(2 * time.Minute))
+	if len(expired) != 1 || expired[0] != "dynamic" {
+		t.Errorf("Expected the dynamic analyzer to expire, got %v", expired)
+	}
+
+	statuses := pool.ListAnalyzers()
+	if len(statuses) != 1 || statuses[0].ID != "static" {
+		t.Errorf("Expected only the static analyzer to remain, got %+v", statuses)
+	}
+
+	if err := pool.RenewLease("dynamic"); err != ErrAnalyzerNotFound {
+		t.Errorf("Expected ErrAnalyzerNotFound after eviction, got %v", err)
+	}
+	if err := pool.RenewLease("static"); err != ErrNotRegistered {
+		t.Errorf("Expected ErrNotRegistered for a static analyzer, got %v", err)
+	}
+}
+
+// TestLeaseDeactivation tests that an expired analyzer can come back by
+// renewing its lease
+func TestLeaseDeactivation(t *testing.T) {
+	pool := NewAnalyzerPool(time.Second*10, WithLeaseExpiry(LeaseDeactivate))
+	pool.Register("dynamic", "http://example.com/dynamic", 1, nil, time.Minute)
+
+	expired := pool.ExpireLeases(time.Now().Add(2 * time.Minute))
+	if len(expired) != 1 {
+		t.Fatalf("Expected 1 expired lease, got %v", expired)
+	}
+
+	statuses := pool.ListAnalyzers()
+	if len(statuses) != 1 || statuses[0].Active || !statuses[0].LeaseExpired {
+		t.Errorf("Expected the analyzer to be kept but inactive, got %+v", statuses)
+	}
+	if len(pool.GetActiveAnalyzers()) != 0 {
+		t.Error("Expected no active analyzers")
+	}
+
+	// An expired lease is only reported once
+	if expired := pool.ExpireLeases(time.Now().Add(3 * time.Minute)); len(expired) != 0 {
+		t.Errorf("Expected no newly expired leases, got %v", expired)
+	}
+
+	if err := pool.RenewLease("dynamic"); err != nil {
+		t.Fatalf("Expected lease renewal to succeed, got %v", err)
+	}
+	if len(pool.GetActiveAnalyzers()) != 1 {
+		t.Error("Expected the analyzer to be active again after renewing")
+	}
+}
+
+// TestRegisterDuringSends tests that re-registering an analyzer does not race
+// with sends reading its URL and weight
+func TestRegisterDuringSends(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	pool := NewAnalyzerPool(time.Second * 10)
+	pool.Register("dynamic", server.URL, 1, nil, time.Minute)
+
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			pool.Register("dynamic", server.URL, float64(i%3+1), nil, time.Minute)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		for _, a := range pool.GetActiveAnalyzers() {
+			_ = a.Weight
+			pool.SendLogPacket(context.Background(), a, &models.LogPacket{PacketID: "packet"})
+		}
+	}
+	close(stop)
+	<-done
+
+	a, err := pool.GetAnalyzer("dynamic")
+	if err != nil || a.URL != server.URL {
+		t.Errorf("Expected the analyzer to stay at %s, got %+v (%v)", server.URL, a, err)
+	}
+}
@@ -0,0 +1,170 @@
+package analyzer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// poolState is the layout of the pool state file
+type poolState struct {
+	Analyzers []analyzerState `json:"analyzers"`
+}
+
+// analyzerState is the persisted membership of one analyzer
+type analyzerState struct {
+	ID         string     `json:"id"`
+	URL        string     `json:"url"`
+	Weight     float64    `json:"weight"`
+	AdminState AdminState `json:"admin_state"`
+	Group      string     `json:"group,omitempty"`
+	// Capabilities and LeaseSeconds are set for self-registered analyzers,
+	// which get a fresh lease when restored
+	Capabilities []string `json:"capabilities,omitempty"`
+	LeaseSeconds float64  `json:"lease_seconds,omitempty"`
+	Batch        bool     `json:"batch,omitempty"`
+}
+
+// WithStateFile persists pool membership (ID, URL, weight, group and admin
+// state) to the file at path after every change, so that it can be restored
+// with RestoreState after a restart
+func WithStateFile(path string) PoolOption {
+	return func(p *AnalyzerPool) {
+		p.statePath = path
+	}
+}
+
+// RestoreState adds the analyzers recorded in the state file and returns how
+// many it restored. Analyzers already in the pool keep their URL, weight and
+// group but take the recorded admin state. A missing file restores nothing.
+func (p *AnalyzerPool) RestoreState() (int, error) {
+	if p.statePath == "" {
+		return 0, nil
+	}
+
+	data, err := os.ReadFile(p.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read pool state: %w", err)
+	}
+
+	var state poolState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, fmt.Errorf("failed to parse pool state: %w", err)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	restored := 0
+	for _, s := range state.Analyzers {
+		if s.ID == "" {
+			continue
+		}
+		if s.AdminState == "" {
+			s.AdminState = AdminEnabled
+		}
+		// Nothing is in flight after a restart, so a drain has finished
+		if s.AdminState == AdminDraining {
+			continue
+		}
+
+		a := p.find(s.ID)
+		if a != nil {
+			a.AdminState = s.AdminState
+		} else {
+			a = p.addAnalyzer(s.ID, s.URL, s.Weight, s.AdminState)
+			a.Group = s.Group
+		}
+		if s.Batch {
+			p.setBatching(a, true)
+		}
+		if s.LeaseSeconds > 0 {
+			a.Capabilities = s.Capabilities
+			a.leaseTTL = time.Duration(s.LeaseSeconds * float64(time.Second))
+			a.leaseExpiresAt = time.Now().Add(a.leaseTTL)
+		}
+		a.Active = a.available()
+		restored++
+	}
+	p.recalculateTotalWeight()
+	p.saveState()
+	return restored, nil
+}
+
+// find returns the analyzer with the given ID, or nil. The caller must hold
+// the mutex.
+func (p *AnalyzerPool) find(id string) *Analyzer {
+	for _, a := range p.analyzers {
+		if a.ID == id {
+			return a
+		}
+	}
+	return nil
+}
+
+// saveState writes the pool membership to the state file, replacing it
+// atomically. Failures are logged and the pool carries on in memory. The
+// caller must hold the mutex.
+func (p *AnalyzerPool) saveState() {
+	if p.statePath == "" {
+		return
+	}
+
+	state := poolState{Analyzers: make([]analyzerState, 0, len(p.analyzers))}
+	for _, a := range p.analyzers {
+		state.Analyzers = append(state.Analyzers, analyzerState{
+			ID:           a.ID,
+			URL:          a.URL,
+			Weight:       a.Weight,
+			AdminState:   a.AdminState,
+			Group:        a.Group,
+			Capabilities: a.Capabilities,
+			LeaseSeconds: a.leaseTTL.Seconds(),
+			Batch:        a.batcher != nil,
+		})
+	}
+
+	if err := writeFileAtomic(p.statePath, state); err != nil {
+		log.Printf("Failed to save analyzer pool state: %v\n", err)
+	}
+}
+
+// writeFileAtomic writes v as JSON to a temporary file and renames it over
+// path so that a crash never leaves a half-written file
+func writeFileAtomic(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	tmpPath := path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
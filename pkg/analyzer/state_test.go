@@ -0,0 +1,93 @@
+package analyzer
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestStateFileRoundTrip tests that pool membership survives a restart
+func TestStateFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pool.json")
+
+	pool := NewAnalyzerPool(time.Second*10, WithStateFile(path))
+	pool.AddAnalyzer("analyzer1", "http://example.com/1", 0.5)
+	pool.AddAnalyzer("analyzer2", "http://example.com/2", 0.3)
+	pool.AddAnalyzer("analyzer3", "http://example.com/3", 0.2)
+	pool.RemoveAnalyzer("analyzer3")
+	if err := pool.UpdateAnalyzer("analyzer1", "http://example.com/one", 0.7); err != nil {
+		t.Fatalf("Expected update to succeed, got %v", err)
+	}
+	if err := pool.SetAdminState("analyzer2", AdminDisabled); err != nil {
+		t.Fatalf("Expected admin state change to succeed, got %v", err)
+	}
+
+	restarted := NewAnalyzerPool(time.Second*10, WithStateFile(path))
+	restored, err := restarted.RestoreState()
+	if err != nil {
+		t.Fatalf("Expected state to restore, got %v", err)
+	}
+	if restored != 2 {
+		t.Errorf("Expected 2 analyzers restored, got %d", restored)
+	}
+
+	statuses := restarted.ListAnalyzers()
+	if len(statuses) != 2 {
+		t.Fatalf("Expected 2 analyzers, got %d", len(statuses))
+	}
+	if a := statuses[0]; a.ID != "analyzer1" || a.URL != "http://example.com/one" || a.Weight != 0.7 || !a.Active {
+		t.Errorf("Expected updated, active analyzer1, got %+v", a)
+	}
+	if a := statuses[1]; a.ID != "analyzer2" || a.AdminState != AdminDisabled || a.Active {
+		t.Errorf("Expected disabled, inactive analyzer2, got %+v", a)
+	}
+
+	active := restarted.GetActiveAnalyzers()
+	if len(active) != 1 || active[0].ID != "analyzer1" {
+		t.Errorf("Expected only analyzer1 to receive traffic, got %d analyzers", len(active))
+	}
+}
+
+// TestRestoreStateMissingFile tests booting without a state file
+func TestRestoreStateMissingFile(t *testing.T) {
+	pool := NewAnalyzerPool(time.Second*10, WithStateFile(filepath.Join(t.TempDir(), "missing.json")))
+
+	restored, err := pool.RestoreState()
+	if err != nil {
+		t.Errorf("Expected no error for a missing state file, got %v", err)
+	}
+	if restored != 0 {
+		t.Errorf("Expected nothing restored, got %d", restored)
+	}
+}
+
+// TestDisabledAnalyzerStaysInactive tests that breaker recovery does not
+// re-enable an analyzer an operator disabled
+func TestDisabledAnalyzerStaysInactive(t *testing.T) {
+	pool := NewAnalyzerPool(time.Second * 10)
+	pool.AddAnalyzer("analyzer1", "http://example.com/1", 1)
+
+	if err := pool.SetAdminState("analyzer1", AdminDisabled); err != nil {
+		t.Fatalf("Expected admin state change to succeed, got %v", err)
+	}
+
+	pool.mutex.RLock()
+	a := pool.analyzers[0]
+	pool.mutex.RUnlock()
+	pool.recordProbe(a, true)
+
+	if len(pool.GetActiveAnalyzers()) != 0 {
+		t.Error("Expected disabled analyzer to stay inactive after a healthy probe")
+	}
+
+	if err := pool.SetAdminState("analyzer1", AdminEnabled); err != nil {
+		t.Fatalf("Expected admin state change to succeed, got %v", err)
+	}
+	if len(pool.GetActiveAnalyzers()) != 1 {
+		t.Error("Expected analyzer to be active after enabling it")
+	}
+
+	if err := pool.SetAdminState("missing", AdminDisabled); err != ErrAnalyzerNotFound {
+		t.Errorf("Expected ErrAnalyzerNotFound, got %v", err)
+	}
+}
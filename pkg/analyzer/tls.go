@@ -0,0 +1,81 @@
+package analyzer
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// WithClientTLS sets the TLS settings used to reach analyzers that have none
+// of their own: over HTTP for https:// URLs, and over gRPC, where they also
+// turn TLS on
+func WithClientTLS(config *tls.Config) PoolOption {
+	return func(p *AnalyzerPool) {
+		p.tlsConfig = config
+		p.httpClient = newHTTPClient(config)
+	}
+}
+
+// newHTTPClient creates a client for analyzer requests, with the given TLS
+// settings if not nil
+func newHTTPClient(config *tls.Config) *http.Client {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+	}
+	if config != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+		client.Transport = transport
+	}
+	return client
+}
+
+// SetTLS gives an analyzer TLS settings of its own, such as a CA or client
+// certificate, or puts it back on the pool's settings if config is nil. Its
+// connections are made again with the new settings.
+func (p *AnalyzerPool) SetTLS(id string, config *tls.Config) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	a := p.find(id)
+	if a == nil {
+		return ErrAnalyzerNotFound
+	}
+
+	if a.httpClient != nil {
+		a.httpClient.CloseIdleConnections()
+	}
+	a.tlsConfig, a.httpClient = config, nil
+	if config != nil {
+		a.httpClient = newHTTPClient(config)
+	}
+	p.closeTransport(a)
+	return nil
+}
+
+// client returns the HTTP client for an analyzer
+func (p *AnalyzerPool) client(a *Analyzer) *http.Client {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if a.httpClient != nil {
+		return a.httpClient
+	}
+	return p.httpClient
+}
+
+// transportCredentials returns the gRPC credentials for an analyzer:
+// TLS with its own or the pool's settings, plaintext if there are none. The
+// caller must hold the mutex.
+func (p *AnalyzerPool) transportCredentials(a *Analyzer) credentials.TransportCredentials {
+	config := a.tlsConfig
+	if config == nil {
+		config = p.tlsConfig
+	}
+	if config == nil {
+		return insecure.NewCredentials()
+	}
+	return credentials.NewTLS(config)
+}
@@ -0,0 +1,112 @@
+package analyzer
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/logpb"
+	"github.com/ryouol/log-distributor/pkg/models"
+	"github.com/ryouol/log-distributor/pkg/tlsconfig"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// trustServer returns client settings trusting a test server's certificate
+func trustServer(t *testing.T, server *httptest.Server, serverName string) *tls.Config {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, data, 0o600); err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+
+	config, err := tlsconfig.ClientConfig{CAFile: caFile, ServerName: serverName}.Load()
+	if err != nil {
+		t.Fatalf("Failed to load TLS settings: %v", err)
+	}
+	return config
+}
+
+// TestAnalyzerTLS tests reaching an https:// analyzer with its own CA and
+// with the pool's
+func TestAnalyzerTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	config := trustServer(t, server, "")
+
+	packet := &models.LogPacket{PacketID: "packet1", LogMessages: []models.LogMessage{{ID: "msg1"}}}
+	send := func(pool *AnalyzerPool) error {
+		return pool.SendLogPacket(context.Background(), pool.GetActiveAnalyzers()[0], packet)
+	}
+
+	pool := NewAnalyzerPool(time.Second * 10)
+	pool.AddAnalyzer("analyzer1", server.URL, 1)
+	if err := send(pool); err == nil {
+		t.Error("Expected the analyzer's certificate to be refused without its CA")
+	}
+
+	if err := pool.SetTLS("analyzer1", config); err != nil {
+		t.Fatalf("Failed to set TLS settings: %v", err)
+	}
+	if err := send(pool); err != nil {
+		t.Errorf("Expected the analyzer's own CA to be trusted, got %v", err)
+	}
+	if err := pool.SetTLS("missing", config); err != ErrAnalyzerNotFound {
+		t.Errorf("Expected ErrAnalyzerNotFound, got %v", err)
+	}
+
+	pool = NewAnalyzerPool(time.Second*10, WithClientTLS(config))
+	pool.AddAnalyzer("analyzer1", server.URL, 1)
+	if err := send(pool); err != nil {
+		t.Errorf("Expected the pool's CA to be trusted, got %v", err)
+	}
+}
+
+// TestGRPCAnalyzerTLS tests that analyzers with TLS settings are dialed
+// over TLS
+func TestGRPCAnalyzerTLS(t *testing.T) {
+	// Borrow the certificate of an HTTPS test server, issued for example.com
+	https := httptest.NewTLSServer(http.NotFoundHandler())
+	https.Close()
+	config := trustServer(t, https, "example.com")
+
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer(grpc.Creds(credentials.NewServerTLSFromCert(&https.TLS.Certificates[0])))
+	analyzer := &grpcAnalyzer{}
+	logpb.RegisterLogAnalyzerServer(grpcServer, analyzer)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	pool := NewAnalyzerPool(time.Second*10, WithGRPCDialOptions(
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+	))
+	pool.AddAnalyzer("analyzer1", "grpc://bufnet", 1)
+	a := pool.GetActiveAnalyzers()[0]
+	packet := &models.LogPacket{PacketID: "packet1", LogMessages: []models.LogMessage{{ID: "msg1", Level: models.Info}}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := pool.SendLogPacket(ctx, a, packet); err == nil {
+		t.Error("Expected a plaintext connection to be refused")
+	}
+
+	pool.SetTLS("analyzer1", config)
+	if err := pool.SendLogPacket(context.Background(), a, packet); err != nil {
+		t.Errorf("Expected the packet to be sent over TLS, got %v", err)
+	}
+	if len(analyzer.packets) != 1 {
+		t.Errorf("Expected 1 packet at the analyzer, got %d", len(analyzer.packets))
+	}
+}
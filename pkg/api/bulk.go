@@ -0,0 +1,73 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/ryouol/log-distributor/pkg/distributor"
+	"github.com/ryouol/log-distributor/pkg/ingest"
+	"github.com/ryouol/log-distributor/pkg/models"
+	"github.com/ryouol/log-distributor/pkg/ratelimit"
+)
+
+// handleBulkLogs handles newline-delimited JSON holding log packets or bare
+// log messages. Bare messages are grouped into packets for the agent named
+// by the agent_id query parameter, group_size messages at a time. Each
+// packet is validated on its own; the body as a whole is not size-limited.
+func (s *Server) handleBulkLogs(w http.ResponseWriter, r *http.Request) {
+	opts := ingest.BulkOptions{AgentID: r.URL.Query().Get("agent_id")}
+	if value := r.URL.Query().Get("group_size"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size <= 0 {
+			http.Error(w, "Invalid group_size", http.StatusBadRequest)
+			return
+		}
+		opts.GroupSize = size
+	}
+	if max := s.validator.MaxMessages(); max > 0 && opts.GroupSize > max {
+		http.Error(w, fmt.Sprintf("group_size must be at most %d", max), http.StatusBadRequest)
+		return
+	}
+
+	full := false
+	var limited *ratelimit.LimitError
+	result, err := ingest.ReadBulk(r.Body, opts, func(packet *models.LogPacket) error {
+		err := s.Enqueue(packet)
+		if errors.Is(err, distributor.ErrQueueFull) {
+			full = true
+		}
+		errors.As(err, &limited)
+		return err
+	})
+
+	response := struct {
+		Status string `json:"status"`
+		*ingest.BulkResult
+		Error string `json:"error,omitempty"`
+	}{Status: "accepted", BulkResult: result}
+
+	code := http.StatusAccepted
+	if err != nil || len(result.Errors) > 0 {
+		response.Status = "partial"
+		if err != nil {
+			response.Error = err.Error()
+		}
+		if result.Accepted == 0 {
+			response.Status = "rejected"
+			code = http.StatusBadRequest
+			if full {
+				code = http.StatusServiceUnavailable
+			} else if limited != nil {
+				code = http.StatusTooManyRequests
+				w.Header().Set("Retry-After", retryAfter(limited))
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(response)
+}
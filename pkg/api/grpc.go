@@ -0,0 +1,73 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/ryouol/log-distributor/pkg/ingest"
+	"github.com/ryouol/log-distributor/pkg/logpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// GRPCServer serves the LogIngestion gRPC service next to the HTTP API
+type GRPCServer struct {
+	addr     string
+	listener net.Listener
+	server   *grpc.Server
+	health   *health.Server
+}
+
+// NewGRPCServer creates a gRPC server handing packets to enqueue, usually
+// the HTTP API server's Enqueue so that both apply the same checks
+func NewGRPCServer(addr string, enqueue ingest.EnqueueFunc, opts ...grpc.ServerOption) *GRPCServer {
+	server := grpc.NewServer(opts...)
+	logpb.RegisterLogIngestionServer(server, ingest.NewGRPCService(enqueue))
+
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+
+	return &GRPCServer{
+		addr:   addr,
+		server: server,
+		health: healthServer,
+	}
+}
+
+// Start binds the address and serves in the background
+func (s *GRPCServer) Start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.addr, err)
+	}
+	s.listener = listener
+
+	go func() {
+		log.Printf("Starting gRPC server on %s\n", listener.Addr())
+		if err := s.server.Serve(listener); err != nil {
+			log.Printf("gRPC server error: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+// Stop finishes in-flight calls, or cuts them off once ctx is done
+func (s *GRPCServer) Stop(ctx context.Context) error {
+	s.health.Shutdown()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		s.server.Stop()
+		return ctx.Err()
+	}
+}
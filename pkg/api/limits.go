@@ -0,0 +1,145 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/ryouol/log-distributor/pkg/ratelimit"
+)
+
+// WithRateLimiter holds agents to the limiter's rate limits and quotas
+func WithRateLimiter(limiter *ratelimit.Limiter) ServerOption {
+	return func(s *Server) {
+		s.limiter = limiter
+	}
+}
+
+// retryAfter returns a LimitError's RetryAfter in whole seconds, rounded up,
+// for the Retry-After header
+func retryAfter(err *ratelimit.LimitError) string {
+	return strconv.Itoa(int(math.Ceil(err.RetryAfter.Seconds())))
+}
+
+// writeLimited responds with 429 to a packet over its agent's limits. It
+// returns false for other errors, leaving the response to the caller.
+func writeLimited(w http.ResponseWriter, err error) bool {
+	var limited *ratelimit.LimitError
+	if !errors.As(err, &limited) {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", retryAfter(limited))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "rate_limited",
+		"message": limited.Error(),
+	})
+	return true
+}
+
+// rateLimiter returns the rate limiter, writing an error response if rate
+// limiting is not enabled
+func (s *Server) rateLimiter(w http.ResponseWriter) *ratelimit.Limiter {
+	if s.limiter == nil {
+		http.Error(w, "Rate limiting is not enabled", http.StatusNotFound)
+	}
+	return s.limiter
+}
+
+// handleListAgents handles listing the limits and usage of known agents
+func (s *Server) handleListAgents(w http.ResponseWriter, r *http.Request) {
+	limiter := s.rateLimiter(w)
+	if limiter == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limiter.List())
+}
+
+// handleGetAgentLimits handles retrieving an agent's limits and usage
+func (s *Server) handleGetAgentLimits(w http.ResponseWriter, r *http.Request) {
+	limiter := s.rateLimiter(w)
+	if limiter == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limiter.Usage(mux.Vars(r)["id"]))
+}
+
+// handleSetAgentLimits handles giving an agent limits of its own
+func (s *Server) handleSetAgentLimits(w http.ResponseWriter, r *http.Request) {
+	limiter := s.rateLimiter(w)
+	if limiter == nil {
+		return
+	}
+
+	var limits ratelimit.Limits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	if err := limiter.SetLimits(id, limits); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limiter.Usage(id))
+}
+
+// handleResetAgentLimits handles putting an agent back on the default limits
+func (s *Server) handleResetAgentLimits(w http.ResponseWriter, r *http.Request) {
+	limiter := s.rateLimiter(w)
+	if limiter == nil {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	limiter.ResetLimits(id)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limiter.Usage(id))
+}
+
+// handleGetDefaultLimits handles retrieving the limits of agents without
+// limits of their own
+func (s *Server) handleGetDefaultLimits(w http.ResponseWriter, r *http.Request) {
+	limiter := s.rateLimiter(w)
+	if limiter == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limiter.Defaults())
+}
+
+// handleSetDefaultLimits handles changing the limits of agents without
+// limits of their own
+func (s *Server) handleSetDefaultLimits(w http.ResponseWriter, r *http.Request) {
+	limiter := s.rateLimiter(w)
+	if limiter == nil {
+		return
+	}
+
+	var limits ratelimit.Limits
+	if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := limiter.SetDefaults(limits); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limiter.Defaults())
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/ryouol/log-distributor/pkg/analyzer"
+	"github.com/ryouol/log-distributor/pkg/distributor"
+	"github.com/ryouol/log-distributor/pkg/ingest"
+	"github.com/ryouol/log-distributor/pkg/ratelimit"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// OTLP/HTTP content types
+const (
+	otlpProtobuf = "application/x-protobuf"
+	otlpJSON     = "application/json"
+)
+
+// otlpRetryAfter is the pause, in seconds, asked of OTLP exporters while the
+// queue is full
+const otlpRetryAfter = "1"
+
+// WithOTLPAgentAttribute sets the resource attribute naming the agent of logs
+// received at /v1/logs
+func WithOTLPAgentAttribute(attribute string) ServerOption {
+	return func(s *Server) {
+		if attribute != "" {
+			s.otlpAgentAttribute = attribute
+		}
+	}
+}
+
+// handleOTLPLogs handles an OTLP/HTTP ExportLogsServiceRequest in the
+// protobuf or JSON encoding. Each resource becomes one packet; the response
+// reports the log records of packets that failed validation or that the
+// queue had no room for.
+func (s *Server) handleOTLPLogs(w http.ResponseWriter, r *http.Request) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != otlpProtobuf && contentType != otlpJSON {
+		http.Error(w, fmt.Sprintf("Unsupported content type, use %s or %s", otlpProtobuf, otlpJSON), http.StatusUnsupportedMediaType)
+		return
+	}
+	isJSON := contentType == otlpJSON
+
+	s.limitBody(w, r)
+	body, err := analyzer.DecodeBody(r)
+	if err != nil {
+		http.Error(w, "Unsupported content encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		if !writeInvalid(w, err) {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		}
+		return
+	}
+
+	request, err := ingest.DecodeOTLP(data, isJSON)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	packets := ingest.OTLPPackets(request, s.otlpAgentAttribute)
+	var rejected int64
+	var message string
+	var limited *ratelimit.LimitError
+	for _, packet := range packets {
+		err := s.Enqueue(packet)
+		if err == nil || errors.Is(err, distributor.ErrDuplicate) {
+			continue
+		}
+		rejected += int64(len(packet.LogMessages))
+		if errors.As(err, &limited) {
+			continue
+		}
+		if message == "" && !errors.Is(err, distributor.ErrQueueFull) {
+			message = err.Error()
+		}
+	}
+
+	response := &collogspb.ExportLogsServiceResponse{}
+	if rejected > 0 {
+		if rejected == totalRecords(request) {
+			if message != "" {
+				http.Error(w, message, http.StatusBadRequest)
+				return
+			}
+			if limited != nil {
+				// OTLP exporters retry on 429 after Retry-After
+				w.Header().Set("Retry-After", retryAfter(limited))
+				http.Error(w, limited.Error(), http.StatusTooManyRequests)
+				return
+			}
+			// Nothing was taken; OTLP exporters retry on 503
+			w.Header().Set("Retry-After", otlpRetryAfter)
+			http.Error(w, "Server is at capacity, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		if message == "" && limited != nil {
+			message = limited.Error()
+		}
+		if message == "" {
+			message = "queue full"
+		}
+		response.PartialSuccess = &collogspb.ExportLogsPartialSuccess{
+			RejectedLogRecords: rejected,
+			ErrorMessage:       message,
+		}
+	}
+
+	var out []byte
+	if isJSON {
+		out, err = protojson.Marshal(response)
+	} else {
+		out, err = proto.Marshal(response)
+	}
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+// totalRecords counts the log records of an export request
+func totalRecords(request *collogspb.ExportLogsServiceRequest) int64 {
+	var total int64
+	for _, rl := range request.GetResourceLogs() {
+		for _, sl := range rl.GetScopeLogs() {
+			total += int64(len(sl.GetLogRecords()))
+		}
+	}
+	return total
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/ryouol/log-distributor/pkg/distributor"
+)
+
+// routeList is the body of GET and PUT /api/v1/routes
+type routeList struct {
+	DefaultGroup string             `json:"default_group"`
+	Rules        []distributor.Rule `json:"rules"`
+}
+
+// routingRules returns the distributor's router, writing an error response
+// if routing is not enabled
+func (s *Server) routingRules(w http.ResponseWriter) *distributor.Router {
+	router := s.distributor.Router()
+	if router == nil {
+		http.Error(w, "Routing is not enabled", http.StatusNotFound)
+	}
+	return router
+}
+
+// writeRoutes writes the rules in evaluation order with the default group
+func writeRoutes(w http.ResponseWriter, router *distributor.Router) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(routeList{
+		DefaultGroup: router.DefaultGroup(),
+		Rules:        router.Rules(),
+	})
+}
+
+// handleListRoutes handles listing the routing rules
+func (s *Server) handleListRoutes(w http.ResponseWriter, r *http.Request) {
+	router := s.routingRules(w)
+	if router == nil {
+		return
+	}
+
+	writeRoutes(w, router)
+}
+
+// handleSetRoutes handles replacing every routing rule
+func (s *Server) handleSetRoutes(w http.ResponseWriter, r *http.Request) {
+	router := s.routingRules(w)
+	if router == nil {
+		return
+	}
+
+	var body routeList
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := router.SetRules(body.Rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeRoutes(w, router)
+}
+
+// handleGetRoute handles retrieving a single routing rule
+func (s *Server) handleGetRoute(w http.ResponseWriter, r *http.Request) {
+	router := s.routingRules(w)
+	if router == nil {
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	for _, rule := range router.Rules() {
+		if rule.Name == name {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(rule)
+			return
+		}
+	}
+	http.Error(w, distributor.ErrRuleNotFound.Error(), http.StatusNotFound)
+}
+
+// handlePutRoute handles adding a routing rule after the others, or
+// replacing the rule of the same name in place
+func (s *Server) handlePutRoute(w http.ResponseWriter, r *http.Request) {
+	router := s.routingRules(w)
+	if router == nil {
+		return
+	}
+
+	var rule distributor.Rule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	rule.Name = mux.Vars(r)["name"]
+
+	created, err := router.PutRule(rule)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(rule)
+}
+
+// handleDeleteRoute handles removing a routing rule
+func (s *Server) handleDeleteRoute(w http.ResponseWriter, r *http.Request) {
+	router := s.routingRules(w)
+	if router == nil {
+		return
+	}
+
+	err := router.RemoveRule(mux.Vars(r)["name"])
+	if errors.Is(err, distributor.ErrRuleNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "deleted",
+		"message": "Route removed successfully",
+	})
+}
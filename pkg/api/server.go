@@ -2,15 +2,24 @@ package api
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/ryouol/log-distributor/pkg/analyzer"
+	"github.com/ryouol/log-distributor/pkg/deadletter"
 	"github.com/ryouol/log-distributor/pkg/distributor"
+	"github.com/ryouol/log-distributor/pkg/ingest"
+	"github.com/ryouol/log-distributor/pkg/metrics"
 	"github.com/ryouol/log-distributor/pkg/models"
+	"github.com/ryouol/log-distributor/pkg/ratelimit"
+	"github.com/ryouol/log-distributor/pkg/validation"
 )
 
 // Server represents the HTTP API server
@@ -19,6 +28,53 @@ type Server struct {
 	httpServer   *http.Server
 	distributor  *distributor.LogDistributor
 	analyzerPool *analyzer.AnalyzerPool
+	registry     *metrics.Registry
+	leaseTTL     time.Duration
+	// otlpAgentAttribute names the agent of logs received at /v1/logs
+	otlpAgentAttribute string
+	validator          *validation.Validator
+	// limiter enforces per-agent rate limits, disabled if nil
+	limiter *ratelimit.Limiter
+}
+
+// DefaultLeaseTTL is how long a self-registered analyzer stays in the pool
+// without a heartbeat unless WithLeaseTTL says otherwise
+const DefaultLeaseTTL = 30 * time.Second
+
+// ServerOption configures optional Server behaviour
+type ServerOption func(*Server)
+
+// WithTimeouts sets the HTTP server read, write and idle timeouts. Zero
+// values keep the defaults.
+func WithTimeouts(read, write, idle time.Duration) ServerOption {
+	return func(s *Server) {
+		if read > 0 {
+			s.httpServer.ReadTimeout = read
+		}
+		if write > 0 {
+			s.httpServer.WriteTimeout = write
+		}
+		if idle > 0 {
+			s.httpServer.IdleTimeout = idle
+		}
+	}
+}
+
+// WithLeaseTTL sets how long self-registered analyzers stay in the pool
+// without a heartbeat
+func WithLeaseTTL(ttl time.Duration) ServerOption {
+	return func(s *Server) {
+		if ttl > 0 {
+			s.leaseTTL = ttl
+		}
+	}
+}
+
+// WithTLS serves the API over TLS with the given settings
+func WithTLS(config *tls.Config) ServerOption {
+	return func(s *Server) {
+		s.httpServer.TLSConfig = config
+	}
 }
 
 // NewServer creates a new API server
@@ -26,13 +82,20 @@ func NewServer(
 	addr string,
 	distributor *distributor.LogDistributor,
 	analyzerPool *analyzer.AnalyzerPool,
+	opts ...ServerOption,
 ) *Server {
 	router := mux.NewRouter()
+	validator, _ := validation.New(validation.DefaultConfig())
 
 	server := &Server{
 		router:       router,
 		distributor:  distributor,
 		analyzerPool: analyzerPool,
+		registry:     metrics.NewRegistry(),
+		leaseTTL:     DefaultLeaseTTL,
+
+		otlpAgentAttribute: ingest.DefaultOTLPAgentAttribute,
+		validator:          validator,
 		httpServer: &http.Server{
 			Addr:         addr,
 			Handler:      router,
@@ -42,6 +105,12 @@ func NewServer(
 		},
 	}
 
+	for _, opt := range opts {
+		opt(server)
+	}
+
+	distributor.RegisterMetrics(server.registry)
+
 	server.setupRoutes()
 	return server
 }
@@ -49,17 +118,74 @@ func NewServer(
 // setupRoutes configures the API routes
 func (s *Server) setupRoutes() {
 	s.router.HandleFunc("/api/v1/logs", s.handleLogPacket).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/v1/logs/bulk", s.handleBulkLogs).Methods(http.MethodPost)
+	s.router.HandleFunc("/v1/logs", s.handleOTLPLogs).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/v1/analyzers", s.handleListAnalyzers).Methods(http.MethodGet)
 	s.router.HandleFunc("/api/v1/analyzers", s.handleAddAnalyzer).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/v1/analyzers/register", s.handleRegisterAnalyzer).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/v1/analyzers/{id}", s.handleGetAnalyzer).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/analyzers/{id}", s.handleUpdateAnalyzer).Methods(http.MethodPatch)
 	s.router.HandleFunc("/api/v1/analyzers/{id}", s.handleDeleteAnalyzer).Methods(http.MethodDelete)
+	s.router.HandleFunc("/api/v1/analyzers/{id}/drain", s.handleDrainAnalyzer).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/v1/analyzers/{id}/enable", s.handleSetAdminState(analyzer.AdminEnabled)).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/v1/analyzers/{id}/disable", s.handleSetAdminState(analyzer.AdminDisabled)).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/v1/analyzers/{id}/heartbeat", s.handleHeartbeat).Methods(http.MethodPost)
 	s.router.HandleFunc("/api/v1/metrics", s.handleGetMetrics).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/deadletters", s.handleListDeadLetters).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/deadletters", s.handlePurgeDeadLetters).Methods(http.MethodDelete)
+	s.router.HandleFunc("/api/v1/deadletters/replay", s.handleReplayDeadLetters).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/v1/deadletters/{id}", s.handleGetDeadLetter).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/deadletters/{id}", s.handleDeleteDeadLetter).Methods(http.MethodDelete)
+	s.router.HandleFunc("/api/v1/deadletters/{id}/replay", s.handleReplayDeadLetter).Methods(http.MethodPost)
+	s.router.HandleFunc("/api/v1/agents", s.handleListAgents).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/agents/limits/defaults", s.handleGetDefaultLimits).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/agents/limits/defaults", s.handleSetDefaultLimits).Methods(http.MethodPut)
+	s.router.HandleFunc("/api/v1/agents/{id}/limits", s.handleGetAgentLimits).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/agents/{id}/limits", s.handleSetAgentLimits).Methods(http.MethodPut)
+	s.router.HandleFunc("/api/v1/agents/{id}/limits", s.handleResetAgentLimits).Methods(http.MethodDelete)
+	s.router.HandleFunc("/api/v1/routes", s.handleListRoutes).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/routes", s.handleSetRoutes).Methods(http.MethodPut)
+	s.router.HandleFunc("/api/v1/routes/{name}", s.handleGetRoute).Methods(http.MethodGet)
+	s.router.HandleFunc("/api/v1/routes/{name}", s.handlePutRoute).Methods(http.MethodPut)
+	s.router.HandleFunc("/api/v1/routes/{name}", s.handleDeleteRoute).Methods(http.MethodDelete)
 	s.router.HandleFunc("/health", s.handleHealthCheck).Methods(http.MethodGet)
+	s.router.Handle("/metrics", s.registry).Methods(http.MethodGet)
+}
+
+// Enqueue validates a packet, takes it from its agent's rate limits and
+// hands it to the distributor. Every ingestion path goes through it. A
+// packet the distributor does not take, as a duplicate or for lack of room,
+// is given back to the limits.
+func (s *Server) Enqueue(packet *models.LogPacket) error {
+	if err := s.validator.Validate(packet); err != nil {
+		return err
+	}
+	if s.limiter == nil {
+		return s.distributor.Enqueue(packet)
+	}
+
+	if err := s.limiter.Allow(packet.AgentID, len(packet.LogMessages)); err != nil {
+		return err
+	}
+	err := s.distributor.Enqueue(packet)
+	if err != nil {
+		s.limiter.Refund(packet.AgentID, len(packet.LogMessages))
+	}
+	return err
 }
 
 // Start starts the HTTP server
 func (s *Server) Start() {
 	go func() {
-		log.Printf("Starting HTTP server on %s\n", s.httpServer.Addr)
-		if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if s.httpServer.TLSConfig != nil {
+			log.Printf("Starting HTTPS server on %s\n", s.httpServer.Addr)
+			err = s.httpServer.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("Starting HTTP server on %s\n", s.httpServer.Addr)
+			err = s.httpServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("HTTP server error: %v", err)
 		}
 	}()
@@ -75,18 +201,31 @@ func (s *Server) handleLogPacket(w http.ResponseWriter, r *http.Request) {
 	var packet models.LogPacket
 
 	// Decode JSON request
+	s.limitBody(w, r)
 	if err := json.NewDecoder(r.Body).Decode(&packet); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		if !writeInvalid(w, err) {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+		}
 		return
 	}
 
 	// Set received timestamp
 	packet.ReceivedAt = time.Now()
 
-	// Enqueue packet for processing
-	success := s.distributor.EnqueuePacket(&packet)
-	if !success {
-		http.Error(w, "Server is at capacity, try again later", http.StatusServiceUnavailable)
+	// Validate and enqueue packet for processing
+	err := s.Enqueue(&packet)
+	if errors.Is(err, distributor.ErrDuplicate) {
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "duplicate",
+			"message": "Log packet already received",
+		})
+		return
+	}
+	if err != nil {
+		if !writeInvalid(w, err) && !writeLimited(w, err) {
+			http.Error(w, "Server is at capacity, try again later", http.StatusServiceUnavailable)
+		}
 		return
 	}
 
@@ -98,12 +237,20 @@ func (s *Server) handleLogPacket(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// handleListAnalyzers handles listing analyzers with their breaker state
+func (s *Server) handleListAnalyzers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.analyzerPool.ListAnalyzers())
+}
+
 // handleAddAnalyzer handles adding a new analyzer
 func (s *Server) handleAddAnalyzer(w http.ResponseWriter, r *http.Request) {
 	var analyzer struct {
 		ID     string  `json:"id"`
 		URL    string  `json:"url"`
 		Weight float64 `json:"weight"`
+		Batch  bool    `json:"batch"`
+		Group  string  `json:"group"`
 	}
 
 	// Decode JSON request
@@ -119,7 +266,16 @@ func (s *Server) handleAddAnalyzer(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Add analyzer to pool
-	s.analyzerPool.AddAnalyzer(analyzer.ID, analyzer.URL, analyzer.Weight)
+	if err := s.analyzerPool.AddAnalyzer(analyzer.ID, analyzer.URL, analyzer.Weight); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if analyzer.Batch {
+		s.analyzerPool.SetBatching(analyzer.ID, true)
+	}
+	if analyzer.Group != "" {
+		s.analyzerPool.SetGroup(analyzer.ID, analyzer.Group)
+	}
 
 	// Return success
 	w.WriteHeader(http.StatusCreated)
@@ -140,7 +296,10 @@ func (s *Server) handleDeleteAnalyzer(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Remove analyzer from pool
-	s.analyzerPool.RemoveAnalyzer(id)
+	if err := s.analyzerPool.RemoveAnalyzer(id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 
 	// Return success
 	w.WriteHeader(http.StatusOK)
@@ -150,12 +309,360 @@ func (s *Server) handleDeleteAnalyzer(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// handleGetAnalyzer handles retrieving a single analyzer with its health,
+// breaker state and counters
+func (s *Server) handleGetAnalyzer(w http.ResponseWriter, r *http.Request) {
+	status, err := s.analyzerPool.GetAnalyzer(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleUpdateAnalyzer handles changing the weight, URL, batching or group
+// of an analyzer
+func (s *Server) handleUpdateAnalyzer(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var update struct {
+		URL    *string  `json:"url"`
+		Weight *float64 `json:"weight"`
+		Batch  *bool    `json:"batch"`
+		Group  *string  `json:"group"`
+	}
+
+	// Decode JSON request
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	current, err := s.analyzerPool.GetAnalyzer(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	url, weight := current.URL, current.Weight
+	if update.URL != nil {
+		url = *update.URL
+	}
+	if update.Weight != nil {
+		weight = *update.Weight
+	}
+
+	// Validate request
+	if url == "" || weight <= 0 {
+		http.Error(w, "Invalid analyzer configuration", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.analyzerPool.UpdateAnalyzer(id, url, weight); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if update.Batch != nil {
+		if err := s.analyzerPool.SetBatching(id, *update.Batch); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+	if update.Group != nil {
+		if err := s.analyzerPool.SetGroup(id, *update.Group); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+
+	s.writeAnalyzer(w, id)
+}
+
+// handleDrainAnalyzer handles draining an analyzer: it gets no new packets
+// and is removed once its in-flight sends finish
+func (s *Server) handleDrainAnalyzer(w http.ResponseWriter, r *http.Request) {
+	removed, err := s.analyzerPool.Drain(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if removed {
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "removed",
+			"message": "Analyzer had no sends in flight and was removed",
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "draining",
+		"message": "Analyzer will be removed once its in-flight sends finish",
+	})
+}
+
+// handleSetAdminState returns a handler enabling or disabling an analyzer
+func (s *Server) handleSetAdminState(state analyzer.AdminState) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+
+		if err := s.analyzerPool.SetAdminState(id, state); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		s.writeAnalyzer(w, id)
+	}
+}
+
+// writeAnalyzer writes the current status of an analyzer
+func (s *Server) writeAnalyzer(w http.ResponseWriter, id string) {
+	status, err := s.analyzerPool.GetAnalyzer(id)
+	if err != nil {
+		// Removed concurrently
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleRegisterAnalyzer handles an analyzer registering itself and starts
+// its lease
+func (s *Server) handleRegisterAnalyzer(w http.ResponseWriter, r *http.Request) {
+	var registration models.AnalyzerRegistration
+
+	// Decode JSON request
+	if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Validate request
+	if registration.ID == "" || registration.URL == "" || registration.Weight <= 0 {
+		http.Error(w, "Invalid analyzer registration", http.StatusBadRequest)
+		return
+	}
+
+	created := s.analyzerPool.Register(registration.ID, registration.URL, registration.Weight,
+		registration.Capabilities, s.leaseTTL)
+	if created {
+		log.Printf("Analyzer %s registered at %s\n", registration.ID, registration.URL)
+	}
+	s.analyzerPool.SetGroup(registration.ID, registration.Group)
+
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(s.lease(registration.ID))
+}
+
+// handleHeartbeat handles an analyzer renewing its lease
+func (s *Server) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	if err := s.analyzerPool.RenewLease(id); err != nil {
+		// Not found tells the analyzer to register again
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.lease(id))
+}
+
+// lease describes the lease granted to a self-registered analyzer
+func (s *Server) lease(id string) models.RegistrationLease {
+	return models.RegistrationLease{
+		ID:               id,
+		LeaseSeconds:     s.leaseTTL.Seconds(),
+		HeartbeatSeconds: (s.leaseTTL / 3).Seconds(),
+	}
+}
+
 // handleGetMetrics handles retrieving distribution metrics
 func (s *Server) handleGetMetrics(w http.ResponseWriter, r *http.Request) {
 	metrics := s.distributor.GetMetrics()
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(metrics)
+	json.NewEncoder(w).Encode(&metrics)
+}
+
+// deadLetterStore returns the dead-letter store, writing an error response if
+// it is not enabled
+func (s *Server) deadLetterStore(w http.ResponseWriter) *deadletter.Store {
+	store := s.distributor.DeadLetters()
+	if store == nil {
+		http.Error(w, "Dead-letter store is not enabled", http.StatusNotFound)
+	}
+	return store
+}
+
+// decodeSelection reads the dead letters a bulk request is about: those in
+// an {"ids": [...]} body, or every one with {"all": true} or ?all=true, for
+// which it returns no IDs. A request naming neither is refused so that a
+// bare request cannot empty the store.
+func decodeSelection(r *http.Request) ([]string, error) {
+	var body struct {
+		IDs []string `json:"ids"`
+		All bool     `json:"all"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		return nil, errors.New("invalid request body")
+	}
+
+	all := body.All || r.URL.Query().Get("all") == "true"
+	switch {
+	case all && len(body.IDs) > 0:
+		return nil, errors.New(`"ids" and "all" cannot be combined`)
+	case !all && len(body.IDs) == 0:
+		return nil, errors.New(`give the "ids" of dead letters or "all": true`)
+	}
+	return body.IDs, nil
+}
+
+// handleListDeadLetters handles listing dead letters
+func (s *Server) handleListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	store := s.deadLetterStore(w)
+	if store == nil {
+		return
+	}
+
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"total":       store.Len(),
+		"evicted":     store.Evicted(),
+		"writeErrors": store.WriteErrors(),
+		"deadletters": store.List(limit),
+	})
+}
+
+// handleGetDeadLetter handles retrieving a single dead letter
+func (s *Server) handleGetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	store := s.deadLetterStore(w)
+	if store == nil {
+		return
+	}
+
+	entry, err := store.Get(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Dead letter not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+// handleReplayDeadLetter handles re-enqueueing a single dead letter
+func (s *Server) handleReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if s.deadLetterStore(w) == nil {
+		return
+	}
+
+	s.replayDeadLetters(w, []string{mux.Vars(r)["id"]})
+}
+
+// handleReplayDeadLetters handles re-enqueueing the dead letters listed in
+// "ids", or all of them with "all": true; a request naming neither is
+// refused
+func (s *Server) handleReplayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if s.deadLetterStore(w) == nil {
+		return
+	}
+
+	ids, err := decodeSelection(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.replayDeadLetters(w, ids)
+}
+
+// replayDeadLetters replays dead letters and writes the outcome
+func (s *Server) replayDeadLetters(w http.ResponseWriter, ids []string) {
+	replayed, err := s.distributor.ReplayDeadLetters(ids)
+	switch {
+	case errors.Is(err, deadletter.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, distributor.ErrQueueFull):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":   "partial",
+			"replayed": replayed,
+			"message":  "Server is at capacity, try again later",
+		})
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "replayed",
+		"replayed": replayed,
+	})
+}
+
+// handleDeleteDeadLetter handles removing a single dead letter
+func (s *Server) handleDeleteDeadLetter(w http.ResponseWriter, r *http.Request) {
+	store := s.deadLetterStore(w)
+	if store == nil {
+		return
+	}
+
+	if err := store.Remove(mux.Vars(r)["id"]); err != nil {
+		http.Error(w, "Dead letter not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "deleted",
+		"message": "Dead letter removed successfully",
+	})
+}
+
+// handlePurgeDeadLetters handles removing the dead letters listed in "ids",
+// or all of them with "all": true; a request naming neither is refused
+func (s *Server) handlePurgeDeadLetters(w http.ResponseWriter, r *http.Request) {
+	store := s.deadLetterStore(w)
+	if store == nil {
+		return
+	}
+
+	ids, err := decodeSelection(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "purged",
+		"purged": store.Purge(ids),
+	})
 }
 
 // handleHealthCheck handles health check requests
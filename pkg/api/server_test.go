@@ -0,0 +1,213 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/analyzer"
+	"github.com/ryouol/log-distributor/pkg/deadletter"
+	"github.com/ryouol/log-distributor/pkg/distributor"
+	"github.com/ryouol/log-distributor/pkg/models"
+	"github.com/ryouol/log-distributor/pkg/ratelimit"
+	"github.com/ryouol/log-distributor/pkg/syslog"
+)
+
+// The syslog listener enqueues through the server to share its checks
+var _ syslog.Enqueuer = (*Server)(nil)
+
+// newTestServer creates a server over an empty pool and a distributor that
+// is not started, keeping dead letters in store
+func newTestServer(store *deadletter.Store, opts ...distributor.Option) (*Server, *analyzer.AnalyzerPool) {
+	pool := analyzer.NewAnalyzerPool(time.Second * 10)
+	if store != nil {
+		opts = append(opts, distributor.WithDeadLetters(store))
+	}
+	d := distributor.NewLogDistributor(pool, 10, 1, 3, time.Second, opts...)
+	return NewServer(":0", d, pool), pool
+}
+
+// serve sends a request to the server and returns the response
+func serve(s *Server, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+	return rec
+}
+
+// TestBulkDeadLetterSelection tests that bulk replays and purges only touch
+// every dead letter when asked to explicitly
+func TestBulkDeadLetterSelection(t *testing.T) {
+	store := deadletter.NewStore(10)
+	server, _ := newTestServer(store)
+	add := func() *deadletter.Entry {
+		return store.Add(deadletter.Entry{Packet: &models.LogPacket{PacketID: "packet1"}})
+	}
+	first, second := add(), add()
+
+	bulk := []struct{ method, target string }{
+		{http.MethodDelete, "/api/v1/deadletters"},
+		{http.MethodPost, "/api/v1/deadletters/replay"},
+	}
+	for _, b := range bulk {
+		for _, body := range []string{"", "{}", `{"ids": []}`, `{"ids": ["x"], "all": true}`, "{"} {
+			if rec := serve(server, b.method, b.target, body); rec.Code != http.StatusBadRequest {
+				t.Errorf("%s %s %q: expected 400, got %d", b.method, b.target, body, rec.Code)
+			}
+		}
+	}
+	if store.Len() != 2 {
+		t.Fatalf("Expected the refused requests to leave 2 dead letters, got %d", store.Len())
+	}
+
+	if rec := serve(server, http.MethodDelete, "/api/v1/deadletters", `{"ids": ["`+first.ID+`"]}`); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a purge by ID, got %d", rec.Code)
+	}
+	if _, err := store.Get(second.ID); err != nil || store.Len() != 1 {
+		t.Errorf("Expected only %s to be left, got %d dead letters", second.ID, store.Len())
+	}
+
+	if rec := serve(server, http.MethodPost, "/api/v1/deadletters/replay?all=true", ""); rec.Code != http.StatusAccepted {
+		t.Errorf("Expected 202 for replaying all, got %d", rec.Code)
+	}
+	add()
+	if rec := serve(server, http.MethodDelete, "/api/v1/deadletters", `{"all": true}`); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 for purging all, got %d", rec.Code)
+	}
+	if store.Len() != 0 {
+		t.Errorf("Expected an empty store, got %d dead letters", store.Len())
+	}
+}
+
+// TestAnalyzerAdminErrors tests the status codes of the analyzer admin
+// endpoints for duplicate and unknown IDs
+func TestAnalyzerAdminErrors(t *testing.T) {
+	server, pool := newTestServer(nil)
+	body := `{"id": "analyzer1", "url": "http://localhost:1", "weight": 1}`
+
+	if rec := serve(server, http.MethodPost, "/api/v1/analyzers", body); rec.Code != http.StatusCreated {
+		t.Errorf("Expected 201 for a new analyzer, got %d", rec.Code)
+	}
+	if rec := serve(server, http.MethodPost, "/api/v1/analyzers", body); rec.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a duplicate analyzer, got %d", rec.Code)
+	}
+	if rec := serve(server, http.MethodDelete, "/api/v1/analyzers/missing", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 deleting an unknown analyzer, got %d", rec.Code)
+	}
+	if rec := serve(server, http.MethodPatch, "/api/v1/analyzers/missing", `{"weight": 2}`); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 updating an unknown analyzer, got %d", rec.Code)
+	}
+	if rec := serve(server, http.MethodPatch, "/api/v1/analyzers/analyzer1", `{"weight": 0}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a zero weight, got %d", rec.Code)
+	}
+
+	if rec := serve(server, http.MethodPatch, "/api/v1/analyzers/analyzer1", `{"weight": 2}`); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 for an update, got %d", rec.Code)
+	}
+	if a, err := pool.GetAnalyzer("analyzer1"); err != nil || a.Weight != 2 || a.URL != "http://localhost:1" {
+		t.Errorf("Expected weight 2 at the old URL, got %+v (%v)", a, err)
+	}
+
+	if rec := serve(server, http.MethodDelete, "/api/v1/analyzers/analyzer1", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 deleting an analyzer, got %d", rec.Code)
+	}
+	if _, err := pool.GetAnalyzer("analyzer1"); err == nil {
+		t.Errorf("Expected analyzer1 to be gone")
+	}
+}
+
+// TestRegisterAndHeartbeat tests self-registration and lease renewal over
+// the API
+func TestRegisterAndHeartbeat(t *testing.T) {
+	server, pool := newTestServer(nil)
+	server.leaseTTL = time.Minute
+
+	for _, body := range []string{"{", `{"id": "dynamic", "url": "http://localhost:1"}`} {
+		if rec := serve(server, http.MethodPost, "/api/v1/analyzers/register", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("Register %q: expected 400, got %d", body, rec.Code)
+		}
+	}
+
+	rec := serve(server, http.MethodPost, "/api/v1/analyzers/register",
+		`{"id": "dynamic", "url": "http://localhost:1", "weight": 1}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 for a new registration, got %d", rec.Code)
+	}
+	var lease models.RegistrationLease
+	if err := json.NewDecoder(rec.Body).Decode(&lease); err != nil {
+		t.Fatalf("Failed to decode lease: %v", err)
+	}
+	if lease.ID != "dynamic" || lease.LeaseSeconds != 60 || lease.HeartbeatSeconds != 20 {
+		t.Errorf("Expected a 60s lease with 20s heartbeats, got %+v", lease)
+	}
+
+	// Registering again moves the analyzer without adding another one
+	rec = serve(server, http.MethodPost, "/api/v1/analyzers/register",
+		`{"id": "dynamic", "url": "http://localhost:2", "weight": 2}`)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a re-registration, got %d", rec.Code)
+	}
+	if a, err := pool.GetAnalyzer("dynamic"); err != nil || a.URL != "http://localhost:2" || a.Weight != 2 {
+		t.Errorf("Expected the analyzer at http://localhost:2 with weight 2, got %+v (%v)", a, err)
+	}
+	if n := len(pool.ListAnalyzers()); n != 1 {
+		t.Errorf("Expected 1 analyzer, got %d", n)
+	}
+
+	if rec := serve(server, http.MethodPost, "/api/v1/analyzers/dynamic/heartbeat", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a heartbeat, got %d", rec.Code)
+	}
+	if rec := serve(server, http.MethodPost, "/api/v1/analyzers/missing/heartbeat", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a heartbeat from an unknown analyzer, got %d", rec.Code)
+	}
+
+	// Analyzers added by an operator hold no lease to renew
+	pool.AddAnalyzer("static", "http://localhost:3", 1)
+	if rec := serve(server, http.MethodPost, "/api/v1/analyzers/static/heartbeat", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a heartbeat from an unregistered analyzer, got %d", rec.Code)
+	}
+}
+
+// TestRateLimitedPackets tests that packets over their agent's limits get a
+// 429 with Retry-After, and that packets the distributor turns away do not
+// use up the limits
+func TestRateLimitedPackets(t *testing.T) {
+	pool := analyzer.NewAnalyzerPool(time.Second * 10)
+	d := distributor.NewLogDistributor(pool, 10, 1, 3, time.Second, distributor.WithDedup(time.Minute, 100))
+	limiter := ratelimit.NewLimiter(ratelimit.Limits{PacketsPerSecond: 1, PacketBurst: 2})
+	server := NewServer(":0", d, pool, WithRateLimiter(limiter))
+
+	packet := func(id, agent string) string {
+		return `{"packet_id": "` + id + `", "agent_id": "` + agent + `", "log_messages": [{"id": "msg1", "level": "ERROR", "message": "test"}]}`
+	}
+
+	// Duplicates are answered without being charged
+	for i := 0; i < 3; i++ {
+		serve(server, http.MethodPost, "/api/v1/logs", packet("packet1", "agent1"))
+	}
+	if usage := limiter.Usage("agent1"); usage.DailyPackets != 1 {
+		t.Errorf("Expected 1 packet charged for a packet sent 3 times, got %d", usage.DailyPackets)
+	}
+
+	if rec := serve(server, http.MethodPost, "/api/v1/logs", packet("packet2", "agent1")); rec.Code != http.StatusAccepted {
+		t.Errorf("Expected 202 within the burst, got %d", rec.Code)
+	}
+	rec := serve(server, http.MethodPost, "/api/v1/logs", packet("packet3", "agent1"))
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 429 with Retry-After 1, got %d and %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	// Packets refused by a full queue are not charged either
+	for i := 0; d.Enqueue(&models.LogPacket{PacketID: fmt.Sprintf("filler%d", i), LogMessages: []models.LogMessage{{ID: "msg1", Level: models.Error}}}) == nil; i++ {
+	}
+	if rec := serve(server, http.MethodPost, "/api/v1/logs", packet("packet4", "agent2")); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 with a full queue, got %d", rec.Code)
+	}
+	if usage := limiter.Usage("agent2"); usage.DailyPackets != 0 || usage.PacketTokens != 2 {
+		t.Errorf("Expected nothing charged for a refused packet, got %+v", usage)
+	}
+}
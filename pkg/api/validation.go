@@ -0,0 +1,57 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ryouol/log-distributor/pkg/validation"
+)
+
+// WithValidator sets the limits packets are checked against before they are
+// queued, in place of validation.DefaultConfig
+func WithValidator(validator *validation.Validator) ServerOption {
+	return func(s *Server) {
+		if validator != nil {
+			s.validator = validator
+		}
+	}
+}
+
+// limitBody caps a request body holding a single packet at the validator's
+// MaxBodyBytes
+func (s *Server) limitBody(w http.ResponseWriter, r *http.Request) {
+	if max := s.validator.MaxBodyBytes(); max > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+	}
+}
+
+// writeInvalid responds with the per-field errors of a request whose body
+// was too large or whose packet failed validation. It returns false for
+// other errors, leaving the response to the caller.
+func writeInvalid(w http.ResponseWriter, err error) bool {
+	response := &validation.Error{}
+	code := http.StatusBadRequest
+
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		code = http.StatusRequestEntityTooLarge
+		response.Fields = []validation.FieldError{{
+			Field:   "body",
+			Message: fmt.Sprintf("is larger than %d bytes", tooLarge.Limit),
+		}}
+	case errors.As(err, &response):
+	default:
+		return false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Status string `json:"status"`
+		*validation.Error
+	}{Status: "rejected", Error: response})
+	return true
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a time.Duration written either as a number of seconds, as in
+// 10 or 0.5, or as a Go duration string, as in "10s" or "5ms"
+type Duration time.Duration
+
+// Duration returns the value as a time.Duration
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+// String returns the value as a Go duration string
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// MarshalJSON writes the value as a Go duration string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON reads a number of seconds or a Go duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	switch v := raw.(type) {
+	case float64:
+		*d = Duration(v * float64(time.Second))
+		return nil
+	case string:
+		parsed, err := parseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+		return nil
+	default:
+		return fmt.Errorf("invalid duration %s", data)
+	}
+}
+
+// MarshalYAML writes the value as a Go duration string
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+// UnmarshalYAML reads a number of seconds or a Go duration string
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	parsed, err := parseDuration(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// parseDuration reads a number of seconds or a Go duration string
+func parseDuration(s string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return parsed, nil
+}
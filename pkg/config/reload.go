@@ -0,0 +1,157 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/analyzer"
+	"github.com/ryouol/log-distributor/pkg/distributor"
+)
+
+// Reloader re-reads the configuration and applies the settings that are safe
+// to change while running: analyzer set, weights and groups, routes, retry
+// policy and worker count. Other changes are logged and take effect on the next restart.
+type Reloader struct {
+	path        string
+	load        func() (*Config, error)
+	current     *Config
+	modTime     time.Time
+	distributor *distributor.LogDistributor
+	pool        *analyzer.AnalyzerPool
+	mutex       sync.Mutex
+}
+
+// NewReloader creates a reloader for the file at path. load reads the new
+// configuration, including any overrides layered over the file; current is
+// the configuration that is already applied.
+func NewReloader(
+	path string,
+	load func() (*Config, error),
+	current *Config,
+	d *distributor.LogDistributor,
+	pool *analyzer.AnalyzerPool,
+) *Reloader {
+	r := &Reloader{
+		path:        path,
+		load:        load,
+		current:     current,
+		distributor: d,
+		pool:        pool,
+	}
+	if info, err := os.Stat(path); err == nil {
+		r.modTime = info.ModTime()
+	}
+	return r
+}
+
+// Reload loads the configuration and applies it. An invalid configuration is
+// rejected as a whole and leaves the running settings untouched.
+func (r *Reloader) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if info, err := os.Stat(r.path); err == nil {
+		r.modTime = info.ModTime()
+	}
+
+	next, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	if changed := r.current.RestartRequired(next); len(changed) > 0 {
+		log.Printf("Configuration changes to %s require a restart to take effect\n", strings.Join(changed, ", "))
+	}
+
+	r.distributor.SetWorkerCount(next.Distributor.NumWorkers)
+	r.distributor.SetRetryPolicy(next.Distributor.MaxRetries, next.RetryPolicy())
+	SyncAnalyzers(r.pool, r.current.Analyzers, next.Analyzers)
+	if router := r.distributor.Router(); router != nil && !reflect.DeepEqual(r.current.Routes, next.Routes) {
+		// Validate already checked the routes
+		router.SetRules(next.Rules())
+	}
+
+	r.current = next
+	log.Printf("Configuration reloaded from %s\n", r.path)
+	return nil
+}
+
+// Watch polls the file every interval and reloads it when its modification
+// time changes, until ctx is canceled
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(r.path)
+			if err != nil {
+				continue
+			}
+
+			r.mutex.Lock()
+			changed := !info.ModTime().Equal(r.modTime)
+			r.mutex.Unlock()
+
+			if changed {
+				if err := r.Reload(); err != nil {
+					log.Printf("Failed to reload configuration: %v\n", err)
+				}
+			}
+		}
+	}
+}
+
+// Current returns the configuration that is applied
+func (r *Reloader) Current() *Config {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.current
+}
+
+// SyncAnalyzers brings the pool in line with a new static analyzer list.
+// Analyzers that were in previous but not in next are removed, known ones are
+// updated and new ones are added. TLS settings are loaded again only when
+// they changed, since that reconnects the analyzer. Analyzers registered
+// through the API are left alone.
+func SyncAnalyzers(pool *analyzer.AnalyzerPool, previous, next []AnalyzerConfig) {
+	keep := make(map[string]bool, len(next))
+	for _, a := range next {
+		keep[a.ID] = true
+	}
+	known := make(map[string]AnalyzerConfig, len(previous))
+	for _, a := range previous {
+		known[a.ID] = a
+		if !keep[a.ID] {
+			pool.RemoveAnalyzer(a.ID)
+		}
+	}
+
+	for _, a := range next {
+		err := pool.UpdateAnalyzer(a.ID, a.URL, a.Weight)
+		added := errors.Is(err, analyzer.ErrAnalyzerNotFound)
+		if added {
+			pool.AddAnalyzer(a.ID, a.URL, a.Weight)
+		}
+		pool.SetBatching(a.ID, a.Batch)
+		pool.SetGroup(a.ID, a.Group)
+
+		if old, ok := known[a.ID]; added || !ok || old.TLS != a.TLS {
+			config, err := a.TLS.Load()
+			if err != nil {
+				log.Printf("Failed to load TLS settings of analyzer %s: %v\n", a.ID, err)
+				continue
+			}
+			pool.SetTLS(a.ID, config)
+		}
+	}
+}
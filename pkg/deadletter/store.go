@@ -0,0 +1,337 @@
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// ErrNotFound is returned when no dead letter has the requested ID
+var ErrNotFound = errors.New("dead letter not found")
+
+// Entry is a packet the distributor gave up on
+type Entry struct {
+	ID         string            `json:"id"`
+	Packet     *models.LogPacket `json:"packet"`
+	Error      string            `json:"error"`
+	AnalyzerID string            `json:"analyzer_id,omitempty"`
+	Attempts   int               `json:"attempts"`
+	FailedAt   time.Time         `json:"failed_at"`
+}
+
+// fileRecord is one line of the backing file
+type fileRecord struct {
+	Op    string `json:"op"`
+	Entry *Entry `json:"entry,omitempty"`
+	ID    string `json:"id,omitempty"`
+}
+
+// Store is a bounded dead-letter store. When full, the oldest entry is
+// evicted. An optional backing file keeps entries across restarts.
+type Store struct {
+	capacity    int
+	entries     []*Entry
+	index       map[string]*Entry
+	path        string
+	file        *os.File
+	fileRecords int
+	closed      bool
+	evicted     int64
+	writeErrors int64
+	mutex       sync.RWMutex
+}
+
+// NewStore creates an in-memory store holding at most capacity entries
+func NewStore(capacity int) *Store {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	return &Store{
+		capacity: capacity,
+		entries:  make([]*Entry, 0),
+		index:    make(map[string]*Entry),
+	}
+}
+
+// OpenStore creates a store backed by the file at path, loading any entries
+// it already holds
+func OpenStore(path string, capacity int) (*Store, error) {
+	s := NewStore(capacity)
+	s.path = path
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Add records a dead letter and returns it with its assigned ID
+func (s *Store) Add(entry Entry) *Entry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if entry.ID == "" {
+		entry.ID = uuid.New().String()
+	}
+	if entry.FailedAt.IsZero() {
+		entry.FailedAt = time.Now()
+	}
+
+	stored := &entry
+	s.insert(stored)
+	s.written(s.appendRecord(fileRecord{Op: "add", Entry: stored}))
+	return stored
+}
+
+// Get returns the dead letter with the given ID
+func (s *Store) Get(id string) (*Entry, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	entry, ok := s.index[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return entry, nil
+}
+
+// List returns up to limit dead letters, oldest first. A limit of zero or
+// less returns all of them.
+func (s *Store) List(limit int) []*Entry {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if limit <= 0 || limit > len(s.entries) {
+		limit = len(s.entries)
+	}
+	entries := make([]*Entry, limit)
+	copy(entries, s.entries[:limit])
+	return entries
+}
+
+// Len returns the number of stored dead letters
+func (s *Store) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.entries)
+}
+
+// Evicted returns how many dead letters were pushed out because the store
+// was full
+func (s *Store) Evicted() int64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.evicted
+}
+
+// WriteErrors returns how many changes failed to reach the backing file.
+// The file is rewritten with every live entry on the next change.
+func (s *Store) WriteErrors() int64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.writeErrors
+}
+
+// Remove deletes a dead letter
+func (s *Store) Remove(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.remove(id) {
+		return ErrNotFound
+	}
+	s.written(s.appendRecord(fileRecord{Op: "del", ID: id}))
+	return nil
+}
+
+// Purge deletes the dead letters with the given IDs, or all of them when no
+// IDs are given, and returns how many were deleted
+func (s *Store) Purge(ids []string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(ids) == 0 {
+		purged := len(s.entries)
+		s.entries = make([]*Entry, 0)
+		s.index = make(map[string]*Entry)
+		s.written(s.compact())
+		return purged
+	}
+
+	purged := 0
+	for _, id := range ids {
+		if s.remove(id) {
+			s.written(s.appendRecord(fileRecord{Op: "del", ID: id}))
+			purged++
+		}
+	}
+	return purged
+}
+
+// Close closes the backing file, if any
+func (s *Store) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// insert adds an entry, evicting the oldest if the store is full. The caller
+// must hold the mutex.
+func (s *Store) insert(entry *Entry) {
+	if old, ok := s.index[entry.ID]; ok {
+		s.remove(old.ID)
+	}
+	for len(s.entries) >= s.capacity {
+		delete(s.index, s.entries[0].ID)
+		s.entries = s.entries[1:]
+		s.evicted++
+	}
+	s.entries = append(s.entries, entry)
+	s.index[entry.ID] = entry
+}
+
+// remove deletes an entry from memory. The caller must hold the mutex.
+func (s *Store) remove(id string) bool {
+	if _, ok := s.index[id]; !ok {
+		return false
+	}
+	delete(s.index, id)
+	for i, e := range s.entries {
+		if e.ID == id {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// appendRecord writes a change to the backing file, compacting it once it
+// holds far more records than live entries. A file left closed by a failed
+// write is rewritten from memory instead. The caller must hold the mutex.
+func (s *Store) appendRecord(record fileRecord) error {
+	if s.path == "" || s.closed {
+		return nil
+	}
+
+	if s.file == nil || s.fileRecords >= 2*s.capacity {
+		return s.compact()
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode dead letter: %w", err)
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		s.file.Close()
+		s.file = nil
+		return fmt.Errorf("failed to write dead-letter file: %w", err)
+	}
+	s.fileRecords++
+	return nil
+}
+
+// written records the outcome of a change to the backing file. The caller
+// must hold the mutex.
+func (s *Store) written(err error) {
+	if err == nil {
+		return
+	}
+	s.writeErrors++
+	log.Printf("Dead-letter store failed to persist a change: %v\n", err)
+}
+
+// load replays the backing file into memory
+func (s *Store) load() error {
+	file, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open dead-letter file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var record fileRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// Skip a torn last line from a crash mid-write
+			continue
+		}
+		switch record.Op {
+		case "add":
+			if record.Entry != nil {
+				s.insert(record.Entry)
+			}
+		case "del":
+			s.remove(record.ID)
+		}
+	}
+	s.evicted = 0
+	return scanner.Err()
+}
+
+// compact rewrites the backing file with only the live entries. The caller
+// must hold the mutex, or be the constructor.
+func (s *Store) compact() error {
+	if s.path == "" {
+		return nil
+	}
+
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create dead-letter file: %w", err)
+	}
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range s.entries {
+		if err := encoder.Encode(fileRecord{Op: "add", Entry: entry}); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to write dead-letter file: %w", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write dead-letter file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write dead-letter file: %w", err)
+	}
+
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to replace dead-letter file: %w", err)
+	}
+
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open dead-letter file: %w", err)
+	}
+	s.file = file
+	s.fileRecords = len(s.entries)
+	return nil
+}
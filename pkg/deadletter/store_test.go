@@ -0,0 +1,128 @@
+package deadletter
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+func testEntry(packetID string) Entry {
+	return Entry{
+		Packet:     &models.LogPacket{PacketID: packetID, AgentID: "test-agent"},
+		Error:      "simulated send error",
+		AnalyzerID: "analyzer1",
+		Attempts:   3,
+	}
+}
+
+// TestStoreBounded tests that the oldest entries are evicted when full
+func TestStoreBounded(t *testing.T) {
+	store := NewStore(3)
+
+	for i := 0; i < 5; i++ {
+		store.Add(testEntry(fmt.Sprintf("packet-%d", i)))
+	}
+
+	entries := store.List(0)
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+	if entries[0].Packet.PacketID != "packet-2" {
+		t.Errorf("Expected oldest remaining entry to be 'packet-2', got '%s'", entries[0].Packet.PacketID)
+	}
+	if store.Evicted() != 2 {
+		t.Errorf("Expected 2 evicted entries, got %d", store.Evicted())
+	}
+}
+
+// TestStoreRemoveAndPurge tests removing single entries and purging
+func TestStoreRemoveAndPurge(t *testing.T) {
+	store := NewStore(10)
+
+	first := store.Add(testEntry("packet-1"))
+	second := store.Add(testEntry("packet-2"))
+	store.Add(testEntry("packet-3"))
+
+	if err := store.Remove(first.ID); err != nil {
+		t.Fatalf("Failed to remove entry: %v", err)
+	}
+	if err := store.Remove(first.ID); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for removed entry, got %v", err)
+	}
+
+	if purged := store.Purge([]string{second.ID, "unknown"}); purged != 1 {
+		t.Errorf("Expected 1 purged entry, got %d", purged)
+	}
+	if purged := store.Purge(nil); purged != 1 {
+		t.Errorf("Expected 1 purged entry, got %d", purged)
+	}
+	if store.Len() != 0 {
+		t.Errorf("Expected empty store, got %d entries", store.Len())
+	}
+}
+
+// TestStoreFileBacking tests that entries survive reopening the store
+func TestStoreFileBacking(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deadletters.jsonl")
+
+	store, err := OpenStore(path, 10)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	kept := store.Add(testEntry("packet-1"))
+	removed := store.Add(testEntry("packet-2"))
+	store.Remove(removed.ID)
+	store.Close()
+
+	store, err = OpenStore(path, 10)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+
+	if store.Len() != 1 {
+		t.Fatalf("Expected 1 entry after reopen, got %d", store.Len())
+	}
+	entry, err := store.Get(kept.ID)
+	if err != nil {
+		t.Fatalf("Failed to get entry: %v", err)
+	}
+	if entry.Packet.PacketID != "packet-1" || entry.Attempts != 3 || entry.AnalyzerID != "analyzer1" {
+		t.Errorf("Unexpected entry after reopen: %+v", entry)
+	}
+}
+
+func TestStoreWriteErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deadletters.jsonl")
+
+	store, err := OpenStore(path, 10)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+
+	// Closing the file underneath the store makes the next write fail
+	store.file.Close()
+	store.Add(testEntry("packet-1"))
+	if store.WriteErrors() != 1 {
+		t.Fatalf("Expected 1 write error, got %d", store.WriteErrors())
+	}
+
+	// The next change rewrites the file with every live entry
+	store.Add(testEntry("packet-2"))
+	if store.WriteErrors() != 1 {
+		t.Errorf("Expected the file to recover, got %d write errors", store.WriteErrors())
+	}
+	store.Close()
+
+	store, err = OpenStore(path, 10)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+
+	if store.Len() != 2 {
+		t.Errorf("Expected 2 entries after reopen, got %d", store.Len())
+	}
+}
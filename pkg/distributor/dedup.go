@@ -0,0 +1,91 @@
+package distributor
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// dedupEntry is a packet ID and when it was first seen
+type dedupEntry struct {
+	id     string
+	seenAt time.Time
+}
+
+// dedupCache remembers packet IDs for a time so that packets agents send
+// again are not delivered twice. IDs are forgotten once their TTL passes or,
+// oldest first, when the cache is at capacity.
+type dedupCache struct {
+	ttl      time.Duration
+	capacity int
+	// order holds the entries oldest first
+	order   *list.List
+	entries map[string]*list.Element
+	mutex   sync.Mutex
+	now     func() time.Time
+}
+
+// newDedupCache creates a cache remembering up to capacity IDs for ttl each
+func newDedupCache(ttl time.Duration, capacity int) *dedupCache {
+	return &dedupCache{
+		ttl:      ttl,
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+		now:      time.Now,
+	}
+}
+
+// add records an ID, returning false if it was already seen within the TTL
+func (c *dedupCache) add(id string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+	c.expire(now)
+	if _, ok := c.entries[id]; ok {
+		return false
+	}
+
+	if c.capacity > 0 && len(c.entries) >= c.capacity {
+		c.evict(c.order.Front())
+	}
+	c.entries[id] = c.order.PushBack(dedupEntry{id: id, seenAt: now})
+	return true
+}
+
+// remove forgets an ID, so that a packet the queue refused can be sent again
+func (c *dedupCache) remove(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[id]; ok {
+		c.evict(element)
+	}
+}
+
+// Len returns the number of IDs remembered
+func (c *dedupCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.expire(c.now())
+	return len(c.entries)
+}
+
+// expire drops the entries older than the TTL. The caller must hold the
+// mutex.
+func (c *dedupCache) expire(now time.Time) {
+	for element := c.order.Front(); element != nil; element = c.order.Front() {
+		if now.Sub(element.Value.(dedupEntry).seenAt) < c.ttl {
+			return
+		}
+		c.evict(element)
+	}
+}
+
+// evict drops one entry. The caller must hold the mutex.
+func (c *dedupCache) evict(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(dedupEntry).id)
+}
@@ -0,0 +1,79 @@
+package distributor
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// TestDedupCache tests that IDs are remembered for the TTL and up to the
+// capacity
+func TestDedupCache(t *testing.T) {
+	now := time.Now()
+	cache := newDedupCache(time.Minute, 2)
+	cache.now = func() time.Time { return now }
+
+	if !cache.add("p1") {
+		t.Fatal("Expected p1 to be new")
+	}
+	if cache.add("p1") {
+		t.Error("Expected p1 to be a duplicate")
+	}
+
+	// The oldest ID makes room at capacity
+	now = now.Add(time.Second)
+	cache.add("p2")
+	cache.add("p3")
+	if cache.Len() != 2 {
+		t.Errorf("Expected 2 IDs, got %d", cache.Len())
+	}
+	if !cache.add("p1") {
+		t.Error("Expected p1 to be evicted")
+	}
+
+	// IDs are forgotten once their TTL passes
+	now = now.Add(time.Minute)
+	if !cache.add("p3") {
+		t.Error("Expected p3 to have expired")
+	}
+
+	cache.remove("p3")
+	if !cache.add("p3") {
+		t.Error("Expected p3 to be forgotten after remove")
+	}
+}
+
+// TestEnqueueDuplicate tests that a packet ID is only queued once, and that a
+// packet the queue refused can be sent again
+func TestEnqueueDuplicate(t *testing.T) {
+	pool := NewMockAnalyzerPool()
+	distributor := NewLogDistributor(pool, 1, 1, 3, time.Second, WithDedup(time.Minute, 100))
+
+	packet := &models.LogPacket{PacketID: "packet1", LogMessages: []models.LogMessage{{ID: "msg1"}}}
+	if err := distributor.Enqueue(packet); err != nil {
+		t.Fatalf("Expected the packet to be queued, got %v", err)
+	}
+	if err := distributor.Enqueue(packet); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("Expected ErrDuplicate, got %v", err)
+	}
+	if !distributor.EnqueuePacket(packet) {
+		t.Error("Expected EnqueuePacket to count a duplicate as taken")
+	}
+
+	// The queue holds one packet, so the next is refused and not remembered
+	other := &models.LogPacket{PacketID: "packet2"}
+	if err := distributor.Enqueue(other); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("Expected ErrQueueFull, got %v", err)
+	}
+	distributor.workQueue.pop()
+	if err := distributor.Enqueue(other); err != nil {
+		t.Errorf("Expected the refused packet to be accepted on retry, got %v", err)
+	}
+
+	metrics := distributor.GetMetrics()
+	if metrics.DuplicatePackets != 2 || metrics.TotalPacketsReceived != 2 {
+		t.Errorf("Expected 2 duplicates and 2 received packets, got %d and %d", metrics.DuplicatePackets, metrics.TotalPacketsReceived)
+	}
+}
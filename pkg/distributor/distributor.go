@@ -2,16 +2,39 @@ package distributor
 
 import (
 	"context"
-	"math/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ryouol/log-distributor/pkg/analyzer"
+	"github.com/ryouol/log-distributor/pkg/deadletter"
+	"github.com/ryouol/log-distributor/pkg/metrics"
 	"github.com/ryouol/log-distributor/pkg/models"
+	"github.com/ryouol/log-distributor/pkg/wal"
 )
 
+var (
+	// ErrQueueFull is returned when the work queue cannot take more packets
+	ErrQueueFull = errors.New("work queue is full")
+	// ErrDuplicate is returned for a packet whose ID was already received
+	ErrDuplicate = errors.New("packet already received")
+
+	errNoActiveAnalyzers   = errors.New("no active analyzers")
+	errDeadLettersDisabled = errors.New("dead-letter store is not enabled")
+)
+
+// maxReschedules bounds how often a packet is put back on the retry queue
+// without counting an attempt; past it, such sends count as failed attempts
+const maxReschedules = 10
+
 // AnalyzerPoolInterface defines methods required by the log distributor
 type AnalyzerPoolInterface interface {
+	// GetActiveAnalyzers returns snapshots of the analyzers that may receive
+	// traffic, which the pool does not change afterwards
 	GetActiveAnalyzers() []*analyzer.Analyzer
 	SendLogPacket(ctx context.Context, a *analyzer.Analyzer, p *models.LogPacket) error
 	StartHealthCheck(ctx context.Context)
@@ -23,20 +46,156 @@ type DistributionMetrics struct {
 	TotalPacketsSent     int64
 	PacketsDropped       int64
 	PacketsByAnalyzer    map[string]int64
-	mutex                sync.RWMutex
+	LogsByAnalyzer       map[string]int64
+	PartialDeliveries    int64
+	// DuplicatePackets counts packets turned away because their ID was
+	// already received
+	DuplicatePackets int64
+	// PacketsShed counts the packets the work queue refused, by lane
+	PacketsShed map[string]int64
+	// ReplicatedPackets counts packets sent to more than one analyzer, and
+	// ReplicasDelivered and ReplicasFailed their replicas that analyzers
+	// accepted and that were given up on. UnderReplicatedPackets counts
+	// replicated packets delivered with fewer replicas than asked for.
+	ReplicatedPackets      int64
+	ReplicasDelivered      int64
+	ReplicasFailed         int64
+	UnderReplicatedPackets int64
+	mutex                  sync.RWMutex
+}
+
+// queuedPacket carries a packet through the work and retry queues together
+// with the distributor's own bookkeeping for it
+type queuedPacket struct {
+	packet *models.LogPacket
+	// walSeq is the write-ahead log sequence number, zero when not persisted
+	walSeq uint64
+	// retries is the number of delivery attempts that have failed so far
+	retries int
+	// reschedules is the number of sends put off without counting an attempt
+	reschedules int
+	// enqueuedAt is when the packet entered the work queue
+	enqueuedAt time.Time
+	// lane is the priority lane of the packet in the work queue
+	lane lane
+	// excluded lists analyzers that rejected the packet's log messages
+	excluded map[string]struct{}
+	// replica is set for a copy of a replicated packet
+	replica *replica
 }
 
 // LogDistributor distributes logs among analyzers based on their weights
 type LogDistributor struct {
 	analyzerPool  AnalyzerPoolInterface
 	metrics       *DistributionMetrics
-	workQueue     chan *models.LogPacket
+	workQueue     *laneQueue
+	laneConfig    LaneConfig
 	maxWorkers    int
 	shutdownCh    chan struct{}
 	workerWg      sync.WaitGroup
-	retryQueue    chan *models.LogPacket
+	workers       *workerSet
+	retryWorkers  *workerSet
+	retryQueue    *retryScheduler
 	maxRetries    int
 	retryInterval time.Duration
+	retryPolicy   RetryPolicy
+	// settingsMutex guards the settings that can be changed while running:
+	// maxWorkers, maxRetries and retryPolicy
+	settingsMutex sync.RWMutex
+	strategy      Strategy
+	wal           *wal.WAL
+	deadLetters   *deadletter.Store
+	dedup         *dedupCache
+	router        *Router
+	replicas      int
+	replicaAck    AckMode
+	// closingCh is closed when the distributor stops accepting packets,
+	// before the backlog is drained and shutdownCh is closed
+	closingCh chan struct{}
+	stopOnce  sync.Once
+	// processing counts packets the workers are delivering
+	processing atomic.Int64
+
+	sendDuration    *metrics.HistogramVec
+	deliveryLatency *metrics.HistogramVec
+}
+
+// Option configures optional LogDistributor behaviour
+type Option func(*LogDistributor)
+
+// WithStrategy sets the strategy used to pick an analyzer for each packet
+func WithStrategy(strategy Strategy) Option {
+	return func(d *LogDistributor) {
+		if strategy != nil {
+			d.strategy = strategy
+		}
+	}
+}
+
+// WithWAL persists every accepted packet to the given write-ahead log until an
+// analyzer has accepted it. Entries left over from a previous run are
+// replayed when the distributor starts.
+func WithWAL(w *wal.WAL) Option {
+	return func(d *LogDistributor) {
+		d.wal = w
+	}
+}
+
+// WithDeadLetters records packets that are dropped after retries in the given
+// store so they can be inspected and replayed
+func WithDeadLetters(store *deadletter.Store) Option {
+	return func(d *LogDistributor) {
+		d.deadLetters = store
+	}
+}
+
+// WithDedup turns away packets whose ID was received within ttl, remembering
+// up to capacity IDs. A zero ttl disables deduplication.
+func WithDedup(ttl time.Duration, capacity int) Option {
+	return func(d *LogDistributor) {
+		if ttl > 0 {
+			d.dedup = newDedupCache(ttl, capacity)
+		}
+	}
+}
+
+// WithLanes sets how the work queue is shared between priority lanes, in
+// place of DefaultLaneConfig
+func WithLanes(config LaneConfig) Option {
+	return func(d *LogDistributor) {
+		d.laneConfig = config
+	}
+}
+
+// WithRouter sends each packet to the analyzer group its routing rules pick,
+// selecting an analyzer within the group. Without a router every active
+// analyzer is a candidate.
+func WithRouter(router *Router) Option {
+	return func(d *LogDistributor) {
+		d.router = router
+	}
+}
+
+// WithReplication sends each packet to replicas distinct analyzers, counting
+// it as delivered once as many of them accepted it as ack requires. Routing
+// rules may ask for other settings.
+func WithReplication(replicas int, ack AckMode) Option {
+	return func(d *LogDistributor) {
+		if replicas > 0 {
+			d.replicas = replicas
+		}
+		if ack != "" {
+			d.replicaAck = ack
+		}
+	}
+}
+
+// WithRetryPolicy sets the backoff and worker count used for retries. By
+// default retries back off exponentially from the retry interval.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(d *LogDistributor) {
+		d.retryPolicy = policy.normalized()
+	}
 }
 
 // NewLogDistributor creates a new log distributor
@@ -46,57 +205,273 @@ func NewLogDistributor(
 	maxWorkers int,
 	maxRetries int,
 	retryInterval time.Duration,
+	opts ...Option,
 ) *LogDistributor {
-	return &LogDistributor{
+	d := &LogDistributor{
 		analyzerPool:  pool,
-		workQueue:     make(chan *models.LogPacket, queueSize),
-		retryQueue:    make(chan *models.LogPacket, queueSize),
+		laneConfig:    DefaultLaneConfig(),
+		retryQueue:    newRetryScheduler(queueSize),
 		maxWorkers:    maxWorkers,
 		shutdownCh:    make(chan struct{}),
+		closingCh:     make(chan struct{}),
 		maxRetries:    maxRetries,
 		retryInterval: retryInterval,
+		retryPolicy:   DefaultRetryPolicy(retryInterval, maxWorkers).normalized(),
+		strategy:      NewWeightedRandomStrategy(),
+		replicas:      1,
+		replicaAck:    AckOne,
 		metrics: &DistributionMetrics{
 			PacketsByAnalyzer: make(map[string]int64),
+			LogsByAnalyzer:    make(map[string]int64),
+			PacketsShed:       make(map[string]int64),
 		},
+		sendDuration: metrics.NewHistogramVec(
+			"log_distributor_send_duration_seconds",
+			"Time taken to send a packet to an analyzer.",
+			metrics.DefaultBuckets,
+			"analyzer",
+		),
+		deliveryLatency: metrics.NewHistogramVec(
+			"log_distributor_delivery_latency_seconds",
+			"Time from a packet being enqueued to an analyzer accepting it.",
+			metrics.DefaultBuckets,
+		),
+	}
+
+	for _, opt := range opts {
+		opt(d)
 	}
+	d.workQueue = newLaneQueue(queueSize, d.laneConfig)
+
+	return d
+}
+
+// Router returns the routing rules, or nil if routing is not enabled
+func (d *LogDistributor) Router() *Router {
+	return d.router
+}
+
+// Strategy returns the strategy used to pick analyzers
+func (d *LogDistributor) Strategy() Strategy {
+	return d.strategy
 }
 
 // Start starts the distributor workers
 func (d *LogDistributor) Start(ctx context.Context) {
+	d.settingsMutex.Lock()
+	d.workers = newWorkerSet(&d.workerWg, func(stop <-chan struct{}) {
+		d.worker(ctx, stop)
+	})
+	d.retryWorkers = newWorkerSet(&d.workerWg, func(stop <-chan struct{}) {
+		d.retryWorker(ctx, stop)
+	})
+
 	// Start main workers
-	for i := 0; i < d.maxWorkers; i++ {
+	d.workers.resize(d.maxWorkers)
+
+	// Start retry dispatcher and workers
+	d.workerWg.Add(1)
+	go func() {
+		defer d.workerWg.Done()
+		d.retryQueue.dispatch(ctx, d.shutdownCh)
+	}()
+	d.retryWorkers.resize(d.retryPolicy.Workers)
+	d.settingsMutex.Unlock()
+
+	// Replay packets persisted by a previous run
+	if d.wal != nil {
 		d.workerWg.Add(1)
-		go d.worker(ctx)
+		go d.replayWAL(ctx)
 	}
+}
 
-	// Start retry worker
-	d.workerWg.Add(1)
-	go d.retryWorker(ctx)
+// SetWorkerCount changes the number of workers delivering packets from the
+// work queue, starting or stopping workers if the distributor is running
+func (d *LogDistributor) SetWorkerCount(n int) {
+	if n <= 0 {
+		return
+	}
+
+	d.settingsMutex.Lock()
+	defer d.settingsMutex.Unlock()
+
+	d.maxWorkers = n
+	if d.workers != nil && !d.stopped() {
+		d.workers.resize(n)
+	}
 }
 
-// Stop gracefully stops the distributor
-func (d *LogDistributor) Stop() {
-	close(d.shutdownCh)
-	d.workerWg.Wait()
-	close(d.workQueue)
-	close(d.retryQueue)
+// SetRetryPolicy changes the retry limit and backoff. Packets already waiting
+// for a retry keep their current due time.
+func (d *LogDistributor) SetRetryPolicy(maxRetries int, policy RetryPolicy) {
+	policy = policy.normalized()
+
+	d.settingsMutex.Lock()
+	defer d.settingsMutex.Unlock()
+
+	d.maxRetries = maxRetries
+	d.retryInterval = policy.BaseDelay
+	d.retryPolicy = policy
+	if d.retryWorkers != nil && !d.stopped() {
+		d.retryWorkers.resize(policy.Workers)
+	}
 }
 
-// EnqueuePacket adds a log packet to the work queue
-func (d *LogDistributor) EnqueuePacket(packet *models.LogPacket) bool {
+// WorkerCount returns the number of workers delivering from the work queue
+func (d *LogDistributor) WorkerCount() int {
+	d.settingsMutex.RLock()
+	defer d.settingsMutex.RUnlock()
+	return d.maxWorkers
+}
+
+// retrySettings returns the current retry limit and backoff
+func (d *LogDistributor) retrySettings() (int, RetryPolicy) {
+	d.settingsMutex.RLock()
+	defer d.settingsMutex.RUnlock()
+	return d.maxRetries, d.retryPolicy
+}
+
+// stopped reports whether Stop has been called
+func (d *LogDistributor) stopped() bool {
 	select {
-	case d.workQueue <- packet:
-		d.metrics.mutex.Lock()
-		d.metrics.TotalPacketsReceived++
-		d.metrics.mutex.Unlock()
+	case <-d.shutdownCh:
 		return true
 	default:
-		// Queue is full, packet is dropped
+		return false
+	}
+}
+
+// Stop stops the distributor without waiting for the backlog, which is
+// spilled as by Shutdown
+func (d *LogDistributor) Stop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.Shutdown(ctx)
+}
+
+// Enqueue adds a log packet to the work queue, in the lane of its priority or
+// its most severe log message. It returns ErrDuplicate if deduplication is
+// enabled and a packet with the same ID was already taken, and ErrQueueFull
+// if the queue is filled to the lane's shed threshold or the distributor is
+// shutting down.
+func (d *LogDistributor) Enqueue(packet *models.LogPacket) error {
+	if d.dedup != nil && packet.PacketID != "" {
+		if !d.dedup.add(packet.PacketID) {
+			d.metrics.mutex.Lock()
+			d.metrics.DuplicatePackets++
+			d.metrics.mutex.Unlock()
+			return ErrDuplicate
+		}
+	}
+
+	if !d.enqueue(packet) {
+		// Let the agent send the packet again
+		if d.dedup != nil {
+			d.dedup.remove(packet.PacketID)
+		}
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// EnqueuePacket adds a log packet to the work queue. It returns false once
+// the distributor is shutting down or if the queue is full. A duplicate
+// packet counts as taken.
+func (d *LogDistributor) EnqueuePacket(packet *models.LogPacket) bool {
+	err := d.Enqueue(packet)
+	return err == nil || errors.Is(err, ErrDuplicate)
+}
+
+// enqueue adds a packet to the work queue without checking for duplicates
+func (d *LogDistributor) enqueue(packet *models.LogPacket) bool {
+	if d.closing() {
+		return false
+	}
+
+	item := &queuedPacket{packet: packet, enqueuedAt: time.Now(), lane: laneOf(packet)}
+
+	if d.wal != nil {
+		if err := d.persist(item); err != nil {
+			log.Printf("Failed to persist packet %s: %v\n", packet.PacketID, err)
+			d.metrics.mutex.Lock()
+			d.metrics.PacketsDropped++
+			d.metrics.mutex.Unlock()
+			return false
+		}
+	}
+
+	if !d.workQueue.push(item, true) {
+		// No room in the packet's lane, packet is dropped
+		d.release(item)
 		d.metrics.mutex.Lock()
 		d.metrics.PacketsDropped++
+		d.metrics.PacketsShed[item.lane.String()]++
 		d.metrics.mutex.Unlock()
 		return false
 	}
+
+	d.metrics.mutex.Lock()
+	d.metrics.TotalPacketsReceived++
+	d.metrics.mutex.Unlock()
+	return true
+}
+
+// persist writes a packet to the write-ahead log
+func (d *LogDistributor) persist(item *queuedPacket) error {
+	payload, err := json.Marshal(item.packet)
+	if err != nil {
+		return err
+	}
+
+	seq, err := d.wal.Append(payload)
+	if err != nil {
+		return err
+	}
+	item.walSeq = seq
+	return nil
+}
+
+// release removes a packet that reached a final outcome (delivered or
+// dropped) from the write-ahead log
+func (d *LogDistributor) release(item *queuedPacket) {
+	if d.wal == nil || item.walSeq == 0 {
+		return
+	}
+	if err := d.wal.Ack(item.walSeq); err != nil && err != wal.ErrClosed {
+		log.Printf("Failed to acknowledge packet %s in write-ahead log: %v\n", item.packet.PacketID, err)
+	}
+}
+
+// replayWAL feeds packets recovered from the write-ahead log back into the
+// work queue, waiting for room rather than dropping or shedding them
+func (d *LogDistributor) replayWAL(ctx context.Context) {
+	defer d.workerWg.Done()
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for _, entry := range d.wal.Pending() {
+		var packet models.LogPacket
+		if err := json.Unmarshal(entry.Data, &packet); err != nil {
+			log.Printf("Discarding unreadable write-ahead log entry %d: %v\n", entry.Seq, err)
+			d.wal.Ack(entry.Seq)
+			continue
+		}
+
+		item := &queuedPacket{packet: &packet, walSeq: entry.Seq, enqueuedAt: time.Now(), lane: laneOf(&packet)}
+		for !d.workQueue.push(item, false) {
+			select {
+			case <-d.shutdownCh:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+		d.metrics.mutex.Lock()
+		d.metrics.TotalPacketsReceived++
+		d.metrics.mutex.Unlock()
+	}
 }
 
 // GetMetrics returns the current distribution metrics
@@ -109,152 +484,506 @@ func (d *LogDistributor) GetMetrics() DistributionMetrics {
 	for k, v := range d.metrics.PacketsByAnalyzer {
 		packetsByAnalyzer[k] = v
 	}
+	logsByAnalyzer := make(map[string]int64)
+	for k, v := range d.metrics.LogsByAnalyzer {
+		logsByAnalyzer[k] = v
+	}
+	packetsShed := make(map[string]int64)
+	for k, v := range d.metrics.PacketsShed {
+		packetsShed[k] = v
+	}
 
 	return DistributionMetrics{
 		TotalPacketsReceived: d.metrics.TotalPacketsReceived,
 		TotalPacketsSent:     d.metrics.TotalPacketsSent,
 		PacketsDropped:       d.metrics.PacketsDropped,
 		PacketsByAnalyzer:    packetsByAnalyzer,
+		LogsByAnalyzer:       logsByAnalyzer,
+		PartialDeliveries:    d.metrics.PartialDeliveries,
+		DuplicatePackets:     d.metrics.DuplicatePackets,
+		PacketsShed:          packetsShed,
+
+		ReplicatedPackets:      d.metrics.ReplicatedPackets,
+		ReplicasDelivered:      d.metrics.ReplicasDelivered,
+		ReplicasFailed:         d.metrics.ReplicasFailed,
+		UnderReplicatedPackets: d.metrics.UnderReplicatedPackets,
 	}
 }
 
-// worker processes packets from the work queue
-func (d *LogDistributor) worker(ctx context.Context) {
-	defer d.workerWg.Done()
+// RegisterMetrics exposes the distributor's metrics on a Prometheus registry
+func (d *LogDistributor) RegisterMetrics(r *metrics.Registry) {
+	r.CounterFunc("log_distributor_packets_received_total", "Packets accepted into the work queue.", nil,
+		func(emit metrics.EmitFunc) {
+			emit(float64(d.GetMetrics().TotalPacketsReceived))
+		})
+	r.CounterFunc("log_distributor_packets_sent_total", "Packets delivered to an analyzer.", nil,
+		func(emit metrics.EmitFunc) {
+			emit(float64(d.GetMetrics().TotalPacketsSent))
+		})
+	r.CounterFunc("log_distributor_packets_dropped_total", "Packets rejected or given up on.", nil,
+		func(emit metrics.EmitFunc) {
+			emit(float64(d.GetMetrics().PacketsDropped))
+		})
+	r.CounterFunc("log_distributor_partial_deliveries_total", "Packets an analyzer accepted only in part.", nil,
+		func(emit metrics.EmitFunc) {
+			emit(float64(d.GetMetrics().PartialDeliveries))
+		})
+	r.CounterFunc("log_distributor_duplicate_packets_total", "Packets turned away because their ID was already received.", nil,
+		func(emit metrics.EmitFunc) {
+			emit(float64(d.GetMetrics().DuplicatePackets))
+		})
+	r.CounterFunc("log_distributor_replicated_packets_total", "Packets sent to more than one analyzer.", nil,
+		func(emit metrics.EmitFunc) {
+			emit(float64(d.GetMetrics().ReplicatedPackets))
+		})
+	r.CounterFunc("log_distributor_replicas_delivered_total", "Replicas of replicated packets accepted by an analyzer.", nil,
+		func(emit metrics.EmitFunc) {
+			emit(float64(d.GetMetrics().ReplicasDelivered))
+		})
+	r.CounterFunc("log_distributor_replicas_failed_total", "Replicas of replicated packets given up on.", nil,
+		func(emit metrics.EmitFunc) {
+			emit(float64(d.GetMetrics().ReplicasFailed))
+		})
+	r.CounterFunc("log_distributor_under_replicated_packets_total", "Replicated packets delivered with fewer replicas than asked for.", nil,
+		func(emit metrics.EmitFunc) {
+			emit(float64(d.GetMetrics().UnderReplicatedPackets))
+		})
+	r.CounterFunc("log_distributor_analyzer_packets_sent_total", "Packets delivered per analyzer.", []string{"analyzer"},
+		func(emit metrics.EmitFunc) {
+			for id, n := range d.GetMetrics().PacketsByAnalyzer {
+				emit(float64(n), id)
+			}
+		})
+	r.CounterFunc("log_distributor_analyzer_logs_sent_total", "Log messages delivered per analyzer.", []string{"analyzer"},
+		func(emit metrics.EmitFunc) {
+			for id, n := range d.GetMetrics().LogsByAnalyzer {
+				emit(float64(n), id)
+			}
+		})
+	r.CounterFunc("log_distributor_packets_shed_total", "Packets the work queue refused per priority lane.", []string{"lane"},
+		func(emit metrics.EmitFunc) {
+			for lane, n := range d.GetMetrics().PacketsShed {
+				emit(float64(n), lane)
+			}
+		})
+	r.GaugeFunc("log_distributor_work_queue_depth", "Packets waiting in the work queue.", nil,
+		func(emit metrics.EmitFunc) {
+			emit(float64(d.workQueue.Len()))
+		})
+	r.GaugeFunc("log_distributor_lane_depth", "Packets waiting in the work queue per priority lane.", []string{"lane"},
+		func(emit metrics.EmitFunc) {
+			for i := range laneLevels {
+				emit(float64(d.workQueue.laneLen(lane(i))), lane(i).String())
+			}
+		})
+	r.GaugeFunc("log_distributor_retry_queue_depth", "Packets waiting for a retry.", nil,
+		func(emit metrics.EmitFunc) {
+			emit(float64(d.retryQueue.Len()))
+		})
+	r.GaugeFunc("log_distributor_active_analyzers", "Analyzers currently receiving traffic.", nil,
+		func(emit metrics.EmitFunc) {
+			emit(float64(len(d.analyzerPool.GetActiveAnalyzers())))
+		})
+	if d.deadLetters != nil {
+		r.GaugeFunc("log_distributor_dead_letters", "Packets held in the dead-letter store.", nil,
+			func(emit metrics.EmitFunc) {
+				emit(float64(d.deadLetters.Len()))
+			})
+	}
+	if d.wal != nil {
+		r.GaugeFunc("log_distributor_wal_pending", "Packets in the write-ahead log awaiting delivery.", nil,
+			func(emit metrics.EmitFunc) {
+				emit(float64(d.wal.Len()))
+			})
+	}
+	r.Register(d.sendDuration)
+	r.Register(d.deliveryLatency)
+}
 
+// worker processes packets from the work queue until stop is closed
+func (d *LogDistributor) worker(ctx context.Context, stop <-chan struct{}) {
 	for {
 		select {
 		case <-d.shutdownCh:
 			return
+		case <-stop:
+			return
 		case <-ctx.Done():
 			return
-		case packet, ok := <-d.workQueue:
-			if !ok {
-				return
+		case <-d.workQueue.readyCh:
+			item := d.workQueue.pop()
+			if item == nil {
+				continue
 			}
-			d.processPacket(ctx, packet, 0)
+			d.processing.Add(1)
+			d.processPacket(ctx, item)
+			d.processing.Add(-1)
 		}
 	}
 }
 
-// retryWorker handles failed packets that need to be retried
-func (d *LogDistributor) retryWorker(ctx context.Context) {
-	defer d.workerWg.Done()
-
-	ticker := time.NewTicker(d.retryInterval)
-	defer ticker.Stop()
-
+// retryWorker delivers packets whose retry backoff has expired until stop is
+// closed
+func (d *LogDistributor) retryWorker(ctx context.Context, stop <-chan struct{}) {
 	for {
 		select {
 		case <-d.shutdownCh:
 			return
+		case <-stop:
+			return
 		case <-ctx.Done():
 			return
-		case packet, ok := <-d.retryQueue:
-			if !ok {
-				return
-			}
-			// Wait for retry interval before processing
-			<-ticker.C
-			d.processPacket(ctx, packet, packet.Metadata["retryCount"].(int))
+		case item := <-d.retryQueue.readyCh:
+			d.processing.Add(1)
+			d.processPacket(ctx, item)
+			d.processing.Add(-1)
 		}
 	}
 }
 
-// processPacket processes a single log packet and sends it to an analyzer
-func (d *LogDistributor) processPacket(ctx context.Context, packet *models.LogPacket, retryCount int) {
+// processPacket processes a single log packet and sends it to an analyzer,
+// or to several if it is replicated
+func (d *LogDistributor) processPacket(ctx context.Context, item *queuedPacket) {
+	packet := item.packet
+
 	// Get active analyzers
 	activeAnalyzers := d.analyzerPool.GetActiveAnalyzers()
 	if len(activeAnalyzers) == 0 {
 		// No active analyzers, put in retry queue if under retry limit
-		if retryCount < d.maxRetries {
-			// Add retry count to metadata
-			if packet.Metadata == nil {
-				packet.Metadata = make(map[string]interface{})
-			}
-			packet.Metadata["retryCount"] = retryCount + 1
+		d.retryOrDrop(item, "", errNoActiveAnalyzers, 0)
+		return
+	}
 
-			select {
-			case d.retryQueue <- packet:
-				// Successfully queued for retry
-			default:
-				// Retry queue full, packet dropped
-				d.metrics.mutex.Lock()
-				d.metrics.PacketsDropped++
-				d.metrics.mutex.Unlock()
-			}
-		} else {
-			// Max retries reached, packet dropped
-			d.metrics.mutex.Lock()
-			d.metrics.PacketsDropped++
-			d.metrics.mutex.Unlock()
+	// Narrow the choice to the packet's analyzer group
+	replicas, ack := d.replicas, d.replicaAck
+	if d.router != nil {
+		group, rule := d.router.match(packet)
+		activeAnalyzers = d.router.members(activeAnalyzers, group)
+		if len(activeAnalyzers) == 0 {
+			d.retryOrDrop(item, "", fmt.Errorf("%w %q", errNoGroupAnalyzers, group), 0)
+			return
+		}
+		if rule != nil && rule.Replicas > 0 {
+			replicas = rule.Replicas
 		}
+		if rule != nil && rule.Ack != "" {
+			ack = rule.Ack
+		}
+	}
+
+	if item.replica == nil && replicas > 1 {
+		d.fanOut(ctx, item, activeAnalyzers, replicas, ack)
 		return
 	}
 
-	// Select analyzer using weighted random selection
-	selectedAnalyzer := d.selectAnalyzerRandom(activeAnalyzers)
+	// Select analyzer using the configured strategy, away from the other
+	// replicas of a replicated packet
+	var selectedAnalyzer *analyzer.Analyzer
+	if item.replica != nil {
+		selectedAnalyzer = item.replica.set.pick(activeAnalyzers, item, d.strategy)
+		if selectedAnalyzer == nil {
+			d.retryOrDrop(item, "", errNoReplicaAnalyzer, 0)
+			return
+		}
+	} else {
+		selectedAnalyzer = d.strategy.Select(withoutExcluded(activeAnalyzers, item.excluded), packet)
+	}
+
+	d.deliver(ctx, item, selectedAnalyzer)
+}
+
+// deliver sends a packet to an analyzer and handles the outcome
+func (d *LogDistributor) deliver(ctx context.Context, item *queuedPacket, selectedAnalyzer *analyzer.Analyzer) {
+	packet := item.packet
 
 	// Send packet to selected analyzer
+	tracker, tracked := d.strategy.(RequestTracker)
+	if tracked {
+		tracker.Begin(selectedAnalyzer.ID)
+	}
+	sendStart := time.Now()
 	err := d.analyzerPool.SendLogPacket(ctx, selectedAnalyzer, packet)
+	d.sendDuration.Observe(time.Since(sendStart).Seconds(), selectedAnalyzer.ID)
+	if tracked {
+		tracker.Done(selectedAnalyzer.ID)
+	}
 	if err != nil {
-		// Failed to send, retry if under retry limit
-		if retryCount < d.maxRetries {
-			// Add retry count to metadata
-			if packet.Metadata == nil {
-				packet.Metadata = make(map[string]interface{})
-			}
-			packet.Metadata["retryCount"] = retryCount + 1
+		var partial *analyzer.PartialDeliveryError
+		if errors.As(err, &partial) {
+			d.handlePartialDelivery(item, selectedAnalyzer, partial)
+			return
+		}
 
-			select {
-			case d.retryQueue <- packet:
-				// Successfully queued for retry
-			default:
-				// Retry queue full, packet dropped
-				d.metrics.mutex.Lock()
-				d.metrics.PacketsDropped++
-				d.metrics.mutex.Unlock()
-			}
-		} else {
-			// Max retries reached, packet dropped
-			d.metrics.mutex.Lock()
-			d.metrics.PacketsDropped++
-			d.metrics.mutex.Unlock()
+		// Failed to send, retry if under retry limit
+		if item.replica != nil {
+			item.replica.set.forget(selectedAnalyzer.ID, item.replica)
+		}
+		if errors.Is(err, analyzer.ErrCircuitOpen) {
+			d.reschedule(item, selectedAnalyzer.ID, err, 0)
+			return
+		}
+		var backpressure *analyzer.BackpressureError
+		if errors.As(err, &backpressure) {
+			// The analyzer asked to slow down rather than failing
+			d.reschedule(item, selectedAnalyzer.ID, err, backpressure.RetryAfter)
+			return
 		}
+		d.retryOrDrop(item, selectedAnalyzer.ID, err, 0)
+		return
+	}
+
+	if item.replica != nil {
+		d.metrics.mutex.Lock()
+		d.metrics.PacketsByAnalyzer[selectedAnalyzer.ID]++
+		d.metrics.LogsByAnalyzer[selectedAnalyzer.ID] += int64(len(packet.LogMessages))
+		d.metrics.mutex.Unlock()
+		d.settleReplica(item, selectedAnalyzer.ID, nil)
 		return
 	}
 
+	d.release(item)
+	d.deliveryLatency.Observe(time.Since(item.enqueuedAt).Seconds())
+
 	// Update metrics
 	d.metrics.mutex.Lock()
 	d.metrics.TotalPacketsSent++
 	d.metrics.PacketsByAnalyzer[selectedAnalyzer.ID]++
+	d.metrics.LogsByAnalyzer[selectedAnalyzer.ID] += int64(len(packet.LogMessages))
 	d.metrics.mutex.Unlock()
 }
 
-// selectAnalyzerRandom selects an analyzer randomly based on weights
-func (d *LogDistributor) selectAnalyzerRandom(analyzers []*analyzer.Analyzer) *analyzer.Analyzer {
-	if len(analyzers) == 1 {
-		return analyzers[0]
+// handlePartialDelivery records the log messages an analyzer accepted and
+// sends the rest on: rejected messages go straight to another analyzer and
+// deferred ones are retried after the analyzer's Retry-After
+func (d *LogDistributor) handlePartialDelivery(item *queuedPacket, a *analyzer.Analyzer, partial *analyzer.PartialDeliveryError) {
+	// A message both rejected and deferred is treated as rejected
+	rejectedIDs := make(map[string]struct{}, len(partial.Rejected))
+	for _, id := range partial.Rejected {
+		rejectedIDs[id] = struct{}{}
+	}
+	deferredIDs := make([]string, 0, len(partial.Deferred))
+	for _, id := range partial.Deferred {
+		if _, ok := rejectedIDs[id]; !ok {
+			deferredIDs = append(deferredIDs, id)
+		}
 	}
 
-	// Calculate total weight of active analyzers
-	totalWeight := 0.0
-	for _, a := range analyzers {
-		totalWeight += a.Weight
+	rejected := subsetPacket(item.packet, partial.Rejected)
+	deferred := subsetPacket(item.packet, deferredIDs)
+	accepted := len(item.packet.LogMessages) - len(rejected.LogMessages) - len(deferred.LogMessages)
+
+	d.metrics.mutex.Lock()
+	d.metrics.PacketsByAnalyzer[a.ID]++
+	d.metrics.LogsByAnalyzer[a.ID] += int64(accepted)
+	if len(rejected.LogMessages) == 0 && len(deferred.LogMessages) == 0 {
+		// None of the IDs matched, so the whole packet counts as delivered
+		if item.replica == nil {
+			d.metrics.TotalPacketsSent++
+		}
+	} else {
+		d.metrics.PartialDeliveries++
+	}
+	d.metrics.mutex.Unlock()
+
+	// Persist the remainders before the original entry is released
+	if len(rejected.LogMessages) > 0 {
+		next := d.remainder(item, rejected)
+		next.excluded[a.ID] = struct{}{}
+		d.reroute(next, a.ID, partial)
+	}
+	if len(deferred.LogMessages) > 0 {
+		next := d.remainder(item, deferred)
+		d.retryOrDrop(next, a.ID, partial, partial.RetryAfter)
+	}
+	if item.replica != nil {
+		d.settleReplica(item, a.ID, nil)
+		return
+	}
+	d.release(item)
+}
+
+// remainder creates the queue entry for the undelivered part of a packet
+func (d *LogDistributor) remainder(item *queuedPacket, packet *models.LogPacket) *queuedPacket {
+	next := &queuedPacket{
+		packet:      packet,
+		retries:     item.retries,
+		reschedules: item.reschedules,
+		enqueuedAt:  item.enqueuedAt,
+		lane:        item.lane,
+		excluded:    make(map[string]struct{}, len(item.excluded)+1),
+		replica:     item.replica,
+	}
+	for id := range item.excluded {
+		next.excluded[id] = struct{}{}
+	}
+
+	// The write-ahead log entry of a replicated packet covers its replicas
+	if item.replica != nil {
+		item.replica.set.split(item.replica)
+		return next
+	}
+	if d.wal != nil {
+		if err := d.persist(next); err != nil {
+			log.Printf("Failed to persist remainder of packet %s: %v\n", packet.PacketID, err)
+		}
+	}
+	return next
+}
+
+// reroute sends a packet back through the work queue right away, falling back
+// to a scheduled retry if the queue is full
+func (d *LogDistributor) reroute(item *queuedPacket, analyzerID string, cause error) {
+	maxRetries, _ := d.retrySettings()
+	item.retries++
+	if item.retries > maxRetries {
+		d.drop(item, item.retries, analyzerID, cause)
+		return
+	}
+
+	if !d.workQueue.push(item, false) {
+		item.retries--
+		d.retryOrDrop(item, analyzerID, cause, 0)
+	}
+}
+
+// retryOrDrop schedules a failed packet for another attempt after its
+// backoff, or after minDelay if that is longer, if it is under the retry
+// limit and drops it otherwise
+func (d *LogDistributor) retryOrDrop(item *queuedPacket, analyzerID string, cause error, minDelay time.Duration) {
+	maxRetries, policy := d.retrySettings()
+	item.retries++
+	if item.retries > maxRetries {
+		// Max retries reached, packet dropped
+		d.drop(item, item.retries, analyzerID, cause)
+		return
+	}
+
+	delay := policy.Delay(item.retries)
+	if delay < minDelay {
+		delay = minDelay
+	}
+	if !d.retryQueue.Schedule(item, delay) {
+		// Retry queue full, packet dropped
+		d.drop(item, item.retries, analyzerID, fmt.Errorf("retry queue full: %w", cause))
+	}
+}
+
+// reschedule puts a packet back on the retry queue, at least minDelay later,
+// without counting an attempt: for sends a circuit breaker turned away
+// before anything was sent, and for analyzers that asked to back off. Once a
+// packet was rescheduled maxReschedules times, it is retried or dropped like
+// any failed send, so that it cannot wait forever.
+func (d *LogDistributor) reschedule(item *queuedPacket, analyzerID string, cause error, minDelay time.Duration) {
+	item.reschedules++
+	if item.reschedules > maxReschedules {
+		d.retryOrDrop(item, analyzerID, cause, minDelay)
+		return
 	}
 
-	// Generate random value between 0 and total weight
-	r := rand.Float64() * totalWeight
+	_, policy := d.retrySettings()
+	delay := policy.Delay(item.retries + 1)
+	if delay < minDelay {
+		delay = minDelay
+	}
+	if !d.retryQueue.Schedule(item, delay) {
+		d.drop(item, item.retries, analyzerID, fmt.Errorf("retry queue full: %w", cause))
+	}
+}
+
+// drop gives up on a packet, recording it in the dead-letter store if one is
+// configured. Giving up on a replica only drops the packet if too few of its
+// replicas are left.
+func (d *LogDistributor) drop(item *queuedPacket, attempts int, analyzerID string, cause error) {
+	if item.replica != nil {
+		d.settleReplica(item, analyzerID, cause)
+		return
+	}
+
+	if d.deadLetters != nil {
+		d.deadLetters.Add(deadletter.Entry{
+			Packet:     item.packet,
+			Error:      cause.Error(),
+			AnalyzerID: analyzerID,
+			Attempts:   attempts,
+		})
+	}
+
+	d.release(item)
+	d.metrics.mutex.Lock()
+	d.metrics.PacketsDropped++
+	d.metrics.mutex.Unlock()
+}
+
+// DeadLetters returns the dead-letter store, or nil if none is configured
+func (d *LogDistributor) DeadLetters() *deadletter.Store {
+	return d.deadLetters
+}
+
+// ReplayDeadLetters re-enqueues the dead letters with the given IDs, or all
+// of them when no IDs are given. Replayed entries are removed from the store;
+// replay stops at the first packet the work queue cannot take.
+func (d *LogDistributor) ReplayDeadLetters(ids []string) (int, error) {
+	if d.deadLetters == nil {
+		return 0, errDeadLettersDisabled
+	}
 
-	// Find the analyzer that corresponds to this random value
-	currentWeight := 0.0
+	var entries []*deadletter.Entry
+	if len(ids) == 0 {
+		entries = d.deadLetters.List(0)
+	} else {
+		for _, id := range ids {
+			entry, err := d.deadLetters.Get(id)
+			if err != nil {
+				return 0, fmt.Errorf("%w: %s", err, id)
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	// Replays are sent again on purpose, so they skip deduplication
+	replayed := 0
+	for _, entry := range entries {
+		if !d.enqueue(entry.Packet) {
+			return replayed, ErrQueueFull
+		}
+		d.deadLetters.Remove(entry.ID)
+		replayed++
+	}
+	return replayed, nil
+}
+
+// withoutExcluded leaves out analyzers that rejected the packet before, unless
+// that would leave none to try
+func withoutExcluded(analyzers []*analyzer.Analyzer, excluded map[string]struct{}) []*analyzer.Analyzer {
+	if len(excluded) == 0 {
+		return analyzers
+	}
+
+	remaining := make([]*analyzer.Analyzer, 0, len(analyzers))
 	for _, a := range analyzers {
-		currentWeight += a.Weight
-		if r <= currentWeight {
-			return a
+		if _, ok := excluded[a.ID]; !ok {
+			remaining = append(remaining, a)
 		}
 	}
+	if len(remaining) == 0 {
+		return analyzers
+	}
+	return remaining
+}
+
+// subsetPacket copies a packet keeping only the log messages with the given IDs
+func subsetPacket(packet *models.LogPacket, ids []string) *models.LogPacket {
+	wanted := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		wanted[id] = struct{}{}
+	}
 
-	// Fallback to first analyzer (should never happen unless weights are 0)
-	return analyzers[0]
+	subset := *packet
+	subset.LogMessages = make([]models.LogMessage, 0, len(ids))
+	for _, msg := range packet.LogMessages {
+		if _, ok := wanted[msg.ID]; ok {
+			subset.LogMessages = append(subset.LogMessages, msg)
+		}
+	}
+	return &subset
 }
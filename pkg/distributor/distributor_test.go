@@ -3,12 +3,19 @@ package distributor
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/ryouol/log-distributor/pkg/analyzer"
+	"github.com/ryouol/log-distributor/pkg/deadletter"
+	"github.com/ryouol/log-distributor/pkg/metrics"
 	"github.com/ryouol/log-distributor/pkg/models"
+	"github.com/ryouol/log-distributor/pkg/wal"
 )
 
 // MockAnalyzerPool implements the AnalyzerPoolInterface for testing
@@ -16,6 +23,7 @@ type MockAnalyzerPool struct {
 	activeAnalyzers []*analyzer.Analyzer
 	sentPackets     map[string][]*models.LogPacket
 	errorOnSend     bool
+	sendHook        func(a *analyzer.Analyzer, p *models.LogPacket) error
 	mutex           sync.Mutex
 	totalWeight     float64
 }
@@ -28,7 +36,17 @@ func NewMockAnalyzerPool() *MockAnalyzerPool {
 }
 
 func (m *MockAnalyzerPool) GetActiveAnalyzers() []*analyzer.Analyzer {
-	return m.activeAnalyzers
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	analyzers := make([]*analyzer.Analyzer, 0, len(m.activeAnalyzers))
+	for _, a := range m.activeAnalyzers {
+		if a.Active {
+			snapshot := *a
+			analyzers = append(analyzers, &snapshot)
+		}
+	}
+	return analyzers
 }
 
 func (m *MockAnalyzerPool) SendLogPacket(ctx context.Context, a *analyzer.Analyzer, p *models.LogPacket) error {
@@ -39,6 +57,12 @@ func (m *MockAnalyzerPool) SendLogPacket(ctx context.Context, a *analyzer.Analyz
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	if m.sendHook != nil {
+		if err := m.sendHook(a, p); err != nil {
+			return err
+		}
+	}
+
 	if m.sentPackets[a.ID] == nil {
 		m.sentPackets[a.ID] = make([]*models.LogPacket, 0)
 	}
@@ -178,8 +202,8 @@ func TestDistributionWithNoAnalyzers(t *testing.T) {
 		t.Fatal("Failed to enqueue packet")
 	}
 
-	// Wait for processing
-	time.Sleep(time.Millisecond * 50)
+	// Wait for processing and retries (backoff of 10ms, 20ms and 40ms)
+	time.Sleep(time.Millisecond * 150)
 
 	// Check metrics
 	metrics := distributor.GetMetrics()
@@ -395,3 +419,402 @@ func TestRetryMechanism(t *testing.T) {
 		t.Errorf("Expected 1 packet sent after error resolved, got %d", metrics.TotalPacketsSent)
 	}
 }
+
+// TestBreakerRejectionKeepsRetries tests that sends a circuit breaker turned
+// away do not use up the packet's retries
+func TestBreakerRejectionKeepsRetries(t *testing.T) {
+	pool := NewMockAnalyzerPool()
+	pool.AddAnalyzer("analyzer1", 1.0)
+	rejections := 0
+	pool.sendHook = func(a *analyzer.Analyzer, p *models.LogPacket) error {
+		if rejections < 3 {
+			rejections++
+			return fmt.Errorf("analyzer %s: %w", a.ID, analyzer.ErrCircuitOpen)
+		}
+		return nil
+	}
+
+	distributor := NewLogDistributor(pool, 100, 1, 1, time.Millisecond*5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	distributor.Start(ctx)
+	defer distributor.Stop()
+
+	distributor.Enqueue(&models.LogPacket{PacketID: "p1", LogMessages: []models.LogMessage{{ID: "msg1"}}})
+	time.Sleep(time.Millisecond * 100)
+
+	metrics := distributor.GetMetrics()
+	if metrics.TotalPacketsSent != 1 || metrics.PacketsDropped != 0 {
+		t.Errorf("Expected the packet to be sent after 3 rejections, got %d sent and %d dropped",
+			metrics.TotalPacketsSent, metrics.PacketsDropped)
+	}
+}
+
+// TestBreakerRejectionsAreBounded tests that a packet whose analyzers keep
+// their breakers open is dead-lettered once it was rescheduled too often
+func TestBreakerRejectionsAreBounded(t *testing.T) {
+	pool := NewMockAnalyzerPool()
+	pool.AddAnalyzer("analyzer1", 1.0)
+	var attempts atomic.Int32
+	pool.sendHook = func(a *analyzer.Analyzer, p *models.LogPacket) error {
+		attempts.Add(1)
+		return fmt.Errorf("analyzer %s: %w", a.ID, analyzer.ErrCircuitOpen)
+	}
+
+	store := deadletter.NewStore(10)
+	distributor := NewLogDistributor(pool, 100, 1, 1, time.Millisecond,
+		WithDeadLetters(store), WithRetryPolicy(RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	distributor.Start(ctx)
+	defer distributor.Stop()
+
+	distributor.Enqueue(&models.LogPacket{PacketID: "p1", LogMessages: []models.LogMessage{{ID: "msg1"}}})
+	time.Sleep(time.Millisecond * 200)
+
+	// Every reschedule, then the first attempt and its one retry
+	if n := attempts.Load(); n != maxReschedules+2 {
+		t.Errorf("Expected %d sends, got %d", maxReschedules+2, n)
+	}
+	if store.Len() != 1 || distributor.GetMetrics().PacketsDropped != 1 {
+		t.Errorf("Expected the packet to be dead-lettered, got %d dead letters", store.Len())
+	}
+}
+
+// TestBackpressureHonorsRetryAfter tests that a packet an analyzer pushed
+// back on is sent again after its Retry-After, without using up a retry
+func TestBackpressureHonorsRetryAfter(t *testing.T) {
+	pool := NewMockAnalyzerPool()
+	pool.AddAnalyzer("analyzer1", 1.0)
+	var sends []time.Time
+	var mutex sync.Mutex
+	pool.sendHook = func(a *analyzer.Analyzer, p *models.LogPacket) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sends = append(sends, time.Now())
+		if len(sends) == 1 {
+			return &analyzer.BackpressureError{AnalyzerID: a.ID, StatusCode: 429, RetryAfter: time.Millisecond * 100}
+		}
+		return nil
+	}
+
+	// No retries at all, so a counted attempt would drop the packet
+	distributor := NewLogDistributor(pool, 100, 1, 0, time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	distributor.Start(ctx)
+	defer distributor.Stop()
+
+	distributor.Enqueue(&models.LogPacket{PacketID: "p1", LogMessages: []models.LogMessage{{ID: "msg1"}}})
+	time.Sleep(time.Millisecond * 50)
+	if metrics := distributor.GetMetrics(); metrics.TotalPacketsSent != 0 || metrics.PacketsDropped != 0 {
+		t.Fatalf("Expected the packet to wait out the Retry-After, got %d sent and %d dropped",
+			metrics.TotalPacketsSent, metrics.PacketsDropped)
+	}
+	time.Sleep(time.Millisecond * 150)
+
+	metrics := distributor.GetMetrics()
+	if metrics.TotalPacketsSent != 1 || metrics.PacketsDropped != 0 {
+		t.Errorf("Expected the packet to be sent after the Retry-After, got %d sent and %d dropped",
+			metrics.TotalPacketsSent, metrics.PacketsDropped)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(sends) != 2 || sends[1].Sub(sends[0]) < time.Millisecond*100 {
+		t.Errorf("Expected a second send at least 100ms after the first, got %d sends", len(sends))
+	}
+}
+
+// TestWALReplay tests that packets accepted before a restart are delivered afterwards
+func TestWALReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	// First run: accept packets but stop before any worker delivers them
+	log1, err := wal.Open(dir, wal.Options{SyncInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to open wal: %v", err)
+	}
+
+	pool := NewMockAnalyzerPool()
+	distributor := NewLogDistributor(pool, 100, 5, 3, time.Millisecond*10, WithWAL(log1))
+	for i := 0; i < 10; i++ {
+		packet := &models.LogPacket{
+			PacketID: "test-packet",
+			AgentID:  "test-agent",
+			LogMessages: []models.LogMessage{
+				{ID: "msg1", Message: "Test message"},
+			},
+		}
+		if !distributor.EnqueuePacket(packet) {
+			t.Fatal("Failed to enqueue packet")
+		}
+	}
+	distributor.Stop()
+
+	// Second run: the recovered packets are delivered and acknowledged
+	log2, err := wal.Open(dir, wal.Options{SyncInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to reopen wal: %v", err)
+	}
+
+	pool = NewMockAnalyzerPool()
+	pool.AddAnalyzer("analyzer1", 1.0)
+	distributor = NewLogDistributor(pool, 100, 5, 3, time.Millisecond*10, WithWAL(log2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	distributor.Start(ctx)
+	time.Sleep(time.Millisecond * 100)
+
+	if count := pool.GetPacketCount("analyzer1"); count != 10 {
+		t.Errorf("Expected 10 replayed packets, got %d", count)
+	}
+	if log2.Len() != 0 {
+		t.Errorf("Expected all packets to be acknowledged, got %d pending", log2.Len())
+	}
+	distributor.Stop()
+}
+
+// TestDeadLetterAndReplay tests that dropped packets are recorded and can be replayed
+func TestDeadLetterAndReplay(t *testing.T) {
+	pool := NewMockAnalyzerPool()
+	pool.AddAnalyzer("analyzer1", 1.0)
+	pool.errorOnSend = true
+
+	store := deadletter.NewStore(10)
+	distributor := NewLogDistributor(pool, 100, 5, 1, time.Millisecond*10, WithDeadLetters(store))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	distributor.Start(ctx)
+	defer distributor.Stop()
+
+	packet := &models.LogPacket{
+		PacketID: "test-packet",
+		AgentID:  "test-agent",
+		LogMessages: []models.LogMessage{
+			{ID: "msg1", Message: "Test message"},
+		},
+	}
+	distributor.EnqueuePacket(packet)
+
+	time.Sleep(time.Millisecond * 100)
+
+	entries := store.List(0)
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %d", len(entries))
+	}
+	if entries[0].AnalyzerID != "analyzer1" || entries[0].Attempts != 2 || entries[0].Error == "" {
+		t.Errorf("Unexpected dead letter: %+v", entries[0])
+	}
+
+	// Replay once the analyzer recovers
+	pool.errorOnSend = false
+	replayed, err := distributor.ReplayDeadLetters(nil)
+	if err != nil || replayed != 1 {
+		t.Fatalf("Expected 1 replayed packet, got %d (%v)", replayed, err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	if count := pool.GetPacketCount("analyzer1"); count != 1 {
+		t.Errorf("Expected replayed packet to be delivered, got %d", count)
+	}
+	if store.Len() != 0 {
+		t.Errorf("Expected dead-letter store to be empty, got %d", store.Len())
+	}
+}
+
+// TestRetryMetadataType tests that a client-supplied retryCount does not affect retries
+func TestRetryMetadataType(t *testing.T) {
+	pool := NewMockAnalyzerPool()
+	pool.AddAnalyzer("analyzer1", 1.0)
+	pool.errorOnSend = true
+
+	distributor := NewLogDistributor(pool, 100, 5, 1, time.Millisecond*10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	distributor.Start(ctx)
+	defer distributor.Stop()
+
+	// JSON numbers decode as float64
+	packet := &models.LogPacket{
+		PacketID: "test-packet",
+		AgentID:  "test-agent",
+		Metadata: map[string]interface{}{"retryCount": float64(7)},
+		LogMessages: []models.LogMessage{
+			{ID: "msg1", Message: "Test message"},
+		},
+	}
+	distributor.EnqueuePacket(packet)
+
+	time.Sleep(time.Millisecond * 100)
+
+	if metrics := distributor.GetMetrics(); metrics.PacketsDropped != 1 {
+		t.Errorf("Expected packet to be dropped after retries, got %d", metrics.PacketsDropped)
+	}
+	if packet.Metadata["retryCount"] != float64(7) {
+		t.Errorf("Expected packet metadata to be left untouched, got %v", packet.Metadata["retryCount"])
+	}
+}
+
+// TestPrometheusMetrics tests that delivery is reflected in the exposition output
+func TestPrometheusMetrics(t *testing.T) {
+	pool := NewMockAnalyzerPool()
+	pool.AddAnalyzer("analyzer1", 1.0)
+
+	distributor := NewLogDistributor(pool, 100, 5, 3, time.Millisecond*10)
+	registry := metrics.NewRegistry()
+	distributor.RegisterMetrics(registry)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	distributor.Start(ctx)
+	defer distributor.Stop()
+
+	packet := &models.LogPacket{
+		PacketID: "test-packet",
+		AgentID:  "test-agent",
+		LogMessages: []models.LogMessage{
+			{ID: "msg1", Message: "Test message"},
+			{ID: "msg2", Message: "Test message"},
+		},
+	}
+	distributor.EnqueuePacket(packet)
+
+	time.Sleep(time.Millisecond * 50)
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	output := rec.Body.String()
+
+	expected := []string{
+		"log_distributor_packets_received_total 1",
+		"log_distributor_packets_sent_total 1",
+		`log_distributor_analyzer_logs_sent_total{analyzer="analyzer1"} 2`,
+		"log_distributor_work_queue_depth 0",
+		"log_distributor_active_analyzers 1",
+		`log_distributor_send_duration_seconds_count{analyzer="analyzer1"} 1`,
+		"log_distributor_delivery_latency_seconds_count 1",
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("Expected metrics to contain %q", line)
+		}
+	}
+}
+
+// TestPartialDeliveryReroutesRejected tests that only rejected log messages are sent again
+func TestPartialDeliveryReroutesRejected(t *testing.T) {
+	pool := NewMockAnalyzerPool()
+	pool.AddAnalyzer("analyzer1", 1.0)
+	pool.AddAnalyzer("analyzer2", 1.0)
+
+	var received []*models.LogPacket
+	pool.sendHook = func(a *analyzer.Analyzer, p *models.LogPacket) error {
+		received = append(received, p)
+		if len(received) == 1 {
+			return &analyzer.PartialDeliveryError{AnalyzerID: a.ID, Rejected: []string{"msg2"}}
+		}
+		return nil
+	}
+
+	distributor := NewLogDistributor(pool, 100, 1, 3, time.Millisecond*10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	distributor.Start(ctx)
+	defer distributor.Stop()
+
+	packet := &models.LogPacket{
+		PacketID: "test-packet",
+		AgentID:  "test-agent",
+		LogMessages: []models.LogMessage{
+			{ID: "msg1", Message: "Test message"},
+			{ID: "msg2", Message: "Test message"},
+			{ID: "msg3", Message: "Test message"},
+		},
+	}
+	distributor.EnqueuePacket(packet)
+
+	time.Sleep(time.Millisecond * 50)
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if len(received) != 2 {
+		t.Fatalf("Expected 2 sends, got %d", len(received))
+	}
+	rerouted := received[1]
+	if len(rerouted.LogMessages) != 1 || rerouted.LogMessages[0].ID != "msg2" {
+		t.Errorf("Expected only 'msg2' to be re-routed, got %v", rerouted.LogMessages)
+	}
+	if len(packet.LogMessages) != 3 {
+		t.Errorf("Expected the original packet to be left intact, got %d messages", len(packet.LogMessages))
+	}
+
+	metrics := distributor.GetMetrics()
+	if metrics.PartialDeliveries != 1 || metrics.TotalPacketsSent != 1 {
+		t.Errorf("Expected 1 partial delivery and 1 packet sent, got %d and %d",
+			metrics.PartialDeliveries, metrics.TotalPacketsSent)
+	}
+	if metrics.LogsByAnalyzer["analyzer1"]+metrics.LogsByAnalyzer["analyzer2"] != 3 {
+		t.Errorf("Expected 3 logs delivered in total, got %v", metrics.LogsByAnalyzer)
+	}
+}
+
+// TestRuntimeSettings tests resizing workers and changing the retry policy
+// while running
+func TestRuntimeSettings(t *testing.T) {
+	pool := NewMockAnalyzerPool()
+	pool.AddAnalyzer("analyzer1", 1.0)
+
+	distributor := NewLogDistributor(pool, 100, 2, 5, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	distributor.Start(ctx)
+	defer distributor.Stop()
+
+	distributor.SetWorkerCount(4)
+	if n := distributor.workers.size(); n != 4 {
+		t.Errorf("Expected 4 running workers, got %d", n)
+	}
+	distributor.SetWorkerCount(1)
+	if n := distributor.workers.size(); n != 1 {
+		t.Errorf("Expected 1 running worker, got %d", n)
+	}
+
+	distributor.EnqueuePacket(&models.LogPacket{PacketID: "p1", LogMessages: []models.LogMessage{{ID: "msg1"}}})
+	time.Sleep(time.Millisecond * 50)
+	if pool.GetPacketCount("analyzer1") != 1 {
+		t.Errorf("Expected packet to be delivered by the remaining worker, got %d", pool.GetPacketCount("analyzer1"))
+	}
+
+	// With no retries left the failing packet is dropped instead of waiting
+	// for the hour-long backoff it started with
+	distributor.SetRetryPolicy(0, DefaultRetryPolicy(time.Millisecond, 3))
+	if n := distributor.retryWorkers.size(); n != 3 {
+		t.Errorf("Expected 3 retry workers, got %d", n)
+	}
+
+	pool.mutex.Lock()
+	pool.errorOnSend = true
+	pool.mutex.Unlock()
+	distributor.EnqueuePacket(&models.LogPacket{PacketID: "p2", LogMessages: []models.LogMessage{{ID: "msg2"}}})
+	time.Sleep(time.Millisecond * 50)
+
+	if dropped := distributor.GetMetrics().PacketsDropped; dropped != 1 {
+		t.Errorf("Expected 1 packet dropped, got %d", dropped)
+	}
+}
@@ -0,0 +1,110 @@
+package distributor
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+
+	"github.com/ryouol/log-distributor/pkg/analyzer"
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// StrategyConsistentHash routes packets with the same key to the same analyzer
+const StrategyConsistentHash = "consistent_hash"
+
+// HashKeyFunc extracts the routing key from a log packet
+type HashKeyFunc func(packet *models.LogPacket) string
+
+// ParseHashKey returns the key function for a field name. Supported fields are
+// "agent_id", "source" (the first log message's source) and "metadata.<key>"
+// (a packet metadata value).
+func ParseHashKey(field string) (HashKeyFunc, error) {
+	switch {
+	case field == "" || field == "agent_id":
+		return func(p *models.LogPacket) string { return p.AgentID }, nil
+	case field == "source":
+		return func(p *models.LogPacket) string {
+			if len(p.LogMessages) == 0 {
+				return ""
+			}
+			return p.LogMessages[0].Source
+		}, nil
+	case strings.HasPrefix(field, "metadata.") && len(field) > len("metadata."):
+		key := strings.TrimPrefix(field, "metadata.")
+		return func(p *models.LogPacket) string {
+			if v, ok := p.Metadata[key]; ok {
+				return fmt.Sprint(v)
+			}
+			return ""
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown hash key field %q", field)
+	}
+}
+
+// ConsistentHashStrategy uses weighted rendezvous hashing so that every packet
+// with the same key lands on the same analyzer. When an analyzer joins or
+// leaves only the keys it gains or owned move; all other keys stay put.
+type ConsistentHashStrategy struct {
+	key HashKeyFunc
+}
+
+// NewConsistentHashStrategy creates a consistent-hash strategy. A nil key
+// function hashes on AgentID.
+func NewConsistentHashStrategy(key HashKeyFunc) *ConsistentHashStrategy {
+	if key == nil {
+		key, _ = ParseHashKey("agent_id")
+	}
+	return &ConsistentHashStrategy{key: key}
+}
+
+// Name returns the strategy name
+func (s *ConsistentHashStrategy) Name() string {
+	return StrategyConsistentHash
+}
+
+// Select picks the analyzer with the highest weighted score for the packet key
+func (s *ConsistentHashStrategy) Select(analyzers []*analyzer.Analyzer, packet *models.LogPacket) *analyzer.Analyzer {
+	key := s.key(packet)
+	if key == "" {
+		// Packets without a key have no affinity; spread them by ID instead
+		key = packet.PacketID
+	}
+
+	var best *analyzer.Analyzer
+	bestScore := math.Inf(-1)
+	for _, a := range analyzers {
+		score := rendezvousScore(key, a)
+		if best == nil || score > bestScore {
+			best, bestScore = a, score
+		}
+	}
+	return best
+}
+
+// rendezvousScore computes the weighted rendezvous score -w/ln(u), where u is
+// the key/analyzer hash mapped into (0, 1)
+func rendezvousScore(key string, a *analyzer.Analyzer) float64 {
+	if a.Weight <= 0 {
+		return math.Inf(-1)
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(a.ID))
+
+	u := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+	return -a.Weight / math.Log(u)
+}
+
+// mix64 is the splitmix64 finalizer, used to spread FNV output bits
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,115 @@
+package distributor
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ryouol/log-distributor/pkg/analyzer"
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+func assignKeys(strategy Strategy, analyzers []*analyzer.Analyzer, numKeys int) map[string]string {
+	assignment := make(map[string]string, numKeys)
+	for i := 0; i < numKeys; i++ {
+		agentID := fmt.Sprintf("agent-%d", i)
+		packet := &models.LogPacket{PacketID: "test-packet", AgentID: agentID}
+		assignment[agentID] = strategy.Select(analyzers, packet).ID
+	}
+	return assignment
+}
+
+// TestConsistentHashAffinity tests that the same key always maps to the same analyzer
+func TestConsistentHashAffinity(t *testing.T) {
+	strategy := NewConsistentHashStrategy(nil)
+	analyzers := testAnalyzers()
+
+	first := assignKeys(strategy, analyzers, 100)
+	second := assignKeys(strategy, analyzers, 100)
+
+	for key, id := range first {
+		if second[key] != id {
+			t.Errorf("Key '%s' moved from '%s' to '%s' without membership change", key, id, second[key])
+		}
+	}
+}
+
+// TestConsistentHashMinimalMovement tests that membership changes only move the affected keys
+func TestConsistentHashMinimalMovement(t *testing.T) {
+	strategy := NewConsistentHashStrategy(nil)
+	analyzers := []*analyzer.Analyzer{
+		{ID: "analyzer1", Weight: 0.4, Active: true},
+		{ID: "analyzer2", Weight: 0.3, Active: true},
+		{ID: "analyzer3", Weight: 0.2, Active: true},
+		{ID: "analyzer4", Weight: 0.1, Active: true},
+	}
+
+	before := assignKeys(strategy, analyzers, 2000)
+
+	// Removing analyzer2 should only move the keys it owned
+	after := assignKeys(strategy, []*analyzer.Analyzer{analyzers[0], analyzers[2], analyzers[3]}, 2000)
+	for key, id := range before {
+		if id != "analyzer2" && after[key] != id {
+			t.Fatalf("Key '%s' moved from '%s' to '%s' although '%s' is still present", key, id, after[key], id)
+		}
+	}
+
+	// Adding analyzer5 should only move keys onto analyzer5
+	grown := append(analyzers, &analyzer.Analyzer{ID: "analyzer5", Weight: 0.4, Active: true})
+	after = assignKeys(strategy, grown, 2000)
+	for key, id := range before {
+		if after[key] != id && after[key] != "analyzer5" {
+			t.Fatalf("Key '%s' moved from '%s' to '%s' instead of the new analyzer", key, id, after[key])
+		}
+	}
+}
+
+// TestConsistentHashWeights tests that key ownership follows analyzer weights
+func TestConsistentHashWeights(t *testing.T) {
+	strategy := NewConsistentHashStrategy(nil)
+	analyzers := []*analyzer.Analyzer{
+		{ID: "analyzer1", Weight: 0.7, Active: true},
+		{ID: "analyzer2", Weight: 0.3, Active: true},
+	}
+
+	numKeys := 5000
+	count1 := 0
+	for _, id := range assignKeys(strategy, analyzers, numKeys) {
+		if id == "analyzer1" {
+			count1++
+		}
+	}
+
+	expected := int(float64(numKeys) * 0.7)
+	margin := int(float64(numKeys) * 0.05)
+	if count1 < expected-margin || count1 > expected+margin {
+		t.Errorf("Expected analyzer1 to own ~%d keys (±%d), got %d", expected, margin, count1)
+	}
+}
+
+// TestParseHashKey tests the supported hash key fields
+func TestParseHashKey(t *testing.T) {
+	packet := &models.LogPacket{
+		AgentID:     "agent-1",
+		LogMessages: []models.LogMessage{{Source: "payments"}},
+		Metadata:    map[string]interface{}{"tenant": "acme"},
+	}
+
+	tests := map[string]string{
+		"agent_id":        "agent-1",
+		"source":          "payments",
+		"metadata.tenant": "acme",
+	}
+	for field, expected := range tests {
+		key, err := ParseHashKey(field)
+		if err != nil {
+			t.Fatalf("Failed to parse hash key '%s': %v", field, err)
+		}
+		if got := key(packet); got != expected {
+			t.Errorf("Expected key '%s' for field '%s', got '%s'", expected, field, got)
+		}
+	}
+
+	if _, err := ParseHashKey("bogus"); err == nil {
+		t.Error("Expected error for unknown hash key field")
+	}
+}
@@ -0,0 +1,268 @@
+package distributor
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// lane is the index of a priority lane in the work queue, from the least
+// severe level up
+type lane int
+
+// laneLevels names the lanes by the log level they carry
+var laneLevels = [...]models.LogLevel{models.Debug, models.Info, models.Warning, models.Error, models.Fatal}
+
+// numLanes is the number of priority lanes
+const numLanes = len(laneLevels)
+
+// defaultLane carries packets without a known level
+const defaultLane lane = 1
+
+// laneOf returns the lane of a packet: that of its explicit priority if it
+// has one, else that of its most severe log message
+func laneOf(packet *models.LogPacket) lane {
+	if packet.Priority != "" {
+		if l, ok := laneFor(packet.Priority); ok {
+			return l
+		}
+	}
+
+	best, found := lane(0), false
+	for _, msg := range packet.LogMessages {
+		if l, ok := laneFor(msg.Level); ok && (!found || l > best) {
+			best, found = l, true
+		}
+	}
+	if !found {
+		return defaultLane
+	}
+	return best
+}
+
+// laneFor returns the lane carrying a log level
+func laneFor(level models.LogLevel) (lane, bool) {
+	for i, l := range laneLevels {
+		if l == level {
+			return lane(i), true
+		}
+	}
+	return 0, false
+}
+
+// String returns the level a lane carries
+func (l lane) String() string {
+	return string(laneLevels[l])
+}
+
+// LaneConfig controls how the work queue is shared between the priority
+// lanes
+type LaneConfig struct {
+	// Weights sets how many packets of each lane are dequeued, relative to
+	// the others, while packets of several lanes wait. Levels left out have
+	// a weight of 1.
+	Weights map[models.LogLevel]int
+	// ShedAt is the fraction of the queue, between 0 and 1, that may be
+	// filled before packets of a lane are refused, so that less severe
+	// packets are shed first. Levels left out may fill the whole queue.
+	ShedAt map[models.LogLevel]float64
+}
+
+// DefaultLaneConfig favors severe packets 16 to 1 over debug packets, and
+// sheds debug, info and warning packets once the queue is 60%, 80% and 90%
+// full
+func DefaultLaneConfig() LaneConfig {
+	return LaneConfig{
+		Weights: map[models.LogLevel]int{
+			models.Debug:   1,
+			models.Info:    2,
+			models.Warning: 4,
+			models.Error:   8,
+			models.Fatal:   16,
+		},
+		ShedAt: map[models.LogLevel]float64{
+			models.Debug:   0.6,
+			models.Info:    0.8,
+			models.Warning: 0.9,
+		},
+	}
+}
+
+// ParseLaneConfig parses lane weights and shed thresholds given as
+// comma-separated LEVEL=value lists, such as "FATAL=16,ERROR=8"
+func ParseLaneConfig(weights, shedAt string) (LaneConfig, error) {
+	config := LaneConfig{
+		Weights: make(map[models.LogLevel]int),
+		ShedAt:  make(map[models.LogLevel]float64),
+	}
+
+	err := parseLevelList(weights, func(level models.LogLevel, value string) error {
+		weight, err := strconv.Atoi(value)
+		if err != nil || weight <= 0 {
+			return fmt.Errorf("weight %q must be a positive integer", value)
+		}
+		config.Weights[level] = weight
+		return nil
+	})
+	if err != nil {
+		return LaneConfig{}, fmt.Errorf("lane weights: %w", err)
+	}
+
+	err = parseLevelList(shedAt, func(level models.LogLevel, value string) error {
+		fraction, err := strconv.ParseFloat(value, 64)
+		if err != nil || fraction <= 0 || fraction > 1 {
+			return fmt.Errorf("threshold %q must be above 0 and at most 1", value)
+		}
+		config.ShedAt[level] = fraction
+		return nil
+	})
+	if err != nil {
+		return LaneConfig{}, fmt.Errorf("lane shed thresholds: %w", err)
+	}
+	return config, nil
+}
+
+// parseLevelList calls set for every LEVEL=value entry of a comma-separated
+// list
+func parseLevelList(s string, set func(level models.LogLevel, value string) error) error {
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("entry %q must be LEVEL=value", entry)
+		}
+		level := models.LogLevel(strings.ToUpper(strings.TrimSpace(name)))
+		if _, known := laneFor(level); !known {
+			return fmt.Errorf("unknown log level %q", name)
+		}
+		if err := set(level, strings.TrimSpace(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// laneQueue is the work queue: a FIFO per priority lane sharing one
+// capacity, dequeued by smooth weighted round-robin across the lanes that
+// have packets waiting
+type laneQueue struct {
+	lanes    [numLanes]*list.List
+	weights  [numLanes]int
+	current  [numLanes]int
+	limits   [numLanes]int
+	size     int
+	capacity int
+	// readyCh holds at least one token per queued packet; workers take a
+	// token before popping
+	readyCh chan struct{}
+	mutex   sync.Mutex
+}
+
+// newLaneQueue creates a work queue holding at most capacity packets
+func newLaneQueue(capacity int, config LaneConfig) *laneQueue {
+	q := &laneQueue{
+		capacity: capacity,
+		readyCh:  make(chan struct{}, capacity),
+	}
+	for i, level := range laneLevels {
+		q.lanes[i] = list.New()
+		q.weights[i] = 1
+		if weight, ok := config.Weights[level]; ok && weight > 0 {
+			q.weights[i] = weight
+		}
+		q.limits[i] = capacity
+		if fraction, ok := config.ShedAt[level]; ok && fraction > 0 && fraction < 1 {
+			q.limits[i] = int(math.Max(1, math.Floor(fraction*float64(capacity))))
+		}
+	}
+	return q
+}
+
+// push queues a packet in its lane. With shed set, the packet is refused
+// once the queue is filled to its lane's threshold; otherwise only when the
+// queue is full.
+func (q *laneQueue) push(item *queuedPacket, shed bool) bool {
+	q.mutex.Lock()
+	limit := q.capacity
+	if shed {
+		limit = q.limits[item.lane]
+	}
+	if q.size >= limit {
+		q.mutex.Unlock()
+		return false
+	}
+	q.lanes[item.lane].PushBack(item)
+	q.size++
+	q.mutex.Unlock()
+
+	select {
+	case q.readyCh <- struct{}{}:
+	default:
+		// Tokens left over from packets taken without one are enough
+	}
+	return true
+}
+
+// pop takes the next packet, or returns nil if the queue is empty
+func (q *laneQueue) pop() *queuedPacket {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	best, total := -1, 0
+	for i := range q.lanes {
+		if q.lanes[i].Len() == 0 {
+			q.current[i] = 0
+			continue
+		}
+		q.current[i] += q.weights[i]
+		total += q.weights[i]
+		if best < 0 || q.current[i] > q.current[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	q.current[best] -= total
+
+	q.size--
+	return q.lanes[best].Remove(q.lanes[best].Front()).(*queuedPacket)
+}
+
+// Len returns the number of queued packets
+func (q *laneQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.size
+}
+
+// laneLen returns the number of packets queued in a lane
+func (q *laneQueue) laneLen(l lane) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.lanes[l].Len()
+}
+
+// drain removes and returns every queued packet, most severe lanes first
+func (q *laneQueue) drain() []*queuedPacket {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	items := make([]*queuedPacket, 0, q.size)
+	for i := numLanes - 1; i >= 0; i-- {
+		for e := q.lanes[i].Front(); e != nil; e = e.Next() {
+			items = append(items, e.Value.(*queuedPacket))
+		}
+		q.lanes[i].Init()
+	}
+	q.size = 0
+	return items
+}
@@ -0,0 +1,149 @@
+package distributor
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// levelPacket creates a packet with one log message per level
+func levelPacket(id string, levels ...models.LogLevel) *models.LogPacket {
+	packet := &models.LogPacket{PacketID: id}
+	for _, level := range levels {
+		packet.LogMessages = append(packet.LogMessages, models.LogMessage{ID: id, Level: level})
+	}
+	return packet
+}
+
+// TestLaneOf tests that packets go to the lane of their most severe level,
+// unless they name a priority
+func TestLaneOf(t *testing.T) {
+	tests := []struct {
+		packet *models.LogPacket
+		want   models.LogLevel
+	}{
+		{levelPacket("p1", models.Debug, models.Error, models.Info), models.Error},
+		{levelPacket("p2", models.Debug), models.Debug},
+		{levelPacket("p3"), models.Info},
+		{levelPacket("p4", "LOUD"), models.Info},
+		{&models.LogPacket{Priority: models.Fatal, LogMessages: []models.LogMessage{{Level: models.Debug}}}, models.Fatal},
+		{&models.LogPacket{Priority: models.Debug, LogMessages: []models.LogMessage{{Level: models.Fatal}}}, models.Debug},
+	}
+
+	for i, test := range tests {
+		if got := laneOf(test.packet).String(); got != string(test.want) {
+			t.Errorf("Test %d: expected lane %s, got %s", i, test.want, got)
+		}
+	}
+}
+
+// TestLaneQueueWeights tests that lanes are dequeued in proportion to their
+// weights, in FIFO order within a lane
+func TestLaneQueueWeights(t *testing.T) {
+	q := newLaneQueue(100, LaneConfig{Weights: map[models.LogLevel]int{models.Error: 3, models.Info: 1}})
+	for i := 0; i < 8; i++ {
+		q.push(&queuedPacket{packet: &models.LogPacket{PacketID: "info"}, lane: 1}, true)
+		q.push(&queuedPacket{packet: &models.LogPacket{PacketID: "error"}, retries: i, lane: 3}, true)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		counts[q.pop().packet.PacketID]++
+	}
+	if counts["error"] != 6 || counts["info"] != 2 {
+		t.Errorf("Expected 6 error and 2 info packets of the first 8, got %v", counts)
+	}
+
+	// The rest drains once the error lane is empty, oldest first
+	for item := q.pop(); item != nil; item = q.pop() {
+		if item.packet.PacketID == "error" && item.retries != 6 && item.retries != 7 {
+			t.Errorf("Expected the error lane in order, got packet %d", item.retries)
+		}
+		counts[item.packet.PacketID]++
+	}
+	if counts["error"] != 8 || counts["info"] != 8 || q.Len() != 0 {
+		t.Errorf("Expected all 16 packets, got %v with %d left", counts, q.Len())
+	}
+}
+
+// TestEnqueueShedsLowPriority tests that less severe packets are refused
+// first as the queue fills up
+func TestEnqueueShedsLowPriority(t *testing.T) {
+	pool := NewMockAnalyzerPool()
+	distributor := NewLogDistributor(pool, 10, 1, 3, time.Second)
+
+	// Debug packets may only fill 60% of the queue
+	accepted := 0
+	for i := 0; i < 10; i++ {
+		if distributor.Enqueue(levelPacket("debug", models.Debug)) == nil {
+			accepted++
+		}
+	}
+	if accepted != 6 {
+		t.Errorf("Expected 6 debug packets to be accepted, got %d", accepted)
+	}
+
+	// Errors can still use the rest of the queue
+	for i := 0; i < 4; i++ {
+		if err := distributor.Enqueue(levelPacket("error", models.Error)); err != nil {
+			t.Fatalf("Expected error packet %d to be accepted, got %v", i, err)
+		}
+	}
+	if err := distributor.Enqueue(levelPacket("fatal", models.Fatal)); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected a full queue to refuse every lane, got %v", err)
+	}
+
+	metrics := distributor.GetMetrics()
+	if metrics.PacketsShed["DEBUG"] != 4 || metrics.PacketsShed["FATAL"] != 1 {
+		t.Errorf("Expected 4 debug and 1 fatal packets shed, got %v", metrics.PacketsShed)
+	}
+}
+
+// TestDefaultLanesShedUnleveledPackets tests that packets without a level
+// are shed with the INFO lane, leaving room for a FATAL packet, and that a
+// DEBUG packet is shed once the queue is past its threshold
+func TestDefaultLanesShedUnleveledPackets(t *testing.T) {
+	pool := NewMockAnalyzerPool()
+	distributor := NewLogDistributor(pool, 10, 1, 3, time.Second)
+
+	accepted := 0
+	for i := 0; i < 10; i++ {
+		if distributor.Enqueue(levelPacket("no-level")) == nil {
+			accepted++
+		}
+	}
+	if accepted != 8 {
+		t.Errorf("Expected 8 packets without a level to be accepted, got %d", accepted)
+	}
+
+	if err := distributor.Enqueue(levelPacket("fatal", models.Fatal)); err != nil {
+		t.Errorf("Expected the FATAL packet to be accepted, got %v", err)
+	}
+	if err := distributor.Enqueue(levelPacket("debug", models.Debug)); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected the DEBUG packet to be shed, got %v", err)
+	}
+
+	shed := distributor.GetMetrics().PacketsShed
+	if shed["INFO"] != 2 || shed["DEBUG"] != 1 || shed["FATAL"] != 0 {
+		t.Errorf("Expected 2 info and 1 debug packets shed, got %v", shed)
+	}
+}
+
+// TestParseLaneConfig tests parsing lane weights and shed thresholds
+func TestParseLaneConfig(t *testing.T) {
+	config, err := ParseLaneConfig("error=8, FATAL=16", "DEBUG=0.5")
+	if err != nil {
+		t.Fatalf("Failed to parse lane config: %v", err)
+	}
+	if config.Weights[models.Error] != 8 || config.Weights[models.Fatal] != 16 || config.ShedAt[models.Debug] != 0.5 {
+		t.Errorf("Expected the parsed weights and thresholds, got %+v", config)
+	}
+
+	for _, test := range [][2]string{{"LOUD=1", ""}, {"ERROR=0", ""}, {"ERROR", ""}, {"", "INFO=1.5"}} {
+		if _, err := ParseLaneConfig(test[0], test[1]); err == nil {
+			t.Errorf("Expected %q, %q to be rejected", test[0], test[1])
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package distributor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/analyzer"
+	"github.com/ryouol/log-distributor/pkg/deadletter"
+)
+
+// AckMode sets how many replicas of a packet analyzers must accept before
+// the packet counts as delivered
+type AckMode string
+
+// Ack modes
+const (
+	AckOne    AckMode = "one"
+	AckQuorum AckMode = "quorum"
+	AckAll    AckMode = "all"
+)
+
+var errNoReplicaAnalyzer = errors.New("no analyzer left for replica")
+
+// ParseAckMode checks an ack mode name. An empty name is AckOne.
+func ParseAckMode(name string) (AckMode, error) {
+	switch mode := AckMode(name); mode {
+	case "":
+		return AckOne, nil
+	case AckOne, AckQuorum, AckAll:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown ack mode %q (want %s, %s or %s)", name, AckOne, AckQuorum, AckAll)
+	}
+}
+
+// required returns how many of n replicas must be accepted
+func (m AckMode) required(n int) int {
+	switch m {
+	case AckAll:
+		return n
+	case AckQuorum:
+		return n/2 + 1
+	default:
+		return 1
+	}
+}
+
+// replicaSet tracks the copies of a replicated packet until every one of
+// them was accepted or given up on
+type replicaSet struct {
+	// origin is the packet as it was queued, holding its write-ahead log
+	// entry
+	origin   *queuedPacket
+	replicas []*replica
+	required int
+	// owners maps each analyzer to the replica sent to it, so that no two
+	// replicas go to the same analyzer
+	owners    map[string]*replica
+	acked     int
+	failed    int
+	settled   bool
+	delivered bool
+	mutex     sync.Mutex
+}
+
+// replica is one copy of a replicated packet. Partial deliveries may split
+// it into pieces; it is accepted once every piece is, and fails if any piece
+// is dropped.
+type replica struct {
+	set     *replicaSet
+	pending int
+	failed  bool
+}
+
+// replicaOutcome is what settling a piece of a replica decided
+type replicaOutcome struct {
+	// settled is set when the replica is, failed when it was given up on
+	settled bool
+	failed  bool
+	// delivered or dropped is set when the packet reached its outcome
+	delivered bool
+	dropped   bool
+	// finished is set when every replica is settled, underReplicated if the
+	// packet was delivered with fewer replicas than asked for
+	finished        bool
+	underReplicated bool
+}
+
+// newReplicaSet creates the replicas of a queued packet
+func newReplicaSet(origin *queuedPacket, replicas int, ack AckMode) *replicaSet {
+	s := &replicaSet{
+		origin:   origin,
+		replicas: make([]*replica, replicas),
+		required: ack.required(replicas),
+		owners:   make(map[string]*replica, replicas),
+	}
+	for i := range s.replicas {
+		s.replicas[i] = &replica{set: s, pending: 1}
+	}
+	return s
+}
+
+// pick selects an analyzer for a replica among those no other replica of the
+// packet went to, or returns nil if there is none
+func (s *replicaSet) pick(analyzers []*analyzer.Analyzer, item *queuedPacket, strategy Strategy) *analyzer.Analyzer {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	candidates := make([]*analyzer.Analyzer, 0, len(analyzers))
+	for _, a := range withoutExcluded(analyzers, item.excluded) {
+		if owner, ok := s.owners[a.ID]; !ok || owner == item.replica {
+			candidates = append(candidates, a)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	selected := strategy.Select(candidates, item.packet)
+	s.owners[selected.ID] = item.replica
+	return selected
+}
+
+// forget frees an analyzer a replica failed to reach for the other replicas
+func (s *replicaSet) forget(analyzerID string, r *replica) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.owners[analyzerID] == r {
+		delete(s.owners, analyzerID)
+	}
+}
+
+// split records that a replica gained a piece to deliver
+func (s *replicaSet) split(r *replica) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	r.pending++
+}
+
+// settle records that a piece of a replica was delivered or given up on
+func (s *replicaSet) settle(r *replica, failed bool) replicaOutcome {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var out replicaOutcome
+	r.pending--
+	r.failed = r.failed || failed
+	if r.pending > 0 {
+		return out
+	}
+
+	out.settled, out.failed = true, r.failed
+	if r.failed {
+		s.failed++
+	} else {
+		s.acked++
+	}
+
+	if !s.settled {
+		switch {
+		case s.acked >= s.required:
+			s.settled, s.delivered = true, true
+			out.delivered = true
+		case len(s.replicas)-s.failed < s.required:
+			s.settled = true
+			out.dropped = true
+		}
+	}
+
+	if s.acked+s.failed == len(s.replicas) {
+		out.finished = true
+		out.underReplicated = s.delivered && s.failed > 0
+	}
+	return out
+}
+
+// isSettled reports whether the packet was delivered or dropped
+func (s *replicaSet) isSettled() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.settled
+}
+
+// fanOut makes the first delivery attempt of a replicated packet, sending
+// its replicas to distinct analyzers at once. Replicas left without an
+// analyzer are retried like a failed send; after that every replica is
+// retried on its own.
+func (d *LogDistributor) fanOut(ctx context.Context, item *queuedPacket, analyzers []*analyzer.Analyzer, replicas int, ack AckMode) {
+	set := newReplicaSet(item, replicas, ack)
+
+	d.metrics.mutex.Lock()
+	d.metrics.ReplicatedPackets++
+	d.metrics.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, r := range set.replicas {
+		next := &queuedPacket{
+			packet:      item.packet,
+			retries:     item.retries,
+			reschedules: item.reschedules,
+			enqueuedAt:  item.enqueuedAt,
+			lane:        item.lane,
+			replica:     r,
+		}
+
+		selected := set.pick(analyzers, next, d.strategy)
+		if selected == nil {
+			d.retryOrDrop(next, "", errNoReplicaAnalyzer, 0)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.deliver(ctx, next, selected)
+		}()
+	}
+	wg.Wait()
+}
+
+// settleReplica records that a piece of a replica was accepted, or given up
+// on with cause. The packet counts as delivered once enough replicas were
+// accepted, and as dropped once too many failed for that; it leaves the
+// write-ahead log when every replica is settled.
+func (d *LogDistributor) settleReplica(item *queuedPacket, analyzerID string, cause error) {
+	set := item.replica.set
+	out := set.settle(item.replica, cause != nil)
+
+	d.metrics.mutex.Lock()
+	switch {
+	case out.settled && out.failed:
+		d.metrics.ReplicasFailed++
+	case out.settled:
+		d.metrics.ReplicasDelivered++
+	}
+	if out.delivered {
+		d.metrics.TotalPacketsSent++
+	}
+	if out.dropped {
+		d.metrics.PacketsDropped++
+	}
+	if out.underReplicated {
+		d.metrics.UnderReplicatedPackets++
+	}
+	d.metrics.mutex.Unlock()
+
+	if out.delivered {
+		d.deliveryLatency.Observe(time.Since(set.origin.enqueuedAt).Seconds())
+	}
+	if out.dropped && d.deadLetters != nil {
+		d.deadLetters.Add(deadletter.Entry{
+			Packet:     set.origin.packet,
+			Error:      fmt.Sprintf("too few replicas delivered: %v", cause),
+			AnalyzerID: analyzerID,
+			Attempts:   item.retries,
+		})
+	}
+	if out.finished {
+		d.release(set.origin)
+	}
+}
+
+// collapseReplicas replaces the replicas among queued packets with the
+// packets they are copies of, once each. Packets whose replicas already
+// settled their outcome are returned apart, in settled, as they must not be
+// delivered again.
+func collapseReplicas(items []*queuedPacket) (pending, settled []*queuedPacket) {
+	pending = make([]*queuedPacket, 0, len(items))
+	seen := make(map[*replicaSet]bool)
+	for _, item := range items {
+		if item.replica == nil {
+			pending = append(pending, item)
+			continue
+		}
+		set := item.replica.set
+		if seen[set] {
+			continue
+		}
+		seen[set] = true
+		if set.isSettled() {
+			settled = append(settled, set.origin)
+		} else {
+			pending = append(pending, set.origin)
+		}
+	}
+	return pending, settled
+}
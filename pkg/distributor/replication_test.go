@@ -0,0 +1,203 @@
+package distributor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/analyzer"
+	"github.com/ryouol/log-distributor/pkg/deadletter"
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// TestReplicatedFanOut tests that each packet reaches as many distinct
+// analyzers as it has replicas
+func TestReplicatedFanOut(t *testing.T) {
+	pool := NewMockAnalyzerPool()
+	pool.AddAnalyzer("analyzer1", 1.0)
+	pool.AddAnalyzer("analyzer2", 1.0)
+	pool.AddAnalyzer("analyzer3", 1.0)
+
+	distributor := NewLogDistributor(pool, 100, 2, 3, time.Millisecond*10, WithReplication(2, AckAll))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	distributor.Start(ctx)
+	defer distributor.Stop()
+
+	for i := 0; i < 10; i++ {
+		distributor.Enqueue(&models.LogPacket{PacketID: fmt.Sprintf("p%d", i), LogMessages: []models.LogMessage{{ID: "msg1"}}})
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	pool.mutex.Lock()
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("p%d", i)
+		analyzers := make(map[string]bool)
+		for analyzerID, packets := range pool.sentPackets {
+			for _, p := range packets {
+				if p.PacketID == id {
+					analyzers[analyzerID] = true
+				}
+			}
+		}
+		if len(analyzers) != 2 {
+			t.Errorf("Expected packet %s at 2 distinct analyzers, got %v", id, analyzers)
+		}
+	}
+	pool.mutex.Unlock()
+
+	metrics := distributor.GetMetrics()
+	if metrics.ReplicatedPackets != 10 || metrics.ReplicasDelivered != 20 || metrics.TotalPacketsSent != 10 {
+		t.Errorf("Expected 10 packets sent as 20 replicas, got %d packets, %d replicas and %d sent",
+			metrics.ReplicatedPackets, metrics.ReplicasDelivered, metrics.TotalPacketsSent)
+	}
+}
+
+// TestReplicaRetriedIndependently tests that a failed replica is retried on
+// its own, without sending the packet to the analyzers that accepted it again
+func TestReplicaRetriedIndependently(t *testing.T) {
+	pool := NewMockAnalyzerPool()
+	pool.AddAnalyzer("analyzer1", 1.0)
+	pool.AddAnalyzer("analyzer2", 1.0)
+	pool.AddAnalyzer("analyzer3", 1.0)
+
+	failures := 0
+	pool.sendHook = func(a *analyzer.Analyzer, p *models.LogPacket) error {
+		if a.ID == "analyzer3" && failures < 2 {
+			failures++
+			return errors.New("simulated send error")
+		}
+		return nil
+	}
+
+	distributor := NewLogDistributor(pool, 100, 1, 3, time.Millisecond*10, WithReplication(3, AckAll))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	distributor.Start(ctx)
+	defer distributor.Stop()
+
+	distributor.Enqueue(&models.LogPacket{PacketID: "p1", LogMessages: []models.LogMessage{{ID: "msg1"}}})
+	time.Sleep(time.Millisecond * 200)
+
+	for _, id := range []string{"analyzer1", "analyzer2", "analyzer3"} {
+		if n := pool.GetPacketCount(id); n != 1 {
+			t.Errorf("Expected 1 packet at %s, got %d", id, n)
+		}
+	}
+
+	metrics := distributor.GetMetrics()
+	if metrics.TotalPacketsSent != 1 || metrics.ReplicasDelivered != 3 || metrics.ReplicasFailed != 0 {
+		t.Errorf("Expected 1 packet sent as 3 replicas, got %d sent, %d replicas and %d failed",
+			metrics.TotalPacketsSent, metrics.ReplicasDelivered, metrics.ReplicasFailed)
+	}
+}
+
+// TestReplicationAckModes tests when a packet with a failing replica counts
+// as delivered
+func TestReplicationAckModes(t *testing.T) {
+	tests := []struct {
+		ack       AckMode
+		delivered bool
+	}{
+		{AckOne, true},
+		{AckQuorum, false},
+		{AckAll, false},
+	}
+
+	for _, test := range tests {
+		pool := NewMockAnalyzerPool()
+		pool.AddAnalyzer("analyzer1", 1.0)
+		pool.AddAnalyzer("analyzer2", 1.0)
+		pool.sendHook = func(a *analyzer.Analyzer, p *models.LogPacket) error {
+			if a.ID == "analyzer2" {
+				return errors.New("simulated send error")
+			}
+			return nil
+		}
+
+		store := deadletter.NewStore(10)
+		distributor := NewLogDistributor(pool, 100, 1, 1, time.Millisecond*10,
+			WithReplication(2, test.ack), WithDeadLetters(store))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		distributor.Start(ctx)
+
+		distributor.Enqueue(&models.LogPacket{PacketID: "p1", LogMessages: []models.LogMessage{{ID: "msg1"}}})
+		time.Sleep(time.Millisecond * 100)
+
+		distributor.Stop()
+		cancel()
+
+		metrics := distributor.GetMetrics()
+		if metrics.ReplicasDelivered != 1 || metrics.ReplicasFailed != 1 {
+			t.Errorf("%s: expected 1 replica delivered and 1 failed, got %d and %d",
+				test.ack, metrics.ReplicasDelivered, metrics.ReplicasFailed)
+		}
+		if test.delivered {
+			if metrics.TotalPacketsSent != 1 || metrics.UnderReplicatedPackets != 1 || store.Len() != 0 {
+				t.Errorf("%s: expected an under-replicated delivery, got %d sent, %d under-replicated and %d dead letters",
+					test.ack, metrics.TotalPacketsSent, metrics.UnderReplicatedPackets, store.Len())
+			}
+		} else {
+			if metrics.PacketsDropped != 1 || metrics.TotalPacketsSent != 0 || store.Len() != 1 {
+				t.Errorf("%s: expected the packet to be dropped, got %d dropped, %d sent and %d dead letters",
+					test.ack, metrics.PacketsDropped, metrics.TotalPacketsSent, store.Len())
+			}
+		}
+	}
+}
+
+// TestRouteReplicas tests that routing rules set the replicas of the packets
+// they match
+func TestRouteReplicas(t *testing.T) {
+	pool := NewMockAnalyzerPool()
+	pool.AddAnalyzer("analyzer1", 1.0)
+	pool.AddAnalyzer("analyzer2", 1.0)
+
+	router := NewRouter("")
+	router.SetRules([]Rule{{Name: "audit", Group: DefaultGroup, Source: "audit", Replicas: 2}})
+	distributor := NewLogDistributor(pool, 100, 1, 3, time.Millisecond*10, WithRouter(router))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	distributor.Start(ctx)
+	defer distributor.Stop()
+
+	distributor.Enqueue(&models.LogPacket{PacketID: "audit", LogMessages: []models.LogMessage{{ID: "msg1", Source: "audit"}}})
+	distributor.Enqueue(&models.LogPacket{PacketID: "web", LogMessages: []models.LogMessage{{ID: "msg1", Source: "web"}}})
+	time.Sleep(time.Millisecond * 50)
+
+	if n := pool.GetPacketCount("analyzer1") + pool.GetPacketCount("analyzer2"); n != 3 {
+		t.Errorf("Expected 2 replicas of the audit packet and 1 web packet, got %d sends", n)
+	}
+	if metrics := distributor.GetMetrics(); metrics.ReplicatedPackets != 1 {
+		t.Errorf("Expected 1 replicated packet, got %d", metrics.ReplicatedPackets)
+	}
+
+	if err := router.SetRules([]Rule{{Name: "bad", Group: "g", Ack: "most"}}); err == nil {
+		t.Error("Expected an unknown ack mode to be rejected")
+	}
+}
+
+// TestAckModeRequired tests how many replicas each ack mode needs
+func TestAckModeRequired(t *testing.T) {
+	tests := []struct {
+		ack      AckMode
+		replicas int
+		want     int
+	}{
+		{AckOne, 3, 1},
+		{AckQuorum, 3, 2},
+		{AckQuorum, 4, 3},
+		{AckAll, 3, 3},
+	}
+	for _, test := range tests {
+		if got := test.ack.required(test.replicas); got != test.want {
+			t.Errorf("Expected %s of %d to need %d, got %d", test.ack, test.replicas, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package distributor
+
+import (
+	"container/heap"
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryPolicy controls how failed packets are retried
+type RetryPolicy struct {
+	// BaseDelay is the delay before the first retry
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between retries
+	MaxDelay time.Duration
+	// Multiplier grows the delay after every attempt
+	Multiplier float64
+	// Jitter is the fraction of each delay, between 0 and 1, that is
+	// randomized away so that packets failing together do not retry together
+	Jitter float64
+	// Workers is the number of goroutines delivering due retries
+	Workers int
+}
+
+// DefaultRetryPolicy returns a doubling backoff starting at baseDelay
+func DefaultRetryPolicy(baseDelay time.Duration, workers int) RetryPolicy {
+	return RetryPolicy{
+		BaseDelay:  baseDelay,
+		MaxDelay:   30 * baseDelay,
+		Multiplier: 2,
+		Jitter:     0.2,
+		Workers:    workers,
+	}
+}
+
+// Delay returns the backoff before the given retry attempt, starting at 1
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	delay := float64(p.BaseDelay) * math.Pow(p.Multiplier, float64(attempt-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		delay -= delay * math.Min(p.Jitter, 1) * rand.Float64()
+	}
+	return time.Duration(delay)
+}
+
+// normalized fills in defaults for unset fields
+func (p RetryPolicy) normalized() RetryPolicy {
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = time.Second
+	}
+	if p.MaxDelay < p.BaseDelay {
+		p.MaxDelay = p.BaseDelay
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 1
+	}
+	if p.Jitter < 0 {
+		p.Jitter = 0
+	}
+	if p.Workers <= 0 {
+		p.Workers = 1
+	}
+	return p
+}
+
+// scheduledRetry is a packet waiting in the retry heap
+type scheduledRetry struct {
+	item *queuedPacket
+	due  time.Time
+}
+
+// retryHeap orders scheduled retries by due time
+type retryHeap []scheduledRetry
+
+func (h retryHeap) Len() int            { return len(h) }
+func (h retryHeap) Less(i, j int) bool  { return h[i].due.Before(h[j].due) }
+func (h retryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *retryHeap) Push(x interface{}) { *h = append(*h, x.(scheduledRetry)) }
+func (h *retryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = scheduledRetry{}
+	*h = old[:n-1]
+	return item
+}
+
+// retryScheduler holds failed packets until their backoff expires and hands
+// them to the retry workers in due order
+type retryScheduler struct {
+	items    retryHeap
+	capacity int
+	wakeCh   chan struct{}
+	readyCh  chan *queuedPacket
+	mutex    sync.Mutex
+}
+
+// newRetryScheduler creates a scheduler holding at most capacity packets
+func newRetryScheduler(capacity int) *retryScheduler {
+	return &retryScheduler{
+		items:    make(retryHeap, 0),
+		capacity: capacity,
+		wakeCh:   make(chan struct{}, 1),
+		readyCh:  make(chan *queuedPacket),
+	}
+}
+
+// Schedule queues a packet to be retried after delay. It returns false if
+// the scheduler is full.
+func (s *retryScheduler) Schedule(item *queuedPacket, delay time.Duration) bool {
+	s.mutex.Lock()
+	if len(s.items) >= s.capacity {
+		s.mutex.Unlock()
+		return false
+	}
+	due := time.Now().Add(delay)
+	heap.Push(&s.items, scheduledRetry{item: item, due: due})
+	earliest := s.items[0].due.Equal(due)
+	s.mutex.Unlock()
+
+	// Wake the dispatcher if this packet is now the next one due
+	if earliest {
+		select {
+		case s.wakeCh <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// Len returns the number of packets waiting to be retried
+func (s *retryScheduler) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.items)
+}
+
+// drain removes and returns every packet waiting to be retried
+func (s *retryScheduler) drain() []*queuedPacket {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	items := make([]*queuedPacket, 0, len(s.items))
+	for _, r := range s.items {
+		items = append(items, r.item)
+	}
+	s.items = s.items[:0]
+	return items
+}
+
+// requeue puts a packet that was popped but never handed out back in front
+func (s *retryScheduler) requeue(item *queuedPacket) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	heap.Push(&s.items, scheduledRetry{item: item, due: time.Now()})
+}
+
+// dispatch moves due packets to the ready channel until stopped
+func (s *retryScheduler) dispatch(ctx context.Context, shutdownCh <-chan struct{}) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		s.mutex.Lock()
+		var wait time.Duration = -1
+		var next *queuedPacket
+		if len(s.items) > 0 {
+			if d := time.Until(s.items[0].due); d > 0 {
+				wait = d
+			} else {
+				next = heap.Pop(&s.items).(scheduledRetry).item
+			}
+		}
+		s.mutex.Unlock()
+
+		if next != nil {
+			select {
+			case <-shutdownCh:
+				s.requeue(next)
+				return
+			case <-ctx.Done():
+				s.requeue(next)
+				return
+			case s.readyCh <- next:
+			}
+			continue
+		}
+
+		var timerCh <-chan time.Time
+		if wait >= 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+			timerCh = timer.C
+		}
+
+		select {
+		case <-shutdownCh:
+			return
+		case <-ctx.Done():
+			return
+		case <-s.wakeCh:
+		case <-timerCh:
+		}
+	}
+}
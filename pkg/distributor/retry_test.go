@@ -0,0 +1,107 @@
+package distributor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// TestRetryPolicyDelay tests exponential growth, capping and jitter bounds
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{
+		BaseDelay:  100 * time.Millisecond,
+		MaxDelay:   time.Second,
+		Multiplier: 2,
+	}
+
+	expected := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for i, want := range expected {
+		if got := policy.Delay(i + 1); got != want {
+			t.Errorf("Attempt %d: expected delay %v, got %v", i+1, want, got)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay := policy.Delay(3)
+		if delay < 200*time.Millisecond || delay > 400*time.Millisecond {
+			t.Fatalf("Expected jittered delay within [200ms, 400ms], got %v", delay)
+		}
+	}
+}
+
+// TestRetrySchedulerOrder tests that packets come out in due order, not insertion order
+func TestRetrySchedulerOrder(t *testing.T) {
+	scheduler := newRetryScheduler(10)
+	shutdownCh := make(chan struct{})
+	defer close(shutdownCh)
+
+	late := &queuedPacket{packet: &models.LogPacket{PacketID: "late"}}
+	early := &queuedPacket{packet: &models.LogPacket{PacketID: "early"}}
+	scheduler.Schedule(late, 40*time.Millisecond)
+	scheduler.Schedule(early, 10*time.Millisecond)
+
+	go scheduler.dispatch(context.Background(), shutdownCh)
+
+	start := time.Now()
+	first := <-scheduler.readyCh
+	second := <-scheduler.readyCh
+
+	if first.packet.PacketID != "early" || second.packet.PacketID != "late" {
+		t.Errorf("Expected 'early' then 'late', got '%s' then '%s'", first.packet.PacketID, second.packet.PacketID)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected late packet to wait its full delay, got %v", elapsed)
+	}
+}
+
+// TestRetrySchedulerCapacity tests that a full scheduler rejects packets
+func TestRetrySchedulerCapacity(t *testing.T) {
+	scheduler := newRetryScheduler(2)
+
+	for i := 0; i < 2; i++ {
+		if !scheduler.Schedule(&queuedPacket{packet: &models.LogPacket{}}, time.Second) {
+			t.Fatalf("Expected packet %d to be scheduled", i)
+		}
+	}
+	if scheduler.Schedule(&queuedPacket{packet: &models.LogPacket{}}, time.Second) {
+		t.Error("Expected full scheduler to reject packet")
+	}
+	if scheduler.Len() != 2 {
+		t.Errorf("Expected 2 scheduled packets, got %d", scheduler.Len())
+	}
+}
+
+// TestRetryThroughput tests that many failed packets are retried concurrently
+func TestRetryThroughput(t *testing.T) {
+	pool := NewMockAnalyzerPool()
+	distributor := NewLogDistributor(pool, 1000, 10, 1, time.Millisecond*20)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	distributor.Start(ctx)
+	defer distributor.Stop()
+
+	// With no analyzers every packet fails once, then succeeds on retry
+	for i := 0; i < 200; i++ {
+		distributor.EnqueuePacket(&models.LogPacket{PacketID: "test-packet", AgentID: "test-agent"})
+	}
+	time.Sleep(time.Millisecond * 5)
+	pool.AddAnalyzer("analyzer1", 1.0)
+
+	time.Sleep(time.Millisecond * 100)
+
+	if count := pool.GetPacketCount("analyzer1"); count != 200 {
+		t.Errorf("Expected all 200 packets to be delivered on retry, got %d", count)
+	}
+}
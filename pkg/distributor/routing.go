@@ -0,0 +1,233 @@
+package distributor
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+
+	"github.com/ryouol/log-distributor/pkg/analyzer"
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// DefaultGroup is the analyzer group of packets no rule matches, unless the
+// router is given another
+const DefaultGroup = "default"
+
+var (
+	// ErrRuleNotFound is returned for an unknown routing rule name
+	ErrRuleNotFound = errors.New("routing rule not found")
+
+	errNoGroupAnalyzers = errors.New("no active analyzers in group")
+)
+
+// Rule sends the packets it matches to an analyzer group. Conditions are
+// glob patterns as in path.Match and all of them must hold: AgentID for the
+// packet, and Source, Level and Metadata for at least one of its log
+// messages. Metadata keys are looked up in the message's metadata, then in
+// the packet's. A rule without conditions matches every packet. Replicas
+// and Ack, when set, replace the distributor's replication settings for the
+// packets the rule matches.
+type Rule struct {
+	Name     string            `json:"name"`
+	Group    string            `json:"group"`
+	AgentID  string            `json:"agent_id,omitempty"`
+	Source   string            `json:"source,omitempty"`
+	Level    string            `json:"level,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Replicas int               `json:"replicas,omitempty"`
+	Ack      AckMode           `json:"ack,omitempty"`
+}
+
+// Validate checks that a rule is named, has a group and holds valid patterns
+// and replication settings
+func (r Rule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("rule name must be set")
+	}
+	if r.Group == "" {
+		return fmt.Errorf("rule %q: group must be set", r.Name)
+	}
+	if r.Replicas < 0 {
+		return fmt.Errorf("rule %q: replicas must not be negative", r.Name)
+	}
+	if _, err := ParseAckMode(string(r.Ack)); err != nil {
+		return fmt.Errorf("rule %q: %w", r.Name, err)
+	}
+
+	patterns := []string{r.AgentID, r.Source, r.Level}
+	for _, pattern := range r.Metadata {
+		patterns = append(patterns, pattern)
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("rule %q: invalid pattern %q: %w", r.Name, pattern, err)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the rule matches a packet
+func (r Rule) matches(packet *models.LogPacket) bool {
+	if !match(r.AgentID, packet.AgentID) {
+		return false
+	}
+	if r.Source == "" && r.Level == "" && len(r.Metadata) == 0 {
+		return true
+	}
+
+	for _, msg := range packet.LogMessages {
+		if r.matchesMessage(packet, &msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesMessage reports whether a log message meets the message conditions
+func (r Rule) matchesMessage(packet *models.LogPacket, msg *models.LogMessage) bool {
+	if !match(r.Source, msg.Source) || !match(r.Level, string(msg.Level)) {
+		return false
+	}
+	for key, pattern := range r.Metadata {
+		value, ok := msg.Metadata[key]
+		if !ok {
+			value, ok = packet.Metadata[key]
+		}
+		if !ok || !match(pattern, fmt.Sprint(value)) {
+			return false
+		}
+	}
+	return true
+}
+
+// match reports whether value matches a pattern; an empty pattern matches
+// anything
+func match(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, value)
+	return ok
+}
+
+// Router picks the analyzer group of each packet from an ordered list of
+// rules. The first matching rule wins; packets no rule matches go to the
+// default group, which also holds analyzers without a group.
+type Router struct {
+	defaultGroup string
+	rules        []Rule
+	mutex        sync.RWMutex
+}
+
+// NewRouter creates a router without rules, sending every packet to
+// defaultGroup, or to DefaultGroup if it is empty
+func NewRouter(defaultGroup string) *Router {
+	if defaultGroup == "" {
+		defaultGroup = DefaultGroup
+	}
+	return &Router{defaultGroup: defaultGroup}
+}
+
+// DefaultGroup returns the group of packets no rule matches
+func (r *Router) DefaultGroup() string {
+	return r.defaultGroup
+}
+
+// Rules returns the rules in the order they are evaluated
+func (r *Router) Rules() []Rule {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return append([]Rule(nil), r.rules...)
+}
+
+// SetRules replaces every rule. Nothing is changed if a rule is invalid or
+// two share a name.
+func (r *Router) SetRules(rules []Rule) error {
+	seen := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+		if seen[rule.Name] {
+			return fmt.Errorf("rule %q is duplicated", rule.Name)
+		}
+		seen[rule.Name] = true
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.rules = append([]Rule(nil), rules...)
+	return nil
+}
+
+// PutRule replaces the rule with the same name in place, or appends it as
+// the last rule. It reports whether the rule is new.
+func (r *Router) PutRule(rule Rule) (bool, error) {
+	if err := rule.Validate(); err != nil {
+		return false, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for i := range r.rules {
+		if r.rules[i].Name == rule.Name {
+			r.rules[i] = rule
+			return false, nil
+		}
+	}
+	r.rules = append(r.rules, rule)
+	return true, nil
+}
+
+// RemoveRule removes the named rule. It returns ErrRuleNotFound if there is
+// none.
+func (r *Router) RemoveRule(name string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for i := range r.rules {
+		if r.rules[i].Name == name {
+			r.rules = append(r.rules[:i], r.rules[i+1:]...)
+			return nil
+		}
+	}
+	return ErrRuleNotFound
+}
+
+// Route returns the group of the first rule matching a packet, or the
+// default group
+func (r *Router) Route(packet *models.LogPacket) string {
+	group, _ := r.match(packet)
+	return group
+}
+
+// match returns the group of a packet and the rule that picked it, or nil
+// for the default group
+func (r *Router) match(packet *models.LogPacket) (string, *Rule) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, rule := range r.rules {
+		if rule.matches(packet) {
+			return rule.Group, &rule
+		}
+	}
+	return r.defaultGroup, nil
+}
+
+// members returns the analyzers in a group
+func (r *Router) members(analyzers []*analyzer.Analyzer, group string) []*analyzer.Analyzer {
+	result := make([]*analyzer.Analyzer, 0, len(analyzers))
+	for _, a := range analyzers {
+		g := a.Group
+		if g == "" {
+			g = r.defaultGroup
+		}
+		if g == group {
+			result = append(result, a)
+		}
+	}
+	return result
+}
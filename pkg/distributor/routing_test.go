@@ -0,0 +1,114 @@
+package distributor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/analyzer"
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// TestRoute tests that the first matching rule picks the group
+func TestRoute(t *testing.T) {
+	router := NewRouter("")
+	err := router.SetRules([]Rule{
+		{Name: "security", Group: "siem", Source: "auth*", Level: "ERROR"},
+		{Name: "payments", Group: "fraud", Metadata: map[string]string{"team": "payments"}},
+		{Name: "edge", Group: "edge", AgentID: "edge-?"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to set rules: %v", err)
+	}
+
+	tests := []struct {
+		packet *models.LogPacket
+		want   string
+	}{
+		// Source and level must hold for the same message
+		{&models.LogPacket{LogMessages: []models.LogMessage{{Source: "authd", Level: models.Error}}}, "siem"},
+		{&models.LogPacket{LogMessages: []models.LogMessage{{Source: "authd", Level: models.Info}, {Source: "web", Level: models.Error}}}, DefaultGroup},
+		// Metadata is looked up in the message, then the packet
+		{&models.LogPacket{LogMessages: []models.LogMessage{{Metadata: map[string]interface{}{"team": "payments"}}}}, "fraud"},
+		{&models.LogPacket{Metadata: map[string]interface{}{"team": "payments"}, LogMessages: []models.LogMessage{{}}}, "fraud"},
+		{&models.LogPacket{AgentID: "edge-1"}, "edge"},
+		{&models.LogPacket{AgentID: "edge-10"}, DefaultGroup},
+	}
+	for i, test := range tests {
+		if got := router.Route(test.packet); got != test.want {
+			t.Errorf("Test %d: expected group %s, got %s", i, test.want, got)
+		}
+	}
+}
+
+// TestRouterRules tests adding, replacing and removing rules
+func TestRouterRules(t *testing.T) {
+	router := NewRouter("general")
+
+	if err := router.SetRules([]Rule{{Name: "a", Group: "g"}, {Name: "a", Group: "h"}}); err == nil {
+		t.Error("Expected duplicated names to be rejected")
+	}
+	if _, err := router.PutRule(Rule{Name: "bad", Group: "g", Source: "[a"}); err == nil {
+		t.Error("Expected an invalid pattern to be rejected")
+	}
+
+	router.PutRule(Rule{Name: "first", Group: "one", AgentID: "a1"})
+	router.PutRule(Rule{Name: "second", Group: "two"})
+	if created, _ := router.PutRule(Rule{Name: "first", Group: "three", AgentID: "a1"}); created {
+		t.Error("Expected the first rule to be replaced")
+	}
+
+	rules := router.Rules()
+	if len(rules) != 2 || rules[0].Name != "first" || rules[0].Group != "three" {
+		t.Errorf("Expected the replaced rule to keep its place, got %+v", rules)
+	}
+
+	if err := router.RemoveRule("second"); err != nil {
+		t.Errorf("Failed to remove rule: %v", err)
+	}
+	if err := router.RemoveRule("second"); err != ErrRuleNotFound {
+		t.Errorf("Expected ErrRuleNotFound, got %v", err)
+	}
+	if group := router.Route(&models.LogPacket{AgentID: "a2"}); group != "general" {
+		t.Errorf("Expected the default group, got %s", group)
+	}
+}
+
+// TestRoutedDistribution tests that packets only reach analyzers in their
+// group, and that analyzers without a group are in the default group
+func TestRoutedDistribution(t *testing.T) {
+	pool := NewMockAnalyzerPool()
+	pool.AddAnalyzer("general", 1)
+	pool.activeAnalyzers = append(pool.activeAnalyzers,
+		&analyzer.Analyzer{ID: "siem1", Weight: 1, Active: true, Group: "siem"},
+		&analyzer.Analyzer{ID: "siem2", Weight: 1, Active: true, Group: "siem"},
+	)
+
+	router := NewRouter("")
+	router.SetRules([]Rule{{Name: "security", Group: "siem", Source: "auth"}, {Name: "payments", Group: "fraud", Source: "billing"}})
+	distributor := NewLogDistributor(pool, 100, 2, 0, time.Second, WithRouter(router))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	distributor.Start(ctx)
+	defer distributor.Stop()
+
+	for i := 0; i < 10; i++ {
+		distributor.Enqueue(&models.LogPacket{LogMessages: []models.LogMessage{{Source: "auth"}}})
+		distributor.Enqueue(&models.LogPacket{LogMessages: []models.LogMessage{{Source: "web"}}})
+	}
+	// The fraud group has no analyzers, so its packet is dropped
+	distributor.Enqueue(&models.LogPacket{LogMessages: []models.LogMessage{{Source: "billing"}}})
+
+	time.Sleep(100 * time.Millisecond)
+
+	if n := pool.GetPacketCount("siem1") + pool.GetPacketCount("siem2"); n != 10 {
+		t.Errorf("Expected 10 packets in the siem group, got %d", n)
+	}
+	if n := pool.GetPacketCount("general"); n != 10 {
+		t.Errorf("Expected 10 packets in the default group, got %d", n)
+	}
+	if metrics := distributor.GetMetrics(); metrics.PacketsDropped != 1 {
+		t.Errorf("Expected the fraud packet to be dropped, got %d drops", metrics.PacketsDropped)
+	}
+}
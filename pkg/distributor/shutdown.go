@@ -0,0 +1,155 @@
+package distributor
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/deadletter"
+)
+
+// drainPollInterval is how often Shutdown checks whether the backlog is empty
+const drainPollInterval = 10 * time.Millisecond
+
+// Spill destinations reported by Shutdown
+const (
+	SpillNone        = ""
+	SpillWAL         = "write-ahead log"
+	SpillDeadLetters = "dead-letter store"
+)
+
+// ShutdownReport tells what happened to the packets that were queued when
+// the distributor shut down
+type ShutdownReport struct {
+	// Flushed packets were delivered while draining
+	Flushed int64
+	// Dropped packets ran out of retries while draining
+	Dropped int64
+	// Spilled packets were still queued at the deadline and were kept in
+	// SpilledTo to be delivered later
+	Spilled   int
+	SpilledTo string
+	// Lost packets were still queued at the deadline with nowhere to keep them
+	Lost int
+}
+
+// Shutdown stops accepting packets and keeps delivering the work and retry
+// queues until they are empty or ctx is done. Packets still queued then are
+// spilled to the write-ahead log, where they are replayed on the next start,
+// or to the dead-letter store if there is no log. Retries keep their backoff,
+// so retries due after the deadline are spilled.
+func (d *LogDistributor) Shutdown(ctx context.Context) ShutdownReport {
+	var report ShutdownReport
+	d.stopOnce.Do(func() {
+		report = d.shutdown(ctx)
+	})
+	return report
+}
+
+// shutdown drains and stops the distributor once
+func (d *LogDistributor) shutdown(ctx context.Context) ShutdownReport {
+	before := d.GetMetrics()
+	close(d.closingCh)
+
+	if d.running() {
+		ticker := time.NewTicker(drainPollInterval)
+		defer ticker.Stop()
+	drain:
+		for !d.idle() {
+			select {
+			case <-ctx.Done():
+				break drain
+			case <-ticker.C:
+			}
+		}
+	}
+
+	d.settingsMutex.Lock()
+	close(d.shutdownCh)
+	d.settingsMutex.Unlock()
+	d.workerWg.Wait()
+
+	after := d.GetMetrics()
+	report := ShutdownReport{
+		Flushed: after.TotalPacketsSent - before.TotalPacketsSent + after.PartialDeliveries - before.PartialDeliveries,
+		Dropped: after.PacketsDropped - before.PacketsDropped,
+	}
+	d.spill(&report)
+
+	// Anything still queued stays in the log and is replayed on next start
+	if d.wal != nil {
+		if err := d.wal.Close(); err != nil {
+			log.Printf("Error closing write-ahead log: %v\n", err)
+		}
+	}
+	return report
+}
+
+// running reports whether Start has been called
+func (d *LogDistributor) running() bool {
+	d.settingsMutex.RLock()
+	defer d.settingsMutex.RUnlock()
+	return d.workers != nil
+}
+
+// idle reports whether no packets are queued, waiting for a retry or being
+// sent
+func (d *LogDistributor) idle() bool {
+	return d.workQueue.Len() == 0 && d.retryQueue.Len() == 0 && d.processing.Load() == 0
+}
+
+// closing reports whether the distributor stopped accepting packets
+func (d *LogDistributor) closing() bool {
+	select {
+	case <-d.closingCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// spill keeps the packets left in the work and retry queues after the
+// workers stopped
+func (d *LogDistributor) spill(report *ShutdownReport) {
+	// Replicas are kept as the packet they are copies of, unless enough of
+	// them were accepted or failed already; the other replicas are given up
+	leftover, settled := collapseReplicas(append(d.retryQueue.drain(), d.workQueue.drain()...))
+	for _, item := range settled {
+		d.release(item)
+	}
+	if len(leftover) == 0 {
+		return
+	}
+
+	switch {
+	case d.wal != nil:
+		// Persisted packets are left unacknowledged and replayed on restart;
+		// remainders that failed to persist are lost
+		report.SpilledTo = SpillWAL
+		for _, item := range leftover {
+			if item.walSeq != 0 {
+				report.Spilled++
+			} else {
+				report.Lost++
+			}
+		}
+	case d.deadLetters != nil:
+		report.SpilledTo = SpillDeadLetters
+		for _, item := range leftover {
+			d.deadLetters.Add(deadletter.Entry{
+				Packet:   item.packet,
+				Error:    "distributor shut down before delivery",
+				Attempts: item.retries,
+			})
+			report.Spilled++
+		}
+	default:
+		report.Lost = len(leftover)
+	}
+
+	if report.Lost > 0 {
+		d.metrics.mutex.Lock()
+		d.metrics.PacketsDropped += int64(report.Lost)
+		d.metrics.mutex.Unlock()
+	}
+}
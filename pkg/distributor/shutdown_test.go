@@ -0,0 +1,157 @@
+package distributor
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/analyzer"
+	"github.com/ryouol/log-distributor/pkg/deadletter"
+	"github.com/ryouol/log-distributor/pkg/models"
+	"github.com/ryouol/log-distributor/pkg/wal"
+)
+
+// TestShutdownFlushesBacklog tests that queued packets are delivered before
+// the distributor stops
+func TestShutdownFlushesBacklog(t *testing.T) {
+	pool := NewMockAnalyzerPool()
+	pool.AddAnalyzer("analyzer1", 1.0)
+	pool.sendHook = func(a *analyzer.Analyzer, p *models.LogPacket) error {
+		time.Sleep(time.Millisecond * 2)
+		return nil
+	}
+
+	distributor := NewLogDistributor(pool, 100, 1, 3, time.Millisecond*10)
+	for i := 0; i < 20; i++ {
+		if !distributor.EnqueuePacket(&models.LogPacket{PacketID: "test-packet", AgentID: "test-agent"}) {
+			t.Fatal("Failed to enqueue packet")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	distributor.Start(ctx)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer shutdownCancel()
+	report := distributor.Shutdown(shutdownCtx)
+
+	if report.Flushed != 20 || report.Spilled != 0 || report.Lost != 0 {
+		t.Errorf("Expected 20 flushed packets, got %+v", report)
+	}
+	if count := pool.GetPacketCount("analyzer1"); count != 20 {
+		t.Errorf("Expected 20 delivered packets, got %d", count)
+	}
+	if distributor.EnqueuePacket(&models.LogPacket{PacketID: "late-packet"}) {
+		t.Error("Expected packets to be refused after shutdown")
+	}
+}
+
+// TestShutdownSpillsToDeadLetters tests that packets still waiting at the
+// deadline are kept in the dead-letter store
+func TestShutdownSpillsToDeadLetters(t *testing.T) {
+	pool := NewMockAnalyzerPool()
+	pool.AddAnalyzer("analyzer1", 1.0)
+	pool.errorOnSend = true
+
+	store := deadletter.NewStore(10)
+	distributor := NewLogDistributor(pool, 100, 2, 3, time.Hour, WithDeadLetters(store))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	distributor.Start(ctx)
+
+	for i := 0; i < 5; i++ {
+		distributor.EnqueuePacket(&models.LogPacket{PacketID: "test-packet", AgentID: "test-agent"})
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer shutdownCancel()
+	report := distributor.Shutdown(shutdownCtx)
+
+	if report.Spilled != 5 || report.SpilledTo != SpillDeadLetters || report.Flushed != 0 {
+		t.Errorf("Expected 5 packets spilled to dead letters, got %+v", report)
+	}
+	if store.Len() != 5 {
+		t.Errorf("Expected 5 dead letters, got %d", store.Len())
+	}
+
+	// A second shutdown does nothing
+	if again := distributor.Shutdown(context.Background()); again != (ShutdownReport{}) {
+		t.Errorf("Expected an empty report from a second shutdown, got %+v", again)
+	}
+}
+
+// TestShutdownSpillsReplicatedPackets tests that a replicated packet is
+// spilled once if it was not delivered yet, and not at all if enough of its
+// replicas were accepted
+func TestShutdownSpillsReplicatedPackets(t *testing.T) {
+	for _, spillTo := range []string{SpillDeadLetters, SpillWAL} {
+		t.Run(spillTo, func(t *testing.T) {
+			pool := NewMockAnalyzerPool()
+			pool.AddAnalyzer("analyzer1", 1.0)
+			pool.AddAnalyzer("analyzer2", 1.0)
+			pool.sendHook = func(a *analyzer.Analyzer, p *models.LogPacket) error {
+				if a.ID == "analyzer2" || p.PacketID == "stuck" {
+					return errors.New("simulated send error")
+				}
+				return nil
+			}
+
+			store := deadletter.NewStore(10)
+			opts := []Option{WithReplication(2, AckOne), WithDeadLetters(store)}
+			dir := t.TempDir()
+			if spillTo == SpillWAL {
+				log, err := wal.Open(dir, wal.Options{SyncInterval: time.Millisecond})
+				if err != nil {
+					t.Fatalf("Failed to open wal: %v", err)
+				}
+				opts = append(opts, WithWAL(log))
+			}
+			distributor := NewLogDistributor(pool, 100, 2, 3, time.Hour, opts...)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			distributor.Start(ctx)
+
+			// Both replicas of "stuck" wait for a retry; "delivered" waits
+			// only for the replica analyzer2 refused
+			distributor.EnqueuePacket(&models.LogPacket{PacketID: "delivered", AgentID: "test-agent"})
+			distributor.EnqueuePacket(&models.LogPacket{PacketID: "stuck", AgentID: "test-agent"})
+			time.Sleep(time.Millisecond * 50)
+
+			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+			defer shutdownCancel()
+			report := distributor.Shutdown(shutdownCtx)
+
+			if report.Spilled != 1 || report.SpilledTo != spillTo || report.Lost != 0 {
+				t.Errorf("Expected 1 packet spilled to the %s, got %+v", spillTo, report)
+			}
+			if count := pool.GetPacketCount("analyzer1"); count != 1 {
+				t.Errorf("Expected 1 packet delivered to analyzer1, got %d", count)
+			}
+
+			var spilled []string
+			if spillTo == SpillWAL {
+				reopened, err := wal.Open(dir, wal.Options{SyncInterval: time.Millisecond})
+				if err != nil {
+					t.Fatalf("Failed to reopen wal: %v", err)
+				}
+				defer reopened.Close()
+				for _, entry := range reopened.Pending() {
+					spilled = append(spilled, string(entry.Data))
+				}
+			} else {
+				for _, entry := range store.List(0) {
+					spilled = append(spilled, entry.Packet.PacketID)
+				}
+			}
+			if len(spilled) != 1 || !strings.Contains(spilled[0], "stuck") {
+				t.Errorf("Expected only the stuck packet to be kept, got %v", spilled)
+			}
+		})
+	}
+}
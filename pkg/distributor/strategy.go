@@ -0,0 +1,297 @@
+package distributor
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ryouol/log-distributor/pkg/analyzer"
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// Strategy names accepted by NewStrategy
+const (
+	StrategyWeightedRandom     = "weighted_random"
+	StrategyWeightedRoundRobin = "weighted_round_robin"
+	StrategyLeastOutstanding   = "least_outstanding"
+	StrategyPowerOfTwo         = "power_of_two"
+)
+
+// Strategy selects the analyzer a log packet is sent to
+type Strategy interface {
+	// Name returns the name the strategy is registered under
+	Name() string
+	// Select picks one of the given analyzers for the packet. The slice is
+	// never empty.
+	Select(analyzers []*analyzer.Analyzer, packet *models.LogPacket) *analyzer.Analyzer
+}
+
+// RequestTracker is implemented by strategies that need to know when a send
+// to an analyzer starts and finishes
+type RequestTracker interface {
+	Begin(analyzerID string)
+	Done(analyzerID string)
+}
+
+// NewStrategy creates a strategy by name
+func NewStrategy(name string) (Strategy, error) {
+	switch name {
+	case "", StrategyWeightedRandom:
+		return NewWeightedRandomStrategy(), nil
+	case StrategyWeightedRoundRobin:
+		return NewWeightedRoundRobinStrategy(), nil
+	case StrategyLeastOutstanding:
+		return NewLeastOutstandingStrategy(), nil
+	case StrategyPowerOfTwo:
+		return NewPowerOfTwoStrategy(), nil
+	case StrategyConsistentHash:
+		return NewConsistentHashStrategy(nil), nil
+	default:
+		return nil, fmt.Errorf("unknown distribution strategy %q", name)
+	}
+}
+
+// WeightedRandomStrategy picks an analyzer at random with probability
+// proportional to its weight
+type WeightedRandomStrategy struct{}
+
+// NewWeightedRandomStrategy creates a weighted random strategy
+func NewWeightedRandomStrategy() *WeightedRandomStrategy {
+	return &WeightedRandomStrategy{}
+}
+
+// Name returns the strategy name
+func (s *WeightedRandomStrategy) Name() string {
+	return StrategyWeightedRandom
+}
+
+// Select picks an analyzer randomly based on weights
+func (s *WeightedRandomStrategy) Select(analyzers []*analyzer.Analyzer, packet *models.LogPacket) *analyzer.Analyzer {
+	return selectWeightedRandom(analyzers)
+}
+
+// selectWeightedRandom selects an analyzer randomly based on weights
+func selectWeightedRandom(analyzers []*analyzer.Analyzer) *analyzer.Analyzer {
+	if len(analyzers) == 1 {
+		return analyzers[0]
+	}
+
+	// Calculate total weight of active analyzers
+	totalWeight := 0.0
+	for _, a := range analyzers {
+		totalWeight += a.Weight
+	}
+
+	// Generate random value between 0 and total weight
+	r := rand.Float64() * totalWeight
+
+	// Find the analyzer that corresponds to this random value
+	currentWeight := 0.0
+	for _, a := range analyzers {
+		currentWeight += a.Weight
+		if r <= currentWeight {
+			return a
+		}
+	}
+
+	// Fallback to first analyzer (should never happen unless weights are 0)
+	return analyzers[0]
+}
+
+// maxRoundRobinSets is the most candidate sets whose round-robin state is
+// kept; the least recently used one is forgotten beyond it
+const maxRoundRobinSets = 64
+
+// WeightedRoundRobinStrategy implements nginx-style smooth weighted
+// round-robin, which interleaves analyzers evenly instead of sending bursts
+// to the heaviest one. Each set of candidates, such as an analyzer group or
+// the pool without excluded analyzers, keeps its own rotation so that
+// selecting among one set does not disturb the others.
+type WeightedRoundRobinStrategy struct {
+	sets  map[string]*roundRobinSet
+	calls uint64
+	mutex sync.Mutex
+}
+
+// roundRobinSet is the rotation among one set of candidates
+type roundRobinSet struct {
+	current  map[string]float64
+	lastUsed uint64
+}
+
+// NewWeightedRoundRobinStrategy creates a smooth weighted round-robin strategy
+func NewWeightedRoundRobinStrategy() *WeightedRoundRobinStrategy {
+	return &WeightedRoundRobinStrategy{
+		sets: make(map[string]*roundRobinSet),
+	}
+}
+
+// set returns the rotation of a set of candidates, starting a fresh one for
+// a set not seen before. The caller must hold the mutex.
+func (s *WeightedRoundRobinStrategy) set(analyzers []*analyzer.Analyzer) *roundRobinSet {
+	ids := make([]string, len(analyzers))
+	for i, a := range analyzers {
+		ids[i] = a.ID
+	}
+	sort.Strings(ids)
+	key := strings.Join(ids, "\x00")
+
+	s.calls++
+	set, ok := s.sets[key]
+	if !ok {
+		if len(s.sets) >= maxRoundRobinSets {
+			s.forgetLeastRecent()
+		}
+		set = &roundRobinSet{current: make(map[string]float64, len(analyzers))}
+		s.sets[key] = set
+	}
+	set.lastUsed = s.calls
+	return set
+}
+
+// forgetLeastRecent drops the rotation used longest ago. The caller must
+// hold the mutex.
+func (s *WeightedRoundRobinStrategy) forgetLeastRecent() {
+	oldest := ""
+	for key, set := range s.sets {
+		if oldest == "" || set.lastUsed < s.sets[oldest].lastUsed {
+			oldest = key
+		}
+	}
+	delete(s.sets, oldest)
+}
+
+// Name returns the strategy name
+func (s *WeightedRoundRobinStrategy) Name() string {
+	return StrategyWeightedRoundRobin
+}
+
+// Select picks the analyzer with the highest current weight
+func (s *WeightedRoundRobinStrategy) Select(analyzers []*analyzer.Analyzer, packet *models.LogPacket) *analyzer.Analyzer {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Analyzers that leave a set change its key, so they start fresh if
+	// they return
+	current := s.set(analyzers).current
+	var best *analyzer.Analyzer
+	totalWeight := 0.0
+	for _, a := range analyzers {
+		current[a.ID] += a.Weight
+		totalWeight += a.Weight
+		if best == nil || current[a.ID] > current[best.ID] {
+			best = a
+		}
+	}
+	current[best.ID] -= totalWeight
+
+	return best
+}
+
+// outstandingRequests counts in-flight sends per analyzer
+type outstandingRequests struct {
+	counts map[string]int
+	mutex  sync.Mutex
+}
+
+// Begin records the start of a send to an analyzer
+func (o *outstandingRequests) Begin(analyzerID string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.counts[analyzerID]++
+}
+
+// Done records the end of a send to an analyzer
+func (o *outstandingRequests) Done(analyzerID string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.counts[analyzerID] <= 1 {
+		delete(o.counts, analyzerID)
+		return
+	}
+	o.counts[analyzerID]--
+}
+
+// load returns the in-flight count of an analyzer relative to its weight.
+// The caller must hold the mutex.
+func (o *outstandingRequests) load(a *analyzer.Analyzer) float64 {
+	if a.Weight <= 0 {
+		return float64(o.counts[a.ID] + 1)
+	}
+	return float64(o.counts[a.ID]+1) / a.Weight
+}
+
+// LeastOutstandingStrategy picks the analyzer with the fewest in-flight sends
+// relative to its weight
+type LeastOutstandingStrategy struct {
+	outstandingRequests
+}
+
+// NewLeastOutstandingStrategy creates a least-outstanding-requests strategy
+func NewLeastOutstandingStrategy() *LeastOutstandingStrategy {
+	return &LeastOutstandingStrategy{
+		outstandingRequests: outstandingRequests{counts: make(map[string]int)},
+	}
+}
+
+// Name returns the strategy name
+func (s *LeastOutstandingStrategy) Name() string {
+	return StrategyLeastOutstanding
+}
+
+// Select picks the least loaded analyzer, breaking ties by weight
+func (s *LeastOutstandingStrategy) Select(analyzers []*analyzer.Analyzer, packet *models.LogPacket) *analyzer.Analyzer {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	best := analyzers[0]
+	bestLoad := s.load(best)
+	for _, a := range analyzers[1:] {
+		load := s.load(a)
+		if load < bestLoad || (load == bestLoad && a.Weight > best.Weight) {
+			best, bestLoad = a, load
+		}
+	}
+	return best
+}
+
+// PowerOfTwoStrategy samples two analyzers by weight and picks the one with
+// fewer in-flight sends relative to its weight
+type PowerOfTwoStrategy struct {
+	outstandingRequests
+}
+
+// NewPowerOfTwoStrategy creates a power-of-two-choices strategy
+func NewPowerOfTwoStrategy() *PowerOfTwoStrategy {
+	return &PowerOfTwoStrategy{
+		outstandingRequests: outstandingRequests{counts: make(map[string]int)},
+	}
+}
+
+// Name returns the strategy name
+func (s *PowerOfTwoStrategy) Name() string {
+	return StrategyPowerOfTwo
+}
+
+// Select picks the less loaded of two weighted random candidates
+func (s *PowerOfTwoStrategy) Select(analyzers []*analyzer.Analyzer, packet *models.LogPacket) *analyzer.Analyzer {
+	if len(analyzers) == 1 {
+		return analyzers[0]
+	}
+
+	first := selectWeightedRandom(analyzers)
+	second := selectWeightedRandom(analyzers)
+	for i := 0; second == first && i < 3; i++ {
+		second = selectWeightedRandom(analyzers)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.load(second) < s.load(first) {
+		return second
+	}
+	return first
+}
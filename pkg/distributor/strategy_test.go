@@ -0,0 +1,138 @@
+package distributor
+
+import (
+	"testing"
+
+	"github.com/ryouol/log-distributor/pkg/analyzer"
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+func testAnalyzers() []*analyzer.Analyzer {
+	return []*analyzer.Analyzer{
+		{ID: "analyzer1", Weight: 5, Active: true},
+		{ID: "analyzer2", Weight: 1, Active: true},
+		{ID: "analyzer3", Weight: 1, Active: true},
+	}
+}
+
+// TestNewStrategy tests creating strategies by name
+func TestNewStrategy(t *testing.T) {
+	names := []string{
+		StrategyWeightedRandom,
+		StrategyWeightedRoundRobin,
+		StrategyLeastOutstanding,
+		StrategyPowerOfTwo,
+	}
+
+	for _, name := range names {
+		strategy, err := NewStrategy(name)
+		if err != nil {
+			t.Fatalf("Failed to create strategy %s: %v", name, err)
+		}
+		if strategy.Name() != name {
+			t.Errorf("Expected strategy name '%s', got '%s'", name, strategy.Name())
+		}
+	}
+
+	if _, err := NewStrategy("unknown"); err == nil {
+		t.Error("Expected error for unknown strategy")
+	}
+}
+
+// TestWeightedRoundRobinSequence tests the smooth weighted round-robin order
+func TestWeightedRoundRobinSequence(t *testing.T) {
+	strategy := NewWeightedRoundRobinStrategy()
+	analyzers := testAnalyzers()
+	packet := &models.LogPacket{PacketID: "test-packet"}
+
+	// nginx reference sequence for weights {5, 1, 1}
+	expected := []string{
+		"analyzer1", "analyzer1", "analyzer2", "analyzer1",
+		"analyzer3", "analyzer1", "analyzer1",
+	}
+
+	for round := 0; round < 3; round++ {
+		for i, id := range expected {
+			selected := strategy.Select(analyzers, packet)
+			if selected.ID != id {
+				t.Fatalf("Round %d pick %d: expected '%s', got '%s'", round, i, id, selected.ID)
+			}
+		}
+	}
+}
+
+// TestWeightedRoundRobinGroups tests that selecting from disjoint groups in
+// turn keeps the weight ratio within each group
+func TestWeightedRoundRobinGroups(t *testing.T) {
+	strategy := NewWeightedRoundRobinStrategy()
+	groupA := []*analyzer.Analyzer{
+		{ID: "a1", Weight: 3, Active: true},
+		{ID: "a2", Weight: 1, Active: true},
+	}
+	groupB := []*analyzer.Analyzer{
+		{ID: "b1", Weight: 1, Active: true},
+		{ID: "b2", Weight: 2, Active: true},
+	}
+	packet := &models.LogPacket{PacketID: "test-packet"}
+
+	counts := make(map[string]int)
+	for i := 0; i < 120; i++ {
+		counts[strategy.Select(groupA, packet).ID]++
+		counts[strategy.Select(groupB, packet).ID]++
+	}
+
+	if counts["a1"] != 90 || counts["a2"] != 30 {
+		t.Errorf("Expected a 3:1 split in group A, got %d and %d", counts["a1"], counts["a2"])
+	}
+	if counts["b1"] != 40 || counts["b2"] != 80 {
+		t.Errorf("Expected a 1:2 split in group B, got %d and %d", counts["b1"], counts["b2"])
+	}
+}
+
+// TestLeastOutstandingSelection tests that in-flight sends steer selection
+func TestLeastOutstandingSelection(t *testing.T) {
+	strategy := NewLeastOutstandingStrategy()
+	analyzers := []*analyzer.Analyzer{
+		{ID: "analyzer1", Weight: 1, Active: true},
+		{ID: "analyzer2", Weight: 1, Active: true},
+	}
+	packet := &models.LogPacket{PacketID: "test-packet"}
+
+	strategy.Begin("analyzer1")
+	if selected := strategy.Select(analyzers, packet); selected.ID != "analyzer2" {
+		t.Errorf("Expected 'analyzer2' while analyzer1 is busy, got '%s'", selected.ID)
+	}
+
+	strategy.Begin("analyzer2")
+	strategy.Begin("analyzer2")
+	strategy.Done("analyzer1")
+	if selected := strategy.Select(analyzers, packet); selected.ID != "analyzer1" {
+		t.Errorf("Expected 'analyzer1' after it finished, got '%s'", selected.ID)
+	}
+}
+
+// TestPowerOfTwoAvoidsBusyAnalyzer tests that the busier candidate loses
+func TestPowerOfTwoAvoidsBusyAnalyzer(t *testing.T) {
+	strategy := NewPowerOfTwoStrategy()
+	analyzers := []*analyzer.Analyzer{
+		{ID: "analyzer1", Weight: 1, Active: true},
+		{ID: "analyzer2", Weight: 1, Active: true},
+	}
+	packet := &models.LogPacket{PacketID: "test-packet"}
+
+	for i := 0; i < 10; i++ {
+		strategy.Begin("analyzer1")
+	}
+
+	busy := 0
+	for i := 0; i < 100; i++ {
+		if strategy.Select(analyzers, packet).ID == "analyzer1" {
+			busy++
+		}
+	}
+
+	// analyzer1 only wins when it is drawn twice in a row
+	if busy > 10 {
+		t.Errorf("Expected busy analyzer to be picked rarely, got %d/100", busy)
+	}
+}
@@ -0,0 +1,49 @@
+package distributor
+
+import "sync"
+
+// workerSet is a group of goroutines running the same loop that can be grown
+// or shrunk while running
+type workerSet struct {
+	run   func(stop <-chan struct{})
+	wg    *sync.WaitGroup
+	stops []chan struct{}
+	mutex sync.Mutex
+}
+
+// newWorkerSet creates an empty set whose goroutines are tracked by wg
+func newWorkerSet(wg *sync.WaitGroup, run func(stop <-chan struct{})) *workerSet {
+	return &workerSet{
+		run: run,
+		wg:  wg,
+	}
+}
+
+// resize starts or stops goroutines until n are running. Stopped goroutines
+// finish the packet they are working on first.
+func (s *workerSet) resize(n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for len(s.stops) < n {
+		stop := make(chan struct{})
+		s.stops = append(s.stops, stop)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.run(stop)
+		}()
+	}
+	for len(s.stops) > n {
+		last := len(s.stops) - 1
+		close(s.stops[last])
+		s.stops = s.stops[:last]
+	}
+}
+
+// size returns the number of running goroutines
+func (s *workerSet) size() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.stops)
+}
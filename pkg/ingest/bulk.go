@@ -0,0 +1,170 @@
+// Package ingest turns the bodies agents send into log packets
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ryouol/log-distributor/pkg/distributor"
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+const (
+	// DefaultGroupSize is how many bare log messages are grouped into one
+	// packet unless BulkOptions says otherwise
+	DefaultGroupSize = 100
+	// MaxLineSize is the longest NDJSON line accepted
+	MaxLineSize = 1 << 20
+	// maxLineErrors caps how many line errors a BulkResult lists
+	maxLineErrors = 1000
+)
+
+// EnqueueFunc hands a packet on for delivery, returning an error if it
+// cannot be taken
+type EnqueueFunc func(packet *models.LogPacket) error
+
+// BulkOptions configures how an NDJSON body is read
+type BulkOptions struct {
+	// AgentID is set on packets built from bare log messages
+	AgentID string
+	// GroupSize is the most bare log messages put into one packet
+	GroupSize int
+}
+
+// LineError reports why a line was not accepted
+type LineError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// BulkResult summarizes an NDJSON body line by line
+type BulkResult struct {
+	// Lines counts the non-empty lines read
+	Lines int `json:"lines"`
+	// Accepted counts the lines whose packet was enqueued
+	Accepted int `json:"accepted"`
+	// Packets and Messages count what was enqueued
+	Packets  int `json:"packets"`
+	Messages int `json:"messages"`
+	// Duplicates counts accepted packets that had already been received
+	Duplicates int `json:"duplicates,omitempty"`
+	// Errors lists the lines that were not accepted, up to a limit
+	Errors    []LineError `json:"errors,omitempty"`
+	Truncated bool        `json:"errors_truncated,omitempty"`
+}
+
+// fail records an error for the given lines
+func (r *BulkResult) fail(lines []int, err error) {
+	for _, line := range lines {
+		if len(r.Errors) >= maxLineErrors {
+			r.Truncated = true
+			return
+		}
+		r.Errors = append(r.Errors, LineError{Line: line, Error: err.Error()})
+	}
+}
+
+// lineKind tells packets from bare log messages
+type lineKind struct {
+	LogMessages json.RawMessage `json:"log_messages"`
+}
+
+// ReadBulk reads newline-delimited JSON holding log packets or bare log
+// messages and enqueues a packet per packet line. Consecutive bare messages
+// are grouped into packets of up to GroupSize messages. The body is read one
+// line at a time, so only the current group is held in memory. An error is
+// returned if the body cannot be read to the end; the result then covers the
+// lines read so far.
+func ReadBulk(r io.Reader, opts BulkOptions, enqueue EnqueueFunc) (*BulkResult, error) {
+	if opts.GroupSize <= 0 {
+		opts.GroupSize = DefaultGroupSize
+	}
+
+	result := &BulkResult{}
+	group := &models.LogPacket{AgentID: opts.AgentID}
+	groupLines := make([]int, 0, opts.GroupSize)
+
+	submit := func(packet *models.LogPacket, lines []int) {
+		packet.ReceivedAt = time.Now()
+		err := enqueue(packet)
+		if errors.Is(err, distributor.ErrDuplicate) {
+			result.Accepted += len(lines)
+			result.Duplicates++
+			return
+		}
+		if err != nil {
+			result.fail(lines, err)
+			return
+		}
+		result.Accepted += len(lines)
+		result.Packets++
+		result.Messages += len(packet.LogMessages)
+	}
+	flushGroup := func() {
+		if len(group.LogMessages) == 0 {
+			return
+		}
+		group.PacketID = uuid.New().String()
+		group.SentAt = time.Now()
+		submit(group, groupLines)
+		group = &models.LogPacket{AgentID: opts.AgentID}
+		groupLines = make([]int, 0, opts.GroupSize)
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), MaxLineSize)
+
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		result.Lines++
+
+		var kind lineKind
+		if err := json.Unmarshal(line, &kind); err != nil {
+			result.fail([]int{lineNumber}, fmt.Errorf("invalid JSON: %w", err))
+			continue
+		}
+
+		if kind.LogMessages != nil {
+			var packet models.LogPacket
+			if err := json.Unmarshal(line, &packet); err != nil {
+				result.fail([]int{lineNumber}, fmt.Errorf("invalid log packet: %w", err))
+				continue
+			}
+			// Keep the order of the body: earlier bare messages go first
+			flushGroup()
+			submit(&packet, []int{lineNumber})
+			continue
+		}
+
+		var msg models.LogMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			result.fail([]int{lineNumber}, fmt.Errorf("invalid log message: %w", err))
+			continue
+		}
+		group.LogMessages = append(group.LogMessages, msg)
+		groupLines = append(groupLines, lineNumber)
+		if len(group.LogMessages) >= opts.GroupSize {
+			flushGroup()
+		}
+	}
+	flushGroup()
+
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			err = fmt.Errorf("line %d is longer than %d bytes", lineNumber+1, MaxLineSize)
+		}
+		return result, err
+	}
+	return result, nil
+}
@@ -0,0 +1,120 @@
+package ingest
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ryouol/log-distributor/pkg/distributor"
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// TestReadBulk tests that packet lines are kept and bare messages are
+// grouped around them in order
+func TestReadBulk(t *testing.T) {
+	body := strings.Join([]string{
+		`{"id": "m1", "level": "INFO", "message": "one"}`,
+		`{"id": "m2", "level": "INFO", "message": "two"}`,
+		`{"id": "m3", "level": "INFO", "message": "three"}`,
+		``,
+		`{"packet_id": "p1", "agent_id": "agent2", "log_messages": [{"id": "m4"}, {"id": "m5"}]}`,
+		`not json`,
+		`{"id": "m6", "level": "ERROR", "message": "six"}`,
+	}, "\n")
+
+	var packets []*models.LogPacket
+	result, err := ReadBulk(strings.NewReader(body), BulkOptions{AgentID: "agent1", GroupSize: 2}, func(p *models.LogPacket) error {
+		packets = append(packets, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected the body to be read, got %v", err)
+	}
+
+	if result.Lines != 6 || result.Accepted != 5 || result.Packets != 4 || result.Messages != 6 {
+		t.Errorf("Expected 6 lines, 5 accepted, 4 packets and 6 messages, got %+v", result)
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Line != 6 {
+		t.Errorf("Expected an error on line 6, got %+v", result.Errors)
+	}
+
+	expected := []struct {
+		agent    string
+		messages int
+	}{{"agent1", 2}, {"agent1", 1}, {"agent2", 2}, {"agent1", 1}}
+	if len(packets) != len(expected) {
+		t.Fatalf("Expected %d packets, got %d", len(expected), len(packets))
+	}
+	for i, e := range expected {
+		if packets[i].AgentID != e.agent || len(packets[i].LogMessages) != e.messages {
+			t.Errorf("Expected packet %d from %s with %d messages, got %+v", i, e.agent, e.messages, packets[i])
+		}
+		if packets[i].PacketID == "" || packets[i].ReceivedAt.IsZero() {
+			t.Errorf("Expected packet %d to have an ID and receive time, got %+v", i, packets[i])
+		}
+	}
+	if packets[2].PacketID != "p1" {
+		t.Errorf("Expected the packet line to keep its ID, got %s", packets[2].PacketID)
+	}
+}
+
+// TestReadBulkEnqueueFailure tests that every line of a refused group is
+// reported
+func TestReadBulkEnqueueFailure(t *testing.T) {
+	body := `{"id": "m1"}` + "\n" + `{"id": "m2"}` + "\n"
+
+	result, err := ReadBulk(strings.NewReader(body), BulkOptions{}, func(p *models.LogPacket) error {
+		return errors.New("queue is full")
+	})
+	if err != nil {
+		t.Fatalf("Expected the body to be read, got %v", err)
+	}
+
+	if result.Accepted != 0 || len(result.Errors) != 2 {
+		t.Fatalf("Expected both lines to fail, got %+v", result)
+	}
+	if result.Errors[0].Line != 1 || result.Errors[1].Line != 2 || result.Errors[0].Error != "queue is full" {
+		t.Errorf("Expected errors for lines 1 and 2, got %+v", result.Errors)
+	}
+}
+
+// TestReadBulkDuplicate tests that a packet already received counts as
+// accepted but not as enqueued
+func TestReadBulkDuplicate(t *testing.T) {
+	body := `{"packet_id": "p1", "log_messages": [{"id": "m1"}]}` + "\n" +
+		`{"packet_id": "p1", "log_messages": [{"id": "m1"}]}` + "\n"
+
+	seen := make(map[string]bool)
+	result, err := ReadBulk(strings.NewReader(body), BulkOptions{}, func(p *models.LogPacket) error {
+		if seen[p.PacketID] {
+			return distributor.ErrDuplicate
+		}
+		seen[p.PacketID] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected the body to be read, got %v", err)
+	}
+
+	if result.Accepted != 2 || result.Packets != 1 || result.Duplicates != 1 || len(result.Errors) != 0 {
+		t.Errorf("Expected 2 accepted lines and 1 duplicate, got %+v", result)
+	}
+}
+
+// TestReadBulkLineTooLong tests that reading stops at an oversized line and
+// the lines before it are kept
+func TestReadBulkLineTooLong(t *testing.T) {
+	body := `{"id": "m1"}` + "\n" + `{"message": "` + strings.Repeat("x", MaxLineSize) + `"}` + "\n"
+
+	count := 0
+	result, err := ReadBulk(strings.NewReader(body), BulkOptions{}, func(p *models.LogPacket) error {
+		count += len(p.LogMessages)
+		return nil
+	})
+	if err == nil {
+		t.Fatal("Expected an error for the oversized line")
+	}
+	if count != 1 || result.Accepted != 1 {
+		t.Errorf("Expected the first line to be accepted, got %d messages and %+v", count, result)
+	}
+}
@@ -0,0 +1,116 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/distributor"
+	"github.com/ryouol/log-distributor/pkg/logpb"
+	"github.com/ryouol/log-distributor/pkg/ratelimit"
+	"github.com/ryouol/log-distributor/pkg/validation"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// retryAfterKey is the trailer telling a rate-limited client how many seconds
+// to wait
+const retryAfterKey = "retry-after"
+
+// GRPCService implements the LogIngestion gRPC service on top of an
+// EnqueueFunc
+type GRPCService struct {
+	logpb.UnimplementedLogIngestionServer
+	enqueue EnqueueFunc
+}
+
+// NewGRPCService creates a service handing packets to enqueue
+func NewGRPCService(enqueue EnqueueFunc) *GRPCService {
+	return &GRPCService{enqueue: enqueue}
+}
+
+// SendLogPacket enqueues one packet. A packet that was already received is
+// answered with the status "duplicate". A packet failing validation is
+// reported as INVALID_ARGUMENT with the invalid fields in a BadRequest
+// detail, and a full queue as RESOURCE_EXHAUSTED, the gRPC counterpart of the
+// HTTP API's 503. A packet over its agent's rate limits is also
+// RESOURCE_EXHAUSTED, with a retry-after trailer in seconds like the one
+// analyzers send.
+func (s *GRPCService) SendLogPacket(ctx context.Context, pb *logpb.LogPacket) (*logpb.IngestResponse, error) {
+	packet := logpb.ToPacket(pb)
+	packet.ReceivedAt = time.Now()
+
+	err := s.enqueue(packet)
+	var invalid *validation.Error
+	var limited *ratelimit.LimitError
+	switch {
+	case errors.Is(err, distributor.ErrDuplicate):
+		return &logpb.IngestResponse{
+			Status:  "duplicate",
+			Message: "Log packet already received",
+		}, nil
+	case errors.As(err, &invalid):
+		return nil, invalidArgument(invalid)
+	case errors.As(err, &limited):
+		grpc.SetTrailer(ctx, metadata.Pairs(retryAfterKey, strconv.Itoa(int(math.Ceil(limited.RetryAfter.Seconds())))))
+		return nil, status.Error(codes.ResourceExhausted, limited.Error())
+	case err != nil:
+		return nil, status.Errorf(codes.ResourceExhausted, "server is at capacity, try again later: %v", err)
+	}
+	return &logpb.IngestResponse{
+		Status:  "accepted",
+		Message: "Log packet queued for processing",
+	}, nil
+}
+
+// StreamLogPackets enqueues packets until the client closes the stream and
+// then reports which ones the queue refused
+func (s *GRPCService) StreamLogPackets(stream logpb.LogIngestion_StreamLogPacketsServer) error {
+	summary := &logpb.StreamSummary{}
+	for {
+		pb, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(summary)
+		}
+		if err != nil {
+			return err
+		}
+
+		packet := logpb.ToPacket(pb)
+		packet.ReceivedAt = time.Now()
+		err = s.enqueue(packet)
+		if errors.Is(err, distributor.ErrDuplicate) {
+			summary.Duplicates++
+			err = nil
+		}
+		if err != nil {
+			summary.Rejected++
+			summary.RejectedPacketIds = append(summary.RejectedPacketIds, packet.PacketID)
+			continue
+		}
+		summary.Accepted++
+	}
+}
+
+// invalidArgument converts a validation error to an INVALID_ARGUMENT status
+func invalidArgument(invalid *validation.Error) error {
+	details := &errdetails.BadRequest{}
+	for _, f := range invalid.Fields {
+		details.FieldViolations = append(details.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       f.Field,
+			Description: f.Message,
+		})
+	}
+
+	st, err := status.New(codes.InvalidArgument, invalid.Error()).WithDetails(details)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, invalid.Error())
+	}
+	return st.Err()
+}
@@ -0,0 +1,196 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/distributor"
+	"github.com/ryouol/log-distributor/pkg/logpb"
+	"github.com/ryouol/log-distributor/pkg/models"
+	"github.com/ryouol/log-distributor/pkg/ratelimit"
+	"github.com/ryouol/log-distributor/pkg/validation"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// startGRPC serves the ingestion service in process and returns a client
+func startGRPC(t *testing.T, enqueue EnqueueFunc) logpb.LogIngestionClient {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	logpb.RegisterLogIngestionServer(server, NewGRPCService(enqueue))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return logpb.NewLogIngestionClient(conn)
+}
+
+// TestGRPCSendLogPacket tests unary ingestion and the full-queue status
+func TestGRPCSendLogPacket(t *testing.T) {
+	var packets []*models.LogPacket
+	full := false
+	client := startGRPC(t, func(p *models.LogPacket) error {
+		if full {
+			return errors.New("queue is full")
+		}
+		packets = append(packets, p)
+		return nil
+	})
+
+	packet := &models.LogPacket{
+		PacketID: "packet1",
+		AgentID:  "agent1",
+		LogMessages: []models.LogMessage{
+			{ID: "msg1", Level: models.Error, Source: "app", Message: "boom", Metadata: map[string]interface{}{"code": 500.0}},
+		},
+	}
+	pb, err := logpb.FromPacket(packet)
+	if err != nil {
+		t.Fatalf("Failed to convert packet: %v", err)
+	}
+
+	response, err := client.SendLogPacket(context.Background(), pb)
+	if err != nil || response.Status != "accepted" {
+		t.Fatalf("Expected the packet to be accepted, got %v, %v", response, err)
+	}
+	if len(packets) != 1 || packets[0].ReceivedAt.IsZero() {
+		t.Fatalf("Expected 1 enqueued packet with a receive time, got %d", len(packets))
+	}
+	msg := packets[0].LogMessages[0]
+	if packets[0].AgentID != "agent1" || msg.Level != models.Error || msg.Metadata["code"] != 500.0 {
+		t.Errorf("Expected the packet to survive the round trip, got %+v", packets[0])
+	}
+
+	full = true
+	_, err = client.SendLogPacket(context.Background(), pb)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected RESOURCE_EXHAUSTED for a full queue, got %v", err)
+	}
+}
+
+// TestGRPCStreamLogPackets tests client-streaming ingestion
+func TestGRPCStreamLogPackets(t *testing.T) {
+	accepted := 0
+	client := startGRPC(t, func(p *models.LogPacket) error {
+		if p.PacketID == "refused" {
+			return errors.New("queue is full")
+		}
+		accepted++
+		return nil
+	})
+
+	stream, err := client.StreamLogPackets(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	for _, id := range []string{"p1", "refused", "p2"} {
+		if err := stream.Send(&logpb.LogPacket{PacketId: id}); err != nil {
+			t.Fatalf("Failed to send packet %s: %v", id, err)
+		}
+	}
+
+	summary, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("Failed to close stream: %v", err)
+	}
+	if summary.Accepted != 2 || summary.Rejected != 1 || len(summary.RejectedPacketIds) != 1 || summary.RejectedPacketIds[0] != "refused" {
+		t.Errorf("Expected 2 accepted and 1 refused packet, got %+v", summary)
+	}
+	if accepted != 2 {
+		t.Errorf("Expected 2 enqueued packets, got %d", accepted)
+	}
+}
+
+// TestGRPCInvalidPacket tests that validation errors come back as
+// INVALID_ARGUMENT with the invalid fields attached
+func TestGRPCInvalidPacket(t *testing.T) {
+	client := startGRPC(t, func(p *models.LogPacket) error {
+		return &validation.Error{Fields: []validation.FieldError{{Field: "packet_id", Message: "is required"}}}
+	})
+
+	_, err := client.SendLogPacket(context.Background(), &logpb.LogPacket{})
+	st := status.Convert(err)
+	if st.Code() != codes.InvalidArgument {
+		t.Fatalf("Expected INVALID_ARGUMENT, got %v", err)
+	}
+
+	details := st.Details()
+	if len(details) != 1 {
+		t.Fatalf("Expected 1 status detail, got %d", len(details))
+	}
+	badRequest, ok := details[0].(*errdetails.BadRequest)
+	if !ok || len(badRequest.FieldViolations) != 1 || badRequest.FieldViolations[0].Field != "packet_id" {
+		t.Errorf("Expected a violation of packet_id, got %v", details[0])
+	}
+}
+
+// TestGRPCRateLimited tests that rate limit errors come back as
+// RESOURCE_EXHAUSTED with a retry-after trailer rounded up to seconds
+func TestGRPCRateLimited(t *testing.T) {
+	client := startGRPC(t, func(p *models.LogPacket) error {
+		return &ratelimit.LimitError{AgentID: p.AgentID, Limit: "packets_per_second", RetryAfter: 1500 * time.Millisecond}
+	})
+
+	var trailer metadata.MD
+	_, err := client.SendLogPacket(context.Background(), &logpb.LogPacket{AgentId: "agent1"}, grpc.Trailer(&trailer))
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expected RESOURCE_EXHAUSTED, got %v", err)
+	}
+	if values := trailer.Get("retry-after"); len(values) != 1 || values[0] != "2" {
+		t.Errorf("Expected a retry-after trailer of 2, got %v", values)
+	}
+}
+
+// TestGRPCDuplicate tests that packets already received are acknowledged as
+// duplicates, and counted as such in stream summaries
+func TestGRPCDuplicate(t *testing.T) {
+	seen := make(map[string]bool)
+	client := startGRPC(t, func(p *models.LogPacket) error {
+		if seen[p.PacketID] {
+			return distributor.ErrDuplicate
+		}
+		seen[p.PacketID] = true
+		return nil
+	})
+
+	if response, err := client.SendLogPacket(context.Background(), &logpb.LogPacket{PacketId: "p1"}); err != nil || response.Status != "accepted" {
+		t.Fatalf("Expected the packet to be accepted, got %v, %v", response, err)
+	}
+	if response, err := client.SendLogPacket(context.Background(), &logpb.LogPacket{PacketId: "p1"}); err != nil || response.Status != "duplicate" {
+		t.Errorf("Expected the packet to be a duplicate, got %v, %v", response, err)
+	}
+
+	stream, err := client.StreamLogPackets(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	for _, id := range []string{"p1", "p2"} {
+		if err := stream.Send(&logpb.LogPacket{PacketId: id}); err != nil {
+			t.Fatalf("Failed to send packet %s: %v", id, err)
+		}
+	}
+	summary, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("Failed to close stream: %v", err)
+	}
+	if summary.Accepted != 2 || summary.Duplicates != 1 || summary.Rejected != 0 {
+		t.Errorf("Expected 2 accepted packets, 1 of them a duplicate, got %+v", summary)
+	}
+}
@@ -0,0 +1,259 @@
+package ingest
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ryouol/log-distributor/pkg/models"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultOTLPAgentAttribute is the resource attribute that names the agent
+// of OTLP packets unless configured otherwise
+const DefaultOTLPAgentAttribute = "service.instance.id"
+
+// OTLP resource and log record attributes with a meaning of their own
+const (
+	otlpServiceName = "service.name"
+	otlpRecordUID   = "log.record.uid"
+)
+
+// DecodeOTLP reads an ExportLogsServiceRequest in the OTLP/HTTP protobuf
+// encoding, or the JSON encoding if isJSON is set
+func DecodeOTLP(data []byte, isJSON bool) (*collogspb.ExportLogsServiceRequest, error) {
+	request := &collogspb.ExportLogsServiceRequest{}
+	if !isJSON {
+		if err := proto.Unmarshal(data, request); err != nil {
+			return nil, fmt.Errorf("invalid OTLP protobuf: %w", err)
+		}
+		return request, nil
+	}
+
+	data, err := hexIDsToBase64(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP JSON: %w", err)
+	}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, request); err != nil {
+		return nil, fmt.Errorf("invalid OTLP JSON: %w", err)
+	}
+	return request, nil
+}
+
+// hexIDsToBase64 rewrites the trace and span IDs of OTLP JSON log records,
+// which OTLP encodes in hex, into the base64 that protojson expects for
+// bytes fields
+func hexIDsToBase64(data []byte) ([]byte, error) {
+	var body map[string]interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, err
+	}
+
+	for _, rl := range objects(body["resourceLogs"]) {
+		for _, sl := range objects(rl["scopeLogs"]) {
+			for _, record := range objects(sl["logRecords"]) {
+				for _, key := range []string{"traceId", "spanId"} {
+					id, ok := record[key].(string)
+					if !ok || id == "" {
+						continue
+					}
+					raw, err := hex.DecodeString(id)
+					if err != nil {
+						return nil, fmt.Errorf("%s %q is not hex", key, id)
+					}
+					record[key] = base64.StdEncoding.EncodeToString(raw)
+				}
+			}
+		}
+	}
+	return json.Marshal(body)
+}
+
+// objects returns the JSON objects of an array, skipping anything else
+func objects(v interface{}) []map[string]interface{} {
+	items, _ := v.([]interface{})
+	result := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		if object, ok := item.(map[string]interface{}); ok {
+			result = append(result, object)
+		}
+	}
+	return result
+}
+
+// OTLPPackets converts an export request into one packet per resource. The
+// agent is named by the resource attribute agentAttribute, and the resource
+// attributes become the packet metadata. The source of each message is the
+// service.name resource attribute, or the instrumentation scope name without
+// one. Log record attributes become the message metadata, next to
+// "resource" and "scope" maps holding the resource and scope attributes.
+func OTLPPackets(request *collogspb.ExportLogsServiceRequest, agentAttribute string) []*models.LogPacket {
+	now := time.Now()
+	packets := make([]*models.LogPacket, 0, len(request.GetResourceLogs()))
+
+	for _, rl := range request.GetResourceLogs() {
+		resource := attributes(rl.GetResource().GetAttributes())
+		agentID, _ := resource[agentAttribute].(string)
+		service, _ := resource[otlpServiceName].(string)
+
+		packet := &models.LogPacket{
+			PacketID: uuid.New().String(),
+			AgentID:  agentID,
+			SentAt:   now,
+		}
+		if len(resource) > 0 {
+			packet.Metadata = resource
+		}
+
+		for _, sl := range rl.GetScopeLogs() {
+			scope := attributes(sl.GetScope().GetAttributes())
+			if name := sl.GetScope().GetName(); name != "" {
+				scope["name"] = name
+			}
+			if version := sl.GetScope().GetVersion(); version != "" {
+				scope["version"] = version
+			}
+			source := service
+			if source == "" {
+				source = sl.GetScope().GetName()
+			}
+
+			for _, record := range sl.GetLogRecords() {
+				packet.LogMessages = append(packet.LogMessages, otlpMessage(record, source, resource, scope, now))
+			}
+		}
+
+		if len(packet.LogMessages) > 0 {
+			packets = append(packets, packet)
+		}
+	}
+	return packets
+}
+
+// otlpMessage converts one log record
+func otlpMessage(record *logspb.LogRecord, source string, resource, scope map[string]interface{}, now time.Time) models.LogMessage {
+	metadata := attributes(record.GetAttributes())
+
+	id, _ := metadata[otlpRecordUID].(string)
+	if id == "" {
+		id = uuid.New().String()
+	}
+
+	timestamp := now
+	if ns := record.GetTimeUnixNano(); ns != 0 {
+		timestamp = time.Unix(0, int64(ns))
+	} else if ns := record.GetObservedTimeUnixNano(); ns != 0 {
+		timestamp = time.Unix(0, int64(ns))
+	}
+
+	if len(resource) > 0 {
+		metadata["resource"] = resource
+	}
+	if len(scope) > 0 {
+		metadata["scope"] = scope
+	}
+	if text := record.GetSeverityText(); text != "" {
+		metadata["severity_text"] = text
+	}
+	if traceID := record.GetTraceId(); len(traceID) > 0 {
+		metadata["trace_id"] = hex.EncodeToString(traceID)
+	}
+	if spanID := record.GetSpanId(); len(spanID) > 0 {
+		metadata["span_id"] = hex.EncodeToString(spanID)
+	}
+
+	var message string
+	switch body := anyValue(record.GetBody()).(type) {
+	case nil:
+	case string:
+		message = body
+	default:
+		// Structured bodies are kept as JSON
+		if data, err := json.Marshal(body); err == nil {
+			message = string(data)
+		}
+	}
+
+	return models.LogMessage{
+		ID:        id,
+		Timestamp: timestamp,
+		Level:     otlpLevel(record.GetSeverityNumber(), record.GetSeverityText()),
+		Source:    source,
+		Message:   message,
+		Metadata:  metadata,
+	}
+}
+
+// otlpLevel maps an OTLP severity to a log level. TRACE becomes DEBUG. Records
+// without a severity number fall back to their severity text, then INFO.
+func otlpLevel(number logspb.SeverityNumber, text string) models.LogLevel {
+	switch {
+	case number >= logspb.SeverityNumber_SEVERITY_NUMBER_FATAL:
+		return models.Fatal
+	case number >= logspb.SeverityNumber_SEVERITY_NUMBER_ERROR:
+		return models.Error
+	case number >= logspb.SeverityNumber_SEVERITY_NUMBER_WARN:
+		return models.Warning
+	case number >= logspb.SeverityNumber_SEVERITY_NUMBER_INFO:
+		return models.Info
+	case number >= logspb.SeverityNumber_SEVERITY_NUMBER_TRACE:
+		return models.Debug
+	}
+
+	switch strings.ToUpper(text) {
+	case "TRACE", "DEBUG":
+		return models.Debug
+	case "WARN", "WARNING":
+		return models.Warning
+	case "ERROR":
+		return models.Error
+	case "FATAL", "CRITICAL":
+		return models.Fatal
+	default:
+		return models.Info
+	}
+}
+
+// attributes converts OTLP key-values to a map
+func attributes(kvs []*commonpb.KeyValue) map[string]interface{} {
+	result := make(map[string]interface{}, len(kvs))
+	for _, kv := range kvs {
+		result[kv.GetKey()] = anyValue(kv.GetValue())
+	}
+	return result
+}
+
+// anyValue converts an OTLP value to its JSON-like Go equivalent. Bytes are
+// base64-encoded as in JSON.
+func anyValue(v *commonpb.AnyValue) interface{} {
+	switch value := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return value.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return value.BoolValue
+	case *commonpb.AnyValue_IntValue:
+		return value.IntValue
+	case *commonpb.AnyValue_DoubleValue:
+		return value.DoubleValue
+	case *commonpb.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(value.BytesValue)
+	case *commonpb.AnyValue_ArrayValue:
+		items := make([]interface{}, 0, len(value.ArrayValue.GetValues()))
+		for _, item := range value.ArrayValue.GetValues() {
+			items = append(items, anyValue(item))
+		}
+		return items
+	case *commonpb.AnyValue_KvlistValue:
+		return attributes(value.KvlistValue.GetValues())
+	default:
+		return nil
+	}
+}
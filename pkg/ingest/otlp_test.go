@@ -0,0 +1,154 @@
+package ingest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/models"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func stringAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+// TestOTLPProtobuf tests that a protobuf export request maps resources to
+// packets and log records to messages
+func TestOTLPProtobuf(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	request := &collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+				stringAttribute("service.name", "checkout"),
+				stringAttribute("service.instance.id", "host-1"),
+			}},
+			ScopeLogs: []*logspb.ScopeLogs{{
+				Scope: &commonpb.InstrumentationScope{Name: "checkout.http", Version: "1.2"},
+				LogRecords: []*logspb.LogRecord{
+					{
+						TimeUnixNano:   uint64(at.UnixNano()),
+						SeverityNumber: logspb.SeverityNumber_SEVERITY_NUMBER_ERROR2,
+						SeverityText:   "Error",
+						Body:           &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: "payment failed"}},
+						Attributes:     []*commonpb.KeyValue{stringAttribute("log.record.uid", "rec1"), stringAttribute("user", "alice")},
+						TraceId:        []byte{0x01, 0x02},
+					},
+					{
+						ObservedTimeUnixNano: uint64(at.UnixNano()),
+						Body: &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{
+							Values: []*commonpb.KeyValue{stringAttribute("event", "login")},
+						}}},
+					},
+				},
+			}},
+		}},
+	}
+	data, err := proto.Marshal(request)
+	if err != nil {
+		t.Fatalf("Failed to marshal request: %v", err)
+	}
+
+	decoded, err := DecodeOTLP(data, false)
+	if err != nil {
+		t.Fatalf("Expected the request to decode, got %v", err)
+	}
+	packets := OTLPPackets(decoded, DefaultOTLPAgentAttribute)
+	if len(packets) != 1 {
+		t.Fatalf("Expected 1 packet, got %d", len(packets))
+	}
+
+	packet := packets[0]
+	if packet.AgentID != "host-1" || packet.PacketID == "" || packet.Metadata["service.name"] != "checkout" {
+		t.Errorf("Expected a packet of agent host-1 carrying the resource, got %+v", packet)
+	}
+	if len(packet.LogMessages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(packet.LogMessages))
+	}
+
+	msg := packet.LogMessages[0]
+	if msg.ID != "rec1" || msg.Level != models.Error || msg.Source != "checkout" || msg.Message != "payment failed" || !msg.Timestamp.Equal(at) {
+		t.Errorf("Expected the first record to map onto the message fields, got %+v", msg)
+	}
+	if msg.Metadata["user"] != "alice" || msg.Metadata["trace_id"] != "0102" || msg.Metadata["severity_text"] != "Error" {
+		t.Errorf("Expected attributes, trace ID and severity text in the metadata, got %v", msg.Metadata)
+	}
+	if scope, _ := msg.Metadata["scope"].(map[string]interface{}); scope["name"] != "checkout.http" || scope["version"] != "1.2" {
+		t.Errorf("Expected the scope in the metadata, got %v", msg.Metadata["scope"])
+	}
+
+	msg = packet.LogMessages[1]
+	if msg.ID == "" || msg.Level != models.Info || msg.Message != `{"event":"login"}` || !msg.Timestamp.Equal(at) {
+		t.Errorf("Expected the second record to get an ID, INFO and a JSON body, got %+v", msg)
+	}
+}
+
+// TestOTLPJSON tests the JSON encoding, whose trace and span IDs are hex
+func TestOTLPJSON(t *testing.T) {
+	body := `{"resourceLogs":[{
+		"resource":{"attributes":[{"key":"host.name","value":{"stringValue":"web-1"}}]},
+		"scopeLogs":[{"scope":{"name":"nginx"},"logRecords":[{
+			"timeUnixNano":"1714564800000000000",
+			"severityNumber":17,
+			"body":{"stringValue":"upstream down"},
+			"traceId":"5b8efff798038103d269b633813fc60c",
+			"spanId":"eee19b7ec3c1b174",
+			"attributes":[{"key":"status","value":{"intValue":"502"}}]
+		}]}]
+	}]}`
+
+	request, err := DecodeOTLP([]byte(body), true)
+	if err != nil {
+		t.Fatalf("Expected the request to decode, got %v", err)
+	}
+	packets := OTLPPackets(request, "host.name")
+	if len(packets) != 1 || len(packets[0].LogMessages) != 1 {
+		t.Fatalf("Expected 1 packet with 1 message, got %+v", packets)
+	}
+	if packets[0].AgentID != "web-1" {
+		t.Errorf("Expected agent web-1, got %q", packets[0].AgentID)
+	}
+
+	msg := packets[0].LogMessages[0]
+	if msg.Level != models.Error || msg.Source != "nginx" || msg.Message != "upstream down" {
+		t.Errorf("Expected an ERROR from nginx, got %+v", msg)
+	}
+	if msg.Metadata["trace_id"] != "5b8efff798038103d269b633813fc60c" || msg.Metadata["span_id"] != "eee19b7ec3c1b174" {
+		t.Errorf("Expected the hex IDs to survive, got %v", msg.Metadata)
+	}
+	if msg.Metadata["status"] != int64(502) {
+		t.Errorf("Expected status 502, got %v", msg.Metadata["status"])
+	}
+
+	if _, err := DecodeOTLP([]byte(`{"resourceLogs":[{"scopeLogs":[{"logRecords":[{"traceId":"xyz"}]}]}]}`), true); err == nil {
+		t.Errorf("Expected an invalid trace ID to be rejected")
+	}
+}
+
+// TestOTLPLevel tests the mapping of OTLP severities to log levels
+func TestOTLPLevel(t *testing.T) {
+	tests := []struct {
+		number logspb.SeverityNumber
+		text   string
+		level  models.LogLevel
+	}{
+		{logspb.SeverityNumber_SEVERITY_NUMBER_TRACE, "", models.Debug},
+		{logspb.SeverityNumber_SEVERITY_NUMBER_DEBUG4, "", models.Debug},
+		{logspb.SeverityNumber_SEVERITY_NUMBER_INFO, "", models.Info},
+		{logspb.SeverityNumber_SEVERITY_NUMBER_WARN3, "", models.Warning},
+		{logspb.SeverityNumber_SEVERITY_NUMBER_ERROR, "", models.Error},
+		{logspb.SeverityNumber_SEVERITY_NUMBER_FATAL4, "", models.Fatal},
+		{logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED, "warn", models.Warning},
+		{logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED, "critical", models.Fatal},
+		{logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED, "", models.Info},
+	}
+
+	for _, tt := range tests {
+		if level := otlpLevel(tt.number, tt.text); level != tt.level {
+			t.Errorf("Expected %s for %s %q, got %s", tt.level, tt.number, tt.text, level)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package logpb
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/models"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// FromPacket converts a log packet to its protobuf form. It fails if the
+// metadata holds values that have no JSON representation.
+func FromPacket(packet *models.LogPacket) (*LogPacket, error) {
+	metadata, err := fromMetadata(packet.Metadata)
+	if err != nil {
+		return nil, fmt.Errorf("packet %s: %w", packet.PacketID, err)
+	}
+
+	pb := &LogPacket{
+		PacketId:    packet.PacketID,
+		AgentId:     packet.AgentID,
+		SentAt:      fromTime(packet.SentAt),
+		ReceivedAt:  fromTime(packet.ReceivedAt),
+		LogMessages: make([]*LogMessage, len(packet.LogMessages)),
+		Metadata:    metadata,
+		Priority:    string(packet.Priority),
+	}
+	for i, msg := range packet.LogMessages {
+		metadata, err := fromMetadata(msg.Metadata)
+		if err != nil {
+			return nil, fmt.Errorf("log message %s: %w", msg.ID, err)
+		}
+		pb.LogMessages[i] = &LogMessage{
+			Id:        msg.ID,
+			Timestamp: fromTime(msg.Timestamp),
+			Level:     string(msg.Level),
+			Source:    msg.Source,
+			Message:   msg.Message,
+			Metadata:  metadata,
+		}
+	}
+	return pb, nil
+}
+
+// ToPacket converts a protobuf log packet back to the model
+func ToPacket(pb *LogPacket) *models.LogPacket {
+	packet := &models.LogPacket{
+		PacketID:    pb.GetPacketId(),
+		AgentID:     pb.GetAgentId(),
+		SentAt:      toTime(pb.GetSentAt()),
+		ReceivedAt:  toTime(pb.GetReceivedAt()),
+		LogMessages: make([]models.LogMessage, len(pb.GetLogMessages())),
+		Metadata:    toMetadata(pb.GetMetadata()),
+		Priority:    models.LogLevel(pb.GetPriority()),
+	}
+	for i, msg := range pb.GetLogMessages() {
+		packet.LogMessages[i] = models.LogMessage{
+			ID:        msg.GetId(),
+			Timestamp: toTime(msg.GetTimestamp()),
+			Level:     models.LogLevel(msg.GetLevel()),
+			Source:    msg.GetSource(),
+			Message:   msg.GetMessage(),
+			Metadata:  toMetadata(msg.GetMetadata()),
+		}
+	}
+	return packet
+}
+
+// FromAnalyzeResponse converts an analyzer response to its protobuf form
+func FromAnalyzeResponse(response models.AnalyzeResponse) *AnalyzeResponse {
+	pb := &AnalyzeResponse{
+		Status:   string(response.Status),
+		Accepted: response.Accepted,
+		Deferred: response.Deferred,
+	}
+	for _, r := range response.Rejected {
+		pb.Rejected = append(pb.Rejected, &LogRejection{Id: r.ID, Reason: r.Reason})
+	}
+	return pb
+}
+
+// ToAnalyzeResponse converts a protobuf analyzer response back to the model
+func ToAnalyzeResponse(pb *AnalyzeResponse) models.AnalyzeResponse {
+	response := models.AnalyzeResponse{
+		Status:   models.AnalyzeStatus(pb.GetStatus()),
+		Accepted: pb.GetAccepted(),
+		Deferred: pb.GetDeferred(),
+	}
+	for _, r := range pb.GetRejected() {
+		response.Rejected = append(response.Rejected, models.LogRejection{ID: r.GetId(), Reason: r.GetReason()})
+	}
+	return response
+}
+
+// fromTime leaves zero times unset
+func fromTime(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+// toTime turns an unset timestamp into the zero time
+func toTime(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	return ts.AsTime()
+}
+
+// fromMetadata leaves empty metadata unset
+func fromMetadata(metadata map[string]interface{}) (*structpb.Struct, error) {
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+	s, err := structpb.NewStruct(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %w", err)
+	}
+	return s, nil
+}
+
+// toMetadata turns unset metadata into a nil map
+func toMetadata(s *structpb.Struct) map[string]interface{} {
+	if len(s.GetFields()) == 0 {
+		return nil
+	}
+	return s.AsMap()
+}
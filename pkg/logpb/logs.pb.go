@@ -0,0 +1,568 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        v5.29.3
+// source: logs.proto
+
+package logpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	structpb "google.golang.org/protobuf/types/known/structpb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// LogMessage mirrors models.LogMessage
+type LogMessage struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Id        string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Timestamp *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	// level is one of DEBUG, INFO, WARNING, ERROR or FATAL
+	Level         string           `protobuf:"bytes,3,opt,name=level,proto3" json:"level,omitempty"`
+	Source        string           `protobuf:"bytes,4,opt,name=source,proto3" json:"source,omitempty"`
+	Message       string           `protobuf:"bytes,5,opt,name=message,proto3" json:"message,omitempty"`
+	Metadata      *structpb.Struct `protobuf:"bytes,6,opt,name=metadata,proto3" json:"metadata,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LogMessage) Reset() {
+	*x = LogMessage{}
+	mi := &file_logs_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LogMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LogMessage) ProtoMessage() {}
+
+func (x *LogMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_logs_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LogMessage.ProtoReflect.Descriptor instead.
+func (*LogMessage) Descriptor() ([]byte, []int) {
+	return file_logs_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *LogMessage) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *LogMessage) GetTimestamp() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Timestamp
+	}
+	return nil
+}
+
+func (x *LogMessage) GetLevel() string {
+	if x != nil {
+		return x.Level
+	}
+	return ""
+}
+
+func (x *LogMessage) GetSource() string {
+	if x != nil {
+		return x.Source
+	}
+	return ""
+}
+
+func (x *LogMessage) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+func (x *LogMessage) GetMetadata() *structpb.Struct {
+	if x != nil {
+		return x.Metadata
+	}
+	return nil
+}
+
+// LogPacket mirrors models.LogPacket
+type LogPacket struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	PacketId    string                 `protobuf:"bytes,1,opt,name=packet_id,json=packetId,proto3" json:"packet_id,omitempty"`
+	AgentId     string                 `protobuf:"bytes,2,opt,name=agent_id,json=agentId,proto3" json:"agent_id,omitempty"`
+	SentAt      *timestamppb.Timestamp `protobuf:"bytes,3,opt,name=sent_at,json=sentAt,proto3" json:"sent_at,omitempty"`
+	ReceivedAt  *timestamppb.Timestamp `protobuf:"bytes,4,opt,name=received_at,json=receivedAt,proto3" json:"received_at,omitempty"`
+	LogMessages []*LogMessage          `protobuf:"bytes,5,rep,name=log_messages,json=logMessages,proto3" json:"log_messages,omitempty"`
+	Metadata    *structpb.Struct       `protobuf:"bytes,6,opt,name=metadata,proto3" json:"metadata,omitempty"`
+	// priority overrides the most severe level in picking the packet's
+	// priority lane, and is one of the levels
+	Priority      string `protobuf:"bytes,7,opt,name=priority,proto3" json:"priority,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LogPacket) Reset() {
+	*x = LogPacket{}
+	mi := &file_logs_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LogPacket) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LogPacket) ProtoMessage() {}
+
+func (x *LogPacket) ProtoReflect() protoreflect.Message {
+	mi := &file_logs_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LogPacket.ProtoReflect.Descriptor instead.
+func (*LogPacket) Descriptor() ([]byte, []int) {
+	return file_logs_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *LogPacket) GetPacketId() string {
+	if x != nil {
+		return x.PacketId
+	}
+	return ""
+}
+
+func (x *LogPacket) GetAgentId() string {
+	if x != nil {
+		return x.AgentId
+	}
+	return ""
+}
+
+func (x *LogPacket) GetSentAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.SentAt
+	}
+	return nil
+}
+
+func (x *LogPacket) GetReceivedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.ReceivedAt
+	}
+	return nil
+}
+
+func (x *LogPacket) GetLogMessages() []*LogMessage {
+	if x != nil {
+		return x.LogMessages
+	}
+	return nil
+}
+
+func (x *LogPacket) GetMetadata() *structpb.Struct {
+	if x != nil {
+		return x.Metadata
+	}
+	return nil
+}
+
+func (x *LogPacket) GetPriority() string {
+	if x != nil {
+		return x.Priority
+	}
+	return ""
+}
+
+// IngestResponse acknowledges a packet sent with SendLogPacket
+type IngestResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Status        string                 `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	Message       string                 `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *IngestResponse) Reset() {
+	*x = IngestResponse{}
+	mi := &file_logs_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *IngestResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*IngestResponse) ProtoMessage() {}
+
+func (x *IngestResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_logs_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use IngestResponse.ProtoReflect.Descriptor instead.
+func (*IngestResponse) Descriptor() ([]byte, []int) {
+	return file_logs_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *IngestResponse) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *IngestResponse) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+// StreamSummary is returned once a client closes a StreamLogPackets stream
+type StreamSummary struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Accepted int64                  `protobuf:"varint,1,opt,name=accepted,proto3" json:"accepted,omitempty"`
+	Rejected int64                  `protobuf:"varint,2,opt,name=rejected,proto3" json:"rejected,omitempty"`
+	// rejected_packet_ids lists the packets the queue refused, so that they
+	// can be sent again
+	RejectedPacketIds []string `protobuf:"bytes,3,rep,name=rejected_packet_ids,json=rejectedPacketIds,proto3" json:"rejected_packet_ids,omitempty"`
+	// duplicates counts the accepted packets that had already been received
+	// and were not queued again
+	Duplicates    int64 `protobuf:"varint,4,opt,name=duplicates,proto3" json:"duplicates,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamSummary) Reset() {
+	*x = StreamSummary{}
+	mi := &file_logs_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamSummary) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamSummary) ProtoMessage() {}
+
+func (x *StreamSummary) ProtoReflect() protoreflect.Message {
+	mi := &file_logs_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamSummary.ProtoReflect.Descriptor instead.
+func (*StreamSummary) Descriptor() ([]byte, []int) {
+	return file_logs_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *StreamSummary) GetAccepted() int64 {
+	if x != nil {
+		return x.Accepted
+	}
+	return 0
+}
+
+func (x *StreamSummary) GetRejected() int64 {
+	if x != nil {
+		return x.Rejected
+	}
+	return 0
+}
+
+func (x *StreamSummary) GetRejectedPacketIds() []string {
+	if x != nil {
+		return x.RejectedPacketIds
+	}
+	return nil
+}
+
+func (x *StreamSummary) GetDuplicates() int64 {
+	if x != nil {
+		return x.Duplicates
+	}
+	return 0
+}
+
+// LogRejection mirrors models.LogRejection
+type LogRejection struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Reason        string                 `protobuf:"bytes,2,opt,name=reason,proto3" json:"reason,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LogRejection) Reset() {
+	*x = LogRejection{}
+	mi := &file_logs_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LogRejection) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LogRejection) ProtoMessage() {}
+
+func (x *LogRejection) ProtoReflect() protoreflect.Message {
+	mi := &file_logs_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LogRejection.ProtoReflect.Descriptor instead.
+func (*LogRejection) Descriptor() ([]byte, []int) {
+	return file_logs_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *LogRejection) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *LogRejection) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+// AnalyzeResponse mirrors models.AnalyzeResponse
+type AnalyzeResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Status        string                 `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	Accepted      []string               `protobuf:"bytes,2,rep,name=accepted,proto3" json:"accepted,omitempty"`
+	Rejected      []*LogRejection        `protobuf:"bytes,3,rep,name=rejected,proto3" json:"rejected,omitempty"`
+	Deferred      []string               `protobuf:"bytes,4,rep,name=deferred,proto3" json:"deferred,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AnalyzeResponse) Reset() {
+	*x = AnalyzeResponse{}
+	mi := &file_logs_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AnalyzeResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AnalyzeResponse) ProtoMessage() {}
+
+func (x *AnalyzeResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_logs_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AnalyzeResponse.ProtoReflect.Descriptor instead.
+func (*AnalyzeResponse) Descriptor() ([]byte, []int) {
+	return file_logs_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *AnalyzeResponse) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *AnalyzeResponse) GetAccepted() []string {
+	if x != nil {
+		return x.Accepted
+	}
+	return nil
+}
+
+func (x *AnalyzeResponse) GetRejected() []*LogRejection {
+	if x != nil {
+		return x.Rejected
+	}
+	return nil
+}
+
+func (x *AnalyzeResponse) GetDeferred() []string {
+	if x != nil {
+		return x.Deferred
+	}
+	return nil
+}
+
+var File_logs_proto protoreflect.FileDescriptor
+
+const file_logs_proto_rawDesc = "" +
+	"\n" +
+	"\n" +
+	"logs.proto\x12\x11logdistributor.v1\x1a\x1cgoogle/protobuf/struct.proto\x1a\x1fgoogle/protobuf/timestamp.proto\"\xd3\x01\n" +
+	"\n" +
+	"LogMessage\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x128\n" +
+	"\ttimestamp\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\ttimestamp\x12\x14\n" +
+	"\x05level\x18\x03 \x01(\tR\x05level\x12\x16\n" +
+	"\x06source\x18\x04 \x01(\tR\x06source\x12\x18\n" +
+	"\amessage\x18\x05 \x01(\tR\amessage\x123\n" +
+	"\bmetadata\x18\x06 \x01(\v2\x17.google.protobuf.StructR\bmetadata\"\xc8\x02\n" +
+	"\tLogPacket\x12\x1b\n" +
+	"\tpacket_id\x18\x01 \x01(\tR\bpacketId\x12\x19\n" +
+	"\bagent_id\x18\x02 \x01(\tR\aagentId\x123\n" +
+	"\asent_at\x18\x03 \x01(\v2\x1a.google.protobuf.TimestampR\x06sentAt\x12;\n" +
+	"\vreceived_at\x18\x04 \x01(\v2\x1a.google.protobuf.TimestampR\n" +
+	"receivedAt\x12@\n" +
+	"\flog_messages\x18\x05 \x03(\v2\x1d.logdistributor.v1.LogMessageR\vlogMessages\x123\n" +
+	"\bmetadata\x18\x06 \x01(\v2\x17.google.protobuf.StructR\bmetadata\x12\x1a\n" +
+	"\bpriority\x18\a \x01(\tR\bpriority\"B\n" +
+	"\x0eIngestResponse\x12\x16\n" +
+	"\x06status\x18\x01 \x01(\tR\x06status\x12\x18\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage\"\x97\x01\n" +
+	"\rStreamSummary\x12\x1a\n" +
+	"\baccepted\x18\x01 \x01(\x03R\baccepted\x12\x1a\n" +
+	"\brejected\x18\x02 \x01(\x03R\brejected\x12.\n" +
+	"\x13rejected_packet_ids\x18\x03 \x03(\tR\x11rejectedPacketIds\x12\x1e\n" +
+	"\n" +
+	"duplicates\x18\x04 \x01(\x03R\n" +
+	"duplicates\"6\n" +
+	"\fLogRejection\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x16\n" +
+	"\x06reason\x18\x02 \x01(\tR\x06reason\"\x9e\x01\n" +
+	"\x0fAnalyzeResponse\x12\x16\n" +
+	"\x06status\x18\x01 \x01(\tR\x06status\x12\x1a\n" +
+	"\baccepted\x18\x02 \x03(\tR\baccepted\x12;\n" +
+	"\brejected\x18\x03 \x03(\v2\x1f.logdistributor.v1.LogRejectionR\brejected\x12\x1a\n" +
+	"\bdeferred\x18\x04 \x03(\tR\bdeferred2\xb6\x01\n" +
+	"\fLogIngestion\x12P\n" +
+	"\rSendLogPacket\x12\x1c.logdistributor.v1.LogPacket\x1a!.logdistributor.v1.IngestResponse\x12T\n" +
+	"\x10StreamLogPackets\x12\x1c.logdistributor.v1.LogPacket\x1a .logdistributor.v1.StreamSummary(\x012Z\n" +
+	"\vLogAnalyzer\x12K\n" +
+	"\aAnalyze\x12\x1c.logdistributor.v1.LogPacket\x1a\".logdistributor.v1.AnalyzeResponseB-Z+github.com/ryouol/log-distributor/pkg/logpbb\x06proto3"
+
+var (
+	file_logs_proto_rawDescOnce sync.Once
+	file_logs_proto_rawDescData []byte
+)
+
+func file_logs_proto_rawDescGZIP() []byte {
+	file_logs_proto_rawDescOnce.Do(func() {
+		file_logs_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_logs_proto_rawDesc), len(file_logs_proto_rawDesc)))
+	})
+	return file_logs_proto_rawDescData
+}
+
+var file_logs_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_logs_proto_goTypes = []any{
+	(*LogMessage)(nil),            // 0: logdistributor.v1.LogMessage
+	(*LogPacket)(nil),             // 1: logdistributor.v1.LogPacket
+	(*IngestResponse)(nil),        // 2: logdistributor.v1.IngestResponse
+	(*StreamSummary)(nil),         // 3: logdistributor.v1.StreamSummary
+	(*LogRejection)(nil),          // 4: logdistributor.v1.LogRejection
+	(*AnalyzeResponse)(nil),       // 5: logdistributor.v1.AnalyzeResponse
+	(*timestamppb.Timestamp)(nil), // 6: google.protobuf.Timestamp
+	(*structpb.Struct)(nil),       // 7: google.protobuf.Struct
+}
+var file_logs_proto_depIdxs = []int32{
+	6,  // 0: logdistributor.v1.LogMessage.timestamp:type_name -> google.protobuf.Timestamp
+	7,  // 1: logdistributor.v1.LogMessage.metadata:type_name -> google.protobuf.Struct
+	6,  // 2: logdistributor.v1.LogPacket.sent_at:type_name -> google.protobuf.Timestamp
+	6,  // 3: logdistributor.v1.LogPacket.received_at:type_name -> google.protobuf.Timestamp
+	0,  // 4: logdistributor.v1.LogPacket.log_messages:type_name -> logdistributor.v1.LogMessage
+	7,  // 5: logdistributor.v1.LogPacket.metadata:type_name -> google.protobuf.Struct
+	4,  // 6: logdistributor.v1.AnalyzeResponse.rejected:type_name -> logdistributor.v1.LogRejection
+	1,  // 7: logdistributor.v1.LogIngestion.SendLogPacket:input_type -> logdistributor.v1.LogPacket
+	1,  // 8: logdistributor.v1.LogIngestion.StreamLogPackets:input_type -> logdistributor.v1.LogPacket
+	1,  // 9: logdistributor.v1.LogAnalyzer.Analyze:input_type -> logdistributor.v1.LogPacket
+	2,  // 10: logdistributor.v1.LogIngestion.SendLogPacket:output_type -> logdistributor.v1.IngestResponse
+	3,  // 11: logdistributor.v1.LogIngestion.StreamLogPackets:output_type -> logdistributor.v1.StreamSummary
+	5,  // 12: logdistributor.v1.LogAnalyzer.Analyze:output_type -> logdistributor.v1.AnalyzeResponse
+	10, // [10:13] is the sub-list for method output_type
+	7,  // [7:10] is the sub-list for method input_type
+	7,  // [7:7] is the sub-list for extension type_name
+	7,  // [7:7] is the sub-list for extension extendee
+	0,  // [0:7] is the sub-list for field type_name
+}
+
+func init() { file_logs_proto_init() }
+func file_logs_proto_init() {
+	if File_logs_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_logs_proto_rawDesc), len(file_logs_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   6,
+			NumExtensions: 0,
+			NumServices:   2,
+		},
+		GoTypes:           file_logs_proto_goTypes,
+		DependencyIndexes: file_logs_proto_depIdxs,
+		MessageInfos:      file_logs_proto_msgTypes,
+	}.Build()
+	File_logs_proto = out.File
+	file_logs_proto_goTypes = nil
+	file_logs_proto_depIdxs = nil
+}
@@ -0,0 +1,277 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.29.3
+// source: logs.proto
+
+package logpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	LogIngestion_SendLogPacket_FullMethodName    = "/logdistributor.v1.LogIngestion/SendLogPacket"
+	LogIngestion_StreamLogPackets_FullMethodName = "/logdistributor.v1.LogIngestion/StreamLogPackets"
+)
+
+// LogIngestionClient is the client API for LogIngestion service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// LogIngestion is served by the distributor to agents
+type LogIngestionClient interface {
+	// SendLogPacket enqueues one packet, failing with RESOURCE_EXHAUSTED when
+	// the queue is full
+	SendLogPacket(ctx context.Context, in *LogPacket, opts ...grpc.CallOption) (*IngestResponse, error)
+	// StreamLogPackets enqueues every packet the client sends and summarizes
+	// them when the client closes the stream
+	StreamLogPackets(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[LogPacket, StreamSummary], error)
+}
+
+type logIngestionClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewLogIngestionClient(cc grpc.ClientConnInterface) LogIngestionClient {
+	return &logIngestionClient{cc}
+}
+
+func (c *logIngestionClient) SendLogPacket(ctx context.Context, in *LogPacket, opts ...grpc.CallOption) (*IngestResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(IngestResponse)
+	err := c.cc.Invoke(ctx, LogIngestion_SendLogPacket_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logIngestionClient) StreamLogPackets(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[LogPacket, StreamSummary], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &LogIngestion_ServiceDesc.Streams[0], LogIngestion_StreamLogPackets_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[LogPacket, StreamSummary]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type LogIngestion_StreamLogPacketsClient = grpc.ClientStreamingClient[LogPacket, StreamSummary]
+
+// LogIngestionServer is the server API for LogIngestion service.
+// All implementations must embed UnimplementedLogIngestionServer
+// for forward compatibility.
+//
+// LogIngestion is served by the distributor to agents
+type LogIngestionServer interface {
+	// SendLogPacket enqueues one packet, failing with RESOURCE_EXHAUSTED when
+	// the queue is full
+	SendLogPacket(context.Context, *LogPacket) (*IngestResponse, error)
+	// StreamLogPackets enqueues every packet the client sends and summarizes
+	// them when the client closes the stream
+	StreamLogPackets(grpc.ClientStreamingServer[LogPacket, StreamSummary]) error
+	mustEmbedUnimplementedLogIngestionServer()
+}
+
+// UnimplementedLogIngestionServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedLogIngestionServer struct{}
+
+func (UnimplementedLogIngestionServer) SendLogPacket(context.Context, *LogPacket) (*IngestResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendLogPacket not implemented")
+}
+func (UnimplementedLogIngestionServer) StreamLogPackets(grpc.ClientStreamingServer[LogPacket, StreamSummary]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamLogPackets not implemented")
+}
+func (UnimplementedLogIngestionServer) mustEmbedUnimplementedLogIngestionServer() {}
+func (UnimplementedLogIngestionServer) testEmbeddedByValue()                      {}
+
+// UnsafeLogIngestionServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to LogIngestionServer will
+// result in compilation errors.
+type UnsafeLogIngestionServer interface {
+	mustEmbedUnimplementedLogIngestionServer()
+}
+
+func RegisterLogIngestionServer(s grpc.ServiceRegistrar, srv LogIngestionServer) {
+	// If the following call pancis, it indicates UnimplementedLogIngestionServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&LogIngestion_ServiceDesc, srv)
+}
+
+func _LogIngestion_SendLogPacket_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LogPacket)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogIngestionServer).SendLogPacket(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LogIngestion_SendLogPacket_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogIngestionServer).SendLogPacket(ctx, req.(*LogPacket))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LogIngestion_StreamLogPackets_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(LogIngestionServer).StreamLogPackets(&grpc.GenericServerStream[LogPacket, StreamSummary]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type LogIngestion_StreamLogPacketsServer = grpc.ClientStreamingServer[LogPacket, StreamSummary]
+
+// LogIngestion_ServiceDesc is the grpc.ServiceDesc for LogIngestion service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var LogIngestion_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "logdistributor.v1.LogIngestion",
+	HandlerType: (*LogIngestionServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SendLogPacket",
+			Handler:    _LogIngestion_SendLogPacket_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamLogPackets",
+			Handler:       _LogIngestion_StreamLogPackets_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "logs.proto",
+}
+
+const (
+	LogAnalyzer_Analyze_FullMethodName = "/logdistributor.v1.LogAnalyzer/Analyze"
+)
+
+// LogAnalyzerClient is the client API for LogAnalyzer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// LogAnalyzer is served by analyzers that take packets over gRPC. Their
+// health is checked with the standard grpc.health.v1 service.
+type LogAnalyzerClient interface {
+	// Analyze processes one packet. RESOURCE_EXHAUSTED or UNAVAILABLE with a
+	// retry-after trailer in seconds asks the distributor to slow down.
+	Analyze(ctx context.Context, in *LogPacket, opts ...grpc.CallOption) (*AnalyzeResponse, error)
+}
+
+type logAnalyzerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewLogAnalyzerClient(cc grpc.ClientConnInterface) LogAnalyzerClient {
+	return &logAnalyzerClient{cc}
+}
+
+func (c *logAnalyzerClient) Analyze(ctx context.Context, in *LogPacket, opts ...grpc.CallOption) (*AnalyzeResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AnalyzeResponse)
+	err := c.cc.Invoke(ctx, LogAnalyzer_Analyze_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// LogAnalyzerServer is the server API for LogAnalyzer service.
+// All implementations must embed UnimplementedLogAnalyzerServer
+// for forward compatibility.
+//
+// LogAnalyzer is served by analyzers that take packets over gRPC. Their
+// health is checked with the standard grpc.health.v1 service.
+type LogAnalyzerServer interface {
+	// Analyze processes one packet. RESOURCE_EXHAUSTED or UNAVAILABLE with a
+	// retry-after trailer in seconds asks the distributor to slow down.
+	Analyze(context.Context, *LogPacket) (*AnalyzeResponse, error)
+	mustEmbedUnimplementedLogAnalyzerServer()
+}
+
+// UnimplementedLogAnalyzerServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedLogAnalyzerServer struct{}
+
+func (UnimplementedLogAnalyzerServer) Analyze(context.Context, *LogPacket) (*AnalyzeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Analyze not implemented")
+}
+func (UnimplementedLogAnalyzerServer) mustEmbedUnimplementedLogAnalyzerServer() {}
+func (UnimplementedLogAnalyzerServer) testEmbeddedByValue()                     {}
+
+// UnsafeLogAnalyzerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to LogAnalyzerServer will
+// result in compilation errors.
+type UnsafeLogAnalyzerServer interface {
+	mustEmbedUnimplementedLogAnalyzerServer()
+}
+
+func RegisterLogAnalyzerServer(s grpc.ServiceRegistrar, srv LogAnalyzerServer) {
+	// If the following call pancis, it indicates UnimplementedLogAnalyzerServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&LogAnalyzer_ServiceDesc, srv)
+}
+
+func _LogAnalyzer_Analyze_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LogPacket)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogAnalyzerServer).Analyze(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: LogAnalyzer_Analyze_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogAnalyzerServer).Analyze(ctx, req.(*LogPacket))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// LogAnalyzer_ServiceDesc is the grpc.ServiceDesc for LogAnalyzer service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var LogAnalyzer_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "logdistributor.v1.LogAnalyzer",
+	HandlerType: (*LogAnalyzerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Analyze",
+			Handler:    _LogAnalyzer_Analyze_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "logs.proto",
+}
@@ -0,0 +1,283 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are latency buckets in seconds from 1ms to 10s
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// EmitFunc reports one sample of a function-backed metric
+type EmitFunc func(value float64, labelValues ...string)
+
+// metric is a family of samples sharing a name
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// Registry holds metrics and renders them in the Prometheus text exposition
+// format
+type Registry struct {
+	metrics []metric
+	mutex   sync.RWMutex
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make([]metric, 0),
+	}
+}
+
+// CounterFunc registers a counter whose samples are read from fn at scrape
+// time. fn must emit label values in the order of labelNames.
+func (r *Registry) CounterFunc(name, help string, labelNames []string, fn func(emit EmitFunc)) {
+	r.register(&funcMetric{
+		metricName: name,
+		help:       help,
+		kind:       "counter",
+		labelNames: labelNames,
+		collect:    fn,
+	})
+}
+
+// GaugeFunc registers a gauge whose samples are read from fn at scrape time.
+// fn must emit label values in the order of labelNames.
+func (r *Registry) GaugeFunc(name, help string, labelNames []string, fn func(emit EmitFunc)) {
+	r.register(&funcMetric{
+		metricName: name,
+		help:       help,
+		kind:       "gauge",
+		labelNames: labelNames,
+		collect:    fn,
+	})
+}
+
+// Register adds a histogram to the registry
+func (r *Registry) Register(h *HistogramVec) {
+	r.register(h)
+}
+
+// register adds a metric, replacing any previous metric of the same name
+func (r *Registry) register(m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for i, existing := range r.metrics {
+		if existing.name() == m.name() {
+			r.metrics[i] = m
+			return
+		}
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+// ServeHTTP writes all metrics in the text exposition format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	r.mutex.RLock()
+	metrics := make([]metric, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.mutex.RUnlock()
+
+	writer := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(writer)
+	}
+	writer.Flush()
+}
+
+// funcMetric is a counter or gauge read from a callback at scrape time
+type funcMetric struct {
+	metricName string
+	help       string
+	kind       string
+	labelNames []string
+	collect    func(emit EmitFunc)
+}
+
+func (m *funcMetric) name() string {
+	return m.metricName
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	type sample struct {
+		labels string
+		value  float64
+	}
+
+	samples := make([]sample, 0)
+	m.collect(func(value float64, labelValues ...string) {
+		samples = append(samples, sample{
+			labels: formatLabels(m.labelNames, labelValues, "", ""),
+			value:  value,
+		})
+	})
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].labels < samples[j].labels
+	})
+
+	writeHeader(w, m.metricName, m.help, m.kind)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", m.metricName, s.labels, formatValue(s.value))
+	}
+}
+
+// HistogramVec is a histogram partitioned by label values
+type HistogramVec struct {
+	metricName string
+	help       string
+	buckets    []float64
+	labelNames []string
+	series     map[string]*histogramSeries
+	mutex      sync.Mutex
+}
+
+// histogramSeries is the state of one label combination
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+// NewHistogramVec creates a histogram with the given upper bucket bounds
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	sorted := make([]float64, len(buckets))
+	copy(sorted, buckets)
+	sort.Float64s(sorted)
+
+	return &HistogramVec{
+		metricName: name,
+		help:       help,
+		buckets:    sorted,
+		labelNames: labelNames,
+		series:     make(map[string]*histogramSeries),
+	}
+}
+
+// Observe records a value for the given label values
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{
+			labelValues: append([]string(nil), labelValues...),
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = s
+	}
+
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// Count returns the number of observations for the given label values
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if s, ok := h.series[strings.Join(labelValues, "\xff")]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) name() string {
+	return h.metricName
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	writeHeader(w, h.metricName, h.help, "histogram")
+	for _, k := range keys {
+		s := h.series[k]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName,
+				formatLabels(h.labelNames, s.labelValues, "le", formatValue(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName,
+			formatLabels(h.labelNames, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName,
+			formatLabels(h.labelNames, s.labelValues, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName,
+			formatLabels(h.labelNames, s.labelValues, "", ""), s.count)
+	}
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric family
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// labelEscaper escapes label values as required by the exposition format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders a label set, with an optional extra label appended
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		fmt.Fprintf(&b, `%s="%s"`, name, labelEscaper.Replace(value))
+	}
+	if extraName != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, extraName, labelEscaper.Replace(extraValue))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// formatValue renders a sample value
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(r *Registry) string {
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	return rec.Body.String()
+}
+
+// TestFuncMetrics tests counters and gauges read at scrape time
+func TestFuncMetrics(t *testing.T) {
+	r := NewRegistry()
+	value := 3.0
+	r.CounterFunc("test_total", "A test counter.", nil, func(emit EmitFunc) {
+		emit(value)
+	})
+	r.GaugeFunc("test_by_analyzer", "A labeled gauge.", []string{"analyzer"}, func(emit EmitFunc) {
+		emit(2, "analyzer2")
+		emit(1, `ana"lyzer1`)
+	})
+
+	value = 5
+	output := scrape(r)
+
+	expected := []string{
+		"# HELP test_total A test counter.",
+		"# TYPE test_total counter",
+		"test_total 5",
+		"# TYPE test_by_analyzer gauge",
+		`test_by_analyzer{analyzer="ana\"lyzer1"} 1`,
+		`test_by_analyzer{analyzer="analyzer2"} 2`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("Expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+}
+
+// TestHistogram tests cumulative buckets, sum and count
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := NewHistogramVec("test_seconds", "A test histogram.", []float64{0.1, 1}, "analyzer")
+	r.Register(h)
+
+	h.Observe(0.05, "analyzer1")
+	h.Observe(0.5, "analyzer1")
+	h.Observe(5, "analyzer1")
+
+	output := scrape(r)
+	expected := []string{
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{analyzer="analyzer1",le="0.1"} 1`,
+		`test_seconds_bucket{analyzer="analyzer1",le="1"} 2`,
+		`test_seconds_bucket{analyzer="analyzer1",le="+Inf"} 3`,
+		`test_seconds_sum{analyzer="analyzer1"} 5.55`,
+		`test_seconds_count{analyzer="analyzer1"} 3`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("Expected output to contain %q, got:\n%s", line, output)
+		}
+	}
+
+	if h.Count("analyzer1") != 3 {
+		t.Errorf("Expected 3 observations, got %d", h.Count("analyzer1"))
+	}
+}
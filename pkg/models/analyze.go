@@ -0,0 +1,47 @@
+package models
+
+// AnalyzeStatus summarizes how an analyzer handled a log packet
+type AnalyzeStatus string
+
+// Analyze statuses
+const (
+	// AnalyzeProcessed means every log message was accepted
+	AnalyzeProcessed AnalyzeStatus = "processed"
+	// AnalyzePartial means some log messages were rejected or deferred
+	AnalyzePartial AnalyzeStatus = "partial"
+)
+
+// LogRejection identifies a log message the analyzer will not process
+type LogRejection struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// AnalyzeResponse is the body an analyzer returns from POST /analyze.
+//
+// Log messages that are neither rejected nor deferred count as accepted, so
+// an analyzer that returns only {"status":"processed"} accepts the whole
+// packet. Rejected messages are re-routed to a different analyzer; deferred
+// messages are retried later, after any Retry-After the analyzer sends.
+type AnalyzeResponse struct {
+	Status   AnalyzeStatus  `json:"status"`
+	Accepted []string       `json:"accepted,omitempty"`
+	Rejected []LogRejection `json:"rejected,omitempty"`
+	Deferred []string       `json:"deferred,omitempty"`
+}
+
+// AnalyzeBatch is the body of POST /analyze/batch, which analyzers with
+// batching enabled receive instead of one request per packet
+type AnalyzeBatch struct {
+	Packets []LogPacket `json:"packets"`
+	// IdempotencyKeys line up with the packets when the distributor sends
+	// idempotency keys
+	IdempotencyKeys []string `json:"idempotency_keys,omitempty"`
+}
+
+// AnalyzeBatchResponse is the body an analyzer returns from POST
+// /analyze/batch. Results line up with the packets of the batch; a packet
+// without a result counts as accepted.
+type AnalyzeBatchResponse struct {
+	Results []AnalyzeResponse `json:"results"`
+}
@@ -34,4 +34,7 @@ type LogPacket struct {
 	ReceivedAt  time.Time              `json:"received_at"`
 	LogMessages []LogMessage           `json:"log_messages"`
 	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	// Priority picks the distributor's priority lane for the packet in place
+	// of its most severe log level
+	Priority LogLevel `json:"priority,omitempty"`
 }
@@ -0,0 +1,25 @@
+package models
+
+// AnalyzerRegistration is the body an analyzer sends to
+// POST /api/v1/analyzers/register when it starts
+type AnalyzerRegistration struct {
+	ID     string  `json:"id"`
+	URL    string  `json:"url"`
+	Weight float64 `json:"weight"`
+	// Capabilities describe what the analyzer can process, such as log
+	// sources or formats
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Group is the analyzer group to join, the default group if empty
+	Group string `json:"group,omitempty"`
+}
+
+// RegistrationLease is returned when an analyzer registers or renews its
+// lease. The analyzer is dropped from the pool unless it sends a heartbeat
+// to POST /api/v1/analyzers/{id}/heartbeat before the lease expires.
+type RegistrationLease struct {
+	ID string `json:"id"`
+	// LeaseSeconds is how long the registration lasts without a heartbeat
+	LeaseSeconds float64 `json:"lease_seconds"`
+	// HeartbeatSeconds is how often the analyzer should send heartbeats
+	HeartbeatSeconds float64 `json:"heartbeat_seconds"`
+}
@@ -0,0 +1,366 @@
+// Package ratelimit keeps each agent to its rate limits and daily quotas
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often agents that have been idle since before the
+// current quota day are forgotten
+const sweepInterval = time.Minute
+
+// Limits bound what an agent may send. Rates are token buckets refilling at
+// the given rate up to the burst; quotas reset at midnight UTC. Zero values
+// are unlimited.
+type Limits struct {
+	PacketsPerSecond  float64 `json:"packets_per_second"`
+	PacketBurst       int     `json:"packet_burst"`
+	MessagesPerSecond float64 `json:"messages_per_second"`
+	MessageBurst      int     `json:"message_burst"`
+	DailyPackets      int64   `json:"daily_packets"`
+	DailyMessages     int64   `json:"daily_messages"`
+}
+
+// Validate reports negative limits
+func (l Limits) Validate() error {
+	if l.PacketsPerSecond < 0 || l.PacketBurst < 0 || l.MessagesPerSecond < 0 ||
+		l.MessageBurst < 0 || l.DailyPackets < 0 || l.DailyMessages < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+// LimitError is returned for a packet over one of the agent's limits
+type LimitError struct {
+	AgentID string
+	// Limit names the exceeded limit, such as "packets_per_second"
+	Limit string
+	// RetryAfter is how long until the packet would be allowed
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("agent %q is over its %s limit, retry after %s", e.AgentID, e.Limit, e.RetryAfter.Round(time.Millisecond))
+}
+
+// Usage describes an agent's limits and what it has used of them
+type Usage struct {
+	AgentID string `json:"agent_id"`
+	Limits  Limits `json:"limits"`
+	// Custom is set when the agent has limits of its own rather than the
+	// defaults
+	Custom bool `json:"custom"`
+	// PacketTokens and MessageTokens are what is left in the rate buckets
+	PacketTokens  float64 `json:"packet_tokens"`
+	MessageTokens float64 `json:"message_tokens"`
+	// DailyPackets and DailyMessages count what was allowed since
+	// QuotaResetAt
+	DailyPackets  int64     `json:"daily_packets"`
+	DailyMessages int64     `json:"daily_messages"`
+	QuotaResetAt  time.Time `json:"quota_reset_at"`
+	// Limited counts the packets turned away
+	Limited int64 `json:"limited"`
+}
+
+// bucket is a token bucket
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// capacity returns the most tokens a bucket with the given rate and burst
+// holds. Without a burst it holds one second's worth, and at least one.
+func capacity(rate float64, burst int) float64 {
+	if burst > 0 {
+		return float64(burst)
+	}
+	return math.Max(1, math.Ceil(rate))
+}
+
+// refill adds the tokens earned since the last update
+func (b *bucket) refill(rate, capacity float64, now time.Time) {
+	if b.updated.IsZero() {
+		b.tokens = capacity
+	} else if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(capacity, b.tokens+elapsed*rate)
+	}
+	b.updated = now
+}
+
+// wait returns how long until n tokens are available. A request larger than
+// the bucket only needs a full bucket and leaves it in debt.
+func (b *bucket) wait(n, rate, capacity float64) time.Duration {
+	need := math.Min(n, capacity)
+	if b.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - b.tokens) / rate * float64(time.Second))
+}
+
+// agentState is the limiter's record of one agent
+type agentState struct {
+	limits        *Limits
+	packets       bucket
+	messages      bucket
+	day           time.Time
+	dailyPackets  int64
+	dailyMessages int64
+	limited       int64
+	lastSeen      time.Time
+}
+
+// Limiter enforces limits per agent
+type Limiter struct {
+	defaults  Limits
+	agents    map[string]*agentState
+	lastSweep time.Time
+	mutex     sync.Mutex
+	now       func() time.Time
+}
+
+// NewLimiter creates a limiter applying defaults to agents without limits of
+// their own
+func NewLimiter(defaults Limits) *Limiter {
+	return &Limiter{
+		defaults: defaults,
+		agents:   make(map[string]*agentState),
+		now:      time.Now,
+	}
+}
+
+// startOfDay returns midnight UTC of the day of t
+func startOfDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// Allow takes one packet of the given number of log messages from the agent's
+// limits. It returns a *LimitError, and takes nothing, if any limit would be
+// exceeded.
+func (l *Limiter) Allow(agentID string, messages int) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	state := l.state(agentID, now)
+	limits := l.limitsOf(state)
+
+	packetCap := capacity(limits.PacketsPerSecond, limits.PacketBurst)
+	messageCap := capacity(limits.MessagesPerSecond, limits.MessageBurst)
+	state.packets.refill(limits.PacketsPerSecond, packetCap, now)
+	state.messages.refill(limits.MessagesPerSecond, messageCap, now)
+
+	limit, retryAfter := "", time.Duration(0)
+	exceed := func(name string, wait time.Duration) {
+		if wait > retryAfter {
+			limit, retryAfter = name, wait
+		}
+	}
+
+	untilReset := state.day.Add(24 * time.Hour).Sub(now)
+	if limits.DailyPackets > 0 && state.dailyPackets+1 > limits.DailyPackets {
+		exceed("daily_packets", untilReset)
+	}
+	if limits.DailyMessages > 0 && state.dailyMessages+int64(messages) > limits.DailyMessages {
+		exceed("daily_messages", untilReset)
+	}
+	if limits.PacketsPerSecond > 0 {
+		exceed("packets_per_second", state.packets.wait(1, limits.PacketsPerSecond, packetCap))
+	}
+	if limits.MessagesPerSecond > 0 {
+		exceed("messages_per_second", state.messages.wait(float64(messages), limits.MessagesPerSecond, messageCap))
+	}
+
+	if limit != "" {
+		state.limited++
+		return &LimitError{AgentID: agentID, Limit: limit, RetryAfter: retryAfter}
+	}
+
+	if limits.PacketsPerSecond > 0 {
+		state.packets.tokens--
+	}
+	if limits.MessagesPerSecond > 0 {
+		state.messages.tokens -= float64(messages)
+	}
+	state.dailyPackets++
+	state.dailyMessages += int64(messages)
+	return nil
+}
+
+// Refund gives back a packet that Allow took but that was not accepted
+// after all, such as a duplicate or one turned away by a full queue
+func (l *Limiter) Refund(agentID string, messages int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	state, ok := l.agents[agentID]
+	if !ok {
+		return
+	}
+	now := l.now()
+	limits := l.limitsOf(state)
+
+	if startOfDay(now).Equal(state.day) {
+		state.dailyPackets = max(0, state.dailyPackets-1)
+		state.dailyMessages = max(0, state.dailyMessages-int64(messages))
+	}
+	if limits.PacketsPerSecond > 0 {
+		packetCap := capacity(limits.PacketsPerSecond, limits.PacketBurst)
+		state.packets.refill(limits.PacketsPerSecond, packetCap, now)
+		state.packets.tokens = math.Min(packetCap, state.packets.tokens+1)
+	}
+	if limits.MessagesPerSecond > 0 {
+		messageCap := capacity(limits.MessagesPerSecond, limits.MessageBurst)
+		state.messages.refill(limits.MessagesPerSecond, messageCap, now)
+		state.messages.tokens = math.Min(messageCap, state.messages.tokens+float64(messages))
+	}
+}
+
+// state returns the record of an agent, starting a new quota day if the
+// last one is over. The caller must hold the mutex.
+func (l *Limiter) state(agentID string, now time.Time) *agentState {
+	state, ok := l.agents[agentID]
+	if !ok {
+		state = &agentState{}
+		l.agents[agentID] = state
+	}
+	if day := startOfDay(now); !state.day.Equal(day) {
+		state.day = day
+		state.dailyPackets, state.dailyMessages = 0, 0
+	}
+	state.lastSeen = now
+	return state
+}
+
+// limitsOf returns the limits that apply to an agent. The caller must hold
+// the mutex.
+func (l *Limiter) limitsOf(state *agentState) Limits {
+	if state.limits != nil {
+		return *state.limits
+	}
+	return l.defaults
+}
+
+// sweep forgets agents without limits of their own that have not been seen
+// on the current quota day. The caller must hold the mutex.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	today := startOfDay(now)
+	for id, state := range l.agents {
+		if state.limits == nil && state.lastSeen.Before(today) {
+			delete(l.agents, id)
+		}
+	}
+}
+
+// usage describes an agent. The caller must hold the mutex.
+func (l *Limiter) usage(agentID string, state *agentState, now time.Time) Usage {
+	limits := l.limitsOf(state)
+	usage := Usage{
+		AgentID:      agentID,
+		Limits:       limits,
+		Custom:       state.limits != nil,
+		QuotaResetAt: state.day.Add(24 * time.Hour),
+		Limited:      state.limited,
+	}
+	if startOfDay(now).Equal(state.day) {
+		usage.DailyPackets, usage.DailyMessages = state.dailyPackets, state.dailyMessages
+	} else {
+		usage.QuotaResetAt = startOfDay(now).Add(24 * time.Hour)
+	}
+
+	// Report the buckets as they would be now without changing them
+	packets, messages := state.packets, state.messages
+	packets.refill(limits.PacketsPerSecond, capacity(limits.PacketsPerSecond, limits.PacketBurst), now)
+	messages.refill(limits.MessagesPerSecond, capacity(limits.MessagesPerSecond, limits.MessageBurst), now)
+	if limits.PacketsPerSecond > 0 {
+		usage.PacketTokens = packets.tokens
+	}
+	if limits.MessagesPerSecond > 0 {
+		usage.MessageTokens = messages.tokens
+	}
+	return usage
+}
+
+// Usage returns an agent's limits and usage. Agents that have not sent
+// anything yet report the defaults and no usage.
+func (l *Limiter) Usage(agentID string) Usage {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	state, ok := l.agents[agentID]
+	if !ok {
+		state = &agentState{day: startOfDay(now)}
+	}
+	return l.usage(agentID, state, now)
+}
+
+// List returns the limits and usage of every known agent, ordered by ID
+func (l *Limiter) List() []Usage {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	result := make([]Usage, 0, len(l.agents))
+	for id, state := range l.agents {
+		result = append(result, l.usage(id, state, now))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].AgentID < result[j].AgentID })
+	return result
+}
+
+// SetLimits gives an agent limits of its own. Its current usage is kept.
+func (l *Limiter) SetLimits(agentID string, limits Limits) error {
+	if err := limits.Validate(); err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	state, ok := l.agents[agentID]
+	if !ok {
+		state = &agentState{day: startOfDay(l.now()), lastSeen: l.now()}
+		l.agents[agentID] = state
+	}
+	state.limits = &limits
+	return nil
+}
+
+// ResetLimits puts an agent back on the default limits
+func (l *Limiter) ResetLimits(agentID string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if state, ok := l.agents[agentID]; ok {
+		state.limits = nil
+	}
+}
+
+// Defaults returns the limits of agents without limits of their own
+func (l *Limiter) Defaults() Limits {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.defaults
+}
+
+// SetDefaults changes the limits of agents without limits of their own
+func (l *Limiter) SetDefaults(limits Limits) error {
+	if err := limits.Validate(); err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.defaults = limits
+	return nil
+}
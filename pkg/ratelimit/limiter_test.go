@@ -0,0 +1,203 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestLimiter creates a limiter whose clock is moved by the returned
+// function
+func newTestLimiter(defaults Limits) (*Limiter, func(time.Duration)) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter := NewLimiter(defaults)
+	limiter.now = func() time.Time { return now }
+	return limiter, func(d time.Duration) { now = now.Add(d) }
+}
+
+// limitOf returns the name of the limit err reports, or an empty string
+func limitOf(t *testing.T, err error) string {
+	t.Helper()
+	if err == nil {
+		return ""
+	}
+	var limited *LimitError
+	if !errors.As(err, &limited) {
+		t.Fatalf("Expected a LimitError, got %v", err)
+	}
+	return limited.Limit
+}
+
+// TestPacketRate tests that packets beyond the burst wait for the bucket to
+// refill
+func TestPacketRate(t *testing.T) {
+	limiter, advance := newTestLimiter(Limits{PacketsPerSecond: 2, PacketBurst: 3})
+
+	for i := 0; i < 3; i++ {
+		if err := limiter.Allow("agent1", 1); err != nil {
+			t.Fatalf("Expected packet %d to be allowed, got %v", i, err)
+		}
+	}
+
+	err := limiter.Allow("agent1", 1)
+	if limit := limitOf(t, err); limit != "packets_per_second" {
+		t.Fatalf("Expected the packets_per_second limit, got %q", limit)
+	}
+	var limited *LimitError
+	errors.As(err, &limited)
+	if limited.RetryAfter != 500*time.Millisecond {
+		t.Errorf("Expected to retry after 500ms, got %v", limited.RetryAfter)
+	}
+
+	// Other agents have buckets of their own
+	if err := limiter.Allow("agent2", 1); err != nil {
+		t.Errorf("Expected agent2 to be allowed, got %v", err)
+	}
+
+	advance(500 * time.Millisecond)
+	if err := limiter.Allow("agent1", 1); err != nil {
+		t.Errorf("Expected a packet to be allowed after refilling, got %v", err)
+	}
+	if usage := limiter.Usage("agent1"); usage.Limited != 1 || usage.DailyPackets != 4 {
+		t.Errorf("Expected 1 limited and 4 allowed packets, got %d and %d", usage.Limited, usage.DailyPackets)
+	}
+}
+
+// TestMessageRate tests that messages are limited per packet, and that a
+// packet larger than the burst is allowed from a full bucket
+func TestMessageRate(t *testing.T) {
+	limiter, advance := newTestLimiter(Limits{MessagesPerSecond: 10, MessageBurst: 10})
+
+	if err := limiter.Allow("agent1", 8); err != nil {
+		t.Fatalf("Expected 8 messages to be allowed, got %v", err)
+	}
+	if limit := limitOf(t, limiter.Allow("agent1", 5)); limit != "messages_per_second" {
+		t.Errorf("Expected the messages_per_second limit, got %q", limit)
+	}
+
+	// A rejected packet takes nothing from the bucket
+	if err := limiter.Allow("agent1", 2); err != nil {
+		t.Errorf("Expected 2 messages to be allowed, got %v", err)
+	}
+
+	advance(time.Second)
+	if err := limiter.Allow("agent1", 25); err != nil {
+		t.Errorf("Expected a packet larger than the burst to be allowed from a full bucket, got %v", err)
+	}
+	if usage := limiter.Usage("agent1"); usage.MessageTokens != -15 {
+		t.Errorf("Expected the bucket to be 15 tokens in debt, got %v", usage.MessageTokens)
+	}
+}
+
+// TestDailyQuota tests that quotas hold until midnight UTC
+func TestDailyQuota(t *testing.T) {
+	limiter, advance := newTestLimiter(Limits{DailyPackets: 2, DailyMessages: 5})
+
+	if err := limiter.Allow("agent1", 3); err != nil {
+		t.Fatalf("Expected the first packet to be allowed, got %v", err)
+	}
+	if limit := limitOf(t, limiter.Allow("agent1", 3)); limit != "daily_messages" {
+		t.Errorf("Expected the daily_messages limit, got %q", limit)
+	}
+	if err := limiter.Allow("agent1", 2); err != nil {
+		t.Fatalf("Expected the second packet to be allowed, got %v", err)
+	}
+
+	err := limiter.Allow("agent1", 0)
+	if limit := limitOf(t, err); limit != "daily_packets" {
+		t.Fatalf("Expected the daily_packets limit, got %q", limit)
+	}
+	var limited *LimitError
+	errors.As(err, &limited)
+	if limited.RetryAfter != 12*time.Hour {
+		t.Errorf("Expected to retry after 12h, got %v", limited.RetryAfter)
+	}
+
+	advance(12 * time.Hour)
+	if err := limiter.Allow("agent1", 5); err != nil {
+		t.Errorf("Expected the quota to reset at midnight, got %v", err)
+	}
+}
+
+// TestRefund tests that a refunded packet no longer counts against the
+// agent's limits
+func TestRefund(t *testing.T) {
+	limiter, _ := newTestLimiter(Limits{PacketsPerSecond: 1, PacketBurst: 1, DailyMessages: 5})
+
+	if err := limiter.Allow("agent1", 5); err != nil {
+		t.Fatalf("Expected the packet to be allowed, got %v", err)
+	}
+	if limit := limitOf(t, limiter.Allow("agent1", 1)); limit == "" {
+		t.Fatal("Expected the agent to be over its limits")
+	}
+
+	limiter.Refund("agent1", 5)
+	if usage := limiter.Usage("agent1"); usage.DailyPackets != 0 || usage.DailyMessages != 0 || usage.PacketTokens != 1 {
+		t.Errorf("Expected the refund to restore the limits, got %+v", usage)
+	}
+	if err := limiter.Allow("agent1", 5); err != nil {
+		t.Errorf("Expected the packet to be allowed after a refund, got %v", err)
+	}
+
+	// Refunds never raise a bucket above its burst
+	limiter.Refund("agent1", 5)
+	limiter.Refund("agent1", 5)
+	if usage := limiter.Usage("agent1"); usage.PacketTokens != 1 || usage.DailyPackets != 0 {
+		t.Errorf("Expected a full bucket and no usage, got %+v", usage)
+	}
+}
+
+// TestCustomLimits tests that agents can be given limits of their own and
+// put back on the defaults
+func TestCustomLimits(t *testing.T) {
+	limiter, _ := newTestLimiter(Limits{DailyPackets: 1})
+
+	if err := limiter.SetLimits("agent1", Limits{DailyPackets: -1}); err == nil {
+		t.Error("Expected negative limits to be rejected")
+	}
+	if err := limiter.SetLimits("agent1", Limits{DailyPackets: 2}); err != nil {
+		t.Fatalf("Failed to set limits: %v", err)
+	}
+
+	limiter.Allow("agent1", 1)
+	if err := limiter.Allow("agent1", 1); err != nil {
+		t.Errorf("Expected the custom quota to apply, got %v", err)
+	}
+
+	usage := limiter.Usage("agent1")
+	if !usage.Custom || usage.Limits.DailyPackets != 2 {
+		t.Errorf("Expected custom limits of 2 daily packets, got %+v", usage)
+	}
+
+	limiter.ResetLimits("agent1")
+	if usage := limiter.Usage("agent1"); usage.Custom || usage.Limits.DailyPackets != 1 || usage.DailyPackets != 2 {
+		t.Errorf("Expected the defaults with usage kept, got %+v", usage)
+	}
+
+	if err := limiter.SetDefaults(Limits{}); err != nil {
+		t.Fatalf("Failed to set defaults: %v", err)
+	}
+	if err := limiter.Allow("agent1", 1); err != nil {
+		t.Errorf("Expected no limits after clearing the defaults, got %v", err)
+	}
+}
+
+// TestSweep tests that idle agents without custom limits are forgotten
+// once a new quota day starts
+func TestSweep(t *testing.T) {
+	limiter, advance := newTestLimiter(Limits{})
+
+	limiter.Allow("agent1", 1)
+	limiter.SetLimits("agent2", Limits{DailyPackets: 10})
+	if agents := limiter.List(); len(agents) != 2 || agents[0].AgentID != "agent1" {
+		t.Fatalf("Expected agent1 and agent2, got %+v", agents)
+	}
+
+	advance(24 * time.Hour)
+	limiter.Allow("agent3", 1)
+
+	agents := limiter.List()
+	if len(agents) != 2 || agents[0].AgentID != "agent2" || agents[1].AgentID != "agent3" {
+		t.Errorf("Expected agent2 and agent3, got %+v", agents)
+	}
+}
@@ -0,0 +1,181 @@
+package registration
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// ErrNotRegistered is returned by Heartbeat when the distributor no longer
+// knows the analyzer, for example after its lease expired
+var ErrNotRegistered = errors.New("analyzer is not registered with the distributor")
+
+// Client registers an analyzer with a distributor and keeps its lease alive
+type Client struct {
+	distributorURL string
+	registration   models.AnalyzerRegistration
+	httpClient     *http.Client
+	retryInterval  time.Duration
+}
+
+// NewClient creates a client registering with the distributor at
+// distributorURL
+func NewClient(distributorURL string, registration models.AnalyzerRegistration) *Client {
+	return &Client{
+		distributorURL: strings.TrimRight(distributorURL, "/"),
+		registration:   registration,
+		httpClient: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+		retryInterval: 2 * time.Second,
+	}
+}
+
+// SetTLS sets the TLS settings used to reach an https:// distributor, such as
+// its CA and the analyzer's client certificate
+func (c *Client) SetTLS(config *tls.Config) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	c.httpClient.Transport = transport
+}
+
+// Run registers the analyzer, retrying until the distributor answers, then
+// sends heartbeats until ctx is canceled and finally deregisters
+func (c *Client) Run(ctx context.Context) {
+	lease, ok := c.registerUntilDone(ctx)
+	if !ok {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			deregisterCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := c.Deregister(deregisterCtx); err != nil {
+				log.Printf("Failed to deregister analyzer %s: %v\n", c.registration.ID, err)
+			}
+			return
+		case <-time.After(heartbeatInterval(lease)):
+		}
+
+		renewed, err := c.Heartbeat(ctx)
+		switch {
+		case errors.Is(err, ErrNotRegistered):
+			log.Printf("Analyzer %s lost its registration, registering again\n", c.registration.ID)
+			if lease, ok = c.registerUntilDone(ctx); !ok {
+				return
+			}
+		case err != nil:
+			// Keep the old lease timing and try again on the next beat
+			log.Printf("Heartbeat for analyzer %s failed: %v\n", c.registration.ID, err)
+		default:
+			lease = renewed
+		}
+	}
+}
+
+// registerUntilDone registers, retrying until it succeeds or ctx is canceled
+func (c *Client) registerUntilDone(ctx context.Context) (models.RegistrationLease, bool) {
+	for {
+		lease, err := c.Register(ctx)
+		if err == nil {
+			log.Printf("Analyzer %s registered with %s, lease %.0fs\n",
+				c.registration.ID, c.distributorURL, lease.LeaseSeconds)
+			return lease, true
+		}
+		log.Printf("Failed to register analyzer %s: %v\n", c.registration.ID, err)
+
+		select {
+		case <-ctx.Done():
+			return models.RegistrationLease{}, false
+		case <-time.After(c.retryInterval):
+		}
+	}
+}
+
+// Register announces the analyzer to the distributor
+func (c *Client) Register(ctx context.Context) (models.RegistrationLease, error) {
+	body, err := json.Marshal(c.registration)
+	if err != nil {
+		return models.RegistrationLease{}, fmt.Errorf("failed to marshal registration: %w", err)
+	}
+	return c.leaseRequest(ctx, http.MethodPost, "/api/v1/analyzers/register", body)
+}
+
+// Heartbeat renews the analyzer's lease
+func (c *Client) Heartbeat(ctx context.Context) (models.RegistrationLease, error) {
+	return c.leaseRequest(ctx, http.MethodPost, "/api/v1/analyzers/"+url.PathEscape(c.registration.ID)+"/heartbeat", nil)
+}
+
+// Deregister removes the analyzer from the distributor's pool
+func (c *Client) Deregister(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete,
+		c.distributorURL+"/api/v1/analyzers/"+url.PathEscape(c.registration.ID), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to deregister: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("distributor returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// leaseRequest sends a request that the distributor answers with a lease
+func (c *Client) leaseRequest(ctx context.Context, method, path string, body []byte) (models.RegistrationLease, error) {
+	var lease models.RegistrationLease
+
+	req, err := http.NewRequestWithContext(ctx, method, c.distributorURL+path, bytes.NewReader(body))
+	if err != nil {
+		return lease, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return lease, fmt.Errorf("failed to reach distributor: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+	case http.StatusNotFound:
+		return lease, ErrNotRegistered
+	default:
+		return lease, fmt.Errorf("distributor returned status %d", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&lease); err != nil {
+		return lease, fmt.Errorf("failed to decode lease: %w", err)
+	}
+	return lease, nil
+}
+
+// heartbeatInterval returns how long to wait before the next heartbeat
+func heartbeatInterval(lease models.RegistrationLease) time.Duration {
+	interval := time.Duration(lease.HeartbeatSeconds * float64(time.Second))
+	if interval <= 0 {
+		interval = time.Duration(lease.LeaseSeconds * float64(time.Second) / 3)
+	}
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	return interval
+}
@@ -0,0 +1,115 @@
+package registration
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// fakeDistributor records the registration calls it receives
+type fakeDistributor struct {
+	registrations []models.AnalyzerRegistration
+	heartbeats    int
+	deregistered  bool
+	failRegister  int
+	forgetOnBeat  int
+	mutex         sync.Mutex
+}
+
+func (f *fakeDistributor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	lease := models.RegistrationLease{ID: "analyzer1", LeaseSeconds: 0.03, HeartbeatSeconds: 0.01}
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1/analyzers/register":
+		if f.failRegister > 0 {
+			f.failRegister--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var registration models.AnalyzerRegistration
+		json.NewDecoder(r.Body).Decode(&registration)
+		f.registrations = append(f.registrations, registration)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(lease)
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1/analyzers/analyzer1/heartbeat":
+		f.heartbeats++
+		if f.heartbeats == f.forgetOnBeat {
+			http.Error(w, "not registered", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(lease)
+	case r.Method == http.MethodDelete && r.URL.Path == "/api/v1/analyzers/analyzer1":
+		f.deregistered = true
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// TestRunLifecycle tests registering, heartbeating, re-registering after the
+// distributor forgets the analyzer, and deregistering on shutdown
+func TestRunLifecycle(t *testing.T) {
+	fake := &fakeDistributor{failRegister: 1, forgetOnBeat: 2}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client := NewClient(server.URL+"/", models.AnalyzerRegistration{
+		ID:           "analyzer1",
+		URL:          "http://localhost:8081",
+		Weight:       0.4,
+		Capabilities: []string{"json"},
+	})
+	client.retryInterval = 5 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		client.Run(ctx)
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Run to return after cancel")
+	}
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	// One registration after the failed attempt, one after the lost lease
+	if len(fake.registrations) != 2 {
+		t.Errorf("Expected 2 registrations, got %d", len(fake.registrations))
+	}
+	if r := fake.registrations[0]; r.Weight != 0.4 || len(r.Capabilities) != 1 || r.Capabilities[0] != "json" {
+		t.Errorf("Expected the registration to carry weight and capabilities, got %+v", r)
+	}
+	if fake.heartbeats < 3 {
+		t.Errorf("Expected several heartbeats, got %d", fake.heartbeats)
+	}
+	if !fake.deregistered {
+		t.Error("Expected the analyzer to deregister on shutdown")
+	}
+}
+
+// TestHeartbeatNotRegistered tests that a 404 is reported as ErrNotRegistered
+func TestHeartbeatNotRegistered(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	client := NewClient(server.URL, models.AnalyzerRegistration{ID: "analyzer1"})
+	if _, err := client.Heartbeat(context.Background()); err != ErrNotRegistered {
+		t.Errorf("Expected ErrNotRegistered, got %v", err)
+	}
+}
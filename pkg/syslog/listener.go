@@ -0,0 +1,463 @@
+package syslog
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ryouol/log-distributor/pkg/distributor"
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// Enqueuer takes packets for delivery, as the API server does after
+// validating them and applying rate limits. Enqueue returns
+// distributor.ErrQueueFull for a packet that may be offered again later.
+type Enqueuer interface {
+	Enqueue(packet *models.LogPacket) error
+}
+
+// Config configures a Listener
+type Config struct {
+	// UDPAddr and TCPAddr are the addresses to listen on, disabled if empty
+	UDPAddr string
+	TCPAddr string
+	// BatchSize is the most messages from one sender put into a packet
+	BatchSize int
+	// FlushInterval is how long a sender's messages are collected before
+	// they are enqueued as a packet
+	FlushInterval time.Duration
+	// MaxMessageSize is the longest message accepted
+	MaxMessageSize int
+}
+
+// DefaultConfig returns the batching and size limits used for unset fields
+func DefaultConfig() Config {
+	return Config{
+		BatchSize:      100,
+		FlushInterval:  time.Second,
+		MaxMessageSize: 64 * 1024,
+	}
+}
+
+// normalized fills in defaults for unset fields
+func (c Config) normalized() Config {
+	defaults := DefaultConfig()
+	if c.BatchSize <= 0 {
+		c.BatchSize = defaults.BatchSize
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = defaults.FlushInterval
+	}
+	if c.MaxMessageSize <= 0 {
+		c.MaxMessageSize = defaults.MaxMessageSize
+	}
+	return c
+}
+
+// Stats counts what a Listener received
+type Stats struct {
+	Received int64 `json:"received"`
+	Invalid  int64 `json:"invalid"`
+	Enqueued int64 `json:"enqueued"`
+	// Dropped messages were refused by a full queue, which only happens for
+	// UDP or while stopping
+	Dropped int64 `json:"dropped"`
+	// Rejected messages failed validation or were over their agent's rate
+	// limits
+	Rejected int64 `json:"rejected"`
+}
+
+// enqueueRetryInterval is how often a TCP sender's packet is offered again
+// to a full queue
+const enqueueRetryInterval = 50 * time.Millisecond
+
+// Listener receives syslog messages and enqueues them as log packets, one
+// packet per sender and batch. Packets refused by a full queue are dropped
+// for UDP; for TCP the connection stops being read until the queue takes
+// them, so the sender is slowed down instead.
+type Listener struct {
+	config   Config
+	enqueuer Enqueuer
+	udpConn  net.PacketConn
+	tcpLn    net.Listener
+
+	conns    map[net.Conn]struct{}
+	connsMu  sync.Mutex
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+
+	received atomic.Int64
+	invalid  atomic.Int64
+	enqueued atomic.Int64
+	dropped  atomic.Int64
+	rejected atomic.Int64
+}
+
+// Listen binds the configured addresses
+func Listen(config Config, enqueuer Enqueuer) (*Listener, error) {
+	l := &Listener{
+		config:   config.normalized(),
+		enqueuer: enqueuer,
+		conns:    make(map[net.Conn]struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if config.UDPAddr != "" {
+		conn, err := net.ListenPacket("udp", config.UDPAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on udp %s: %w", config.UDPAddr, err)
+		}
+		l.udpConn = conn
+	}
+	if config.TCPAddr != "" {
+		ln, err := net.Listen("tcp", config.TCPAddr)
+		if err != nil {
+			if l.udpConn != nil {
+				l.udpConn.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on tcp %s: %w", config.TCPAddr, err)
+		}
+		l.tcpLn = ln
+	}
+	return l, nil
+}
+
+// UDPAddr returns the bound UDP address, nil if UDP is disabled
+func (l *Listener) UDPAddr() net.Addr {
+	if l.udpConn == nil {
+		return nil
+	}
+	return l.udpConn.LocalAddr()
+}
+
+// TCPAddr returns the bound TCP address, nil if TCP is disabled
+func (l *Listener) TCPAddr() net.Addr {
+	if l.tcpLn == nil {
+		return nil
+	}
+	return l.tcpLn.Addr()
+}
+
+// Start begins receiving messages
+func (l *Listener) Start() {
+	if l.udpConn != nil {
+		l.wg.Add(1)
+		go l.serveUDP()
+	}
+	if l.tcpLn != nil {
+		l.wg.Add(1)
+		go l.serveTCP()
+	}
+}
+
+// Stop closes the listeners and connections, enqueues the messages already
+// collected and waits for every goroutine to finish or ctx to be done
+func (l *Listener) Stop(ctx context.Context) error {
+	l.stopOnce.Do(func() {
+		close(l.done)
+		if l.udpConn != nil {
+			l.udpConn.Close()
+		}
+		if l.tcpLn != nil {
+			l.tcpLn.Close()
+		}
+		l.connsMu.Lock()
+		for conn := range l.conns {
+			conn.Close()
+		}
+		l.connsMu.Unlock()
+	})
+
+	stopped := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stats returns the message counters
+func (l *Listener) Stats() Stats {
+	return Stats{
+		Received: l.received.Load(),
+		Invalid:  l.invalid.Load(),
+		Enqueued: l.enqueued.Load(),
+		Dropped:  l.dropped.Load(),
+		Rejected: l.rejected.Load(),
+	}
+}
+
+// batch collects the messages of one sender
+type batch struct {
+	sender    string
+	transport string
+	packet    *models.LogPacket
+	started   time.Time
+}
+
+// add parses a message into the batch, starting a packet if needed
+func (l *Listener) add(b *batch, data []byte) {
+	l.received.Add(1)
+	msg, err := Parse(data)
+	if err != nil {
+		l.invalid.Add(1)
+		return
+	}
+
+	if b.packet == nil {
+		// Name the agent after the host that logged, falling back to the
+		// address the messages came from
+		agentID := msg.Hostname
+		if agentID == "" {
+			agentID = b.sender
+		}
+		b.packet = &models.LogPacket{
+			PacketID: uuid.New().String(),
+			AgentID:  agentID,
+			Metadata: map[string]interface{}{
+				"transport": b.transport,
+				"sender":    b.sender,
+			},
+		}
+		b.started = time.Now()
+	}
+	b.packet.LogMessages = append(b.packet.LogMessages, msg.LogMessage())
+}
+
+// full reports whether the batch reached its size
+func (l *Listener) full(b *batch) bool {
+	return b.packet != nil && len(b.packet.LogMessages) >= l.config.BatchSize
+}
+
+// due reports whether the batch has waited out the flush interval
+func (l *Listener) due(b *batch, now time.Time) bool {
+	return b.packet != nil && now.Sub(b.started) >= l.config.FlushInterval
+}
+
+// flush enqueues the batch. With wait set, a full queue is offered the
+// packet again until it takes it or the listener stops; otherwise the
+// packet is dropped. Packets refused for any other reason are rejected.
+func (l *Listener) flush(b *batch, wait bool) {
+	packet := b.packet
+	if packet == nil {
+		return
+	}
+	b.packet = nil
+
+	now := time.Now()
+	packet.SentAt, packet.ReceivedAt = now, now
+	count := int64(len(packet.LogMessages))
+	err := l.enqueuer.Enqueue(packet)
+	for errors.Is(err, distributor.ErrQueueFull) {
+		if !wait || l.stopping() {
+			l.dropped.Add(count)
+			return
+		}
+		select {
+		case <-l.done:
+		case <-time.After(enqueueRetryInterval):
+		}
+		err = l.enqueuer.Enqueue(packet)
+	}
+
+	if err != nil && !errors.Is(err, distributor.ErrDuplicate) {
+		l.rejected.Add(count)
+		return
+	}
+	l.enqueued.Add(count)
+}
+
+// stopping reports whether Stop was called
+func (l *Listener) stopping() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// serveUDP reads one message per datagram, batching per sender address
+func (l *Listener) serveUDP() {
+	defer l.wg.Done()
+
+	batches := make(map[string]*batch)
+	buf := make([]byte, l.config.MaxMessageSize)
+	for {
+		// Wake up at least once per interval to flush quiet senders
+		l.udpConn.SetReadDeadline(time.Now().Add(l.config.FlushInterval))
+		n, addr, err := l.udpConn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				for _, b := range batches {
+					l.flush(b, false)
+				}
+				return
+			}
+		}
+
+		if n > 0 {
+			sender := addr.String()
+			if host, _, err := net.SplitHostPort(sender); err == nil {
+				sender = host
+			}
+			b, ok := batches[sender]
+			if !ok {
+				b = &batch{sender: sender, transport: "udp"}
+				batches[sender] = b
+			}
+			l.add(b, buf[:n])
+			if l.full(b) {
+				l.flush(b, false)
+			}
+		}
+
+		now := time.Now()
+		for sender, b := range batches {
+			if l.due(b, now) {
+				l.flush(b, false)
+			}
+			if b.packet == nil {
+				delete(batches, sender)
+			}
+		}
+	}
+}
+
+// serveTCP accepts connections until the listener is closed
+func (l *Listener) serveTCP() {
+	defer l.wg.Done()
+
+	for {
+		conn, err := l.tcpLn.Accept()
+		if err != nil {
+			if !l.stopping() {
+				log.Printf("Syslog TCP listener stopped: %v\n", err)
+			}
+			return
+		}
+
+		l.connsMu.Lock()
+		l.conns[conn] = struct{}{}
+		l.connsMu.Unlock()
+
+		l.wg.Add(1)
+		go l.handleConn(conn)
+	}
+}
+
+// handleConn batches the messages of a TCP connection. Frames are read by a
+// separate goroutine so that quiet connections are flushed on time; while a
+// packet waits for room in the queue, no more frames are taken and the
+// sender is held back by TCP flow control.
+func (l *Listener) handleConn(conn net.Conn) {
+	defer l.wg.Done()
+	defer func() {
+		l.connsMu.Lock()
+		delete(l.conns, conn)
+		l.connsMu.Unlock()
+		conn.Close()
+	}()
+
+	frames := make(chan []byte)
+	go func() {
+		defer close(frames)
+		reader := bufio.NewReaderSize(conn, l.config.MaxMessageSize)
+		for {
+			frame, err := readFrame(reader, l.config.MaxMessageSize)
+			if err != nil {
+				if !errors.Is(err, io.EOF) && !l.stopping() {
+					log.Printf("Closing syslog connection from %s: %v\n", conn.RemoteAddr(), err)
+				}
+				return
+			}
+			frames <- frame
+		}
+	}()
+
+	sender := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(sender); err == nil {
+		sender = host
+	}
+	b := &batch{sender: sender, transport: "tcp"}
+
+	ticker := time.NewTicker(l.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case frame, ok := <-frames:
+			if !ok {
+				l.flush(b, true)
+				return
+			}
+			l.add(b, frame)
+			if l.full(b) {
+				l.flush(b, true)
+			}
+		case now := <-ticker.C:
+			if l.due(b, now) {
+				l.flush(b, true)
+			}
+		}
+	}
+}
+
+// readFrame reads an RFC 6587 frame: octet-counted ("<length> <message>")
+// when it starts with a digit, newline-terminated otherwise
+func readFrame(r *bufio.Reader, maxSize int) ([]byte, error) {
+	for {
+		first, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+
+		if first[0] >= '0' && first[0] <= '9' {
+			digits, err := r.ReadSlice(' ')
+			if err != nil {
+				return nil, fmt.Errorf("invalid frame length: %w", err)
+			}
+			length, err := strconv.Atoi(string(digits[:len(digits)-1]))
+			if err != nil || length > maxSize {
+				return nil, fmt.Errorf("invalid frame length %q", digits[:len(digits)-1])
+			}
+			frame := make([]byte, length)
+			if _, err := io.ReadFull(r, frame); err != nil {
+				return nil, err
+			}
+			return frame, nil
+		}
+
+		line, err := r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return nil, fmt.Errorf("message longer than %d bytes", maxSize)
+		}
+		if err != nil && (len(line) == 0 || !errors.Is(err, io.EOF)) {
+			return nil, err
+		}
+		// Skip blank lines between messages
+		if len(line) > 0 && line[0] != '\n' && line[0] != '\r' {
+			frame := make([]byte, len(line))
+			copy(frame, line)
+			return frame, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
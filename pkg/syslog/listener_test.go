@@ -0,0 +1,168 @@
+package syslog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/distributor"
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// fakeQueue records enqueued packets, refuses them while full is set and
+// rejects them with reject if set
+type fakeQueue struct {
+	packets []*models.LogPacket
+	full    bool
+	reject  error
+	offered int
+	mutex   sync.Mutex
+}
+
+func (q *fakeQueue) Enqueue(packet *models.LogPacket) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.offered++
+	if q.reject != nil {
+		return q.reject
+	}
+	if q.full {
+		return distributor.ErrQueueFull
+	}
+	q.packets = append(q.packets, packet)
+	return nil
+}
+
+func (q *fakeQueue) setFull(full bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.full = full
+}
+
+func (q *fakeQueue) messages() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	count := 0
+	for _, p := range q.packets {
+		count += len(p.LogMessages)
+	}
+	return count
+}
+
+// startListener starts a listener on loopback ports
+func startListener(t *testing.T, queue *fakeQueue, batchSize int) *Listener {
+	l, err := Listen(Config{
+		UDPAddr:       "127.0.0.1:0",
+		TCPAddr:       "127.0.0.1:0",
+		BatchSize:     batchSize,
+		FlushInterval: 20 * time.Millisecond,
+	}, queue)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	l.Start()
+	t.Cleanup(func() { l.Stop(context.Background()) })
+	return l
+}
+
+// TestUDPBatchesPerSender tests that datagrams are grouped into packets and
+// dropped while the queue is full
+func TestUDPBatchesPerSender(t *testing.T) {
+	queue := &fakeQueue{}
+	l := startListener(t, queue, 3)
+
+	conn, err := net.Dial("udp", l.UDPAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < 4; i++ {
+		fmt.Fprintf(conn, "<11>1 - web01 nginx - - - request %d", i)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	queue.mutex.Lock()
+	if len(queue.packets) != 2 || len(queue.packets[0].LogMessages) != 3 || len(queue.packets[1].LogMessages) != 1 {
+		t.Fatalf("Expected a full packet and a flushed one, got %d packets", len(queue.packets))
+	}
+	packet := queue.packets[0]
+	if packet.AgentID != "web01" || packet.LogMessages[0].Source != "nginx" || packet.LogMessages[0].Level != models.Error {
+		t.Errorf("Unexpected packet: %+v", packet)
+	}
+	queue.mutex.Unlock()
+
+	queue.setFull(true)
+	fmt.Fprint(conn, "<14>1 - web01 nginx - - - dropped")
+	fmt.Fprint(conn, "not syslog")
+	time.Sleep(time.Millisecond * 100)
+
+	stats := l.Stats()
+	if stats.Received != 6 || stats.Invalid != 1 || stats.Enqueued != 4 || stats.Dropped != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+// TestTCPBackPressure tests that TCP messages wait for a full queue instead
+// of being dropped, with both framings
+func TestTCPBackPressure(t *testing.T) {
+	queue := &fakeQueue{full: true}
+	l := startListener(t, queue, 100)
+
+	conn, err := net.Dial("tcp", l.TCPAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	octetCounted := "<13>1 - db01 postgres - - - checkpoint"
+	fmt.Fprintf(conn, "<13>Oct 11 22:14:15 db01 postgres[9]: vacuum\n\n%d %s", len(octetCounted), octetCounted)
+	time.Sleep(time.Millisecond * 100)
+
+	if count := queue.messages(); count != 0 {
+		t.Fatalf("Expected nothing enqueued while the queue is full, got %d messages", count)
+	}
+
+	queue.setFull(false)
+	time.Sleep(time.Millisecond * 150)
+
+	if count := queue.messages(); count != 2 {
+		t.Fatalf("Expected 2 messages once the queue has room, got %d", count)
+	}
+	if stats := l.Stats(); stats.Dropped != 0 || stats.Enqueued != 2 {
+		t.Errorf("Expected no dropped messages, got %+v", stats)
+	}
+	if agent := queue.packets[0].AgentID; agent != "db01" {
+		t.Errorf("Expected agent db01, got %s", agent)
+	}
+}
+
+// TestRejectedPackets tests that packets refused for reasons other than a
+// full queue are not offered again, even over TCP
+func TestRejectedPackets(t *testing.T) {
+	queue := &fakeQueue{reject: errors.New("agent is over its limits")}
+	l := startListener(t, queue, 100)
+
+	conn, err := net.Dial("tcp", l.TCPAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	fmt.Fprint(conn, "<13>1 - db01 postgres - - - checkpoint\n<13>1 - db01 postgres - - - vacuum\n")
+	time.Sleep(time.Millisecond * 150)
+
+	queue.mutex.Lock()
+	offered := queue.offered
+	queue.mutex.Unlock()
+	if offered != 1 {
+		t.Errorf("Expected the packet to be offered once, got %d", offered)
+	}
+	if stats := l.Stats(); stats.Rejected != 2 || stats.Enqueued != 0 || stats.Dropped != 0 {
+		t.Errorf("Expected 2 rejected messages, got %+v", stats)
+	}
+}
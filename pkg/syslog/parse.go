@@ -0,0 +1,238 @@
+// Package syslog receives syslog messages over UDP and TCP and hands them to
+// the distributor as log packets
+package syslog
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// nilValue marks an empty RFC 5424 header field
+const nilValue = "-"
+
+// Message is a parsed RFC 5424 or RFC 3164 syslog message
+type Message struct {
+	Facility  int
+	Severity  int
+	Timestamp time.Time
+	Hostname  string
+	AppName   string
+	ProcID    string
+	MsgID     string
+	// StructuredData is the raw RFC 5424 structured data, empty if absent
+	StructuredData string
+	Text           string
+}
+
+// Level maps a syslog severity to a log level. Emergency, alert and
+// critical become FATAL, notice and informational become INFO.
+func Level(severity int) models.LogLevel {
+	switch {
+	case severity <= 2:
+		return models.Fatal
+	case severity == 3:
+		return models.Error
+	case severity == 4:
+		return models.Warning
+	case severity <= 6:
+		return models.Info
+	default:
+		return models.Debug
+	}
+}
+
+// LogMessage converts the message to a log message. The app-name becomes
+// the source and the remaining header fields go into the metadata.
+func (m *Message) LogMessage() models.LogMessage {
+	metadata := map[string]interface{}{
+		"facility": m.Facility,
+		"severity": m.Severity,
+	}
+	for key, value := range map[string]string{
+		"hostname":        m.Hostname,
+		"procid":          m.ProcID,
+		"msgid":           m.MsgID,
+		"structured_data": m.StructuredData,
+	} {
+		if value != "" {
+			metadata[key] = value
+		}
+	}
+
+	return models.LogMessage{
+		ID:        uuid.New().String(),
+		Timestamp: m.Timestamp,
+		Level:     Level(m.Severity),
+		Source:    m.AppName,
+		Message:   m.Text,
+		Metadata:  metadata,
+	}
+}
+
+// Parse reads an RFC 5424 message, or an RFC 3164 message when the priority
+// is not followed by a version. Messages without a timestamp are stamped
+// with the current time.
+func Parse(data []byte) (*Message, error) {
+	data = bytes.TrimRight(data, "\r\n\x00")
+
+	pri, rest, err := parsePriority(data)
+	if err != nil {
+		return nil, err
+	}
+	msg := &Message{Facility: pri / 8, Severity: pri % 8}
+
+	if len(rest) >= 2 && rest[0] >= '1' && rest[0] <= '9' && rest[1] == ' ' {
+		err = parse5424(msg, string(rest[2:]))
+	} else {
+		parse3164(msg, string(rest), time.Now())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	return msg, nil
+}
+
+// parsePriority reads the leading <PRI>
+func parsePriority(data []byte) (int, []byte, error) {
+	if len(data) == 0 || data[0] != '<' {
+		return 0, nil, errors.New("missing priority")
+	}
+	end := bytes.IndexByte(data, '>')
+	if end < 2 || end > 4 {
+		return 0, nil, errors.New("malformed priority")
+	}
+	pri, err := strconv.Atoi(string(data[1:end]))
+	if err != nil || pri > 191 {
+		return 0, nil, fmt.Errorf("invalid priority %q", data[1:end])
+	}
+	return pri, data[end+1:], nil
+}
+
+// parse5424 reads the fields following the version of an RFC 5424 message
+func parse5424(msg *Message, s string) error {
+	fields := make([]string, 5)
+	for i := range fields {
+		var ok bool
+		fields[i], s, ok = strings.Cut(s, " ")
+		if !ok {
+			return errors.New("truncated RFC 5424 header")
+		}
+	}
+
+	if fields[0] != nilValue {
+		ts, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return fmt.Errorf("invalid timestamp: %w", err)
+		}
+		msg.Timestamp = ts
+	}
+	msg.Hostname = nilToEmpty(fields[1])
+	msg.AppName = nilToEmpty(fields[2])
+	msg.ProcID = nilToEmpty(fields[3])
+	msg.MsgID = nilToEmpty(fields[4])
+
+	if strings.HasPrefix(s, nilValue) {
+		s = s[len(nilValue):]
+	} else {
+		end, err := structuredDataEnd(s)
+		if err != nil {
+			return err
+		}
+		msg.StructuredData, s = s[:end], s[end:]
+	}
+	s = strings.TrimPrefix(s, " ")
+	msg.Text = strings.TrimPrefix(s, "\ufeff")
+	return nil
+}
+
+// structuredDataEnd returns the length of the structured data elements at
+// the start of s, honoring quoted and escaped parameter values
+func structuredDataEnd(s string) (int, error) {
+	i := 0
+	for i < len(s) && s[i] == '[' {
+		quoted := false
+		for i++; i < len(s); i++ {
+			c := s[i]
+			if c == '\\' && quoted {
+				i++
+				continue
+			}
+			if c == '"' {
+				quoted = !quoted
+			}
+			if c == ']' && !quoted {
+				break
+			}
+		}
+		if i >= len(s) {
+			return 0, errors.New("unterminated structured data")
+		}
+		i++
+	}
+	if i == 0 {
+		return 0, errors.New("invalid structured data")
+	}
+	return i, nil
+}
+
+// parse3164 reads the fields following the priority of an RFC 3164
+// message. The format is loose, so anything not recognized is kept as text.
+func parse3164(msg *Message, s string, now time.Time) {
+	// "Jan _2 15:04:05" carries no year: take the one that puts the
+	// timestamp closest to now
+	if len(s) >= len(time.Stamp) {
+		if ts, err := time.ParseInLocation(time.Stamp, s[:len(time.Stamp)], now.Location()); err == nil {
+			ts = ts.AddDate(now.Year(), 0, 0)
+			if ts.After(now.AddDate(0, 0, 1)) {
+				ts = ts.AddDate(-1, 0, 0)
+			}
+			msg.Timestamp = ts
+			s = strings.TrimPrefix(s[len(time.Stamp):], " ")
+
+			if host, rest, ok := strings.Cut(s, " "); ok && !strings.ContainsAny(host, ":[") {
+				msg.Hostname, s = host, rest
+			}
+		}
+	}
+
+	// The tag is the program name, optionally followed by [pid], then ':'
+	end := strings.IndexAny(s, "[: ")
+	if end <= 0 || end > 48 {
+		msg.Text = s
+		return
+	}
+	tag, rest := s[:end], s[end:]
+	if strings.HasPrefix(rest, "[") {
+		pid, after, ok := strings.Cut(rest[1:], "]")
+		if !ok {
+			msg.Text = s
+			return
+		}
+		msg.ProcID, rest = pid, after
+	}
+	if !strings.HasPrefix(rest, ":") {
+		msg.ProcID = ""
+		msg.Text = s
+		return
+	}
+	msg.AppName = tag
+	msg.Text = strings.TrimPrefix(rest[1:], " ")
+}
+
+// nilToEmpty turns the RFC 5424 nil value into an empty string
+func nilToEmpty(s string) string {
+	if s == nilValue {
+		return ""
+	}
+	return s
+}
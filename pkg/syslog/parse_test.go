@@ -0,0 +1,101 @@
+package syslog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// TestParse5424 tests reading RFC 5424 messages
+func TestParse5424(t *testing.T) {
+	msg, err := Parse([]byte(`<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="App]lication"][other@1 a="b"] ` + "\ufeff" + "An application event\n"))
+	if err != nil {
+		t.Fatalf("Expected the message to parse, got %v", err)
+	}
+
+	if msg.Facility != 20 || msg.Severity != 5 {
+		t.Errorf("Expected facility 20 and severity 5, got %d and %d", msg.Facility, msg.Severity)
+	}
+	if !msg.Timestamp.Equal(time.Date(2003, 10, 11, 22, 14, 15, 3e6, time.UTC)) {
+		t.Errorf("Expected the header timestamp, got %v", msg.Timestamp)
+	}
+	if msg.Hostname != "mymachine.example.com" || msg.AppName != "evntslog" || msg.ProcID != "" || msg.MsgID != "ID47" {
+		t.Errorf("Unexpected header fields: %+v", msg)
+	}
+	if msg.StructuredData != `[exampleSDID@32473 iut="3" eventSource="App]lication"][other@1 a="b"]` {
+		t.Errorf("Unexpected structured data: %q", msg.StructuredData)
+	}
+	if msg.Text != "An application event" {
+		t.Errorf("Expected the message text, got %q", msg.Text)
+	}
+
+	logMsg := msg.LogMessage()
+	if logMsg.Level != models.Info || logMsg.Source != "evntslog" || logMsg.ID == "" {
+		t.Errorf("Expected an INFO message from evntslog, got %+v", logMsg)
+	}
+
+	// Nil timestamp, structured data and no message
+	msg, err = Parse([]byte("<11>1 - host app 12 - -"))
+	if err != nil {
+		t.Fatalf("Expected the message to parse, got %v", err)
+	}
+	if msg.Timestamp.IsZero() || msg.ProcID != "12" || msg.Text != "" || Level(msg.Severity) != models.Error {
+		t.Errorf("Unexpected message: %+v", msg)
+	}
+}
+
+// TestParse3164 tests reading RFC 3164 messages
+func TestParse3164(t *testing.T) {
+	msg, err := Parse([]byte("<34>Oct 11 22:14:15 mymachine su[123]: 'su root' failed for lonvick on /dev/pts/8"))
+	if err != nil {
+		t.Fatalf("Expected the message to parse, got %v", err)
+	}
+
+	if msg.Severity != 2 || Level(msg.Severity) != models.Fatal {
+		t.Errorf("Expected a critical message, got severity %d", msg.Severity)
+	}
+	if msg.Timestamp.Month() != time.October || msg.Timestamp.Day() != 11 || msg.Timestamp.Hour() != 22 {
+		t.Errorf("Expected the header timestamp, got %v", msg.Timestamp)
+	}
+	if msg.Hostname != "mymachine" || msg.AppName != "su" || msg.ProcID != "123" {
+		t.Errorf("Unexpected header fields: %+v", msg)
+	}
+	if msg.Text != "'su root' failed for lonvick on /dev/pts/8" {
+		t.Errorf("Expected the message text, got %q", msg.Text)
+	}
+
+	// Without timestamp and hostname
+	msg, err = Parse([]byte("<15>cron: job done"))
+	if err != nil {
+		t.Fatalf("Expected the message to parse, got %v", err)
+	}
+	if msg.AppName != "cron" || msg.Text != "job done" || Level(msg.Severity) != models.Debug {
+		t.Errorf("Unexpected message: %+v", msg)
+	}
+
+	// Text without a tag is kept whole
+	msg, err = Parse([]byte("<14>just some text"))
+	if err != nil {
+		t.Fatalf("Expected the message to parse, got %v", err)
+	}
+	if msg.AppName != "" || msg.Text != "just some text" {
+		t.Errorf("Unexpected message: %+v", msg)
+	}
+}
+
+// TestParseInvalid tests that malformed messages are rejected
+func TestParseInvalid(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"no priority",
+		"<999>1 - - - - - -",
+		"<13>1 2003-10-11T22:14:15Z host app",
+		"<13>1 yesterday host app - - - text",
+		"<13>1 - host app - - [unterminated",
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("Expected %q to be rejected", data)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+// Package tlsconfig builds TLS settings from PEM files, loading certificates
+// again when their files change
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Client authentication modes of a server
+const (
+	// ClientAuthNone asks agents for no certificate
+	ClientAuthNone = "none"
+	// ClientAuthOptional verifies a certificate if the agent sends one
+	ClientAuthOptional = "optional"
+	// ClientAuthRequire rejects agents without a valid certificate
+	ClientAuthRequire = "require"
+)
+
+// ParseClientAuth checks a client authentication mode. An empty mode is
+// ClientAuthNone.
+func ParseClientAuth(mode string) (string, error) {
+	switch mode {
+	case "":
+		return ClientAuthNone, nil
+	case ClientAuthNone, ClientAuthOptional, ClientAuthRequire:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown client auth mode %q (want %s, %s or %s)",
+			mode, ClientAuthNone, ClientAuthOptional, ClientAuthRequire)
+	}
+}
+
+// ServerConfig names the files a TLS server is set up from
+type ServerConfig struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile holds the CAs that sign client certificates, which are
+	// checked as ClientAuth says
+	ClientCAFile string
+	ClientAuth   string
+}
+
+// Enabled reports whether a certificate is configured
+func (c ServerConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// Server serves the certificate and verifies client certificates of a
+// ServerConfig. The files are read again on the first handshake after they
+// changed; if that fails, the previous certificate and CAs stay in use.
+type Server struct {
+	clientAuth string
+	cert       *keyPair
+	clientCAs  *certPool
+}
+
+// NewServer loads the files of a server configuration
+func NewServer(config ServerConfig) (*Server, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("certificate and key files must both be set")
+	}
+	clientAuth, err := ParseClientAuth(config.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	if clientAuth != ClientAuthNone && config.ClientCAFile == "" {
+		return nil, fmt.Errorf("client auth mode %s needs a client CA file", clientAuth)
+	}
+
+	s := &Server{clientAuth: clientAuth}
+	if s.cert, err = loadKeyPair(config.CertFile, config.KeyFile); err != nil {
+		return nil, err
+	}
+	if config.ClientCAFile != "" {
+		if s.clientCAs, err = loadCertPool(config.ClientCAFile); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// TLSConfig returns the settings to serve with
+func (s *Server) TLSConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.cert.get(), nil
+		},
+	}
+
+	// Client certificates are verified against the current CAs here rather
+	// than through ClientCAs, which could not be reloaded
+	switch s.clientAuth {
+	case ClientAuthOptional:
+		config.ClientAuth = tls.RequestClientCert
+		config.VerifyPeerCertificate = s.verifyClient
+	case ClientAuthRequire:
+		config.ClientAuth = tls.RequireAnyClientCert
+		config.VerifyPeerCertificate = s.verifyClient
+	}
+	return config
+}
+
+// verifyClient checks that a client certificate, if one was sent, chains up
+// to a client CA
+func (s *Server) verifyClient(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return nil
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("invalid client certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         s.clientCAs.get(),
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("client certificate not trusted: %w", err)
+	}
+	return nil
+}
+
+// ClientConfig names the files used to connect to a TLS server
+type ClientConfig struct {
+	// CAFile holds the CAs that sign the server's certificate, the system's
+	// if empty
+	CAFile string
+	// CertFile and KeyFile are the certificate shown to servers that ask
+	// for one
+	CertFile string
+	KeyFile  string
+	// ServerName is checked against the server's certificate instead of the
+	// host name
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// Enabled reports whether anything is configured
+func (c ClientConfig) Enabled() bool {
+	return c != ClientConfig{}
+}
+
+// Load builds the client settings. The client certificate is read again on
+// the first handshake after its files changed.
+func (c ClientConfig) Load() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CAFile != "" {
+		pool, err := readCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, errors.New("certificate and key files must both be set")
+		}
+		cert, err := loadKeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert.get(), nil
+		}
+	}
+	return config, nil
+}
+
+// keyPair is a certificate and its key, loaded again when the files change
+type keyPair struct {
+	certFile string
+	keyFile  string
+	files    *fileSet
+	cert     *tls.Certificate
+	mutex    sync.Mutex
+}
+
+// loadKeyPair reads a certificate and its key
+func loadKeyPair(certFile, keyFile string) (*keyPair, error) {
+	k := &keyPair{certFile: certFile, keyFile: keyFile, files: newFileSet(certFile, keyFile)}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate %s: %w", certFile, err)
+	}
+	k.cert = &cert
+	return k, nil
+}
+
+// get returns the certificate, reloading it if the files changed
+func (k *keyPair) get() *tls.Certificate {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if k.files.changed() {
+		cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+		if err != nil {
+			log.Printf("Failed to reload certificate %s, keeping the previous one: %v\n", k.certFile, err)
+		} else {
+			k.cert = &cert
+			log.Printf("Reloaded certificate %s\n", k.certFile)
+		}
+	}
+	return k.cert
+}
+
+// certPool is a set of CA certificates, loaded again when the file changes
+type certPool struct {
+	path  string
+	files *fileSet
+	pool  *x509.CertPool
+	mutex sync.Mutex
+}
+
+// loadCertPool reads the PEM certificates in a file
+func loadCertPool(path string) (*certPool, error) {
+	c := &certPool{path: path, files: newFileSet(path)}
+	pool, err := readCertPool(path)
+	if err != nil {
+		return nil, err
+	}
+	c.pool = pool
+	return c, nil
+}
+
+// get returns the CAs, reloading them if the file changed
+func (c *certPool) get() *x509.CertPool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.files.changed() {
+		pool, err := readCertPool(c.path)
+		if err != nil {
+			log.Printf("Failed to reload CA file %s, keeping the previous one: %v\n", c.path, err)
+		} else {
+			c.pool = pool
+			log.Printf("Reloaded CA file %s\n", c.path)
+		}
+	}
+	return c.pool
+}
+
+// readCertPool parses the PEM certificates in a file
+func readCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// fileSet remembers the size and modification time of files
+type fileSet struct {
+	paths    []string
+	modTimes []time.Time
+	sizes    []int64
+}
+
+// newFileSet records the current state of files
+func newFileSet(paths ...string) *fileSet {
+	s := &fileSet{
+		paths:    paths,
+		modTimes: make([]time.Time, len(paths)),
+		sizes:    make([]int64, len(paths)),
+	}
+	s.changed()
+	return s
+}
+
+// changed reports whether any file changed since the last call. Files that
+// cannot be read are left out.
+func (s *fileSet) changed() bool {
+	changed := false
+	for i, path := range s.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(s.modTimes[i]) || info.Size() != s.sizes[i] {
+			s.modTimes[i], s.sizes[i] = info.ModTime(), info.Size()
+			changed = true
+		}
+	}
+	return changed
+}
@@ -0,0 +1,265 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a self-signed CA issuing certificates into a directory
+type testCA struct {
+	t      *testing.T
+	dir    string
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+// newTestCA creates a CA and writes its certificate to <name>.pem
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	ca := &testCA{t: t, dir: dir, cert: cert, key: key, serial: 1}
+	ca.write(name+".pem", "CERTIFICATE", der)
+	return ca
+}
+
+// issue writes a certificate for localhost and its key to <name>.pem and
+// <name>-key.pem, returning the certificate's serial number
+func (ca *testCA) issue(name string, usage x509.ExtKeyUsage) int64 {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatalf("Failed to generate key: %v", err)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	ca.write(name+".pem", "CERTIFICATE", der)
+	ca.write(name+"-key.pem", "EC PRIVATE KEY", keyDER)
+	return ca.serial
+}
+
+// write stores a PEM block, moving its modification time forward so that a
+// rewrite within the same second is noticed
+func (ca *testCA) write(name, blockType string, der []byte) {
+	path := filepath.Join(ca.dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		ca.t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	modTime := time.Now().Add(time.Duration(ca.serial) * time.Second)
+	os.Chtimes(path, modTime, modTime)
+}
+
+// serve accepts TLS connections with the server's settings, answering each
+// with a byte once the handshake is done
+func serve(t *testing.T, server *Server) string {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", server.TLSConfig())
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if conn.(*tls.Conn).Handshake() == nil {
+					conn.Write([]byte{1})
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// dial connects with client settings, returning the serial number of the
+// server's certificate
+func dial(addr string, client ClientConfig) (int64, error) {
+	config, err := client.Load()
+	if err != nil {
+		return 0, err
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// TLS 1.3 clients learn that their certificate was refused on the
+	// first read
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+		return 0, err
+	}
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+}
+
+// TestClientAuth tests verifying agent certificates in each mode
+func TestClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	ca.issue("server", x509.ExtKeyUsageServerAuth)
+	ca.issue("agent", x509.ExtKeyUsageClientAuth)
+	other := newTestCA(t, dir, "other")
+	other.issue("stranger", x509.ExtKeyUsageClientAuth)
+
+	path := func(name string) string { return filepath.Join(dir, name) }
+	anonymous := ClientConfig{CAFile: path("ca.pem")}
+	agent := ClientConfig{CAFile: path("ca.pem"), CertFile: path("agent.pem"), KeyFile: path("agent-key.pem")}
+	stranger := ClientConfig{CAFile: path("ca.pem"), CertFile: path("stranger.pem"), KeyFile: path("stranger-key.pem")}
+
+	tests := []struct {
+		mode    string
+		client  ClientConfig
+		succeed bool
+	}{
+		{ClientAuthNone, anonymous, true},
+		{ClientAuthOptional, anonymous, true},
+		{ClientAuthOptional, agent, true},
+		{ClientAuthOptional, stranger, false},
+		{ClientAuthRequire, anonymous, false},
+		{ClientAuthRequire, agent, true},
+		{ClientAuthRequire, stranger, false},
+	}
+
+	for i, test := range tests {
+		server, err := NewServer(ServerConfig{
+			CertFile:     path("server.pem"),
+			KeyFile:      path("server-key.pem"),
+			ClientCAFile: path("ca.pem"),
+			ClientAuth:   test.mode,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create server: %v", err)
+		}
+
+		_, err = dial(serve(t, server), test.client)
+		if test.succeed && err != nil {
+			t.Errorf("Test %d: expected %s to accept the client, got %v", i, test.mode, err)
+		}
+		if !test.succeed && err == nil {
+			t.Errorf("Test %d: expected %s to refuse the client", i, test.mode)
+		}
+	}
+
+	// A server certificate from an unknown CA is refused
+	if _, err := dial(serve(t, mustServer(t, ServerConfig{CertFile: path("stranger.pem"), KeyFile: path("stranger-key.pem")})), anonymous); err == nil {
+		t.Error("Expected a certificate from an unknown CA to be refused")
+	}
+}
+
+// mustServer creates a server or fails the test
+func mustServer(t *testing.T, config ServerConfig) *Server {
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	return server
+}
+
+// TestCertificateReload tests that a renewed certificate is served without
+// a restart, and that a broken one leaves the previous one in use
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	first := ca.issue("server", x509.ExtKeyUsageServerAuth)
+
+	addr := serve(t, mustServer(t, ServerConfig{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+	}))
+	client := ClientConfig{CAFile: filepath.Join(dir, "ca.pem")}
+
+	if serial, err := dial(addr, client); err != nil || serial != first {
+		t.Fatalf("Expected certificate %d, got %d (%v)", first, serial, err)
+	}
+
+	second := ca.issue("server", x509.ExtKeyUsageServerAuth)
+	if serial, err := dial(addr, client); err != nil || serial != second {
+		t.Errorf("Expected the renewed certificate %d, got %d (%v)", second, serial, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "server-key.pem"), []byte("garbage"), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	if serial, err := dial(addr, client); err != nil || serial != second {
+		t.Errorf("Expected certificate %d to stay in use, got %d (%v)", second, serial, err)
+	}
+}
+
+// TestConfigErrors tests that incomplete settings are rejected
+func TestConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	ca.issue("server", x509.ExtKeyUsageServerAuth)
+	cert, key := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")
+
+	servers := []ServerConfig{
+		{CertFile: cert},
+		{CertFile: cert, KeyFile: key, ClientAuth: ClientAuthRequire},
+		{CertFile: cert, KeyFile: key, ClientAuth: "sometimes", ClientCAFile: cert},
+		{CertFile: cert, KeyFile: filepath.Join(dir, "missing.pem")},
+		{CertFile: cert, KeyFile: key, ClientCAFile: key, ClientAuth: ClientAuthOptional},
+	}
+	for i, config := range servers {
+		if _, err := NewServer(config); err == nil {
+			t.Errorf("Server %d: expected %+v to be rejected", i, config)
+		}
+	}
+
+	clients := []ClientConfig{
+		{KeyFile: key},
+		{CAFile: filepath.Join(dir, "missing.pem")},
+	}
+	for i, config := range clients {
+		if _, err := config.Load(); err == nil {
+			t.Errorf("Client %d: expected %+v to be rejected", i, config)
+		}
+	}
+}
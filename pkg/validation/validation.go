@@ -0,0 +1,220 @@
+// Package validation checks log packets against configurable limits before
+// they are queued
+package validation
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+// Fields that can be required. Message fields apply to every log message of
+// the packet.
+const (
+	FieldPacketID    = "packet_id"
+	FieldAgentID     = "agent_id"
+	FieldSentAt      = "sent_at"
+	FieldLogMessages = "log_messages"
+	FieldID          = "log_messages.id"
+	FieldTimestamp   = "log_messages.timestamp"
+	FieldLevel       = "log_messages.level"
+	FieldSource      = "log_messages.source"
+	FieldMessage     = "log_messages.message"
+)
+
+// FieldPriority is the optional packet priority, checked to be a log level
+// when set
+const FieldPriority = "priority"
+
+// maxFieldErrors caps how many field errors an Error lists
+const maxFieldErrors = 100
+
+// Config holds the limits packets are checked against. Zero limits are
+// disabled.
+type Config struct {
+	// MaxBodyBytes is the largest request body holding a single packet
+	MaxBodyBytes int64
+	// MaxMessages is the most log messages in one packet
+	MaxMessages int
+	// MaxMessageLength is the longest message text in bytes
+	MaxMessageLength int
+	// AllowedLevels lists the accepted log levels; any level is accepted
+	// if empty
+	AllowedLevels []models.LogLevel
+	// RequiredFields lists the fields that must be set
+	RequiredFields []string
+	// AutoFill generates missing packet and message IDs and timestamps
+	// instead of rejecting the packet
+	AutoFill bool
+}
+
+// DefaultConfig returns the limits used unless configured otherwise
+func DefaultConfig() Config {
+	return Config{
+		MaxBodyBytes:     10 << 20,
+		MaxMessages:      10000,
+		MaxMessageLength: 64 << 10,
+		AllowedLevels:    []models.LogLevel{models.Debug, models.Info, models.Warning, models.Error, models.Fatal},
+		RequiredFields:   []string{FieldPacketID, FieldLogMessages, FieldID, FieldLevel},
+	}
+}
+
+// FieldError reports why one field of a packet is invalid
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error lists the fields of a packet that failed validation
+type Error struct {
+	Fields []FieldError `json:"errors"`
+	// Truncated is set when there were more errors than listed
+	Truncated bool `json:"errors_truncated,omitempty"`
+}
+
+func (e *Error) Error() string {
+	parts := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		parts = append(parts, f.Field+" "+f.Message)
+	}
+	if e.Truncated {
+		parts = append(parts, "...")
+	}
+	return "invalid log packet: " + strings.Join(parts, "; ")
+}
+
+// add records an error for a field
+func (e *Error) add(field, format string, args ...interface{}) {
+	if len(e.Fields) >= maxFieldErrors {
+		e.Truncated = true
+		return
+	}
+	e.Fields = append(e.Fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validator checks packets against a Config
+type Validator struct {
+	config   Config
+	levels   map[models.LogLevel]bool
+	required map[string]bool
+}
+
+// New creates a validator, rejecting unknown levels and fields
+func New(config Config) (*Validator, error) {
+	if config.MaxBodyBytes < 0 || config.MaxMessages < 0 || config.MaxMessageLength < 0 {
+		return nil, fmt.Errorf("limits must not be negative")
+	}
+
+	v := &Validator{
+		config:   config,
+		levels:   make(map[models.LogLevel]bool, len(config.AllowedLevels)),
+		required: make(map[string]bool, len(config.RequiredFields)),
+	}
+	for _, level := range config.AllowedLevels {
+		if !knownLevel(level) {
+			return nil, fmt.Errorf("unknown log level %q", level)
+		}
+		v.levels[level] = true
+	}
+	for _, field := range config.RequiredFields {
+		switch field {
+		case FieldPacketID, FieldAgentID, FieldSentAt, FieldLogMessages,
+			FieldID, FieldTimestamp, FieldLevel, FieldSource, FieldMessage:
+			v.required[field] = true
+		default:
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+	}
+	return v, nil
+}
+
+// knownLevel reports whether level is one of the five log levels
+func knownLevel(level models.LogLevel) bool {
+	switch level {
+	case models.Debug, models.Info, models.Warning, models.Error, models.Fatal:
+		return true
+	}
+	return false
+}
+
+// MaxBodyBytes returns the largest request body holding a single packet, or
+// zero if unlimited
+func (v *Validator) MaxBodyBytes() int64 {
+	return v.config.MaxBodyBytes
+}
+
+// MaxMessages returns the most log messages in one packet, or zero if
+// unlimited
+func (v *Validator) MaxMessages() int {
+	return v.config.MaxMessages
+}
+
+// Validate checks a packet, first filling in missing IDs and timestamps if
+// AutoFill is set. It returns an *Error listing every invalid field.
+func (v *Validator) Validate(packet *models.LogPacket) error {
+	if v.config.AutoFill {
+		fill(packet)
+	}
+
+	e := &Error{}
+	v.check(e, FieldPacketID, packet.PacketID == "", FieldPacketID)
+	v.check(e, FieldAgentID, packet.AgentID == "", FieldAgentID)
+	v.check(e, FieldSentAt, packet.SentAt.IsZero(), FieldSentAt)
+	v.check(e, FieldLogMessages, len(packet.LogMessages) == 0, FieldLogMessages)
+	if packet.Priority != "" && !knownLevel(packet.Priority) {
+		e.add(FieldPriority, "%q is not a log level", packet.Priority)
+	}
+	if max := v.config.MaxMessages; max > 0 && len(packet.LogMessages) > max {
+		e.add(FieldLogMessages, "has %d messages, more than %d", len(packet.LogMessages), max)
+	}
+
+	for i, msg := range packet.LogMessages {
+		path := fmt.Sprintf("log_messages[%d].", i)
+		v.check(e, FieldID, msg.ID == "", path+"id")
+		v.check(e, FieldTimestamp, msg.Timestamp.IsZero(), path+"timestamp")
+		v.check(e, FieldLevel, msg.Level == "", path+"level")
+		v.check(e, FieldSource, msg.Source == "", path+"source")
+		v.check(e, FieldMessage, msg.Message == "", path+"message")
+		if msg.Level != "" && len(v.levels) > 0 && !v.levels[msg.Level] {
+			e.add(path+"level", "%q is not an allowed level", msg.Level)
+		}
+		if max := v.config.MaxMessageLength; max > 0 && len(msg.Message) > max {
+			e.add(path+"message", "is %d bytes, longer than %d", len(msg.Message), max)
+		}
+	}
+
+	if len(e.Fields) > 0 {
+		return e
+	}
+	return nil
+}
+
+// check reports a required field that is missing
+func (v *Validator) check(e *Error, field string, missing bool, path string) {
+	if missing && v.required[field] {
+		e.add(path, "is required")
+	}
+}
+
+// fill generates missing IDs and timestamps. Messages without a timestamp
+// take the time the packet was sent.
+func fill(packet *models.LogPacket) {
+	if packet.PacketID == "" {
+		packet.PacketID = uuid.New().String()
+	}
+	if packet.SentAt.IsZero() {
+		packet.SentAt = time.Now()
+	}
+	for i := range packet.LogMessages {
+		msg := &packet.LogMessages[i]
+		if msg.ID == "" {
+			msg.ID = uuid.New().String()
+		}
+		if msg.Timestamp.IsZero() {
+			msg.Timestamp = packet.SentAt
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package validation
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ryouol/log-distributor/pkg/models"
+)
+
+func validPacket() *models.LogPacket {
+	return &models.LogPacket{
+		PacketID: "packet1",
+		AgentID:  "agent1",
+		SentAt:   time.Now(),
+		LogMessages: []models.LogMessage{
+			{ID: "msg1", Timestamp: time.Now(), Level: models.Info, Source: "app", Message: "hello"},
+		},
+	}
+}
+
+// fieldErrors returns the fields reported by a validation error
+func fieldErrors(t *testing.T, err error) map[string]string {
+	var invalid *Error
+	if !errors.As(err, &invalid) {
+		t.Fatalf("Expected a validation error, got %v", err)
+	}
+	fields := make(map[string]string, len(invalid.Fields))
+	for _, f := range invalid.Fields {
+		fields[f.Field] = f.Message
+	}
+	return fields
+}
+
+// TestValidateDefaults tests the default limits
+func TestValidateDefaults(t *testing.T) {
+	v, err := New(DefaultConfig())
+	if err != nil {
+		t.Fatalf("Expected the default config to be valid, got %v", err)
+	}
+
+	if err := v.Validate(validPacket()); err != nil {
+		t.Errorf("Expected a complete packet to be valid, got %v", err)
+	}
+
+	// Agent, source and timestamps are optional by default
+	packet := &models.LogPacket{
+		PacketID:    "packet1",
+		LogMessages: []models.LogMessage{{ID: "msg1", Level: models.Debug}},
+	}
+	if err := v.Validate(packet); err != nil {
+		t.Errorf("Expected a minimal packet to be valid, got %v", err)
+	}
+
+	fields := fieldErrors(t, v.Validate(&models.LogPacket{}))
+	if len(fields) != 2 || fields["packet_id"] != "is required" || fields["log_messages"] != "is required" {
+		t.Errorf("Expected packet_id and log_messages to be required, got %v", fields)
+	}
+
+	packet = validPacket()
+	packet.LogMessages = append(packet.LogMessages,
+		models.LogMessage{Level: "LOUD", Message: "x"},
+		models.LogMessage{ID: "msg3", Level: models.Info, Message: strings.Repeat("x", 64<<10+1)},
+	)
+	fields = fieldErrors(t, v.Validate(packet))
+	if _, ok := fields["log_messages[1].id"]; !ok {
+		t.Errorf("Expected the second message to need an ID, got %v", fields)
+	}
+	if !strings.Contains(fields["log_messages[1].level"], "not an allowed level") {
+		t.Errorf("Expected LOUD to be refused, got %v", fields)
+	}
+	if !strings.Contains(fields["log_messages[2].message"], "longer than") {
+		t.Errorf("Expected the third message to be too long, got %v", fields)
+	}
+}
+
+// TestValidateLimits tests configured limits and required fields
+func TestValidateLimits(t *testing.T) {
+	v, err := New(Config{
+		MaxMessages:    1,
+		AllowedLevels:  []models.LogLevel{models.Error, models.Fatal},
+		RequiredFields: []string{FieldAgentID, FieldSource},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create validator: %v", err)
+	}
+
+	packet := validPacket()
+	packet.AgentID = ""
+	packet.Priority = "URGENT"
+	packet.LogMessages = append(packet.LogMessages, models.LogMessage{Level: models.Error})
+	fields := fieldErrors(t, v.Validate(packet))
+
+	for _, field := range []string{"agent_id", "priority", "log_messages", "log_messages[0].level", "log_messages[1].source"} {
+		if _, ok := fields[field]; !ok {
+			t.Errorf("Expected an error for %s, got %v", field, fields)
+		}
+	}
+	if _, ok := fields["log_messages[1].id"]; ok {
+		t.Errorf("Expected message IDs to be optional, got %v", fields)
+	}
+}
+
+// TestValidateAutoFill tests generating missing IDs and timestamps
+func TestValidateAutoFill(t *testing.T) {
+	config := DefaultConfig()
+	config.AutoFill = true
+	config.RequiredFields = append(config.RequiredFields, FieldSentAt, FieldTimestamp)
+	v, err := New(config)
+	if err != nil {
+		t.Fatalf("Failed to create validator: %v", err)
+	}
+
+	packet := &models.LogPacket{
+		LogMessages: []models.LogMessage{{Level: models.Info}, {Level: models.Info}},
+	}
+	if err := v.Validate(packet); err != nil {
+		t.Fatalf("Expected the packet to be filled in, got %v", err)
+	}
+
+	if packet.PacketID == "" || packet.SentAt.IsZero() {
+		t.Errorf("Expected a packet ID and send time, got %+v", packet)
+	}
+	first, second := packet.LogMessages[0], packet.LogMessages[1]
+	if first.ID == "" || first.ID == second.ID {
+		t.Errorf("Expected distinct message IDs, got %q and %q", first.ID, second.ID)
+	}
+	if !first.Timestamp.Equal(packet.SentAt) {
+		t.Errorf("Expected messages to take the send time, got %v", first.Timestamp)
+	}
+
+	// Auto-fill does not make up levels
+	packet.LogMessages = append(packet.LogMessages, models.LogMessage{})
+	if _, ok := fieldErrors(t, v.Validate(packet))["log_messages[2].level"]; !ok {
+		t.Errorf("Expected the level to stay required")
+	}
+}
+
+// TestNewInvalid tests rejecting unknown levels and fields
+func TestNewInvalid(t *testing.T) {
+	if _, err := New(Config{AllowedLevels: []models.LogLevel{"LOUD"}}); err == nil {
+		t.Errorf("Expected an unknown level to be rejected")
+	}
+	if _, err := New(Config{RequiredFields: []string{"color"}}); err == nil {
+		t.Errorf("Expected an unknown field to be rejected")
+	}
+	if _, err := New(Config{MaxMessages: -1}); err == nil {
+		t.Errorf("Expected a negative limit to be rejected")
+	}
+}
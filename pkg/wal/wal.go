@@ -0,0 +1,442 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record types stored in a segment
+const (
+	recordEntry byte = 1
+	recordAck   byte = 2
+)
+
+const (
+	segmentExt = ".wal"
+	// headerSize is the length and checksum prefix of every record
+	headerSize = 8
+	// bodyPrefixSize is the record type and sequence number
+	bodyPrefixSize = 9
+)
+
+// ErrClosed is returned when the log is used after Close
+var ErrClosed = errors.New("wal: log is closed")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Options configures a write-ahead log
+type Options struct {
+	// SegmentSize is the size in bytes after which a new segment is started
+	SegmentSize int64
+	// SyncInterval is how long appends are batched before a single fsync.
+	// Zero syncs every append on its own.
+	SyncInterval time.Duration
+}
+
+// DefaultOptions returns the options used when none are given
+func DefaultOptions() Options {
+	return Options{
+		SegmentSize:  64 << 20,
+		SyncInterval: 5 * time.Millisecond,
+	}
+}
+
+// Entry is a record recovered from disk that has not been acknowledged
+type Entry struct {
+	Seq  uint64
+	Data []byte
+}
+
+// segment is one file of the log
+type segment struct {
+	path    string
+	size    int64
+	pending int
+}
+
+// syncBatch is shared by all appends waiting for the same fsync
+type syncBatch struct {
+	done chan struct{}
+	err  error
+}
+
+// WAL is a segmented write-ahead log. Entries are appended and fsynced in
+// batches, and acknowledged entries are reclaimed by deleting whole segments
+// from the head of the log once nothing in them is pending.
+type WAL struct {
+	dir      string
+	opts     Options
+	segments []*segment
+	active   *segment
+	file     *os.File
+	writer   *bufio.Writer
+	owner    map[uint64]*segment
+	nextSeq  uint64
+	batch    *syncBatch
+	pending  []Entry
+	closed   bool
+	mutex    sync.Mutex
+}
+
+// Open opens or creates the log in dir and recovers unacknowledged entries,
+// which are available through Pending
+func Open(dir string, opts Options) (*WAL, error) {
+	defaults := DefaultOptions()
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaults.SegmentSize
+	}
+	if opts.SyncInterval < 0 {
+		opts.SyncInterval = 0
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create wal directory: %w", err)
+	}
+
+	w := &WAL{
+		dir:     dir,
+		opts:    opts,
+		owner:   make(map[uint64]*segment),
+		nextSeq: 1,
+	}
+
+	if err := w.recover(); err != nil {
+		return nil, err
+	}
+
+	if err := w.openSegment(); err != nil {
+		return nil, err
+	}
+	w.truncateHead()
+
+	return w, nil
+}
+
+// Pending returns the entries recovered at Open that were never acknowledged,
+// in append order. It returns them only once.
+func (w *WAL) Pending() []Entry {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	pending := w.pending
+	w.pending = nil
+	return pending
+}
+
+// Append writes data to the log and blocks until it is durable on disk
+func (w *WAL) Append(data []byte) (uint64, error) {
+	w.mutex.Lock()
+	if w.closed {
+		w.mutex.Unlock()
+		return 0, ErrClosed
+	}
+
+	if w.active.size >= w.opts.SegmentSize {
+		if err := w.rotate(); err != nil {
+			w.mutex.Unlock()
+			return 0, err
+		}
+	}
+
+	seq := w.nextSeq
+	if err := w.writeRecord(recordEntry, seq, data); err != nil {
+		w.mutex.Unlock()
+		return 0, err
+	}
+	w.nextSeq++
+	w.active.pending++
+	w.owner[seq] = w.active
+
+	if w.opts.SyncInterval == 0 {
+		err := w.syncLocked()
+		w.mutex.Unlock()
+		return seq, err
+	}
+
+	batch := w.scheduleSync()
+	w.mutex.Unlock()
+
+	<-batch.done
+	return seq, batch.err
+}
+
+// Ack marks an entry as processed so that it is not replayed and its segment
+// can be reclaimed. Acks are made durable with the next batch.
+func (w *WAL) Ack(seq uint64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	seg, ok := w.owner[seq]
+	if !ok {
+		return nil
+	}
+	delete(w.owner, seq)
+	seg.pending--
+
+	if err := w.writeRecord(recordAck, seq, nil); err != nil {
+		return err
+	}
+	if w.opts.SyncInterval == 0 {
+		if err := w.syncLocked(); err != nil {
+			return err
+		}
+	} else {
+		w.scheduleSync()
+	}
+
+	w.truncateHead()
+	return nil
+}
+
+// Len returns the number of entries that have not been acknowledged
+func (w *WAL) Len() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(w.owner)
+}
+
+// Close flushes and closes the log
+func (w *WAL) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	err := w.syncLocked()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// scheduleSync returns the batch for the next fsync, starting its timer if
+// this is the first write in the batch. The caller must hold the mutex.
+func (w *WAL) scheduleSync() *syncBatch {
+	if w.batch == nil {
+		w.batch = &syncBatch{done: make(chan struct{})}
+		time.AfterFunc(w.opts.SyncInterval, func() {
+			w.mutex.Lock()
+			defer w.mutex.Unlock()
+			if !w.closed {
+				w.syncLocked()
+			}
+		})
+	}
+	return w.batch
+}
+
+// syncLocked flushes buffered records, fsyncs the active segment and releases
+// everyone waiting on the current batch. The caller must hold the mutex.
+func (w *WAL) syncLocked() error {
+	batch := w.batch
+	w.batch = nil
+
+	var err error
+	if w.file != nil {
+		if err = w.writer.Flush(); err == nil {
+			err = w.file.Sync()
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to sync wal segment: %w", err)
+		}
+	}
+
+	if batch != nil {
+		batch.err = err
+		close(batch.done)
+	}
+	return err
+}
+
+// writeRecord encodes a record into the active segment. The caller must hold
+// the mutex.
+func (w *WAL) writeRecord(kind byte, seq uint64, data []byte) error {
+	body := make([]byte, bodyPrefixSize+len(data))
+	body[0] = kind
+	binary.BigEndian.PutUint64(body[1:bodyPrefixSize], seq)
+	copy(body[bodyPrefixSize:], data)
+
+	var header [headerSize]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(body, crcTable))
+
+	if _, err := w.writer.Write(header[:]); err != nil {
+		return fmt.Errorf("failed to write wal record: %w", err)
+	}
+	if _, err := w.writer.Write(body); err != nil {
+		return fmt.Errorf("failed to write wal record: %w", err)
+	}
+	w.active.size += int64(headerSize + len(body))
+	return nil
+}
+
+// rotate makes the active segment durable and starts a new one. The caller
+// must hold the mutex.
+func (w *WAL) rotate() error {
+	if err := w.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush wal segment: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync wal segment: %w", err)
+	}
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("failed to close wal segment: %w", err)
+	}
+	if err := w.openSegment(); err != nil {
+		return err
+	}
+	w.truncateHead()
+	return nil
+}
+
+// openSegment creates a new active segment named after the next sequence
+// number. The caller must hold the mutex.
+func (w *WAL) openSegment() error {
+	path := filepath.Join(w.dir, fmt.Sprintf("%020d%s", w.nextSeq, segmentExt))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open wal segment: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat wal segment: %w", err)
+	}
+
+	// Reuse the last recovered segment if it already carries this name
+	var seg *segment
+	if n := len(w.segments); n > 0 && w.segments[n-1].path == path {
+		seg = w.segments[n-1]
+	} else {
+		seg = &segment{path: path}
+		w.segments = append(w.segments, seg)
+	}
+	seg.size = info.Size()
+	w.active = seg
+	w.file = file
+	w.writer = bufio.NewWriter(file)
+	return nil
+}
+
+// truncateHead deletes leading segments that hold no pending entries. Only
+// the head is reclaimed so that ack records for older segments are never
+// deleted before the entries they acknowledge. The caller must hold the mutex.
+func (w *WAL) truncateHead() {
+	for len(w.segments) > 1 && w.segments[0] != w.active && w.segments[0].pending == 0 {
+		os.Remove(w.segments[0].path)
+		w.segments = w.segments[1:]
+	}
+}
+
+// recover reads all segments in order and rebuilds the pending entries
+func (w *WAL) recover() error {
+	matches, err := filepath.Glob(filepath.Join(w.dir, "*"+segmentExt))
+	if err != nil {
+		return fmt.Errorf("failed to list wal segments: %w", err)
+	}
+	sort.Strings(matches)
+
+	entries := make(map[uint64][]byte)
+	owners := make(map[uint64]*segment)
+	for _, path := range matches {
+		name := strings.TrimSuffix(filepath.Base(path), segmentExt)
+		if _, err := strconv.ParseUint(name, 10, 64); err != nil {
+			continue
+		}
+
+		seg := &segment{path: path}
+		if err := readSegment(seg, func(kind byte, seq uint64, data []byte) {
+			switch kind {
+			case recordEntry:
+				entries[seq] = data
+				owners[seq] = seg
+			case recordAck:
+				delete(entries, seq)
+				delete(owners, seq)
+			}
+			if seq >= w.nextSeq {
+				w.nextSeq = seq + 1
+			}
+		}); err != nil {
+			return err
+		}
+		w.segments = append(w.segments, seg)
+	}
+
+	for seq, seg := range owners {
+		seg.pending++
+		w.owner[seq] = seg
+		w.pending = append(w.pending, Entry{Seq: seq, Data: entries[seq]})
+	}
+	sort.Slice(w.pending, func(i, j int) bool {
+		return w.pending[i].Seq < w.pending[j].Seq
+	})
+
+	return nil
+}
+
+// readSegment decodes every record of a segment. A torn or corrupt tail, as
+// left by a crash mid-write, is cut off.
+func readSegment(seg *segment, fn func(kind byte, seq uint64, data []byte)) error {
+	file, err := os.OpenFile(seg.path, os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open wal segment: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat wal segment: %w", err)
+	}
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	var header [headerSize]byte
+	for {
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			break
+		}
+
+		// A length running past the end of the segment comes from a torn
+		// header and must not be allocated
+		length := binary.BigEndian.Uint32(header[0:4])
+		if length < bodyPrefixSize || int64(length) > info.Size()-offset-headerSize {
+			break
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			break
+		}
+		if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+			break
+		}
+
+		fn(body[0], binary.BigEndian.Uint64(body[1:bodyPrefixSize]), body[bodyPrefixSize:])
+		offset += int64(headerSize) + int64(length)
+	}
+
+	if err := file.Truncate(offset); err != nil {
+		return fmt.Errorf("failed to truncate wal segment: %w", err)
+	}
+	seg.size = offset
+	return nil
+}
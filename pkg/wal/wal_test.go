@@ -0,0 +1,205 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestAppendAndReplay tests that unacknowledged entries survive a reopen
+func TestAppendAndReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := Open(dir, Options{SyncInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to open wal: %v", err)
+	}
+
+	var seqs []uint64
+	for i := 0; i < 5; i++ {
+		seq, err := w.Append([]byte(fmt.Sprintf("packet-%d", i)))
+		if err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+		seqs = append(seqs, seq)
+	}
+
+	// Acknowledge two of the five entries
+	w.Ack(seqs[1])
+	w.Ack(seqs[3])
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to close wal: %v", err)
+	}
+
+	w, err = Open(dir, Options{SyncInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to reopen wal: %v", err)
+	}
+	defer w.Close()
+
+	pending := w.Pending()
+	expected := []string{"packet-0", "packet-2", "packet-4"}
+	if len(pending) != len(expected) {
+		t.Fatalf("Expected %d pending entries, got %d", len(expected), len(pending))
+	}
+	for i, entry := range pending {
+		if string(entry.Data) != expected[i] {
+			t.Errorf("Expected entry %d to be '%s', got '%s'", i, expected[i], entry.Data)
+		}
+	}
+
+	// New appends must not reuse recovered sequence numbers
+	seq, err := w.Append([]byte("packet-5"))
+	if err != nil {
+		t.Fatalf("Failed to append after reopen: %v", err)
+	}
+	if seq <= seqs[len(seqs)-1] {
+		t.Errorf("Expected sequence after %d, got %d", seqs[len(seqs)-1], seq)
+	}
+}
+
+// TestConcurrentAppends tests that batched appends all become durable
+func TestConcurrentAppends(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := Open(dir, Options{SyncInterval: 2 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to open wal: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := w.Append([]byte(fmt.Sprintf("packet-%d", i))); err != nil {
+				t.Errorf("Failed to append: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	w.Close()
+
+	w, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("Failed to reopen wal: %v", err)
+	}
+	defer w.Close()
+
+	if pending := w.Pending(); len(pending) != 100 {
+		t.Errorf("Expected 100 pending entries, got %d", len(pending))
+	}
+}
+
+// TestSegmentTruncation tests that fully acknowledged segments are deleted
+func TestSegmentTruncation(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := Open(dir, Options{SegmentSize: 64})
+	if err != nil {
+		t.Fatalf("Failed to open wal: %v", err)
+	}
+	defer w.Close()
+
+	var seqs []uint64
+	for i := 0; i < 20; i++ {
+		seq, err := w.Append([]byte("0123456789abcdef0123456789abcdef"))
+		if err != nil {
+			t.Fatalf("Failed to append: %v", err)
+		}
+		seqs = append(seqs, seq)
+	}
+
+	before, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if len(before) < 10 {
+		t.Fatalf("Expected entries to span many segments, got %d", len(before))
+	}
+
+	for _, seq := range seqs {
+		w.Ack(seq)
+	}
+
+	after, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if len(after) != 1 {
+		t.Errorf("Expected only the active segment to remain, got %d", len(after))
+	}
+	if w.Len() != 0 {
+		t.Errorf("Expected no pending entries, got %d", w.Len())
+	}
+}
+
+// TestTornTail tests that a partially written record is discarded on recovery
+func TestTornTail(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("Failed to open wal: %v", err)
+	}
+	w.Append([]byte("complete"))
+	w.Close()
+
+	// Simulate a crash in the middle of writing a record
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	file, err := os.OpenFile(segments[len(segments)-1], os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("Failed to open segment: %v", err)
+	}
+	file.Write([]byte{0, 0, 0, 50, 1, 2, 3})
+	file.Close()
+
+	w, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("Failed to reopen wal: %v", err)
+	}
+	defer w.Close()
+
+	pending := w.Pending()
+	if len(pending) != 1 || string(pending[0].Data) != "complete" {
+		t.Fatalf("Expected only the complete entry to be recovered, got %v", pending)
+	}
+}
+
+// TestTornHeaderLength tests that a torn header claiming a huge record is
+// cut off instead of allocated
+func TestTornHeaderLength(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("Failed to open wal: %v", err)
+	}
+	w.Append([]byte("complete"))
+	w.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	file, err := os.OpenFile(segments[len(segments)-1], os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("Failed to open segment: %v", err)
+	}
+	file.Write([]byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4, 5})
+	file.Close()
+
+	var allocs runtime.MemStats
+	runtime.ReadMemStats(&allocs)
+	before := allocs.TotalAlloc
+
+	w, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("Failed to reopen wal: %v", err)
+	}
+	defer w.Close()
+
+	runtime.ReadMemStats(&allocs)
+	if grown := allocs.TotalAlloc - before; grown > 64<<20 {
+		t.Errorf("Expected no allocation for the torn record, got %d bytes", grown)
+	}
+	if pending := w.Pending(); len(pending) != 1 || string(pending[0].Data) != "complete" {
+		t.Fatalf("Expected only the complete entry to be recovered, got %v", pending)
+	}
+}